@@ -16,7 +16,9 @@
 package autopaho
 
 import (
+	"context"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -129,6 +131,55 @@ func DefaultExponentialBackoff() Backoff {
 	)
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// implementation for a reconnect rate limit
+////////////////////////////////////////////////////////////////////////////////
+
+// ReconnectRateLimit limits the number of connection attempts within a period (e.g. no more than 10 per minute). This
+// is applied in addition to the ReconnectBackoff and may be shared between multiple ConnectionManagers to provide a
+// global cap (protecting the broker when many connections are being reestablished following an outage).
+type ReconnectRateLimit struct {
+	mu       sync.Mutex
+	attempts int
+	period   time.Duration
+	recent   []time.Time // times of the most recent attempts (oldest first, at most attempts entries)
+}
+
+// NewReconnectRateLimit creates a ReconnectRateLimit that allows, at most, attempts connection attempts in any period.
+func NewReconnectRateLimit(attempts int, period time.Duration) *ReconnectRateLimit {
+	if attempts <= 0 {
+		panic("attempts must NOT be less than or equal to: 0")
+	}
+	if period <= 0 {
+		panic("period must NOT be less than or equal to: 0")
+	}
+	return &ReconnectRateLimit{attempts: attempts, period: period}
+}
+
+// Wait blocks until a connection attempt is permitted (recording the attempt) or ctx is done.
+func (r *ReconnectRateLimit) Wait(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		now := time.Now()
+		for len(r.recent) > 0 && now.Sub(r.recent[0]) >= r.period {
+			r.recent = r.recent[1:]
+		}
+		if len(r.recent) < r.attempts {
+			r.recent = append(r.recent, now)
+			r.mu.Unlock()
+			return nil
+		}
+		delay := r.recent[0].Add(r.period).Sub(now)
+		r.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // util functions
 ////////////////////////////////////////////////////////////////////////////////
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/rtalhouk/paho.golang/packets"
 	"github.com/rtalhouk/paho.golang/paho"
 	"github.com/rtalhouk/paho.golang/paho/log"
 )
@@ -37,6 +38,8 @@ type errorHandler struct {
 
 	userOnClientError      func(error)            // User provided onClientError function
 	userOnServerDisconnect func(*paho.Disconnect) // User provided OnServerDisconnect function
+
+	disconnect *paho.Disconnect // DISCONNECT received from the server (if any); protected by mu
 }
 
 // shutdown prevents any further calls from emitting a message
@@ -57,12 +60,22 @@ func (e *errorHandler) onClientError(err error) {
 // clean server shutdown). We want to begin attempting to reconnect when this occurs (and pass a detectable error
 // to the user)
 func (e *errorHandler) onServerDisconnect(d *paho.Disconnect) {
-	e.handleError(&DisconnectError{err: fmt.Sprintf("server requested disconnect (reason: %d)", d.ReasonCode)})
+	e.mu.Lock()
+	e.disconnect = d
+	e.mu.Unlock()
+	e.handleError(&DisconnectError{err: fmt.Sprintf("server requested disconnect (reason: %d)", d.ReasonCode), ReasonCode: d.ReasonCode})
 	if e.userOnServerDisconnect != nil {
 		go e.userOnServerDisconnect(d)
 	}
 }
 
+// serverDisconnect returns the DISCONNECT received from the server (nil if none)
+func (e *errorHandler) serverDisconnect() *paho.Disconnect {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.disconnect
+}
+
 // handleError ensures that only a single error is sent to the channel (all errors go to the users OnClientError function)
 // Returns true if the error was sent to the channel (i.e. this is the first error we have seen)
 func (e *errorHandler) handleError(err error) bool {
@@ -81,12 +94,23 @@ func (e *errorHandler) handleError(err error) bool {
 }
 
 // DisconnectError will be passed when the server requests disconnection (allows this error type to be detected)
-type DisconnectError struct{ err string }
+type DisconnectError struct {
+	err        string
+	ReasonCode byte // Reason code from the DISCONNECT packet
+}
 
 func (d *DisconnectError) Error() string {
 	return d.err
 }
 
+// Unwrap returns paho.ErrKeepAliveTimeout if the reason code is 0x8D (Keep Alive timeout), otherwise nil
+func (d *DisconnectError) Unwrap() error {
+	if d.ReasonCode == packets.DisconnectKeepAliveTimeout {
+		return paho.ErrKeepAliveTimeout
+	}
+	return nil
+}
+
 // ConnackError will be passed when the server denies connection in CONNACK packet
 type ConnackError struct {
 	ReasonCode byte   // CONNACK reason code
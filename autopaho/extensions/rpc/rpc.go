@@ -18,6 +18,7 @@ package rpc
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,9 +30,12 @@ import (
 // MQTT v5 client
 type Handler struct {
 	sync.Mutex
-	cm            *autopaho.ConnectionManager
-	correlData    map[string]chan *paho.Publish
-	responseTopic string
+	cm             *autopaho.ConnectionManager
+	router         paho.Router
+	correlData     map[string]chan *paho.Publish
+	baseTopic      string             // response topic before any Response Information is applied
+	responseTopic  string             // topic to which responses are sent
+	responseHandle paho.HandlerHandle // handler registered for responseTopic
 }
 
 type HandlerOpts struct {
@@ -39,28 +43,90 @@ type HandlerOpts struct {
 	Router           paho.Router
 	ResponseTopicFmt string
 	ClientID         string
+
+	// UseResponseInformation, if true, prefixes the response topic with the Response Information from the CONNACK
+	// (i.e. "{ResponseInformation}/{response topic}"). As the Response Information may change, the response topic is
+	// updated (and subscribed to) whenever the connection is reestablished. The CONNECT must request Response
+	// Information (ConnectProperties.RequestResponseInfo); if none is provided the response topic is used unaltered.
+	UseResponseInformation bool
 }
 
+// resubscribeTimeout limits the time spent subscribing to an updated response topic following reconnection
+const resubscribeTimeout = 10 * time.Second
+
 func NewHandler(ctx context.Context, opts HandlerOpts) (*Handler, error) {
 	h := &Handler{
 		cm:         opts.Conn,
+		router:     opts.Router,
 		correlData: make(map[string]chan *paho.Publish),
+		baseTopic:  fmt.Sprintf(opts.ResponseTopicFmt, opts.ClientID),
+	}
+
+	responseTopic := h.baseTopic
+	if opts.UseResponseInformation {
+		opts.Conn.AddOnConnectionUp(func(cm *autopaho.ConnectionManager, ca *paho.Connack) {
+			var info string
+			if ca.Properties != nil {
+				info = ca.Properties.ResponseInfo
+			}
+			if h.setResponseTopic(h.topicFor(info)) {
+				go func() { // Must not block
+					ctx, cancel := context.WithTimeout(context.Background(), resubscribeTimeout)
+					defer cancel()
+					_ = h.subscribe(ctx)
+				}()
+			}
+		})
+		responseTopic = h.topicFor(opts.Conn.ResponseInformation())
+	}
+	h.setResponseTopic(responseTopic)
+
+	if err := h.subscribe(ctx); err != nil {
+		return nil, err
 	}
 
-	h.responseTopic = fmt.Sprintf(opts.ResponseTopicFmt, opts.ClientID)
+	return h, nil
+}
+
+// topicFor returns the response topic to use given the Response Information from the CONNACK
+func (h *Handler) topicFor(responseInfo string) string {
+	if responseInfo == "" {
+		return h.baseTopic
+	}
+	return strings.TrimSuffix(responseInfo, "/") + "/" + h.baseTopic
+}
 
-	opts.Router.RegisterHandler(h.responseTopic, h.responseHandler)
+// setResponseTopic sets the topic to which responses are to be sent (registering a handler with the router); returns
+// false if the topic is unchanged
+func (h *Handler) setResponseTopic(topic string) bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.responseHandle != nil && topic == h.responseTopic {
+		return false
+	}
+	if h.responseHandle != nil {
+		h.responseHandle.Unregister()
+	}
+	h.responseTopic = topic
+	h.responseHandle = h.router.RegisterHandler(topic, h.responseHandler)
+	return true
+}
 
-	_, err := opts.Conn.Subscribe(ctx, &paho.Subscribe{
+// subscribe subscribes to the current response topic
+func (h *Handler) subscribe(ctx context.Context) error {
+	_, err := h.cm.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: []paho.SubscribeOptions{
-			{Topic: h.responseTopic, QoS: 1},
+			{Topic: h.ResponseTopic(), QoS: 1},
 		},
 	})
-	if err != nil {
-		return nil, err
-	}
+	return err
+}
 
-	return h, nil
+// ResponseTopic returns the topic to which responses are currently requested to be sent
+func (h *Handler) ResponseTopic() string {
+	h.Lock()
+	defer h.Unlock()
+	return h.responseTopic
 }
 
 func (h *Handler) addCorrelID(cID string, r chan *paho.Publish) {
@@ -91,7 +157,7 @@ func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (resp *paho.Pub
 	}
 
 	pb.Properties.CorrelationData = []byte(cID)
-	pb.Properties.ResponseTopic = h.responseTopic
+	pb.Properties.ResponseTopic = h.ResponseTopic()
 	pb.Retain = false
 
 	_, err = h.cm.Publish(ctx, pb)
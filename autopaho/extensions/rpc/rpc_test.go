@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/autopaho"
+	"github.com/rtalhouk/paho.golang/internal/testserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	"github.com/rtalhouk/paho.golang/paho"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+)
+
+const shortDelay = 500 * time.Millisecond // Used when something should happen pretty quickly (increase when debugging)
+
+// TestResponseInformation confirms that, with UseResponseInformation set, the response topic follows the Response
+// Information returned in each CONNACK
+func TestResponseInformation(t *testing.T) {
+	server, _ := url.Parse("tcp://127.0.0.1:1883")
+	serverLogger := paholog.NewTestLogger(t, "testServer:")
+	logger := paholog.NewTestLogger(t, "test:")
+
+	ts := testserver.New(serverLogger)
+	var mu sync.Mutex
+	var connectCount int
+	var subscribed []string
+	responseTopics := make(chan string, 10)
+	ts.SetConnectCallback(func(cp *packets.Connect, ca *packets.Connack) {
+		mu.Lock()
+		defer mu.Unlock()
+		connectCount++
+		if cp.Properties.RequestResponseInfo == nil || *cp.Properties.RequestResponseInfo != 1 {
+			t.Errorf("CONNECT did not request Response Information")
+		}
+		ca.Properties.ResponseInfo = []string{"", "first", "second/"}[min(connectCount, 2)]
+	})
+	ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+		switch p := cp.Content.(type) {
+		case *packets.Subscribe:
+			mu.Lock()
+			for _, s := range p.Subscriptions {
+				subscribed = append(subscribed, s.Topic)
+			}
+			mu.Unlock()
+		case *packets.Publish:
+			if p.Properties != nil {
+				responseTopics <- p.Properties.ResponseTopic
+			}
+		}
+		return nil
+	})
+
+	serverDone := make(chan chan struct{}, 20)
+	router := paho.NewStandardRouter()
+	config := autopaho.ClientConfig{
+		ServerUrls:       []*url.URL{server},
+		ReconnectBackoff: autopaho.NewConstantBackoff(time.Millisecond),
+		ConnectTimeout:   shortDelay,
+		AttemptConnection: func(ctx context.Context, _ autopaho.ClientConfig, _ *url.URL) (net.Conn, error) {
+			conn, done, err := ts.Connect(ctx)
+			if err == nil {
+				serverDone <- done
+			}
+			return conn, err
+		},
+		ConnectPacketBuilder: func(c *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			if c.Properties == nil {
+				c.Properties = &paho.ConnectProperties{}
+			}
+			c.Properties.RequestResponseInfo = true
+			return c, nil
+		},
+		Debug:      logger,
+		PahoDebug:  logger,
+		PahoErrors: logger,
+		ClientConfig: paho.ClientConfig{
+			ClientID: "test",
+			Router:   router,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cm, err := autopaho.NewConnection(ctx, config)
+	if err != nil {
+		t.Fatalf("expected NewConnection success: %s", err)
+	}
+	if err = cm.AwaitConnection(ctx); err != nil {
+		t.Fatalf("AwaitConnection failed: %s", err)
+	}
+
+	h, err := NewHandler(ctx, HandlerOpts{
+		Conn:                   cm,
+		Router:                 router,
+		ResponseTopicFmt:       "%s/responses",
+		ClientID:               "test",
+		UseResponseInformation: true,
+	})
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+
+	// request sends a request and returns the response topic it specified
+	request := func() string {
+		t.Helper()
+		reqCtx, reqCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer reqCancel()
+		if _, err := h.Request(reqCtx, &paho.Publish{Topic: "request", QoS: 0}); err == nil {
+			t.Fatal("expected request to fail (there is no responder)")
+		}
+		select {
+		case rt := <-responseTopics:
+			return rt
+		case <-time.After(shortDelay):
+			t.Fatal("timeout waiting for request")
+		}
+		return ""
+	}
+
+	// awaitResponseTopic reconnects and waits until the response topic is want
+	awaitResponseTopic := func(want string) {
+		t.Helper()
+		cm.TerminateConnectionForTest()
+		deadline := time.Now().Add(shortDelay)
+		for h.ResponseTopic() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("response topic is %q, expected %q", h.ResponseTopic(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := cm.AwaitConnection(ctx); err != nil {
+			t.Fatalf("AwaitConnection failed: %s", err)
+		}
+	}
+
+	if rt := request(); rt != "first/test/responses" {
+		t.Fatalf("expected response topic first/test/responses, got %q", rt)
+	}
+	awaitResponseTopic("second/test/responses")
+	if rt := request(); rt != "second/test/responses" {
+		t.Fatalf("expected response topic second/test/responses, got %q", rt)
+	}
+
+	// Handler should have subscribed to each response topic
+	deadline := time.Now().Add(shortDelay)
+	for {
+		mu.Lock()
+		got := append([]string(nil), subscribed...)
+		mu.Unlock()
+		if len(got) == 2 {
+			if got[0] != "first/test/responses" || got[1] != "second/test/responses" {
+				t.Fatalf("unexpected subscriptions: %v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected subscriptions: %v", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := cm.Disconnect(ctx); err != nil && !errors.Is(err, autopaho.ConnectionDownError) {
+		t.Fatalf("Disconnect returned error: %s", err)
+	}
+	close(serverDone)
+	for done := range serverDone {
+		select {
+		case <-done:
+		case <-time.After(shortDelay):
+			t.Fatal("test server did not shutdown within expected time")
+		}
+	}
+}
@@ -16,8 +16,12 @@
 package autopaho
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -38,83 +42,160 @@ import (
 
 // Network (establishing connection) functionality for AutoPaho
 
+// ErrCertificatePinMismatch is returned when TlsPins is set and none of the certificates presented by the server
+// match any of the pins.
+var ErrCertificatePinMismatch = errors.New("server certificate does not match any pin")
+
 // establishServerConnection - establishes a connection with the MQTT server retrying until successful or the
-// context is cancelled (in which case nil will be returned).
-func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConnection bool) (*paho.Client, *paho.Connack) {
+// context is cancelled (in which case nil will be returned). The CONNECT packet sent is also returned, along with the
+// number of the successful attempt (attempts are numbered from attempt, which is passed to ReconnectBackoff).
+func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConnection bool, attempt int) (*paho.Client, *paho.Connect, *paho.Connack, int) {
 	// Note: We do not touch b.cli in order to avoid adding thread safety issues.
 
-	var attempt int = 0
 	for {
 		// Delay before attempting connection
 		select {
 		case <-time.After(cfg.ReconnectBackoff(attempt)):
 		case <-ctx.Done():
-			return nil, nil
+			return nil, nil, nil, attempt
+		}
+		cli, cp, connack, _ := attemptServerConnection(ctx, cfg, firstConnection)
+		if cli != nil {
+			return cli, cp, connack, attempt
 		}
-		for _, u := range cfg.ServerUrls {
-			var connack *paho.Connack
+		// Possible failure was due to outer context being cancelled
+		if ctx.Err() != nil {
+			return nil, nil, nil, attempt
+		}
+		attempt++
+	}
+}
 
-			cp, err := cfg.buildConnectPacket(firstConnection, u)
-			if err == nil {
-				connectionCtx, cancelConnCtx := context.WithTimeout(ctx, cfg.ConnectTimeout)
-
-				if cfg.AttemptConnection != nil { // Use custom function if it is provided
-					cfg.Conn, err = cfg.AttemptConnection(ctx, cfg, u)
-				} else {
-					switch strings.ToLower(u.Scheme) {
-					case "mqtt", "tcp", "":
-						cfg.Conn, err = attemptTCPConnection(connectionCtx, u.Host)
-					case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
-						cfg.Conn, err = attemptTLSConnection(connectionCtx, cfg.TlsCfg, u.Host)
-					case "ws":
-						cfg.Conn, err = attemptWebsocketConnection(connectionCtx, nil, cfg.WebSocketCfg, u)
-					case "wss":
-						cfg.Conn, err = attemptWebsocketConnection(connectionCtx, cfg.TlsCfg, cfg.WebSocketCfg, u)
-					default:
-						if cfg.OnConnectError != nil {
-							cfg.OnConnectError(fmt.Errorf("unsupported scheme (%s) user in url %s", u.Scheme, u.String()))
-						}
-						cancelConnCtx()
-						continue
-					}
-				}
+// attemptServerConnection - makes a single attempt to connect to each of the servers (in order) returning the first
+// successful connection (along with the CONNECT packet sent). If no connection could be established the last error
+// is returned.
+func attemptServerConnection(ctx context.Context, cfg ClientConfig, firstConnection bool) (*paho.Client, *paho.Connect, *paho.Connack, error) {
+	tlsCfg := pinnedTLSConfig(cfg.TlsCfg, cfg.TlsPins)
 
-				if err == nil {
-					cli := paho.NewClient(cfg.ClientConfig)
-					if cfg.PahoDebug != nil {
-						cli.SetDebugLogger(cfg.PahoDebug)
-					}
+	var lastErr error
+	for _, u := range cfg.ServerUrls {
+		var connack *paho.Connack
 
-					if cfg.PahoErrors != nil {
-						cli.SetErrorLogger(cfg.PahoErrors)
-					}
+		if cfg.ReconnectRateLimit != nil {
+			if err := cfg.ReconnectRateLimit.Wait(ctx); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 
-					connack, err = cli.Connect(connectionCtx, cp) // will return an error if the connection is unsuccessful (checks the reason code)
-					if err == nil {                               // Successfully connected
-						cancelConnCtx()
-						return cli, connack
+		cp, err := cfg.buildConnectPacket(firstConnection, u)
+		if err == nil {
+			connectionCtx, cancelConnCtx := context.WithTimeout(ctx, cfg.ConnectTimeout)
+
+			if cfg.AttemptConnection != nil { // Use custom function if it is provided
+				cfg.Conn, err = cfg.AttemptConnection(ctx, cfg, u)
+			} else {
+				switch strings.ToLower(u.Scheme) {
+				case "mqtt", "tcp", "":
+					cfg.Conn, err = attemptTCPConnection(connectionCtx, u.Host)
+				case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+					cfg.Conn, err = attemptTLSConnection(connectionCtx, tlsCfg, u.Host)
+				case "ws":
+					cfg.Conn, err = attemptWebsocketConnection(connectionCtx, nil, cfg.WebSocketCfg, u)
+				case "wss":
+					cfg.Conn, err = attemptWebsocketConnection(connectionCtx, tlsCfg, cfg.WebSocketCfg, u)
+				default:
+					lastErr = fmt.Errorf("unsupported scheme (%s) user in url %s", u.Scheme, u.Redacted())
+					if cfg.OnConnectError != nil {
+						cfg.OnConnectError(lastErr)
 					}
+					cancelConnCtx()
+					continue
 				}
-				cancelConnCtx()
 			}
 
-			// Possible failure was due to outer context being cancelled
-			if ctx.Err() != nil {
-				return nil, nil
-			}
-			cfg.Debug.Printf("failed to connect to %s: %s", u.String(), err)
+			if err == nil {
+				cli := paho.NewClient(cfg.ClientConfig)
+				if cfg.PahoDebug != nil {
+					cli.SetDebugLogger(cfg.PahoDebug)
+				}
+
+				if cfg.PahoErrors != nil {
+					cli.SetErrorLogger(cfg.PahoErrors)
+				}
 
-			if cfg.OnConnectError != nil {
-				cerr := fmt.Errorf("failed to connect to %s: %w", u.String(), err)
-				if connack != nil {
-					cerr = NewConnackError(err, connack)
+				connack, err = cli.Connect(connectionCtx, cp) // will return an error if the connection is unsuccessful (checks the reason code)
+				if err == nil {                               // Successfully connected
+					cancelConnCtx()
+					return cli, cp, connack, nil
 				}
-				cfg.OnConnectError(cerr)
 			}
+			cancelConnCtx()
 		}
 
-		attempt++
+		// Possible failure was due to outer context being cancelled
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		cfg.Debug.Printf("failed to connect to %s: %s", u.Redacted(), err)
+
+		lastErr = fmt.Errorf("failed to connect to %s: %w", u.Redacted(), err)
+		if connack != nil {
+			lastErr = NewConnackError(err, connack)
+		}
+		if cfg.OnConnectError != nil {
+			cfg.OnConnectError(lastErr)
+		}
 	}
+	return nil, nil, nil, lastErr
+}
+
+// SPKIHash returns the SHA-256 hash of the certificate's SubjectPublicKeyInfo; this is the value expected in TlsPins.
+// Pinning the public key (rather than the whole certificate) means that the pin remains valid when a certificate
+// is renewed using the same key.
+func SPKIHash(cert *x509.Certificate) []byte {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return h[:]
+}
+
+// pinnedTLSConfig returns a copy of tlsCfg that will reject connections where none of the certificates in the verified
+// chain (or the leaf certificate, if verification is skipped) match one of the pins. If pins is empty, tlsCfg is returned unchanged.
+func pinnedTLSConfig(tlsCfg *tls.Config, pins [][]byte) *tls.Config {
+	if len(pins) == 0 {
+		return tlsCfg
+	}
+	var cfg *tls.Config
+	if tlsCfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = tlsCfg.Clone()
+	}
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		// Only certificates that form part of a verified chain are considered (the server may send additional,
+		// unverified, certificates). If verification was skipped, only the leaf can be trusted to be the servers.
+		var certs []*x509.Certificate
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+		for _, cert := range certs {
+			h := SPKIHash(cert)
+			for _, p := range pins {
+				if bytes.Equal(h, p) {
+					return nil
+				}
+			}
+		}
+		return ErrCertificatePinMismatch
+	}
+	return cfg
 }
 
 // attemptTCPConnection - makes a single attempt at establishing a TCP connection with the server
@@ -245,3 +326,38 @@ func (c *websocketConnector) Read(p []byte) (int, error) {
 		return n, err
 	}
 }
+
+// serverReferenceUrls returns the URLs referenced in the Server Reference property of a DISCONNECT (nil if none).
+// The property may contain multiple space separated references; those without a scheme use defaultScheme.
+func serverReferenceUrls(d *paho.Disconnect, defaultScheme string) []*url.URL {
+	if d.Properties == nil {
+		return nil
+	}
+	var urls []*url.URL
+	for _, ref := range strings.Fields(d.Properties.ServerReference) {
+		if !strings.Contains(ref, "://") {
+			ref = defaultScheme + "://" + ref
+		}
+		u, err := url.Parse(ref)
+		if err != nil || u.Host == "" {
+			continue // Format is implementation specific; ignore anything we cannot use
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// prependUrls returns a new slice containing refs followed by any entries in urls not also in refs
+func prependUrls(refs, urls []*url.URL) []*url.URL {
+	res := append([]*url.URL{}, refs...)
+urlLoop:
+	for _, u := range urls {
+		for _, r := range refs {
+			if u.String() == r.String() {
+				continue urlLoop
+			}
+		}
+		res = append(res, u)
+	}
+	return res
+}
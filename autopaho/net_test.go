@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/internal/testcert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTLSPins checks that connections are only accepted when the server certificate matches a pin
+func TestTLSPins(t *testing.T) {
+	t.Parallel()
+	cert, pool, err := testcert.New("127.0.0.1")
+	require.NoError(t, err)
+	otherCert, _, err := testcert.New("127.0.0.1")
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake() // Will fail if the client rejects the certificate
+			_ = conn.Close()
+		}
+	}()
+
+	baseCfg := &tls.Config{RootCAs: pool}
+	tests := []struct {
+		name    string
+		pins    [][]byte
+		wantErr bool
+	}{
+		{name: "noPins", pins: nil},
+		{name: "matchingPin", pins: [][]byte{SPKIHash(otherCert.Leaf), SPKIHash(cert.Leaf)}},
+		{name: "nonMatchingPin", pins: [][]byte{SPKIHash(otherCert.Leaf)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := attemptTLSConnection(ctx, pinnedTLSConfig(baseCfg, tt.pins), l.Addr().String())
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrCertificatePinMismatch)
+				return
+			}
+			require.NoError(t, err)
+			_ = conn.Close()
+		})
+	}
+
+	// The callers config must not be modified
+	assert.Nil(t, baseCfg.VerifyConnection)
+}
+
+// TestTLSPinsAppendedCertificate checks that a pinned certificate appended to the chain sent by the server (but not
+// part of the verified chain) does not satisfy the pin
+func TestTLSPinsAppendedCertificate(t *testing.T) {
+	t.Parallel()
+	cert, pool, err := testcert.New("127.0.0.1")
+	require.NoError(t, err)
+	pinnedCert, _, err := testcert.New("127.0.0.1")
+	require.NoError(t, err)
+
+	// The leaf is valid (but not pinned); the pinned certificate follows it
+	served := cert
+	served.Certificate = [][]byte{cert.Certificate[0], pinnedCert.Certificate[0]}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{served}})
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake() // Will fail if the client rejects the certificate
+			_ = conn.Close()
+		}
+	}()
+
+	pins := [][]byte{SPKIHash(pinnedCert.Leaf)}
+	for _, cfg := range []*tls.Config{{RootCAs: pool}, {InsecureSkipVerify: true}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := attemptTLSConnection(ctx, pinnedTLSConfig(cfg, pins), l.Addr().String())
+		cancel()
+		require.ErrorIs(t, err, ErrCertificatePinMismatch, "InsecureSkipVerify: %v", cfg.InsecureSkipVerify)
+	}
+
+	// Pinning the leaf is permitted when verification is skipped
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := attemptTLSConnection(ctx, pinnedTLSConfig(&tls.Config{InsecureSkipVerify: true}, [][]byte{SPKIHash(cert.Leaf)}), l.Addr().String())
+	require.NoError(t, err)
+	_ = conn.Close()
+}
@@ -49,6 +49,8 @@ type Queue struct {
 	queueEmpty      bool              // true is the queue is currently empty
 	waiting         []chan<- struct{} // closed when something arrives in the queue
 	waitingForEmpty []chan<- struct{} // closed when queue is empty
+	count           int               // number of entries in the queue
+	watermarks      *queue.Watermarks // nil unless SetWatermarks called
 }
 
 // New creates a new file-based queue. Note that a file is written, read and deleted as part of this process to check
@@ -97,6 +99,9 @@ func New(path string, prefix string, extension string) (*Queue, error) {
 	} else if err != nil {
 		return nil, fmt.Errorf("failed checking for oldest entry: %w", err)
 	}
+	if q.count, err = q.countEntries(); err != nil {
+		return nil, fmt.Errorf("failed counting entries: %w", err)
+	}
 
 	return q, nil
 
@@ -130,21 +135,66 @@ func (q *Queue) WaitForEmpty() chan struct{} {
 	return c
 }
 
+// Len returns the number of items in the queue
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// SetWatermarks requests that fn be called when the number of items in the queue rises to high, and then again when
+// it falls to low (fn will be called once per crossing; it must not block).
+func (q *Queue) SetWatermarks(high, low int, fn queue.WatermarkFunc) error {
+	w, err := queue.NewWatermarks(high, low, fn)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.watermarks = w
+	notify := w.Update(q.count)
+	q.mu.Unlock()
+	if notify != nil {
+		notify()
+	}
+	return nil
+}
+
 // Enqueue add item to the queue.
 func (q *Queue) Enqueue(p io.Reader) error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
 	err := q.put(p)
-	if err == nil && q.queueEmpty {
-		q.queueEmpty = false
-		for _, c := range q.waiting {
-			close(c)
+	var notify func()
+	if err == nil {
+		q.count++
+		notify = q.watermarks.Update(q.count)
+		if q.queueEmpty {
+			q.queueEmpty = false
+			for _, c := range q.waiting {
+				close(c)
+			}
+			q.waiting = q.waiting[:0]
 		}
-		q.waiting = q.waiting[:0]
+	}
+	q.mu.Unlock()
+	if notify != nil {
+		notify()
 	}
 	return err
 }
 
+// removed is called when an entry has been removed from the queue
+func (q *Queue) removed() {
+	q.mu.Lock()
+	if q.count > 0 {
+		q.count--
+	}
+	notify := q.watermarks.Update(q.count)
+	q.mu.Unlock()
+	if notify != nil {
+		notify()
+	}
+}
+
 // Peek retrieves the oldest item from the queue (without removing it)
 func (q *Queue) Peek() (queue.Entry, error) {
 	q.mu.Lock()
@@ -195,7 +245,27 @@ func (q *Queue) get() (entry, error) {
 	if err != nil {
 		return entry{}, err
 	}
-	return entry{f: f}, nil
+	return entry{f: f, q: q}, nil
+}
+
+// countEntries returns the number of entries in the queue folder
+func (q *Queue) countEntries() (int, error) {
+	entries, err := os.ReadDir(q.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dir: %w", err)
+	}
+	var count int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if match, err := filepath.Match(q.prefix+"*"+q.extension, entry.Name()); err != nil {
+			return 0, fmt.Errorf("failed to read match %s: %w", entry.Name(), err)
+		} else if match {
+			count++
+		}
+	}
+	return count, nil
 }
 
 // oldestEntry returns the filename of the oldest entry in the queue (if any - io.EOF means none)
@@ -239,6 +309,7 @@ func (q *Queue) oldestEntry() (string, error) {
 // entry is used to return a queue entry from Peek
 type entry struct {
 	f *os.File
+	q *Queue
 }
 
 // Reader provides access to the file contents
@@ -257,6 +328,7 @@ func (e entry) Remove() error {
 	if err := os.Remove(e.f.Name()); err != nil {
 		return err
 	}
+	e.q.removed()
 	if cErr != nil {
 		return cErr
 	}
@@ -273,8 +345,10 @@ func (e entry) Quarantine() error {
 		if rErr := os.Remove(e.f.Name()); rErr != nil {
 			return err // Error from rename is best thing to return
 		}
+		e.q.removed()
 		return fmt.Errorf("rename failed so file deleted: %w", err)
 	}
+	e.q.removed()
 	if cErr != nil {
 		return cErr
 	}
@@ -157,3 +157,65 @@ func TestLeaveAndError(t *testing.T) {
 		t.Errorf(".corrupt file not found in test folder")
 	}
 }
+
+// TestLenAndWatermarks checks that Len tracks the queue depth and the watermark callback is called once per crossing
+func TestLenAndWatermarks(t *testing.T) {
+	q, err := New(t.TempDir(), "queueTest-", ".que")
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+
+	type event struct {
+		depth int
+		high  bool
+	}
+	var events []event
+	if err := q.SetWatermarks(5, 2, func(depth int, high bool) {
+		events = append(events, event{depth: depth, high: high})
+	}); err != nil {
+		t.Fatalf("SetWatermarks failed: %s", err)
+	}
+	if err := q.SetWatermarks(2, 2, func(int, bool) {}); err == nil {
+		t.Fatalf("expected error when low watermark is not below high watermark")
+	}
+
+	enqueue := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := q.Enqueue(bytes.NewReader([]byte(fmt.Sprintf("entry %d", i)))); err != nil {
+				t.Fatalf("error adding entry: %s", err)
+			}
+		}
+	}
+	dequeue := func(n int) {
+		for i := 0; i < n; i++ {
+			entry, err := q.Peek()
+			if err != nil {
+				t.Fatalf("error peeking entry: %s", err)
+			}
+			if err = entry.Remove(); err != nil && !errors.Is(err, queue.ErrEmpty) {
+				t.Fatalf("error removing entry: %s", err)
+			}
+		}
+	}
+
+	enqueue(4)
+	if len(events) != 0 {
+		t.Fatalf("expected no events below high watermark, got %v", events)
+	}
+	enqueue(3) // crosses high watermark once
+	if l := q.Len(); l != 7 {
+		t.Fatalf("expected Len 7, got %d", l)
+	}
+	dequeue(4) // depth 3 (above low watermark)
+	if exp := []event{{5, true}}; fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Fatalf("expected events %v, got %v", exp, events)
+	}
+	dequeue(3) // crosses low watermark once
+	if l := q.Len(); l != 0 {
+		t.Fatalf("expected Len 0, got %d", l)
+	}
+	enqueue(5) // crosses high watermark again
+	if exp := []event{{5, true}, {2, false}, {5, true}}; fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Fatalf("expected events %v, got %v", exp, events)
+	}
+}
@@ -26,12 +26,21 @@ import (
 
 // A queue implementation that stores all data in RAM
 
-// Queue - basic memory based queue
+// Queue - basic memory based queue (implements queue.PriorityQueue)
 type Queue struct {
 	mu              sync.Mutex
-	messages        [][]byte
+	messages        []message         // ordered by priority (highest first), then by the order added
+	peeked          bool              // true if an Entry is outstanding (so messages[0] must not change)
 	waiting         []chan<- struct{} // closed when something arrives in the queue
 	waitingForEmpty []chan<- struct{} // closed when queue is empty
+	watermarks      *queue.Watermarks // nil unless SetWatermarks called
+	maxLen          int               // maximum number of items (0 = unlimited)
+}
+
+// message is a queued item
+type message struct {
+	priority int
+	data     []byte
 }
 
 // New creates a new memory-based queue
@@ -67,20 +76,77 @@ func (q *Queue) WaitForEmpty() chan struct{} {
 	return c
 }
 
+// Len returns the number of items in the queue
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// SetWatermarks requests that fn be called when the number of items in the queue rises to high, and then again when
+// it falls to low (fn will be called once per crossing; it must not block).
+func (q *Queue) SetWatermarks(high, low int, fn queue.WatermarkFunc) error {
+	w, err := queue.NewWatermarks(high, low, fn)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.watermarks = w
+	notify := w.Update(len(q.messages))
+	q.mu.Unlock()
+	if notify != nil {
+		notify()
+	}
+	return nil
+}
+
+// SetMaxLen limits the number of items in the queue to n (0, the default, means unlimited); once the limit is
+// reached, Enqueue will return queue.ErrFull.
+func (q *Queue) SetMaxLen(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxLen = n
+}
+
 // Enqueue add item to the queue.
 func (q *Queue) Enqueue(p io.Reader) error {
+	return q.EnqueuePriority(p, 0)
+}
+
+// EnqueuePriority adds an item to the queue; it will be returned by Peek after any items with the same, or a higher,
+// priority that are already in the queue.
+func (q *Queue) EnqueuePriority(p io.Reader, priority int) error {
 	var b bytes.Buffer
 	_, err := b.ReadFrom(p)
 	if err != nil {
 		return fmt.Errorf("Queue.Push failed to read into buffer: %w", err)
 	}
 	q.mu.Lock()
-	defer q.mu.Unlock()
-	q.messages = append(q.messages, b.Bytes())
+	if q.maxLen > 0 && len(q.messages) >= q.maxLen {
+		q.mu.Unlock()
+		return queue.ErrFull
+	}
+	// Find the insertion point; this will be after all items with priority >= the new item's (maintaining FIFO
+	// ordering within a priority). The entry returned by Peek must not be displaced.
+	i := len(q.messages)
+	for i > 0 && q.messages[i-1].priority < priority {
+		i--
+	}
+	if i == 0 && q.peeked {
+		i = 1
+	}
+	q.messages = append(q.messages, message{})
+	copy(q.messages[i+1:], q.messages[i:])
+	q.messages[i] = message{priority: priority, data: b.Bytes()}
 	for _, c := range q.waiting {
 		close(c)
 	}
 	q.waiting = q.waiting[:0]
+	notify := q.watermarks.Update(len(q.messages))
+	q.mu.Unlock()
+	if notify != nil {
+		notify()
+	}
 	return nil
 }
 
@@ -91,6 +157,7 @@ func (q *Queue) Peek() (queue.Entry, error) {
 	if len(q.messages) == 0 {
 		return nil, queue.ErrEmpty
 	}
+	q.peeked = true
 	// Queue implements Entry directly (as this always references q.messages[0]
 	return q, nil
 }
@@ -103,12 +170,15 @@ func (q *Queue) Reader() (io.Reader, error) {
 	if len(q.messages) == 0 {
 		return nil, queue.ErrEmpty
 	}
-	return bytes.NewReader(q.messages[0]), nil
+	return bytes.NewReader(q.messages[0].data), nil
 }
 
 // Leave implements Entry.Leave - the entry (will be returned on subsequent calls to Peek)
 func (q *Queue) Leave() error {
-	return nil // No action (item is already in the queue and there is nothing to close)
+	q.mu.Lock()
+	q.peeked = false // item is already in the queue and there is nothing to close
+	q.mu.Unlock()
+	return nil
 }
 
 // Remove implements Entry.Remove this entry from the queue
@@ -123,11 +193,19 @@ func (q *Queue) Quarantine() error {
 
 // remove removes the first item in the queue.
 func (q *Queue) remove() error {
+	var notify func()
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	defer func() {
+		q.mu.Unlock()
+		if notify != nil {
+			notify()
+		}
+	}()
+	q.peeked = false
 	initialLen := len(q.messages)
 	if initialLen > 0 {
 		q.messages = q.messages[1:]
+		notify = q.watermarks.Update(len(q.messages))
 	}
 	if initialLen <= 1 { // Queue is now, or was already, empty
 		for _, c := range q.waitingForEmpty {
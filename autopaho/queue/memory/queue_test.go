@@ -19,6 +19,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -128,3 +130,225 @@ func TestLeaveAndQuarantine(t *testing.T) {
 		t.Errorf("expected ErrEmpty, got %s", err)
 	}
 }
+
+// TestLenAndWatermarks checks that Len tracks the queue depth and the watermark callback is called once per crossing
+func TestLenAndWatermarks(t *testing.T) {
+	q := New()
+
+	type event struct {
+		depth int
+		high  bool
+	}
+	var events []event
+	if err := q.SetWatermarks(5, 2, func(depth int, high bool) {
+		events = append(events, event{depth: depth, high: high})
+	}); err != nil {
+		t.Fatalf("SetWatermarks failed: %s", err)
+	}
+	if err := q.SetWatermarks(2, 2, func(int, bool) {}); err == nil {
+		t.Fatalf("expected error when low watermark is not below high watermark")
+	}
+
+	enqueue := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := q.Enqueue(bytes.NewReader([]byte(fmt.Sprintf("entry %d", i)))); err != nil {
+				t.Fatalf("error adding entry: %s", err)
+			}
+		}
+	}
+	dequeue := func(n int) {
+		for i := 0; i < n; i++ {
+			entry, err := q.Peek()
+			if err != nil {
+				t.Fatalf("error peeking entry: %s", err)
+			}
+			if err = entry.Remove(); err != nil && !errors.Is(err, queue.ErrEmpty) {
+				t.Fatalf("error removing entry: %s", err)
+			}
+		}
+	}
+
+	enqueue(4)
+	if len(events) != 0 {
+		t.Fatalf("expected no events below high watermark, got %v", events)
+	}
+	enqueue(3) // crosses high watermark once
+	if l := q.Len(); l != 7 {
+		t.Fatalf("expected Len 7, got %d", l)
+	}
+	dequeue(4) // depth 3 (above low watermark)
+	if exp := []event{{5, true}}; fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Fatalf("expected events %v, got %v", exp, events)
+	}
+	dequeue(3) // crosses low watermark once
+	if l := q.Len(); l != 0 {
+		t.Fatalf("expected Len 0, got %d", l)
+	}
+	enqueue(5) // crosses high watermark again
+	if exp := []event{{5, true}, {2, false}, {5, true}}; fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Fatalf("expected events %v, got %v", exp, events)
+	}
+}
+
+// TestWatermarksOrdering confirms that, when the queue is filled and drained concurrently, watermark notifications
+// are serialised and delivered in the order in which the crossings occurred
+func TestWatermarksOrdering(t *testing.T) {
+	q := New()
+
+	var mu sync.Mutex
+	var events []bool
+	var active atomic.Int32
+	if err := q.SetWatermarks(2, 1, func(_ int, high bool) {
+		if active.Add(1) != 1 {
+			t.Errorf("concurrent call to WatermarkFunc")
+		}
+		time.Sleep(time.Millisecond) // Give any out-of-order notification a chance to overtake
+		mu.Lock()
+		events = append(events, high)
+		mu.Unlock()
+		active.Add(-1)
+	}); err != nil {
+		t.Fatalf("SetWatermarks failed: %s", err)
+	}
+
+	const count = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			if err := q.Enqueue(bytes.NewReader([]byte("entry"))); err != nil {
+				t.Errorf("error adding entry: %s", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for removed := 0; removed < count; {
+			entry, err := q.Peek()
+			if errors.Is(err, queue.ErrEmpty) {
+				time.Sleep(10 * time.Microsecond)
+				continue
+			}
+			if err != nil {
+				t.Errorf("error peeking entry: %s", err)
+				return
+			}
+			if err = entry.Remove(); err != nil {
+				t.Errorf("error removing entry: %s", err)
+				return
+			}
+			removed++
+		}
+	}()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 {
+		t.Fatal("expected at least one watermark crossing")
+	}
+	for i, high := range events {
+		if high != (i%2 == 0) { // Must alternate high, low, high...
+			t.Fatalf("notification %d out of order: %v", i, events)
+		}
+	}
+	if events[len(events)-1] { // Queue is empty so the last crossing must be low
+		t.Fatalf("expected final notification to be low: %v", events)
+	}
+}
+
+// TestPriority confirms that higher priority entries are returned first, with FIFO ordering within a priority, and
+// that the entry returned by Peek is not displaced by a higher priority entry added before it is removed.
+func TestPriority(t *testing.T) {
+	var _ queue.PriorityQueue = New() // Compile time check
+
+	q := New()
+	for _, e := range []struct {
+		data     string
+		priority int
+	}{
+		{"low1", -1},
+		{"normal1", 0},
+		{"high1", 5},
+		{"normal2", 0},
+		{"low2", -1},
+		{"high2", 5},
+		{"urgent", 10},
+	} {
+		if err := q.EnqueuePriority(bytes.NewReader([]byte(e.data)), e.priority); err != nil {
+			t.Fatalf("error adding %s: %s", e.data, err)
+		}
+	}
+	if err := q.Enqueue(bytes.NewReader([]byte("normal3"))); err != nil { // Enqueue uses priority 0
+		t.Fatalf("error adding normal3: %s", err)
+	}
+
+	next := func() string {
+		t.Helper()
+		entry, err := q.Peek()
+		if err != nil {
+			t.Fatalf("error peeking: %s", err)
+		}
+		r, err := entry.Reader()
+		if err != nil {
+			t.Fatalf("error getting reader: %s", err)
+		}
+		var b bytes.Buffer
+		if _, err = b.ReadFrom(r); err != nil {
+			t.Fatalf("error reading entry: %s", err)
+		}
+		return b.String()
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, next())
+		if i == 0 { // Add a higher priority entry whilst the head of the queue is being processed
+			if err := q.EnqueuePriority(bytes.NewReader([]byte("critical")), 20); err != nil {
+				t.Fatalf("error adding critical: %s", err)
+			}
+		}
+		if err := q.Remove(); err != nil {
+			t.Fatalf("error removing entry: %s", err)
+		}
+	}
+	for q.Len() > 0 {
+		got = append(got, next())
+		_ = q.Remove()
+	}
+
+	want := []string{"urgent", "critical", "high1", "high2", "normal1", "normal2", "normal3", "low1", "low2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// TestMaxLen confirms that Enqueue returns queue.ErrFull once the maximum length is reached
+func TestMaxLen(t *testing.T) {
+	q := New()
+	q.SetMaxLen(2)
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(bytes.NewReader([]byte{byte(i)})); err != nil {
+			t.Fatalf("error adding to queue: %s", err)
+		}
+	}
+	if err := q.Enqueue(bytes.NewReader([]byte{2})); !errors.Is(err, queue.ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 items in queue, got %d", q.Len())
+	}
+
+	entry, err := q.Peek()
+	if err != nil {
+		t.Fatalf("error peeking queue: %s", err)
+	}
+	if err = entry.Remove(); err != nil {
+		t.Fatalf("error removing entry: %s", err)
+	}
+	if err := q.Enqueue(bytes.NewReader([]byte{3})); err != nil {
+		t.Fatalf("expected space in queue following Remove: %s", err)
+	}
+}
@@ -17,11 +17,14 @@ package queue
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 )
 
 var (
 	ErrEmpty = errors.New("empty queue")
+	ErrFull  = errors.New("queue full") // Returned by Enqueue when a queue has reached its maximum length
 )
 
 // Entry - permits access to a queue entry
@@ -48,3 +51,90 @@ type Queue interface {
 	// Warning: Peek is not safe for concurrent use (it may return the same Entry leading to unpredictable results)
 	Peek() (Entry, error)
 }
+
+// PriorityQueue is an optional interface that may be implemented by a Queue that supports prioritisation.
+// Entries with a higher priority are returned by Peek before those with a lower priority; entries with the same
+// priority are returned in the order they were added (FIFO). Enqueue is equivalent to EnqueuePriority(p, 0).
+type PriorityQueue interface {
+	Queue
+
+	// EnqueuePriority adds an item to the queue with the specified priority
+	EnqueuePriority(p io.Reader, priority int) error
+}
+
+// WatermarkFunc is called when the number of items in a queue rises to the high watermark (high == true) or,
+// having done so, subsequently falls to the low watermark (high == false).
+type WatermarkFunc func(depth int, high bool)
+
+// Watermarks tracks the depth of a queue against high and low watermarks; it is intended for use by Queue
+// implementations (which must serialise calls to Update).
+// Calls to the WatermarkFunc are serialised, and made in the order in which the crossings occurred (so a "low"
+// notification will never be delivered before the "high" notification that preceded it).
+type Watermarks struct {
+	high, low int
+	fn        WatermarkFunc
+	isHigh    bool // true if the high watermark has been reached (and low watermark not subsequently reached)
+
+	mu        sync.Mutex       // protects pending and notifying
+	pending   []watermarkEvent // crossings awaiting notification (oldest first)
+	notifying bool             // true whilst a goroutine is calling fn
+}
+
+// watermarkEvent records a watermark crossing
+type watermarkEvent struct {
+	depth int
+	high  bool
+}
+
+// NewWatermarks returns a Watermarks that will call fn when the depth reaches high, and then again when the depth
+// falls to low (each crossing results in a single call). low must be less than high.
+func NewWatermarks(high, low int, fn WatermarkFunc) (*Watermarks, error) {
+	if low < 0 || low >= high {
+		return nil, fmt.Errorf("invalid watermarks (high: %d, low: %d); low must be >= 0 and less than high", high, low)
+	}
+	return &Watermarks{high: high, low: low, fn: fn}, nil
+}
+
+// Update records the current depth of the queue. If a watermark has been crossed, a function that will deliver the
+// notification is returned (this allows the caller to release any locks before calling it); otherwise nil.
+// If another goroutine is already delivering notifications the returned function will not block; the crossing will
+// be notified, in order, by that goroutine.
+func (w *Watermarks) Update(depth int) func() {
+	if w == nil {
+		return nil
+	}
+	var e watermarkEvent
+	switch {
+	case !w.isHigh && depth >= w.high:
+		w.isHigh = true
+		e = watermarkEvent{depth: depth, high: true}
+	case w.isHigh && depth <= w.low:
+		w.isHigh = false
+		e = watermarkEvent{depth: depth, high: false}
+	default:
+		return nil
+	}
+	w.mu.Lock()
+	w.pending = append(w.pending, e)
+	w.mu.Unlock()
+	return w.notify
+}
+
+// notify calls fn for each pending crossing (in order) unless another goroutine is already doing so
+func (w *Watermarks) notify() {
+	w.mu.Lock()
+	if w.notifying {
+		w.mu.Unlock()
+		return
+	}
+	w.notifying = true
+	for len(w.pending) > 0 {
+		e := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+		w.fn(e.depth, e.high)
+		w.mu.Lock()
+	}
+	w.notifying = false
+	w.mu.Unlock()
+}
@@ -384,3 +384,184 @@ func TestPreloadPublish(t *testing.T) {
 		t.Fatal("test server did not shutdown within expected time")
 	}
 }
+
+// TestFlushQueue confirms that FlushQueue blocks until all queued messages have been transmitted
+func TestFlushQueue(t *testing.T) {
+	t.Parallel()
+	const messageCount = 20
+
+	server, _ := url.Parse(dummyURL)
+	serverLogger := paholog.NewTestLogger(t, "testServer:")
+	logger := paholog.NewTestLogger(t, "test:")
+
+	ts := testserver.New(serverLogger)
+	var publishReceived atomic.Int32
+	gotAllMessages := make(chan struct{})
+	ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+		if cp.Type == packets.PUBLISH && publishReceived.Add(1) == messageCount {
+			close(gotAllMessages)
+		}
+		return nil
+	})
+
+	q := memqueue.New()
+	for i := 0; i < messageCount; i++ {
+		var b bytes.Buffer
+		publish := packets.Publish{
+			Topic:   "test/flush",
+			Payload: []byte("packet: " + strconv.Itoa(i)),
+			QoS:     1,
+		}
+		if _, err := publish.WriteTo(&b); err != nil {
+			t.Fatalf("failed to write publish: %s", err)
+		}
+		if err := q.Enqueue(&b); err != nil {
+			t.Fatalf("failed to enqueue: %s", err)
+		}
+	}
+
+	var tsDone chan struct{} // Set on AttemptConnection and closed when that test server connection is done
+	config := ClientConfig{
+		ServerUrls:       []*url.URL{server},
+		KeepAlive:        0,
+		ReconnectBackoff: NewConstantBackoff(shortDelay), // Retry connection very quickly!
+		ConnectTimeout:   shortDelay,                     // Connection should come up very quickly
+		Queue:            q,
+		AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+			var conn net.Conn
+			var err error
+			conn, tsDone, err = ts.Connect(ctx)
+			return conn, err
+		},
+		Debug:      logger,
+		PahoDebug:  logger,
+		PahoErrors: logger,
+		ClientConfig: paho.ClientConfig{
+			ClientID: "test",
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cm, err := NewConnection(ctx, config)
+	if err != nil {
+		t.Fatalf("expected NewConnection success: %s", err)
+	}
+
+	if err := cm.AwaitConnection(ctx); err != nil {
+		t.Fatalf("AwaitConnection failed: %s", err)
+	}
+	flushCtx, flushCancel := context.WithTimeout(ctx, longerDelay)
+	defer flushCancel()
+	if err := cm.FlushQueue(flushCtx); err != nil {
+		t.Fatalf("FlushQueue returned error: %s", err)
+	}
+	if _, err := q.Peek(); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("expected queue to be empty following FlushQueue, got %v", err)
+	}
+
+	select {
+	case <-gotAllMessages:
+	case <-time.After(longerDelay):
+		t.Fatalf("timeout awaiting messages (received %d)", publishReceived.Load())
+	}
+
+	// FlushQueue should also return promptly when the queue is already empty
+	if err := cm.FlushQueue(flushCtx); err != nil {
+		t.Fatalf("FlushQueue on empty queue returned error: %s", err)
+	}
+
+	if err := cm.Disconnect(ctx); err != nil {
+		t.Fatalf("Disconnect returned error: %s", err)
+	}
+	select {
+	case <-tsDone:
+	case <-time.After(shortDelay):
+		t.Fatal("test server did not shutdown within expected time")
+	}
+
+	// FlushQueue should fail once the connection manager has shutdown
+	if err := cm.FlushQueue(ctx); err == nil {
+		t.Fatal("expected FlushQueue to return an error following Disconnect")
+	}
+}
+
+// TestPublishDisposition confirms that PublishOrQueue reports whether a message was sent, queued (connection down) or
+// rejected because the queue is full.
+func TestPublishDisposition(t *testing.T) {
+	t.Parallel()
+	server, _ := url.Parse(dummyURL)
+	serverLogger := paholog.NewTestLogger(t, "testServer:")
+	logger := paholog.NewTestLogger(t, "test:")
+
+	ts := testserver.New(serverLogger)
+	q := memqueue.New()
+	q.SetMaxLen(1)
+
+	var allowConnection atomic.Bool
+	serverDone := make(chan chan struct{}, 20)
+	config := ClientConfig{
+		ServerUrls:       []*url.URL{server},
+		KeepAlive:        0,
+		ReconnectBackoff: NewConstantBackoff(shortDelay),
+		ConnectTimeout:   shortDelay,
+		Queue:            q,
+		AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+			if !allowConnection.Load() {
+				return nil, errors.New("connection not permitted")
+			}
+			conn, done, err := ts.Connect(ctx)
+			if err == nil {
+				serverDone <- done
+			}
+			return conn, err
+		},
+		Debug:      logger,
+		PahoDebug:  logger,
+		PahoErrors: logger,
+		ClientConfig: paho.ClientConfig{
+			ClientID: "test",
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cm, err := NewConnection(ctx, config)
+	if err != nil {
+		t.Fatalf("expected NewConnection success: %s", err)
+	}
+
+	msg := &QueuePublish{Publish: &paho.Publish{Topic: "test/disposition", QoS: 1, Payload: []byte("test")}}
+	r, err := cm.PublishOrQueue(ctx, msg)
+	if err != nil || r.Disposition != PublishQueued {
+		t.Fatalf("expected message to be queued, got %s (err: %v)", r.Disposition, err)
+	}
+	r, err = cm.PublishOrQueue(ctx, msg)
+	if !errors.Is(err, queue.ErrFull) || r.Disposition != PublishRejectedQueueFull {
+		t.Fatalf("expected queue full, got %s (err: %v)", r.Disposition, err)
+	}
+
+	allowConnection.Store(true)
+	if err := cm.AwaitConnection(ctx); err != nil {
+		t.Fatalf("AwaitConnection failed: %s", err)
+	}
+	if err := cm.FlushQueue(ctx); err != nil {
+		t.Fatalf("FlushQueue returned error: %s", err)
+	}
+	r, err = cm.PublishOrQueue(ctx, msg)
+	if err != nil || r.Disposition != PublishSent || r.Response == nil {
+		t.Fatalf("expected message to be sent, got %s (err: %v)", r.Disposition, err)
+	}
+
+	if err := cm.Disconnect(ctx); err != nil {
+		t.Fatalf("Disconnect returned error: %s", err)
+	}
+	close(serverDone)
+	for done := range serverDone {
+		select {
+		case <-done:
+		case <-time.After(shortDelay):
+			t.Fatal("test server did not shutdown within expected time")
+		}
+	}
+}
@@ -39,6 +39,7 @@ type TestServer struct {
 	receivedMu      sync.Mutex
 	receivedPubacks []*packets.Puback
 	receivedPubrecs []*packets.Pubrec
+	receivedSubs    []*packets.Subscribe
 
 	logger Logger
 }
@@ -123,6 +124,9 @@ func (t *TestServer) Run() {
 				}
 			case packets.SUBSCRIBE:
 				t.logger.Println("received", recv.Content.(*packets.Subscribe))
+				t.receivedMu.Lock()
+				t.receivedSubs = append(t.receivedSubs, recv.Content.(*packets.Subscribe))
+				t.receivedMu.Unlock()
 				if p, ok := t.responses[packets.SUBACK]; ok {
 					p.(*packets.Suback).PacketID = recv.PacketID()
 					if _, err := p.WriteTo(t.conn); err != nil {
@@ -228,3 +232,13 @@ func (t *TestServer) ReceivedPubrecs() []packets.Pubrec {
 	}
 	return ret
 }
+
+func (t *TestServer) ReceivedSubscribes() []packets.Subscribe {
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+	ret := make([]packets.Subscribe, len(t.receivedSubs))
+	for k := range t.receivedSubs {
+		ret[k] = *t.receivedSubs[k]
+	}
+	return ret
+}
@@ -505,7 +505,7 @@ func (i *Instance) processIncoming(cp *packets.ControlPacket, out chan<- *packet
 		authProp := cp.Content.(*packets.Auth).Properties
 		switch authProp.AuthMethod {
 		case "TEST":
-			if !bytes.Equal(authProp.AuthData, []byte("secret data")) {
+			if !bytes.HasPrefix(authProp.AuthData, []byte("secret data")) { // suffix permitted so refreshed data can be identified
 				return fmt.Errorf("invalid authentication data received: %s", authProp.AuthData)
 			}
 		default:
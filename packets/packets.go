@@ -17,6 +17,7 @@ package packets
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -73,17 +74,24 @@ type (
 // NewThreadSafeConn wraps net.Conn with a mutex. ControlPacket uses it in
 // WriteTo method to ensure parallel writes are thread-Safe.
 func NewThreadSafeConn(c net.Conn) net.Conn {
-	type threadSafeConn struct {
-		net.Conn
-		sync.Locker
-	}
-
 	return &threadSafeConn{
 		Conn:   c,
 		Locker: &sync.Mutex{},
 	}
 }
 
+// threadSafeConn is the net.Conn returned by NewThreadSafeConn
+type threadSafeConn struct {
+	net.Conn
+	sync.Locker
+}
+
+// NetConn returns the wrapped connection (matching tls.Conn) so that callers can access the underlying
+// connection (e.g. to retrieve the tls.ConnectionState).
+func (c *threadSafeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 // WriteTo operates on a FixedHeader and takes the option values and produces
 // the wire format byte that represents these.
 func (f *FixedHeader) WriteTo(w io.Writer) (int64, error) {
@@ -237,6 +245,14 @@ func NewControlPacket(t byte) *ControlPacket {
 // ReadPacket reads a control packet from a io.Reader and returns a completed
 // struct with the appropriate data
 func ReadPacket(r io.Reader) (*ControlPacket, error) {
+	return ReadPacketStream(r, 0)
+}
+
+// ReadPacketStream is as ReadPacket except that, if minStreamSize is greater than 0, the payload of a PUBLISH packet
+// with a payload of at least minStreamSize bytes is not read. Instead, Publish.PayloadReader is set to a reader that
+// returns the payload (and Publish.PayloadSize to its length), meaning the payload need not be held in memory. The
+// payload MUST be read in full before the next packet is read from r.
+func ReadPacketStream(r io.Reader, minStreamSize int64) (*ControlPacket, error) {
 	t := [1]byte{}
 	_, err := io.ReadFull(r, t[:])
 	if err != nil {
@@ -307,6 +323,13 @@ func ReadPacket(r io.Reader) (*ControlPacket, error) {
 		return nil, err
 	}
 
+	if cp.Type == PUBLISH && minStreamSize > 0 && int64(cp.remainingLength) >= minStreamSize {
+		if err := readPublishStream(r, cp, minStreamSize); err != nil {
+			return nil, err
+		}
+		return cp, nil
+	}
+
 	var content bytes.Buffer
 	content.Grow(cp.remainingLength)
 
@@ -325,6 +348,66 @@ func ReadPacket(r io.Reader) (*ControlPacket, error) {
 	return cp, nil
 }
 
+// readPublishStream reads the variable header of the PUBLISH cp from r and, if the payload is at least minStreamSize
+// bytes, sets PayloadReader (leaving the payload unread). Otherwise, the remainder of the packet is read and unpacked
+// as normal.
+func readPublishStream(r io.Reader, cp *ControlPacket, minStreamSize int64) error {
+	p := cp.Content.(*Publish)
+	remaining := int64(cp.remainingLength)
+	var vh bytes.Buffer
+	readN := func(n int64) error {
+		if n > remaining {
+			return fmt.Errorf("PUBLISH variable header exceeds remaining length %d", cp.remainingLength)
+		}
+		if _, err := io.CopyN(&vh, r, n); err != nil {
+			return err
+		}
+		remaining -= n
+		return nil
+	}
+	if err := readN(2); err != nil {
+		return err
+	}
+	topicLen := int64(binary.BigEndian.Uint16(vh.Bytes()))
+	if p.QoS > 0 {
+		topicLen += 2 // packet identifier
+	}
+	if err := readN(topicLen); err != nil {
+		return err
+	}
+	propLenVBI, err := getVBI(r)
+	if err != nil {
+		return err
+	}
+	propLenBytes := int64(propLenVBI.Len())
+	propLen, err := decodeVBI(bytes.NewBuffer(propLenVBI.Bytes()))
+	if err != nil {
+		return err
+	}
+	if propLenBytes > remaining {
+		return fmt.Errorf("PUBLISH variable header exceeds remaining length %d", cp.remainingLength)
+	}
+	vh.Write(propLenVBI.Bytes())
+	remaining -= propLenBytes
+	if err := readN(int64(propLen)); err != nil {
+		return err
+	}
+
+	if remaining < minStreamSize { // Properties were larger than expected, so the payload is small
+		if err := readN(remaining); err != nil {
+			return err
+		}
+		return p.Unpack(&vh)
+	}
+	if err := p.Unpack(&vh); err != nil {
+		return err
+	}
+	p.Payload = nil
+	p.PayloadReader = io.LimitReader(r, remaining)
+	p.PayloadSize = remaining
+	return nil
+}
+
 // WriteTo writes a packet to an io.Writer, handling packing all the parts of
 // a control packet.
 func (c *ControlPacket) WriteTo(w io.Writer) (int64, error) {
@@ -357,7 +440,31 @@ func (c *ControlPacket) WriteTo(w io.Writer) (int64, error) {
 		safe.Lock()
 		defer safe.Unlock()
 	}
-	return buffers.WriteTo(w)
+	if _, ok := w.(*net.TCPConn); ok {
+		return buffers.WriteTo(w) // uses writev which handles partial writes
+	}
+	return writeBuffers(w, buffers)
+}
+
+// writeBuffers writes the contents of buffers to w. net.Buffers.WriteTo relies upon w.Write returning an error
+// if it writes fewer bytes than requested (as required by io.Writer); not all net.Conn implementations honour this,
+// so we keep writing until each buffer has been fully written (or an error occurs).
+func writeBuffers(w io.Writer, buffers net.Buffers) (int64, error) {
+	var n int64
+	for _, b := range buffers {
+		for len(b) > 0 {
+			nb, err := w.Write(b)
+			n += int64(nb)
+			if err != nil {
+				return n, err
+			}
+			if nb == 0 {
+				return n, io.ErrShortWrite
+			}
+			b = b[nb:]
+		}
+	}
+	return n, nil
 }
 
 func encodeVBI(length int) []byte {
@@ -465,6 +572,44 @@ func writeBinary(d []byte, b *bytes.Buffer) {
 	b.Write(d)
 }
 
+func appendUint16(b []byte, u uint16) []byte {
+	return append(b, byte(u>>8), byte(u))
+}
+
+func appendUint32(b []byte, u uint32) []byte {
+	return append(b, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+}
+
+func appendString(b []byte, s string) []byte {
+	// Due to the 16 bit header strings are limited to 65535 bytes
+	if len(s) > 65535 {
+		s = s[:65535]
+	}
+	return append(appendUint16(b, uint16(len(s))), s...)
+}
+
+func appendBinary(b []byte, d []byte) []byte {
+	// Due to the 16 bit header binary data is limited to 65535 bytes
+	if len(d) > 65535 {
+		d = d[:65535]
+	}
+	return append(appendUint16(b, uint16(len(d))), d...)
+}
+
+func appendVBI(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
 func readUint16(b *bytes.Buffer) (uint16, error) {
 	b1, err := b.ReadByte()
 	if err != nil {
@@ -516,3 +516,46 @@ func TestNewThreadSafeWrapper(t *testing.T) {
 		t.Error("NewThreadSafeConn does not implement sync.Locker")
 	}
 }
+
+// chunkedWriter accepts at most chunk bytes per call to Write (without returning an error) to simulate a
+// connection that performs partial writes.
+type chunkedWriter struct {
+	bytes.Buffer
+	chunk int
+	calls int
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	c.calls++
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	return c.Buffer.Write(p)
+}
+
+func TestWriteToPartialWrites(t *testing.T) {
+	x := NewControlPacket(PUBLISH)
+	x.Content.(*Publish).QoS = 1
+	x.Content.(*Publish).Topic = "test/partial/write"
+	x.Content.(*Publish).PacketID = 42
+	x.Content.(*Publish).Payload = bytes.Repeat([]byte("payload"), 100)
+	x.Content.(*Publish).Properties = &Properties{ContentType: "text/plain"}
+
+	var expected bytes.Buffer
+	en, err := x.WriteTo(&expected)
+	require.NoError(t, err)
+
+	w := &chunkedWriter{chunk: 3}
+	n, err := x.WriteTo(w)
+	require.NoError(t, err)
+	assert.Equal(t, en, n)
+	assert.Greater(t, w.calls, len(x.Content.Buffers())) // confirm partial writes occurred
+	assert.Equal(t, expected.Bytes(), w.Bytes())
+
+	r, err := ReadPacket(&w.Buffer)
+	require.NoError(t, err)
+	p := r.Content.(*Publish)
+	assert.Equal(t, "test/partial/write", p.Topic)
+	assert.Equal(t, uint16(42), p.PacketID)
+	assert.Equal(t, x.Content.(*Publish).Payload, p.Payload)
+}
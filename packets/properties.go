@@ -244,335 +244,208 @@ func (p *Properties) String() string {
 // Pack takes all the defined properties for an Properties and produces
 // a slice of bytes representing the wire format for the information
 func (i *Properties) Pack(p byte) []byte {
-	var b bytes.Buffer
-
 	if i == nil {
 		return nil
 	}
-
-	if p == PUBLISH {
-		if i.PayloadFormat != nil {
-			b.WriteByte(PropPayloadFormat)
-			b.WriteByte(*i.PayloadFormat)
-		}
-
-		if i.MessageExpiry != nil {
-			b.WriteByte(PropMessageExpiry)
-			writeUint32(*i.MessageExpiry, &b)
-		}
-
-		if i.ContentType != "" {
-			b.WriteByte(PropContentType)
-			writeString(i.ContentType, &b)
-		}
-
-		if i.ResponseTopic != "" {
-			b.WriteByte(PropResponseTopic)
-			writeString(i.ResponseTopic, &b)
-		}
-
-		if len(i.CorrelationData) > 0 {
-			b.WriteByte(PropCorrelationData)
-			writeBinary(i.CorrelationData, &b)
-		}
-
-		if i.TopicAlias != nil {
-			b.WriteByte(PropTopicAlias)
-			writeUint16(*i.TopicAlias, &b)
-		}
-	}
-
-	if p == PUBLISH || p == SUBSCRIBE {
-		if i.SubscriptionIdentifier != nil {
-			b.WriteByte(PropSubscriptionIdentifier)
-			encodeVBIdirect(*i.SubscriptionIdentifier, &b)
-		}
-	}
-
-	if p == CONNECT || p == CONNACK {
-		if i.ReceiveMaximum != nil {
-			b.WriteByte(PropReceiveMaximum)
-			writeUint16(*i.ReceiveMaximum, &b)
-		}
-
-		if i.TopicAliasMaximum != nil {
-			b.WriteByte(PropTopicAliasMaximum)
-			writeUint16(*i.TopicAliasMaximum, &b)
-		}
-
-		if i.MaximumPacketSize != nil {
-			b.WriteByte(PropMaximumPacketSize)
-			writeUint32(*i.MaximumPacketSize, &b)
-		}
+	size := i.packedSizeHint()
+	if size == 0 {
+		return nil
 	}
+	return i.appendPacked(make([]byte, 0, size), p)
+}
 
-	if p == CONNACK {
-		if i.MaximumQOS != nil {
-			b.WriteByte(PropMaximumQOS)
-			b.WriteByte(*i.MaximumQOS)
-		}
-
-		if i.AssignedClientID != "" {
-			b.WriteByte(PropAssignedClientID)
-			writeString(i.AssignedClientID, &b)
-		}
-
-		if i.ServerKeepAlive != nil {
-			b.WriteByte(PropServerKeepAlive)
-			writeUint16(*i.ServerKeepAlive, &b)
-		}
-
-		if i.WildcardSubAvailable != nil {
-			b.WriteByte(PropWildcardSubAvailable)
-			b.WriteByte(*i.WildcardSubAvailable)
-		}
-
-		if i.SubIDAvailable != nil {
-			b.WriteByte(PropSubIDAvailable)
-			b.WriteByte(*i.SubIDAvailable)
-		}
-
-		if i.SharedSubAvailable != nil {
-			b.WriteByte(PropSharedSubAvailable)
-			b.WriteByte(*i.SharedSubAvailable)
-		}
-
-		if i.RetainAvailable != nil {
-			b.WriteByte(PropRetainAvailable)
-			b.WriteByte(*i.RetainAvailable)
-		}
-
-		if i.ResponseInfo != "" {
-			b.WriteByte(PropResponseInfo)
-			writeString(i.ResponseInfo, &b)
-		}
+// PackBuf will create a bytes.Buffer of the packed properties, it
+// will only pack the properties appropriate to the packet type p
+// even though other properties may exist, it will silently ignore
+// them
+func (i *Properties) PackBuf(p byte) *bytes.Buffer {
+	if i == nil {
+		return nil
 	}
+	return bytes.NewBuffer(i.Pack(p))
+}
 
-	if p == CONNECT {
-		if i.RequestProblemInfo != nil {
-			b.WriteByte(PropRequestProblemInfo)
-			b.WriteByte(*i.RequestProblemInfo)
-		}
-
-		if i.WillDelayInterval != nil {
-			b.WriteByte(PropWillDelayInterval)
-			writeUint32(*i.WillDelayInterval, &b)
-		}
-
-		if i.RequestResponseInfo != nil {
-			b.WriteByte(PropRequestResponseInfo)
-			b.WriteByte(*i.RequestResponseInfo)
+// packedSizeHint returns an upper bound on the size of the packed properties (regardless of packet type); this
+// allows the buffer to be allocated once.
+func (i *Properties) packedSizeHint() int {
+	var n int
+	for _, s := range [...]string{i.ContentType, i.ResponseTopic, i.AssignedClientID, i.AuthMethod, i.ResponseInfo,
+		i.ServerReference, i.ReasonString} {
+		if s != "" {
+			n += 3 + len(s) // identifier, length, string
 		}
 	}
-
-	if p == CONNECT || p == CONNACK || p == DISCONNECT {
-		if i.SessionExpiryInterval != nil {
-			b.WriteByte(PropSessionExpiryInterval)
-			writeUint32(*i.SessionExpiryInterval, &b)
-		}
+	if len(i.CorrelationData) > 0 {
+		n += 3 + len(i.CorrelationData)
 	}
-
-	if p == CONNECT || p == CONNACK || p == AUTH {
-		if i.AuthMethod != "" {
-			b.WriteByte(PropAuthMethod)
-			writeString(i.AuthMethod, &b)
-		}
-
-		if i.AuthData != nil && len(i.AuthData) > 0 {
-			b.WriteByte(PropAuthData)
-			writeBinary(i.AuthData, &b)
-		}
+	if len(i.AuthData) > 0 {
+		n += 3 + len(i.AuthData)
 	}
-
-	if p == CONNACK || p == DISCONNECT {
-		if i.ServerReference != "" {
-			b.WriteByte(PropServerReference)
-			writeString(i.ServerReference, &b)
-		}
+	for _, u := range i.User {
+		n += 5 + len(u.Key) + len(u.Value)
 	}
-
-	if p != CONNECT {
-		if i.ReasonString != "" {
-			b.WriteByte(PropReasonString)
-			writeString(i.ReasonString, &b)
+	for _, set := range [...]bool{i.PayloadFormat != nil, i.MessageExpiry != nil, i.SubscriptionIdentifier != nil,
+		i.SessionExpiryInterval != nil, i.ServerKeepAlive != nil, i.RequestProblemInfo != nil,
+		i.WillDelayInterval != nil, i.RequestResponseInfo != nil, i.ReceiveMaximum != nil,
+		i.TopicAliasMaximum != nil, i.TopicAlias != nil, i.MaximumQOS != nil, i.RetainAvailable != nil,
+		i.MaximumPacketSize != nil, i.WildcardSubAvailable != nil, i.SubIDAvailable != nil,
+		i.SharedSubAvailable != nil} {
+		if set {
+			n += 5 // identifier plus, at most, a four byte value
 		}
 	}
-
-	for _, v := range i.User {
-		b.WriteByte(PropUser)
-		writeString(v.Key, &b)
-		writeString(v.Value, &b)
-	}
-
-	return b.Bytes()
+	return n
 }
 
-// PackBuf will create a bytes.Buffer of the packed properties, it
-// will only pack the properties appropriate to the packet type p
-// even though other properties may exist, it will silently ignore
-// them
-func (i *Properties) PackBuf(p byte) *bytes.Buffer {
-	var b bytes.Buffer
-
-	if i == nil {
-		return nil
-	}
-
+// appendPacked appends the wire format of the properties appropriate to packet type p to b
+func (i *Properties) appendPacked(b []byte, p byte) []byte {
 	if p == PUBLISH {
 		if i.PayloadFormat != nil {
-			b.WriteByte(PropPayloadFormat)
-			b.WriteByte(*i.PayloadFormat)
+			b = append(b, PropPayloadFormat, *i.PayloadFormat)
 		}
 
 		if i.MessageExpiry != nil {
-			b.WriteByte(PropMessageExpiry)
-			writeUint32(*i.MessageExpiry, &b)
+			b = append(b, PropMessageExpiry)
+			b = appendUint32(b, *i.MessageExpiry)
 		}
 
 		if i.ContentType != "" {
-			b.WriteByte(PropContentType)
-			writeString(i.ContentType, &b)
+			b = append(b, PropContentType)
+			b = appendString(b, i.ContentType)
 		}
 
 		if i.ResponseTopic != "" {
-			b.WriteByte(PropResponseTopic)
-			writeString(i.ResponseTopic, &b)
+			b = append(b, PropResponseTopic)
+			b = appendString(b, i.ResponseTopic)
 		}
 
-		if i.CorrelationData != nil && len(i.CorrelationData) > 0 {
-			b.WriteByte(PropCorrelationData)
-			writeBinary(i.CorrelationData, &b)
+		if len(i.CorrelationData) > 0 {
+			b = append(b, PropCorrelationData)
+			b = appendBinary(b, i.CorrelationData)
 		}
 
 		if i.TopicAlias != nil {
-			b.WriteByte(PropTopicAlias)
-			writeUint16(*i.TopicAlias, &b)
+			b = append(b, PropTopicAlias)
+			b = appendUint16(b, *i.TopicAlias)
 		}
 	}
 
 	if p == PUBLISH || p == SUBSCRIBE {
 		if i.SubscriptionIdentifier != nil {
-			b.WriteByte(PropSubscriptionIdentifier)
-			encodeVBIdirect(*i.SubscriptionIdentifier, &b)
+			b = append(b, PropSubscriptionIdentifier)
+			b = appendVBI(b, *i.SubscriptionIdentifier)
 		}
 	}
 
 	if p == CONNECT || p == CONNACK {
 		if i.ReceiveMaximum != nil {
-			b.WriteByte(PropReceiveMaximum)
-			writeUint16(*i.ReceiveMaximum, &b)
+			b = append(b, PropReceiveMaximum)
+			b = appendUint16(b, *i.ReceiveMaximum)
 		}
 
 		if i.TopicAliasMaximum != nil {
-			b.WriteByte(PropTopicAliasMaximum)
-			writeUint16(*i.TopicAliasMaximum, &b)
+			b = append(b, PropTopicAliasMaximum)
+			b = appendUint16(b, *i.TopicAliasMaximum)
 		}
 
 		if i.MaximumPacketSize != nil {
-			b.WriteByte(PropMaximumPacketSize)
-			writeUint32(*i.MaximumPacketSize, &b)
+			b = append(b, PropMaximumPacketSize)
+			b = appendUint32(b, *i.MaximumPacketSize)
 		}
 	}
 
 	if p == CONNACK {
 		if i.MaximumQOS != nil {
-			b.WriteByte(PropMaximumQOS)
-			b.WriteByte(*i.MaximumQOS)
+			b = append(b, PropMaximumQOS, *i.MaximumQOS)
 		}
 
 		if i.AssignedClientID != "" {
-			b.WriteByte(PropAssignedClientID)
-			writeString(i.AssignedClientID, &b)
+			b = append(b, PropAssignedClientID)
+			b = appendString(b, i.AssignedClientID)
 		}
 
 		if i.ServerKeepAlive != nil {
-			b.WriteByte(PropServerKeepAlive)
-			writeUint16(*i.ServerKeepAlive, &b)
+			b = append(b, PropServerKeepAlive)
+			b = appendUint16(b, *i.ServerKeepAlive)
 		}
 
 		if i.WildcardSubAvailable != nil {
-			b.WriteByte(PropWildcardSubAvailable)
-			b.WriteByte(*i.WildcardSubAvailable)
+			b = append(b, PropWildcardSubAvailable, *i.WildcardSubAvailable)
 		}
 
 		if i.SubIDAvailable != nil {
-			b.WriteByte(PropSubIDAvailable)
-			b.WriteByte(*i.SubIDAvailable)
+			b = append(b, PropSubIDAvailable, *i.SubIDAvailable)
 		}
 
 		if i.SharedSubAvailable != nil {
-			b.WriteByte(PropSharedSubAvailable)
-			b.WriteByte(*i.SharedSubAvailable)
+			b = append(b, PropSharedSubAvailable, *i.SharedSubAvailable)
 		}
 
 		if i.RetainAvailable != nil {
-			b.WriteByte(PropRetainAvailable)
-			b.WriteByte(*i.RetainAvailable)
+			b = append(b, PropRetainAvailable, *i.RetainAvailable)
 		}
 
 		if i.ResponseInfo != "" {
-			b.WriteByte(PropResponseInfo)
-			writeString(i.ResponseInfo, &b)
+			b = append(b, PropResponseInfo)
+			b = appendString(b, i.ResponseInfo)
 		}
 	}
 
 	if p == CONNECT {
 		if i.RequestProblemInfo != nil {
-			b.WriteByte(PropRequestProblemInfo)
-			b.WriteByte(*i.RequestProblemInfo)
+			b = append(b, PropRequestProblemInfo, *i.RequestProblemInfo)
 		}
 
 		if i.WillDelayInterval != nil {
-			b.WriteByte(PropWillDelayInterval)
-			writeUint32(*i.WillDelayInterval, &b)
+			b = append(b, PropWillDelayInterval)
+			b = appendUint32(b, *i.WillDelayInterval)
 		}
 
 		if i.RequestResponseInfo != nil {
-			b.WriteByte(PropRequestResponseInfo)
-			b.WriteByte(*i.RequestResponseInfo)
+			b = append(b, PropRequestResponseInfo, *i.RequestResponseInfo)
 		}
 	}
 
 	if p == CONNECT || p == CONNACK || p == DISCONNECT {
 		if i.SessionExpiryInterval != nil {
-			b.WriteByte(PropSessionExpiryInterval)
-			writeUint32(*i.SessionExpiryInterval, &b)
+			b = append(b, PropSessionExpiryInterval)
+			b = appendUint32(b, *i.SessionExpiryInterval)
 		}
 	}
 
 	if p == CONNECT || p == CONNACK || p == AUTH {
 		if i.AuthMethod != "" {
-			b.WriteByte(PropAuthMethod)
-			writeString(i.AuthMethod, &b)
+			b = append(b, PropAuthMethod)
+			b = appendString(b, i.AuthMethod)
 		}
 
-		if i.AuthData != nil && len(i.AuthData) > 0 {
-			b.WriteByte(PropAuthData)
-			writeBinary(i.AuthData, &b)
+		if len(i.AuthData) > 0 {
+			b = append(b, PropAuthData)
+			b = appendBinary(b, i.AuthData)
 		}
 	}
 
 	if p == CONNACK || p == DISCONNECT {
 		if i.ServerReference != "" {
-			b.WriteByte(PropServerReference)
-			writeString(i.ServerReference, &b)
+			b = append(b, PropServerReference)
+			b = appendString(b, i.ServerReference)
 		}
 	}
 
 	if p != CONNECT {
 		if i.ReasonString != "" {
-			b.WriteByte(PropReasonString)
-			writeString(i.ReasonString, &b)
+			b = append(b, PropReasonString)
+			b = appendString(b, i.ReasonString)
 		}
 	}
 
 	for _, v := range i.User {
-		b.WriteByte(PropUser)
-		writeString(v.Key, &b)
-		writeString(v.Value, &b)
+		b = append(b, PropUser)
+		b = appendString(b, v.Key)
+		b = appendString(b, v.Value)
 	}
 
-	return &b
+	return b
 }
 
 // Unpack takes a buffer of bytes and reads out the defined properties
@@ -16,6 +16,7 @@
 package packets
 
 import (
+	"encoding/hex"
 	"fmt"
 	"testing"
 )
@@ -167,3 +168,124 @@ func BenchmarkPropertyCreationStruct(b *testing.B) {
 	}
 	fmt.Sprintln(p)
 }
+
+// allProperties returns Properties with every field set (used to confirm the wire format for each packet type)
+func allProperties() *Properties {
+	u8 := func(v byte) *byte { return &v }
+	u16 := func(v uint16) *uint16 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	subID := 300
+	return &Properties{
+		PayloadFormat:          u8(1),
+		MessageExpiry:          u32(3600),
+		ContentType:            "application/json",
+		ResponseTopic:          "reply/topic",
+		CorrelationData:        []byte("correlation"),
+		SubscriptionIdentifier: &subID,
+		SessionExpiryInterval:  u32(86400),
+		AssignedClientID:       "assigned",
+		ServerKeepAlive:        u16(45),
+		AuthMethod:             "SCRAM-SHA-1",
+		AuthData:               []byte{1, 2, 3},
+		RequestProblemInfo:     u8(0),
+		WillDelayInterval:      u32(10),
+		RequestResponseInfo:    u8(1),
+		ResponseInfo:           "response",
+		ServerReference:        "other:1883",
+		ReasonString:           "reason",
+		ReceiveMaximum:         u16(100),
+		TopicAliasMaximum:      u16(20),
+		TopicAlias:             u16(3),
+		MaximumQOS:             u8(1),
+		RetainAvailable:        u8(1),
+		User:                   []User{{Key: "k1", Value: "v1"}, {Key: "k2", Value: "v2"}},
+		MaximumPacketSize:      u32(65536),
+		WildcardSubAvailable:   u8(1),
+		SubIDAvailable:         u8(0),
+		SharedSubAvailable:     u8(1),
+	}
+}
+
+// typicalPublishProperties returns the properties commonly found on a PUBLISH
+func typicalPublishProperties() *Properties {
+	pf := byte(1)
+	return &Properties{
+		PayloadFormat: &pf,
+		ContentType:   "application/json",
+		User:          []User{{Key: "trace-id", Value: "8d3c5a3e-7a43-4f0e-9d3b-2b4a7f1c9e21"}},
+	}
+}
+
+// TestPropertiesPackGolden confirms that the wire format produced by Pack/PackBuf is unchanged
+func TestPropertiesPackGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		props  *Properties
+		packet byte
+		want   string // hex encoded
+	}{
+		{"nil", nil, PUBLISH, ""},
+		{"empty", &Properties{}, PUBLISH, ""},
+		{"typicalPublish", typicalPublishProperties(), PUBLISH, "01010300106170706c69636174696f6e2f6a736f6e26000874726163652d6964002438643363356133652d376134332d346630652d396433622d326234613766316339653231"},
+		{"allCONNECT", allProperties(), CONNECT, "21006422001427000100001700180000000a1901110001518015000b534352414d2d5348412d311600030102032600026b31000276312600026b3200027632"},
+		{"allCONNACK", allProperties(), CONNACK, "2100642200142700010000240112000861737369676e656413002d280129002a0125011a0008726573706f6e7365110001518015000b534352414d2d5348412d311600030102031c000a6f746865723a313838331f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allPUBLISH", allProperties(), PUBLISH, "01010200000e100300106170706c69636174696f6e2f6a736f6e08000b7265706c792f746f70696309000b636f7272656c6174696f6e2300030bac021f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allPUBACK", allProperties(), PUBACK, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allPUBREC", allProperties(), PUBREC, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allPUBREL", allProperties(), PUBREL, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allPUBCOMP", allProperties(), PUBCOMP, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allSUBSCRIBE", allProperties(), SUBSCRIBE, "0bac021f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allSUBACK", allProperties(), SUBACK, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allUNSUBSCRIBE", allProperties(), UNSUBSCRIBE, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allUNSUBACK", allProperties(), UNSUBACK, "1f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allDISCONNECT", allProperties(), DISCONNECT, "11000151801c000a6f746865723a313838331f0006726561736f6e2600026b31000276312600026b3200027632"},
+		{"allAUTH", allProperties(), AUTH, "15000b534352414d2d5348412d311600030102031f0006726561736f6e2600026b31000276312600026b3200027632"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.props.Pack(tt.packet)); got != tt.want {
+				t.Errorf("Pack() = %s, want %s", got, tt.want)
+			}
+			var got string
+			if b := tt.props.PackBuf(tt.packet); b != nil {
+				got = hex.EncodeToString(b.Bytes())
+			}
+			if got != tt.want {
+				t.Errorf("PackBuf() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkPropertiesPack packs the properties commonly found on a PUBLISH
+func BenchmarkPropertiesPack(b *testing.B) {
+	p := typicalPublishProperties()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.Pack(PUBLISH)
+	}
+}
+
+// BenchmarkPropertiesPackAll packs properties with every field set
+func BenchmarkPropertiesPackAll(b *testing.B) {
+	p := allProperties()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.Pack(CONNACK)
+	}
+}
+
+// BenchmarkPublishBuffers encodes a PUBLISH with a few properties
+func BenchmarkPublishBuffers(b *testing.B) {
+	p := &Publish{
+		QoS:        1,
+		PacketID:   10,
+		Topic:      "sensors/building1/floor2/temperature",
+		Properties: typicalPublishProperties(),
+		Payload:    []byte(`{"temperature":21.5}`),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.Buffers()
+	}
+}
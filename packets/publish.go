@@ -17,12 +17,21 @@ package packets
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"sync"
 )
 
+// MaxRemainingLength is the largest Remaining Length that can be encoded in a fixed header (section 1.5.5)
+const MaxRemainingLength = 268435455
+
+// ErrPayloadSize is returned by Publish.WriteStreamTo when the payload size is invalid, or the packet would exceed
+// MaxRemainingLength
+var ErrPayloadSize = errors.New("invalid payload size")
+
 // Publish is the Variable Header definition for a publish control packet
 type Publish struct {
 	Payload    []byte
@@ -32,6 +41,11 @@ type Publish struct {
 	QoS        byte
 	Duplicate  bool
 	Retain     bool
+
+	// PayloadReader, if not nil, supplies the payload of a received PUBLISH in place of Payload (see
+	// ReadPacketStream); PayloadSize is the payload length in bytes. These are not used when writing a packet.
+	PayloadReader io.Reader
+	PayloadSize   int64
 }
 
 func (p *Publish) String() string {
@@ -77,15 +91,35 @@ func (p *Publish) Unpack(r *bytes.Buffer) error {
 
 // Buffers is the implementation of the interface required function for a packet
 func (p *Publish) Buffers() net.Buffers {
-	var b bytes.Buffer
-	writeString(p.Topic, &b)
+	idvp := p.Properties.Pack(PUBLISH)
+	b := make([]byte, 0, 2+len(p.Topic)+2+4) // topic, packet ID, property length
+	b = appendString(b, p.Topic)
 	if p.QoS > 0 {
-		_ = writeUint16(p.PacketID, &b)
+		b = appendUint16(b, p.PacketID)
 	}
-	idvp := p.Properties.Pack(PUBLISH)
-	encodeVBIdirect(len(idvp), &b)
-	return net.Buffers{b.Bytes(), idvp, p.Payload}
+	b = appendVBI(b, len(idvp))
+	return net.Buffers{b, idvp, p.Payload}
+}
+
+// Size returns the number of bytes p will occupy when written (including the fixed header); this is the value that
+// is compared against the Maximum Packet Size.
+func (p *Publish) Size() int64 {
+	return p.SizeWithPayload(int64(len(p.Payload)))
+}
 
+// SizeWithPayload is Size but with a payload of payloadSize bytes in place of p.Payload (see WriteStreamTo)
+func (p *Publish) SizeWithPayload(payloadSize int64) int64 {
+	vh := *p
+	vh.Payload = nil
+	remainingLength := payloadSize
+	for _, b := range vh.Buffers() {
+		remainingLength += int64(len(b))
+	}
+	vbiLength := int64(1)
+	for l := remainingLength; l >= 128; l /= 128 {
+		vbiLength++
+	}
+	return 1 + vbiLength + remainingLength
 }
 
 // WriteTo is the implementation of the interface required function for a packet
@@ -93,6 +127,41 @@ func (p *Publish) WriteTo(w io.Writer) (int64, error) {
 	return p.ToControlPacket().WriteTo(w)
 }
 
+// WriteStreamTo writes p to w, with the payload (which must be exactly size bytes) read from payload rather than taken
+// from p.Payload (which is ignored); this avoids holding large payloads in memory. As with ControlPacket.WriteTo, if
+// w implements sync.Locker it is locked whilst the packet is written. If payload returns fewer than size bytes, an
+// error wrapping io.ErrUnexpectedEOF is returned after a partial packet has been written (so the connection must not
+// be used further).
+func (p *Publish) WriteStreamTo(w io.Writer, payload io.Reader, size int64) (int64, error) {
+	vh := *p
+	vh.Payload = nil
+	buffers := vh.Buffers()
+	remainingLength := size
+	for _, b := range buffers {
+		remainingLength += int64(len(b))
+	}
+	if size < 0 || remainingLength > MaxRemainingLength {
+		return 0, fmt.Errorf("%w: %d byte payload (packet remaining length would be %d)", ErrPayloadSize, size, remainingLength)
+	}
+	header := append([]byte{vh.ToControlPacket().Flags | PUBLISH<<4}, encodeVBI(int(remainingLength))...)
+	buffers = append(net.Buffers{header}, buffers...)
+
+	if safe, ok := w.(sync.Locker); ok {
+		safe.Lock()
+		defer safe.Unlock()
+	}
+	n, err := writeBuffers(w, buffers)
+	if err != nil {
+		return n, err
+	}
+	pn, err := io.CopyN(w, payload, size)
+	n += pn
+	if errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("payload shorter than the %d bytes specified: %w", size, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
 // ToControlPacket returns the packet as a ControlPacket
 func (p *Publish) ToControlPacket() *ControlPacket {
 	f := p.QoS << 1
@@ -17,6 +17,10 @@ package packets
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -75,3 +79,150 @@ func TestPublishPackUnpack(t *testing.T) {
 		}
 	}
 }
+
+// TestPublishWireGolden confirms that the wire format of a PUBLISH with properties is unchanged
+func TestPublishWireGolden(t *testing.T) {
+	tests := []struct {
+		qos  byte
+		want string // hex encoded
+	}{
+		{0, "3060001373656e736f72732f74656d70657261747572654601010300106170706c69636174696f6e2f6a736f6e26000874726163652d6964002438643363356133652d376134332d346630652d396433622d32623461376631633965323132312e35"},
+		{1, "3262001373656e736f72732f74656d7065726174757265000a4601010300106170706c69636174696f6e2f6a736f6e26000874726163652d6964002438643363356133652d376134332d346630652d396433622d32623461376631633965323132312e35"},
+	}
+	for _, tt := range tests {
+		p := &Publish{
+			QoS:        tt.qos,
+			PacketID:   10,
+			Topic:      "sensors/temperature",
+			Properties: typicalPublishProperties(),
+			Payload:    []byte("21.5"),
+		}
+		var b bytes.Buffer
+		if _, err := p.WriteTo(&b); err != nil {
+			t.Fatalf("WriteTo failed: %s", err)
+		}
+		if got := hex.EncodeToString(b.Bytes()); got != tt.want {
+			t.Errorf("QoS%d: got %s, want %s", tt.qos, got, tt.want)
+		}
+	}
+}
+
+// TestPublishSize confirms that Size matches the number of bytes written (including where the remaining length
+// crosses a variable byte integer boundary)
+func TestPublishSize(t *testing.T) {
+	for _, size := range []int{0, 100, 117, 118, 16000, 20000, 2100000} {
+		for _, qos := range []byte{0, 1} {
+			p := &Publish{
+				QoS:        qos,
+				PacketID:   10,
+				Topic:      "sensors/temperature",
+				Properties: typicalPublishProperties(),
+				Payload:    bytes.Repeat([]byte{'x'}, size),
+			}
+			n, err := p.WriteTo(io.Discard)
+			if err != nil {
+				t.Fatalf("WriteTo failed: %s", err)
+			}
+			if got := p.Size(); got != n {
+				t.Errorf("QoS%d, %d byte payload: Size returned %d, wrote %d bytes", qos, size, got, n)
+			}
+			payload := p.Payload
+			p.Payload = nil
+			if got := p.SizeWithPayload(int64(len(payload))); got != n {
+				t.Errorf("QoS%d, %d byte payload: SizeWithPayload returned %d, wrote %d bytes", qos, size, got, n)
+			}
+		}
+	}
+}
+
+// TestPublishWriteStreamTo confirms that WriteStreamTo produces the same bytes as WriteTo
+func TestPublishWriteStreamTo(t *testing.T) {
+	payload := strings.Repeat("0123456789", 20000) // Remaining length needs a 3 byte VBI
+	for _, qos := range []byte{0, 1, 2} {
+		p := &Publish{
+			QoS:        qos,
+			PacketID:   10,
+			Topic:      "sensors/temperature",
+			Properties: typicalPublishProperties(),
+			Retain:     true,
+			Payload:    []byte(payload),
+		}
+		var want bytes.Buffer
+		if _, err := p.WriteTo(&want); err != nil {
+			t.Fatalf("WriteTo failed: %s", err)
+		}
+		p.Payload = nil
+		var got bytes.Buffer
+		n, err := p.WriteStreamTo(&got, strings.NewReader(payload), int64(len(payload)))
+		if err != nil {
+			t.Fatalf("WriteStreamTo failed: %s", err)
+		}
+		if n != int64(got.Len()) {
+			t.Errorf("QoS%d: WriteStreamTo returned %d, wrote %d bytes", qos, n, got.Len())
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("QoS%d: WriteStreamTo output differs from WriteTo", qos)
+		}
+	}
+
+	p := &Publish{Topic: "test"}
+	if _, err := p.WriteStreamTo(io.Discard, strings.NewReader("short"), 10); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := p.WriteStreamTo(io.Discard, strings.NewReader(""), MaxRemainingLength); !errors.Is(err, ErrPayloadSize) {
+		t.Errorf("expected ErrPayloadSize, got %v", err)
+	}
+	if _, err := p.WriteStreamTo(io.Discard, strings.NewReader(""), -1); !errors.Is(err, ErrPayloadSize) {
+		t.Errorf("expected ErrPayloadSize, got %v", err)
+	}
+}
+
+// TestReadPacketStream confirms that ReadPacketStream leaves large payloads unread (for the caller to stream)
+func TestReadPacketStream(t *testing.T) {
+	payload := strings.Repeat("0123456789", 20000)
+	for _, qos := range []byte{0, 1, 2} {
+		p := &Publish{
+			QoS:        qos,
+			PacketID:   10,
+			Topic:      "sensors/temperature",
+			Properties: typicalPublishProperties(),
+			Payload:    []byte(payload),
+		}
+		var b bytes.Buffer
+		for i := 0; i < 2; i++ { // The second packet confirms the stream is positioned correctly
+			if _, err := p.WriteTo(&b); err != nil {
+				t.Fatalf("WriteTo failed: %s", err)
+			}
+		}
+
+		cp, err := ReadPacketStream(&b, 1000)
+		if err != nil {
+			t.Fatalf("QoS%d: ReadPacketStream failed: %s", qos, err)
+		}
+		rp := cp.Content.(*Publish)
+		if rp.PayloadReader == nil || rp.Payload != nil {
+			t.Fatalf("QoS%d: payload should be streamed", qos)
+		}
+		if rp.PayloadSize != int64(len(payload)) || rp.Topic != p.Topic || (qos > 0 && rp.PacketID != p.PacketID) || rp.QoS != qos ||
+			rp.Properties.ContentType != p.Properties.ContentType {
+			t.Errorf("QoS%d: unexpected packet %s (payload size %d)", qos, rp, rp.PayloadSize)
+		}
+		got, err := io.ReadAll(rp.PayloadReader)
+		if err != nil || string(got) != payload {
+			t.Fatalf("QoS%d: payload not read correctly (%d bytes, %v)", qos, len(got), err)
+		}
+
+		// Below the threshold the packet should be read as normal
+		cp, err = ReadPacketStream(&b, int64(len(payload)+1))
+		if err != nil {
+			t.Fatalf("QoS%d: ReadPacketStream failed: %s", qos, err)
+		}
+		rp = cp.Content.(*Publish)
+		if rp.PayloadReader != nil || string(rp.Payload) != payload {
+			t.Errorf("QoS%d: payload should not be streamed", qos)
+		}
+		if b.Len() != 0 {
+			t.Errorf("QoS%d: %d bytes left unread", qos, b.Len())
+		}
+	}
+}
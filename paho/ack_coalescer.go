@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// batchAcker is implemented by session managers that can acknowledge multiple messages using a single write
+// (state.State implements this)
+type batchAcker interface {
+	AckBatch(pbs []*packets.Publish) error
+}
+
+// ackCoalescer combines acknowledgements requested concurrently (e.g. by parallel handlers) so they can be sent with
+// a single write. The first caller becomes responsible for writing; acknowledgements requested whilst it is doing so
+// are queued, and written (in the order requested) as a single batch once the current write completes. Each call to
+// ack returns once its acknowledgement has been written.
+type ackCoalescer struct {
+	mu      sync.Mutex
+	pending []*packets.Publish
+	waiters []chan struct{} // closed when the corresponding entry in pending has been written
+	writing bool            // true whilst a goroutine is writing acknowledgements
+}
+
+// ack queues pb for acknowledgement (via write) and blocks until the acknowledgement has been written
+func (a *ackCoalescer) ack(pb *packets.Publish, write func([]*packets.Publish)) {
+	written := make(chan struct{})
+	a.mu.Lock()
+	a.pending = append(a.pending, pb)
+	a.waiters = append(a.waiters, written)
+	if a.writing {
+		a.mu.Unlock()
+		<-written
+		return
+	}
+	a.writing = true
+	for len(a.pending) > 0 {
+		batch, waiters := a.pending, a.waiters
+		a.pending, a.waiters = nil, nil
+		a.mu.Unlock()
+		write(batch)
+		for _, w := range waiters {
+			close(w)
+		}
+		a.mu.Lock()
+	}
+	a.writing = false
+	a.mu.Unlock()
+}
@@ -21,3 +21,15 @@ type Auther interface {
 	Authenticate(*Auth) *Auth // Authenticate will be called when an AUTH packet is received.
 	Authenticated()           // Authenticated will be called when CONNACK is received
 }
+
+// Authenticator is an alternative to Auther for multi-step enhanced authentication flows (e.g. SCRAM or Kerberos).
+// Each time the server sends an AUTH packet with reason code Continue Authentication (0x18), Authenticate is called
+// with the AuthData it contains and the returned Auth is sent to the server; this repeats until a CONNACK (or, when
+// reauthenticating, an AUTH with reason code Success) is received, or the exchange fails.
+type Authenticator interface {
+	// Authenticate is passed the server's AuthData and returns the Auth to send in response. If the ReasonCode is 0
+	// it will be set to Continue Authentication and, if no AuthMethod is set, the server's AuthMethod will be used.
+	// Returning an error aborts the exchange (and closes the connection).
+	Authenticate(authData []byte) (*Auth, error)
+	Authenticated() // Authenticated will be called when authentication completes successfully
+}
@@ -17,8 +17,10 @@ package paho
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"strings"
@@ -38,6 +40,18 @@ var (
 	ErrNetworkErrorAfterStored      = errors.New("error after packet added to state")         // Could not send packet but its stored (and response will be sent on chan at some point in the future)
 	ErrConnectionLost               = errors.New("connection lost after request transmitted") // We don't know whether the server received the request or not
 
+	ErrSessionExportNotSupported = errors.New("session does not support export") // Session does not implement Export (see ExportSession)
+
+	ErrPublishAckTimeout = errors.New("publish not acknowledged within timeout") // See PublishOptions.AckTimeout
+
+	// ErrPacketTooLarge is returned (alongside ErrInvalidArguments) when a PUBLISH would exceed the Maximum Packet Size
+	// specified by the server in the CONNACK (nothing is sent; the server would otherwise disconnect).
+	ErrPacketTooLarge = errors.New("packet exceeds server maximum packet size")
+
+	// ErrKeepAliveTimeout is passed to OnClientError (if OnServerDisconnect is not set) when the server disconnects
+	// with reason code 0x8D (Keep Alive timeout); this generally means PINGREQ packets are not reaching the server.
+	ErrKeepAliveTimeout = errors.New("server disconnected due to keep alive timeout")
+
 	ErrInvalidArguments = errors.New("invalid argument") // If included (errors.Join) in an error, there is a problem with the arguments passed. Retrying on the same connection with the same arguments will not succeed.
 )
 
@@ -48,6 +62,10 @@ type (
 
 		AlreadyHandled bool    // Set to true if a previous callback has returned true (indicating some action has already been taken re the message)
 		Errs           []error // Errors returned by previous handlers (if any).
+
+		// Context is cancelled when the connection the message was received on is lost or closed. Handlers performing
+		// lengthy work may use this to abort (an acknowledgement cannot be sent once the connection is down).
+		Context context.Context
 	}
 
 	// ClientConfig are the user-configurable options for the client, an
@@ -56,18 +74,38 @@ type (
 	// PingHandler, PacketTimeout and Router.
 	ClientConfig struct {
 		ClientID string
+		// AutoGenerateClientID, when true, causes Connect to generate a client ID (using GenerateClientID with
+		// ClientIDPrefix) if the Connect packet has an empty ClientID and CleanStart is true (rather than leaving it
+		// to the server to assign an ID). The generated ID is available via Client.ClientID().
+		AutoGenerateClientID bool
+		// ClientIDPrefix is prepended to client IDs generated when AutoGenerateClientID is set (the random portion is
+		// appended so the ID remains unique).
+		ClientIDPrefix string
+		// ClientIDRand, if not nil, is the random source used when generating a client ID (defaults to crypto/rand).
+		ClientIDRand io.Reader
 		// Conn is the connection to broker.
 		// BEWARE that most wrapped net.Conn implementations like tls.Conn are
 		// not thread safe for writing. To fix, use packets.NewThreadSafeConn
 		// wrapper or extend the custom net.Conn struct with sync.Locker.
 		Conn net.Conn
+		// EnableConnSwap permits the connection to be replaced, using SwapConn, whilst the client is running
+		// (EXPERIMENTAL). When enabled Conn is wrapped, meaning that some optimisations (e.g. use of writev with a
+		// net.TCPConn) are not available.
+		EnableConnSwap bool
 
 		Session          session.SessionManager
 		autoCloseSession bool
 
-		AuthHandler   Auther
+		AuthHandler Auther
+		// Authenticator drives multi-step enhanced authentication (see Authenticator); if set it is used in preference
+		// to AuthHandler.
+		Authenticator Authenticator
 		PingHandler   Pinger
 		defaultPinger bool
+		// DisableInitialPing prevents the PINGREQ that is, by default, sent immediately following connection. This is a
+		// broker-compatibility option (some brokers handle an immediate PINGREQ poorly); it is applied to the
+		// PingHandler via SetSendInitialPing(false) (so has no effect if a custom Pinger lacks that method).
+		DisableInitialPing bool
 
 		// Router - new inbound messages will be passed to the `Route(*packets.Publish)` function.
 		//
@@ -84,8 +122,90 @@ type (
 		// ParallelizePublishReceived indicates whether this client should spin off handler in a goroutine or handle received
 		// packets serially. If this is set to true, it is not guaranteed that packets received will be handled in order
 		ParallelizePublishReceived bool
+		// AckWorkers limits the number of goroutines used to handle received messages (call the OnPublishReceived
+		// callbacks and send the acknowledgement) when ParallelizePublishReceived is true. If 0 (the default), a new
+		// goroutine is started for each message received; under high inbound rates this can lead to a large number
+		// of short-lived goroutines.
+		AckWorkers int
+		// MaxConcurrentHandlers, if greater than 0, caps the number of goroutines concurrently handling received
+		// messages when ParallelizePublishReceived is true and AckWorkers is 0. When the cap is reached, no further
+		// messages will be dispatched (and, consequently, reading from the connection will pause once internal buffers
+		// fill) until a handler completes. This provides a safety bound when messages arrive faster than they can be handled.
+		MaxConcurrentHandlers int
+		// UnsubscribedPublishPolicy determines how a PUBLISH whose topic matches no tracked subscription (see
+		// Client.Subscriptions) is handled. By default such messages are passed to the OnPublishReceived handlers.
+		// Note that tracking relies on Subscribe/Unsubscribe (or InitialSubscriptions); subscriptions made in other
+		// ways (e.g. by the server) are unknown to the client.
+		UnsubscribedPublishPolicy UnsubscribedPublishPolicy
+		// MaxSubscriptionIdentifiers, if greater than 0, caps the number of distinct Subscription Identifiers that may be
+		// in use (Subscribe will return an error wrapping ErrInvalidArguments if a new identifier would exceed this).
+		MaxSubscriptionIdentifiers int
+		// DisconnectOnDuplicatePacketID, if true, treats receipt of a QoS1/2 PUBLISH, without the DUP flag set, that uses
+		// the packet identifier of an earlier PUBLISH which has not yet been fully acknowledged as a protocol violation;
+		// the connection will be closed (reason code 0x82) and ErrDuplicatePacketID passed to OnClientError. By default
+		// the new message overwrites the old one.
+		DisconnectOnDuplicatePacketID bool
+		// ReceiveMaximumPolicy determines how a QoS1/2 PUBLISH, received when the server already has ReceiveMaximum (as
+		// sent in the CONNECT) unacknowledged QoS1/2 messages outstanding, is handled. By default such messages are
+		// processed as normal. Streamed messages (see StreamPayloadThreshold) cannot be buffered.
+		ReceiveMaximumPolicy ReceiveMaximumPolicy
+		// ReceiveMaximumBufferTimeout is the maximum time a message will be held when ReceiveMaximumPolicy is
+		// ReceiveMaximumBuffer. Defaults to 1 second.
+		ReceiveMaximumBufferTimeout time.Duration
+		// ValidateSubscriptionIdentifiers, if true, checks the Subscription Identifier in each received PUBLISH against
+		// those this client has requested. An unrequested identifier (e.g. due to a misbehaving server) is logged (to the
+		// error logger) and removed from the message, so it cannot be used to route the message incorrectly.
+		ValidateSubscriptionIdentifiers bool
+		// MaxInboundPayloadSize, if greater than 0, is the maximum payload size (in bytes) of PUBLISH packets that will
+		// be passed to the OnPublishReceived handlers. Larger messages are acknowledged (so the server will not resend
+		// them) and dropped, with OnPayloadTooLarge being called. Unlike the Maximum Packet Size (which is enforced by
+		// the server), this does not impact the connection.
+		MaxInboundPayloadSize int
+		// OnPayloadTooLarge, if not nil, is called when a message is dropped due to MaxInboundPayloadSize. It is called
+		// from the goroutine that routes messages, so should not block.
+		OnPayloadTooLarge func(*Publish)
+		// StreamPayloadThreshold, if greater than 0, results in received PUBLISH packets with payloads of at least this
+		// many bytes being streamed; rather than Payload being populated, Publish.PayloadReader supplies the payload
+		// directly from the connection (so it need not be held in memory). No further packets are read from the
+		// connection until the OnPublishReceived callbacks have returned; any of the payload remaining unread is then
+		// discarded, and the message acknowledged. The reader cannot be used after the callback returns (so handlers
+		// registered with a Router using ordered delivery, or that start a goroutine, must not use it), and streaming
+		// should be completed within the keep alive period (PINGRESP packets cannot be read whilst waiting).
+		StreamPayloadThreshold int64
+		// ValidateConnect, if true, results in Connect calling Connect.Validate (returning any error without sending
+		// the CONNECT).
+		ValidateConnect bool
+		// ValidateClientID, if set, is called by Connect with the ClientID that will be sent (generated if
+		// AutoGenerateClientID applies) before anything is sent; if it returns an error the connection attempt is aborted and that error returned. This allows
+		// broker-specific constraints (e.g. length or permitted characters) to be enforced client-side.
+		ValidateClientID func(string) error
+		// OnFlowControlBlocked, if set, is called, with the time spent waiting, whenever a QoS1/2 publish had to wait
+		// for an in-flight slot because the servers Receive Maximum had been reached. It is called from the goroutine
+		// calling Publish (so should not block), and requires a Session that supports it (as state.State does).
+		OnFlowControlBlocked func(waited time.Duration)
+		// MaxInflightDuration, if > 0, bounds the time a QoS1/2 PUBLISH may remain unacknowledged (measured from when
+		// it is added to the session), regardless of any per-call timeout or PublishMethod. Upon expiry the transaction
+		// is abandoned, freeing its packet identifier and in-flight slot, and any waiting Publish call returns
+		// ErrPublishAckTimeout. Requires a Session that supports this (as state.State does).
+		MaxInflightDuration time.Duration
+		// WaitForPacketID, if true, results in Publish/Subscribe/Unsubscribe blocking (until the context is done, or the
+		// connection lost) when all packet identifiers are in use, rather than failing with
+		// session.ErrPacketIdentifiersExhausted. Requires a Session that supports this (as state.State does).
+		WaitForPacketID bool
+		// WriteCoalesceDelay, if greater than 0, enables write coalescing; PUBLISH packets are buffered for up to this
+		// period so that multiple packets can be sent to the connection in a single write (reducing system call
+		// overhead when publishing many small messages). Other packets (e.g. SUBSCRIBE, PUBREL, PINGREQ, DISCONNECT)
+		// are written immediately, along with any buffered PUBLISH packets (which must precede them). Note that errors
+		// writing buffered packets will not be returned by Publish (the connection will be closed).
+		WriteCoalesceDelay time.Duration
 
 		PacketTimeout time.Duration
+		// ReadLoopDrainTimeout is the maximum time that shutdown (e.g. Disconnect) will wait for the goroutine reading
+		// from the connection to exit after the connection has been closed. Closing the connection should unblock any
+		// Read; if it does not (indicating a faulty net.Conn implementation) a warning is logged (to the error logger)
+		// and shutdown continues without waiting for the read loop (or the handlers of messages it has received).
+		// Defaults to 10 seconds.
+		ReadLoopDrainTimeout time.Duration
 		// OnServerDisconnect is called only when a packets.DISCONNECT is received from server
 		OnServerDisconnect func(*Disconnect)
 		// OnClientError is for example called on net.Error. Note that this may be called multiple times and may be
@@ -96,7 +216,41 @@ type (
 		// Publish, an example of the utility of this is provided in the
 		// Topic Alias Handler extension which will automatically assign
 		// and use topic alias values rather than topic strings.
+		// The hook is passed a copy of the Publish (including its Properties and User properties) so changes it makes
+		// do not affect the callers Publish (Payload should be replaced, not modified in place).
 		PublishHook func(*Publish)
+		// TraceIDKey, if not empty, enables the automatic addition of a trace ID (a random UUID) to outbound PUBLISH
+		// packets. The ID is added as a user property with this key (e.g. "trace-id") unless the message already has a
+		// user property with the key. The ID is logged (debug) to aid in correlating messages across systems.
+		TraceIDKey string
+		// AdaptivePublishThrottle, if true, slows QoS1/2 publishing as the number of unacknowledged messages approaches
+		// the servers Receive Maximum (avoiding publish calls blocking when a slow server causes the quota to be
+		// exhausted). Once over half of the quota is in use, a delay, rising linearly to PublishThrottleMaxDelay when the
+		// quota is fully used, is inserted before each publish. Requires that Session implement
+		// `InFlight() (inFlight, limit int)` (as state.State does).
+		AdaptivePublishThrottle bool
+		// PublishThrottleMaxDelay is the maximum delay applied by AdaptivePublishThrottle (defaults to 100ms)
+		PublishThrottleMaxDelay time.Duration
+		// OnMalformedPacket, if set, is called when a packet received from the server cannot be decoded (before the
+		// connection is closed). It receives the raw bytes of the packet (up to MalformedPacketCaptureLimit) and the
+		// error; this is intended to aid in diagnosing interoperability issues. The call is made from the goroutine
+		// reading from the connection, so should return promptly.
+		OnMalformedPacket func(raw []byte, err error)
+		// MalformedPacketCaptureLimit is the maximum number of bytes passed to OnMalformedPacket (defaults to 4096)
+		MalformedPacketCaptureLimit int
+		// ClockSkewTimestampKey, if not empty, is the key of a user property holding a timestamp (Unix milliseconds or
+		// RFC 3339) that the server/publisher adds to messages. When present on a received message, the difference between
+		// the local clock and the timestamp is calculated and logged (debug), and made available via Client.ClockSkew.
+		ClockSkewTimestampKey string
+		// DisableJSONPublishProperties prevents PublishJSON from setting the ContentType ("application/json") and
+		// PayloadFormat (1 - UTF-8) properties on outbound messages (by default these are set unless already present).
+		DisableJSONPublishProperties bool
+		// InitialSubscriptions seeds the set of tracked subscriptions (see Client.Subscriptions); this would generally be
+		// the result of calling Subscriptions on the Client used for a previous connection. Use ResyncSubscriptions to
+		// reestablish these if the server did not retain the session.
+		InitialSubscriptions []Subscription
+		// PublishLatencyMetrics enables the collection of QoS1/2 publish latency metrics (see Client.Metrics)
+		PublishLatencyMetrics bool
 		// EnableManualAcknowledgment is used to control the acknowledgment of packets manually.
 		// BEWARE that the MQTT specs require clients to send acknowledgments in the order in which the corresponding
 		// PUBLISH packets were received.
@@ -104,6 +258,20 @@ type (
 		// If you acknowledge 3 first, no ack is actually sent to the server but it's buffered until also 1 and 2
 		// are acknowledged.
 		EnableManualAcknowledgment bool
+		// CoalesceAcks, if true, combines acknowledgements (PUBACK/PUBREC) that are ready to send at the same time (e.g.
+		// from parallel handlers) into a single write to the connection. Each acknowledgement is still sent as a separate
+		// packet (as the protocol requires); only the socket writes are batched, reducing the number of system calls
+		// under high inbound QoS1/2 message rates. Requires a Session that supports batching (state.State does).
+		// Acknowledgements queued by manual acknowledgement (EnableManualAcknowledgment) are always batched.
+		CoalesceAcks bool
+		// EnableOutboundTopicAlias, if true, results in topic aliases being automatically assigned (up to the servers
+		// TopicAliasMaximum) to PUBLISH packets sent; the first PUBLISH to a topic carries the topic and alias, later
+		// ones only the alias. This can be changed after connecting with Client.EnableOutboundTopicAlias. Publish
+		// packets that already have a TopicAlias are sent unchanged.
+		EnableOutboundTopicAlias bool
+		// AliasEvictionPolicy selects the alias to reassign when EnableOutboundTopicAlias is in use, all aliases have been
+		// assigned, and a message is published to a new topic. Defaults to NewLRUAliasEvictionPolicy().
+		AliasEvictionPolicy AliasEvictionPolicy
 		// SendAcksInterval is used only when EnableManualAcknowledgment is true
 		// it determines how often the client tries to send a batch of acknowledgments in the right order to the server.
 		SendAcksInterval time.Duration
@@ -121,19 +289,38 @@ type (
 		authResponse   chan<- packets.ControlPacket
 		authResponseMu sync.Mutex // protects the above
 
+		ctx        context.Context // cancelled when the client shuts down (set in Connect)
 		cancelFunc func()
 
 		connectCalled   bool       // if true `Connect` has been called and a connection is being managed
+		connectedAt     time.Time  // time the CONNACK was received (zero if the connection was not established)
+		connectPacket   *Connect   // the Connect passed to Connect (see WillAccepted)
+		connack         *Connack   // the CONNACK received (nil until received)
 		connectCalledMu sync.Mutex // protects the above
 
-		done           <-chan struct{} // closed when shutdown complete (only valid after Connect returns nil error)
-		publishPackets chan *packets.Publish
-		acksTracker    acksTracker
-		workers        sync.WaitGroup
-		serverProps    CommsProperties
-		clientProps    CommsProperties
-		debug          log.Logger
-		errors         log.Logger
+		conn *swappableConn // wraps config.Conn (set in Connect if EnableConnSwap) so the connection can be swapped (see SwapConn)
+
+		done            <-chan struct{} // closed when shutdown complete (only valid after Connect returns nil error)
+		publishPackets  chan *packets.Publish
+		acksTracker     acksTracker
+		subscriptions   subscriptionTracker // active subscriptions (see Subscriptions)
+		handlers        handlersTracker     // handlers currently processing messages (see DisconnectGracefully)
+		clockSkew       clockSkewTracker    // most recently observed clock skew (see ClockSkew)
+		inboundIDs      inboundIDTracker    // packet IDs of unacknowledged PUBLISH packets from the server (see DisconnectOnDuplicatePacketID)
+		inboundQuota    inboundQuota        // enforces the Receive Maximum sent in the CONNECT (see ReceiveMaximumPolicy)
+		ackCoalescer    ackCoalescer        // combines concurrent acknowledgements (see CoalesceAcks)
+		outboundAliases outboundAliases     // topic aliases used in PUBLISH packets sent (see EnableOutboundTopicAlias)
+		inboundAliases  inboundAliases      // topic aliases registered by the server (see resolveTopicAlias)
+		workers         sync.WaitGroup
+		readers         sync.WaitGroup // read loop (incoming) and the publish loop it feeds (see ReadLoopDrainTimeout)
+		readLoopDone    chan struct{}  // closed when incoming returns
+		serverProps     CommsProperties
+		clientProps     CommsProperties
+		keepAlive       uint16            // Keep alive in use (may be set by the server in the CONNACK)
+		sessionPresent  bool              // SessionPresent flag from the CONNACK
+		publishLatency  *latencyHistogram // nil unless PublishLatencyMetrics is true
+		debug           log.Logger
+		errors          log.Logger
 	}
 
 	// CommsProperties is a struct of the communication properties that may
@@ -149,6 +336,21 @@ type (
 		SubIDAvailable       bool
 		SharedSubAvailable   bool
 	}
+
+	// NegotiatedLimits holds the limits that apply to the connection following the CONNECT/CONNACK exchange.
+	// "Client" values are those sent by the client in the CONNECT (and apply to messages from the server), "Server"
+	// values are those received in the CONNACK (or the defaults where the server did not specify a value).
+	NegotiatedLimits struct {
+		KeepAlive                uint16 // Keep alive in seconds (ServerKeepAlive if this was provided in the CONNACK)
+		ClientReceiveMaximum     uint16 // Maximum number of QoS1/2 publications the client will process concurrently
+		ServerReceiveMaximum     uint16 // Maximum number of QoS1/2 publications the server will process concurrently
+		MaximumQoS               byte   // Maximum QoS supported by the server
+		ClientMaximumPacketSize  uint32 // Maximum packet size the client will accept (0 = no limit)
+		ServerMaximumPacketSize  uint32 // Maximum packet size the server will accept (0 = no limit)
+		ClientTopicAliasMaximum  uint16 // Maximum topic alias value the client will accept
+		ServerTopicAliasMaximum  uint16 // Maximum topic alias value the server will accept
+		SubscriptionIDsAvailable bool   // true if the server supports Subscription Identifiers
+	}
 )
 
 // NewClient is used to create a new default instance of an MQTT client.
@@ -190,6 +392,21 @@ func NewClient(conf ClientConfig) *Client {
 	if c.config.PacketTimeout == 0 {
 		c.config.PacketTimeout = 10 * time.Second
 	}
+	if c.config.ReadLoopDrainTimeout == 0 {
+		c.config.ReadLoopDrainTimeout = 10 * time.Second
+	}
+	if c.config.PublishLatencyMetrics {
+		c.publishLatency = &latencyHistogram{}
+	}
+	if c.config.AdaptivePublishThrottle && c.config.PublishThrottleMaxDelay == 0 {
+		c.config.PublishThrottleMaxDelay = 100 * time.Millisecond
+	}
+	c.subscriptions.seed(c.config.InitialSubscriptions)
+	c.outboundAliases.setEnabled(c.config.EnableOutboundTopicAlias)
+	if c.config.AliasEvictionPolicy == nil {
+		c.config.AliasEvictionPolicy = NewLRUAliasEvictionPolicy()
+	}
+	c.outboundAliases.setPolicy(c.config.AliasEvictionPolicy)
 
 	if c.config.Router == nil && len(c.onPublishReceived) == 0 {
 		c.config.Router = NewStandardRouter() // Maintain backwards compatibility (for now!)
@@ -208,6 +425,23 @@ func NewClient(conf ClientConfig) *Client {
 		c.config.PingHandler = NewDefaultPinger()
 		c.config.defaultPinger = true
 	}
+	if c.config.DisableInitialPing {
+		if p, ok := c.config.PingHandler.(interface{ SetSendInitialPing(bool) }); ok {
+			p.SetSendInitialPing(false)
+		}
+	}
+	if c.config.OnFlowControlBlocked != nil {
+		if s, ok := c.config.Session.(interface {
+			SetFlowControlBlockedHandler(func(time.Duration))
+		}); ok {
+			s.SetFlowControlBlockedHandler(c.config.OnFlowControlBlocked)
+		}
+	}
+	if c.config.WaitForPacketID {
+		if s, ok := c.config.Session.(interface{ SetWaitForPacketID(bool) }); ok {
+			s.SetWaitForPacketID(true)
+		}
+	}
 	if c.config.OnClientError == nil {
 		c.config.OnClientError = func(e error) {}
 	}
@@ -226,6 +460,28 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	if c.config.Conn == nil {
 		return nil, fmt.Errorf("client connection is nil")
 	}
+	if c.config.ValidateConnect {
+		if err := cp.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	clientID := cp.ClientID
+	if clientID == "" && cp.CleanStart && c.config.AutoGenerateClientID {
+		if c.config.ClientIDRand != nil {
+			var err error
+			if clientID, err = GenerateClientIDFrom(c.config.ClientIDPrefix, c.config.ClientIDRand); err != nil {
+				return nil, fmt.Errorf("failed to generate client ID: %w", err)
+			}
+		} else {
+			clientID = GenerateClientID(c.config.ClientIDPrefix)
+		}
+		c.debug.Printf("generated client ID %s", clientID)
+	}
+	if c.config.ValidateClientID != nil {
+		if err := c.config.ValidateClientID(clientID); err != nil {
+			return nil, err
+		}
+	}
 
 	// The connection is in c.config.Conn which is inaccessible to the user.
 	// The end result of `Connect` (possibly some time after it returns) will be to close the connection so calling
@@ -236,6 +492,14 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		return nil, fmt.Errorf("connect must only be called once")
 	}
 	c.connectCalled = true
+	c.connectPacket = cp
+	if c.config.EnableConnSwap {
+		c.conn = newSwappableConn(c.config.Conn)
+		c.config.Conn = c.conn
+	}
+	if c.config.WriteCoalesceDelay > 0 {
+		c.config.Conn = newCoalescingConn(c.config.Conn, c.config.WriteCoalesceDelay)
+	}
 	c.connectCalledMu.Unlock()
 
 	// The passed in ctx applies to the connection process only. clientCtx applies to Client (signals that the
@@ -249,8 +513,10 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		close(done)
 	}
 
+	c.ctx = clientCtx
 	c.cancelFunc = cancelFunc
 	c.done = done
+	c.readLoopDone = make(chan struct{})
 
 	var publishPacketsSize uint16 = math.MaxUint16
 	if cp.Properties != nil && cp.Properties.ReceiveMaximum != nil {
@@ -259,7 +525,7 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	c.publishPackets = make(chan *packets.Publish, publishPacketsSize)
 
 	keepalive := cp.KeepAlive
-	c.config.ClientID = cp.ClientID
+	c.config.ClientID = clientID
 	if cp.Properties != nil {
 		if cp.Properties.MaximumPacketSize != nil {
 			c.clientProps.MaximumPacketSize = *cp.Properties.MaximumPacketSize
@@ -272,11 +538,14 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		}
 	}
 
+	c.inboundQuota.reset(c.clientProps.ReceiveMaximum)
+
 	c.debug.Println("connecting")
 	connCtx, cf := context.WithTimeout(ctx, c.config.PacketTimeout)
 	defer cf()
 
 	ccp := cp.Packet()
+	ccp.ClientID = clientID
 	ccp.ProtocolName = "MQTT"
 	ccp.ProtocolVersion = 5
 
@@ -296,7 +565,7 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		caPacketCh  = make(chan *packets.Connack, 1)
 		caPacketErr = make(chan error, 1)
 	)
-	go c.expectConnack(caPacketCh, caPacketErr)
+	go c.expectConnack(connCtx, caPacketCh, caPacketErr)
 	select {
 	case <-connCtx.Done():
 		ctxErr := connCtx.Err()
@@ -311,6 +580,12 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	}
 
 	ca := ConnackFromPacketConnack(caPacket)
+	c.connectCalledMu.Lock()
+	c.connack = ca
+	c.connectCalledMu.Unlock()
+	if err := cp.ValidateWill(ca); err != nil {
+		c.debug.Println("will not accepted:", err)
+	}
 
 	if ca.ReasonCode >= 0x80 {
 		var reason string
@@ -330,6 +605,9 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	// the connection is now fully up and a nil error will be returned.
 	// cleanup() must not be called past this point and will be handled by `shutdown`
 	context.AfterFunc(clientCtx, func() { c.shutdown(done) })
+	c.connectCalledMu.Lock()
+	c.connectedAt = time.Now()
+	c.connectCalledMu.Unlock()
 
 	if ca.Properties != nil {
 		if ca.Properties.ServerKeepAlive != nil {
@@ -350,12 +628,20 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		if ca.Properties.TopicAliasMaximum != nil {
 			c.serverProps.TopicAliasMaximum = *ca.Properties.TopicAliasMaximum
 		}
+		c.outboundAliases.setMaximum(c.serverProps.TopicAliasMaximum)
 		c.serverProps.RetainAvailable = ca.Properties.RetainAvailable
 		c.serverProps.WildcardSubAvailable = ca.Properties.WildcardSubAvailable
 		c.serverProps.SubIDAvailable = ca.Properties.SubIDAvailable
 		c.serverProps.SharedSubAvailable = ca.Properties.SharedSubAvailable
 	}
 
+	if r, ok := c.config.Router.(subscriptionIDRouter); ok {
+		r.SetSubscriptionIDsAvailable(c.serverProps.SubIDAvailable)
+	}
+
+	c.keepAlive = keepalive
+	c.sessionPresent = ca.SessionPresent
+
 	c.debug.Println("received CONNACK, starting PingHandler")
 	c.workers.Add(1)
 	go func() {
@@ -367,9 +653,9 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	}()
 
 	c.debug.Println("starting publish packets loop")
-	c.workers.Add(1)
+	c.readers.Add(1)
 	go func() {
-		defer c.workers.Done()
+		defer c.readers.Done()
 		defer c.debug.Println("returning from publish packets loop worker")
 		// exits when `c.publishPackets` is closed (`c.incoming()` closes this). This is important because
 		// messages may be passed for processing after `c.stop` has been closed.
@@ -377,9 +663,10 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	}()
 
 	c.debug.Println("starting incoming")
-	c.workers.Add(1)
+	c.readers.Add(1)
 	go func() {
-		defer c.workers.Done()
+		defer c.readers.Done()
+		defer close(c.readLoopDone)
 		defer c.debug.Println("returning from incoming worker")
 		c.incoming(clientCtx)
 	}()
@@ -403,11 +690,7 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 				case <-clientCtx.Done():
 					return
 				case <-t.C:
-					c.acksTracker.flush(func(pbs []*packets.Publish) {
-						for _, pb := range pbs {
-							c.ack(pb)
-						}
-					})
+					c.acksTracker.flush(c.ackBatch)
 				}
 			}
 		}()
@@ -422,6 +705,23 @@ func (c *Client) Done() <-chan struct{} {
 	return c.done
 }
 
+// ConnectedSince returns the time at which the connection was established (the CONNACK received) and true, if the
+// connection is up. If the connection has not been established, or has been lost or closed, false is returned.
+func (c *Client) ConnectedSince() (time.Time, bool) {
+	c.connectCalledMu.Lock()
+	connectedAt := c.connectedAt
+	c.connectCalledMu.Unlock()
+	if connectedAt.IsZero() {
+		return time.Time{}, false
+	}
+	select {
+	case <-c.done: // safe to access as c.connectedAt is set after c.done
+		return time.Time{}, false
+	default:
+		return connectedAt, true
+	}
+}
+
 // Ack transmits an acknowledgement of the `Publish` packet.
 // WARNING: Calling Ack after the connection is closed may have unpredictable results (particularly if the sessionState
 // is being accessed by a new connection). See issue #160.
@@ -437,23 +737,136 @@ func (c *Client) Ack(pb *Publish) error {
 
 // ack acknowledges a message (note: called by acksTracker to ensure these are sent in order)
 func (c *Client) ack(pb *packets.Publish) {
+	if _, ok := c.config.Session.(batchAcker); ok && c.config.CoalesceAcks && pb.QoS != 0 {
+		c.ackCoalescer.ack(pb, c.ackBatch)
+		return
+	}
+	if pb.QoS == 1 && c.config.DisconnectOnDuplicatePacketID {
+		c.inboundIDs.remove(pb.PacketID) // must be removed before the PUBACK is sent (server may then reuse the ID)
+	}
+	if pb.QoS == 1 {
+		c.inboundQuota.remove(pb.PacketID)
+	}
 	c.config.Session.Ack(pb)
 }
 
+// ackDropped acknowledges a message that will not be passed to the handlers
+func (c *Client) ackDropped(pb *packets.Publish) {
+	if c.config.EnableManualAcknowledgment && pb.QoS != 0 {
+		// Acknowledgements must be sent in the order the PUBLISH packets were received, so queue this one
+		// behind any that the application has yet to acknowledge.
+		c.acksTracker.add(pb)
+		if err := c.acksTracker.markAsAcked(pb); err != nil {
+			c.errors.Printf("failed to acknowledge dropped PUBLISH %d: %s", pb.PacketID, err)
+		}
+		return
+	}
+	if pb.QoS != 0 {
+		c.ack(pb)
+	}
+}
+
+// checkPayloadSize applies MaxInboundPayloadSize to a received PUBLISH, returning false (having acknowledged the
+// message and called OnPayloadTooLarge) if the message should not be passed to the handlers.
+func (c *Client) checkPayloadSize(pb *packets.Publish) bool {
+	size := int64(len(pb.Payload))
+	if pb.PayloadReader != nil {
+		size = pb.PayloadSize
+	}
+	if c.config.MaxInboundPayloadSize <= 0 || size <= int64(c.config.MaxInboundPayloadSize) {
+		return true
+	}
+	c.debug.Printf("dropping PUBLISH to %s (payload of %d bytes exceeds MaxInboundPayloadSize)", pb.Topic, size)
+	c.ackDropped(pb)
+	if c.config.OnPayloadTooLarge != nil {
+		c.config.OnPayloadTooLarge(PublishFromPacketPublish(pb))
+	}
+	return false
+}
+
+// ackBatch acknowledges messages, in order, using a single write where the session supports this
+func (c *Client) ackBatch(pbs []*packets.Publish) {
+	ba, ok := c.config.Session.(batchAcker)
+	if !ok {
+		for _, pb := range pbs {
+			c.ack(pb)
+		}
+		return
+	}
+	for _, pb := range pbs {
+		if pb.QoS == 1 {
+			if c.config.DisconnectOnDuplicatePacketID {
+				c.inboundIDs.remove(pb.PacketID) // must be removed before the PUBACK is sent (server may then reuse the ID)
+			}
+			c.inboundQuota.remove(pb.PacketID)
+		}
+	}
+	_ = ba.AckBatch(pbs) // errors are logged by the session
+}
+
 // routePublishPackets listens on c.publishPackets and passes received messages to the handlers
 // terminates when publishPackets closed
 func (c *Client) routePublishPackets() {
+	if c.config.ParallelizePublishReceived && c.config.AckWorkers > 0 {
+		c.routePublishPacketsPooled(c.config.AckWorkers)
+		return
+	}
+	var handlerSlots chan struct{} // limits concurrent handlers (nil = no limit)
+	if c.config.ParallelizePublishReceived && c.config.MaxConcurrentHandlers > 0 {
+		handlerSlots = make(chan struct{}, c.config.MaxConcurrentHandlers)
+	}
 	for pb := range c.publishPackets {
+		c.handlers.start() // before handoff so that queued messages are tracked (see DisconnectGracefully)
 		if c.config.ParallelizePublishReceived {
 			packetCopy := *pb
-			go c.routePublishPacket(&packetCopy)
+			if handlerSlots == nil {
+				go c.routePublishPacket(&packetCopy)
+				continue
+			}
+			handlerSlots <- struct{}{} // blocks when the maximum number of handlers are running
+			go func() {
+				defer func() { <-handlerSlots }()
+				c.routePublishPacket(&packetCopy)
+			}()
 		} else {
 			c.routePublishPacket(pb)
 		}
 	}
 }
 
+// routePublishPacketsPooled passes messages received on c.publishPackets to a fixed number of workers, each of which
+// calls the handlers and acknowledges the message. Terminates when publishPackets closed and all workers have returned.
+func (c *Client) routePublishPacketsPooled(workers int) {
+	work := make(chan *packets.Publish, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for pb := range work {
+				c.routePublishPacket(pb)
+			}
+		}()
+	}
+	for pb := range c.publishPackets {
+		packetCopy := *pb
+		c.handlers.start() // before handoff so that queued messages are tracked (see DisconnectGracefully)
+		work <- &packetCopy
+	}
+	close(work)
+	wg.Wait()
+}
+
+// routePublishPacket passes pb to the handlers (and acknowledges it where appropriate). The caller must have called
+// c.handlers.start() (c.handlers.done() will be called when processing is complete).
 func (c *Client) routePublishPacket(pb *packets.Publish) {
+	defer c.handlers.done()
+	defer finishPayloadStream(pb) // if the message is dropped
+
+	if !c.checkSubscribed(pb) || !c.checkPayloadSize(pb) {
+		return
+	}
+
 	// Copy onPublishReceived so lock is only held briefly
 	c.onPublishReceivedMu.Lock()
 	handlers := make([]func(PublishReceived) (bool, error), len(c.onPublishReceived))
@@ -475,12 +888,14 @@ func (c *Client) routePublishPacket(pb *packets.Publish) {
 			Client:         c,
 			AlreadyHandled: handled,
 			Errs:           errs,
+			Context:        c.ctx,
 		})
 		if ha {
 			handled = true
 		}
 		errs = append(errs, err)
 	}
+	finishPayloadStream(pb) // the payload must be fully read before the message is acknowledged
 
 	if !c.config.EnableManualAcknowledgment {
 		c.ack(pb)
@@ -497,13 +912,49 @@ func (c *Client) incoming(ctx context.Context) {
 	defer c.debug.Println("client stopping, incoming stopping")
 	defer close(c.publishPackets)
 
+	// Messages buffered due to ReceiveMaximumPolicy are passed to the session by releaseBuffered, which must exit
+	// before publishPackets is closed.
+	releaseStop := make(chan struct{})
+	var releasers sync.WaitGroup
+	defer func() {
+		close(releaseStop)
+		releasers.Wait()
+	}()
+
+	var r io.Reader = c.config.Conn
+	var capture *packetCapture
+	if c.config.OnMalformedPacket != nil {
+		capture = &packetCapture{r: c.config.Conn, limit: c.config.MalformedPacketCaptureLimit}
+		if capture.limit <= 0 {
+			capture.limit = defaultMalformedPacketCaptureLimit
+		}
+		r = capture
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			recv, err := packets.ReadPacket(c.config.Conn)
+			if capture != nil {
+				capture.reset()
+			}
+			recv, err := packets.ReadPacketStream(r, c.config.StreamPayloadThreshold)
+			var stream *payloadStream
+			if err == nil && recv.Type == packets.PUBLISH && recv.Content.(*packets.Publish).PayloadReader != nil {
+				stream = newPayloadStream(recv.Content.(*packets.Publish))
+			} else if c.conn != nil {
+				c.conn.packetRead() // the connection may now be swapped
+			}
+			if ctx.Err() != nil {
+				return // the client is shutting down (and may not have waited for this read to complete)
+			}
 			if err != nil {
+				if capture != nil {
+					if raw, ok := capture.malformed(); ok {
+						c.config.OnMalformedPacket(raw, err)
+					}
+				}
 				go c.error(err)
 				return
 			}
@@ -518,9 +969,7 @@ func (c *Client) incoming(ctx context.Context) {
 				ap := recv.Content.(*packets.Auth)
 				switch ap.ReasonCode {
 				case packets.AuthSuccess:
-					if c.config.AuthHandler != nil {
-						go c.config.AuthHandler.Authenticated()
-					}
+					c.authenticated()
 					c.authResponseMu.Lock()
 					if c.authResponse != nil {
 						select { // authResponse must be buffered, and we should only receive 1 AUTH packet a time
@@ -530,8 +979,13 @@ func (c *Client) incoming(ctx context.Context) {
 					}
 					c.authResponseMu.Unlock()
 				case packets.AuthContinueAuthentication:
-					if c.config.AuthHandler != nil {
-						if _, err := c.config.AuthHandler.Authenticate(AuthFromPacketAuth(ap)).Packet().WriteTo(c.config.Conn); err != nil {
+					if c.config.AuthHandler != nil || c.config.Authenticator != nil {
+						resp, err := c.authContinue(ap)
+						if err != nil {
+							go c.error(err)
+							return
+						}
+						if _, err := resp.WriteTo(c.config.Conn); err != nil {
 							go c.error(err)
 							return
 						}
@@ -540,7 +994,41 @@ func (c *Client) incoming(ctx context.Context) {
 				}
 			case packets.PUBLISH:
 				pb := recv.Content.(*packets.Publish)
-				if pb.QoS > 0 { // QOS1 or 2 need to be recorded in session state
+				if !c.resolveTopicAlias(pb) {
+					return
+				}
+				if c.config.ClockSkewTimestampKey != "" {
+					c.observeClockSkew(pb)
+				}
+				if c.config.ValidateSubscriptionIdentifiers {
+					c.checkSubscriptionIdentifier(pb)
+				}
+				if stream != nil {
+					if pb.QoS > 0 && c.config.ReceiveMaximumPolicy != ReceiveMaximumIgnore {
+						if ok, _ := c.checkInboundQuota(recv, false); !ok {
+							return
+						}
+					}
+					if !c.receiveStream(ctx, recv, stream) {
+						return
+					}
+				} else if pb.QoS > 0 { // QOS1 or 2 need to be recorded in session state
+					if c.config.DisconnectOnDuplicatePacketID && !c.checkInboundPacketID(pb) {
+						return
+					}
+					if c.config.ReceiveMaximumPolicy != ReceiveMaximumIgnore {
+						ok, start := c.checkInboundQuota(recv, true)
+						if start {
+							releasers.Add(1)
+							go func() {
+								defer releasers.Done()
+								c.releaseBuffered(releaseStop)
+							}()
+						}
+						if !ok {
+							continue // buffered (or the connection is being closed)
+						}
+					}
 					c.config.Session.PacketReceived(recv, c.publishPackets)
 				} else {
 					c.debug.Printf("received QoS%d PUBLISH", pb.QoS)
@@ -551,6 +1039,12 @@ func (c *Client) incoming(ctx context.Context) {
 					}
 				}
 			case packets.PUBACK, packets.PUBCOMP, packets.SUBACK, packets.UNSUBACK, packets.PUBREC, packets.PUBREL:
+				if recv.Type == packets.PUBREL {
+					if c.config.DisconnectOnDuplicatePacketID {
+						c.inboundIDs.remove(recv.PacketID()) // QoS2 transaction complete once PUBCOMP sent
+					}
+					c.inboundQuota.remove(recv.PacketID())
+				}
 				c.config.Session.PacketReceived(recv, c.publishPackets)
 			case packets.DISCONNECT:
 				pd := recv.Content.(*packets.Disconnect)
@@ -567,6 +1061,8 @@ func (c *Client) incoming(ctx context.Context) {
 				go func() {
 					if c.config.OnServerDisconnect != nil {
 						go c.serverDisconnect(DisconnectFromPacketDisconnect(pd))
+					} else if pd.ReasonCode == packets.DisconnectKeepAliveTimeout {
+						go c.error(ErrKeepAliveTimeout)
 					} else {
 						go c.error(fmt.Errorf("server initiated disconnect"))
 					}
@@ -580,6 +1076,35 @@ func (c *Client) incoming(ctx context.Context) {
 	}
 }
 
+// Close shuts down the client without sending a DISCONNECT packet (use Disconnect for a clean disconnection). The
+// pinger, read loop, and other goroutines are stopped, the connection is closed, and the session state is updated
+// (flushed), with the session being closed if it was created by the Client. Close blocks until shutdown is complete,
+// so must not be called from a message handler.
+// Close is idempotent; it may be called multiple times, and after Disconnect or a connection failure. If called before
+// Connect, the connection (and session, where created by the Client) are closed and subsequent calls to Connect will
+// fail. It must not be called concurrently with Connect.
+func (c *Client) Close() error {
+	c.connectCalledMu.Lock()
+	if !c.connectCalled {
+		c.connectCalled = true // prevents Connect being called after Close
+		done := make(chan struct{})
+		close(done)
+		c.cancelFunc = func() {} // subsequent calls to Close will return immediately
+		c.done = done
+		c.connectCalledMu.Unlock()
+		if c.config.Conn != nil {
+			_ = c.config.Conn.Close()
+		}
+		if c.config.autoCloseSession {
+			return c.config.Session.Close()
+		}
+		return nil
+	}
+	c.connectCalledMu.Unlock()
+	c.close()
+	return nil
+}
+
 // close terminates the connection and waits for a clean shutdown
 // may be called multiple times (subsequent calls will wait on previously requested shutdown)
 func (c *Client) close() {
@@ -602,11 +1127,29 @@ func (c *Client) shutdown(done chan<- struct{}) {
 		}
 	}
 	c.debug.Println("session updated, waiting on workers")
+	c.waitForReaders()
 	c.workers.Wait()
 	c.debug.Println("workers done")
 	close(done)
 }
 
+// waitForReaders waits for the read loop, and the publish loop it feeds, to exit. The read loop should exit promptly
+// once the connection is closed; if it does not do so within ReadLoopDrainTimeout a warning is logged, and we stop
+// waiting (the goroutines will exit if, and when, the Read returns).
+func (c *Client) waitForReaders() {
+	if c.readLoopDone == nil {
+		return // read loop not started by Connect
+	}
+	t := time.NewTimer(c.config.ReadLoopDrainTimeout)
+	defer t.Stop()
+	select {
+	case <-c.readLoopDone:
+		c.readers.Wait()
+	case <-t.C:
+		c.errors.Printf("read loop did not exit within %s of the connection being closed (does the net.Conn Read honour Close?)", c.config.ReadLoopDrainTimeout)
+	}
+}
+
 // error is called to signify that an error situation has occurred, this
 // causes the client's Stop channel to be closed (if it hasn't already been)
 // which results in the other client goroutines terminating.
@@ -625,7 +1168,7 @@ func (c *Client) serverDisconnect(d *Disconnect) {
 
 // Authenticate is used to initiate a reauthentication of credentials with the
 // server. This function sends the initial Auth packet to start the reauthentication
-// then relies on the client AuthHandler managing any further requests from the
+// then relies on the client AuthHandler (or Authenticator) managing any further requests from the
 // server until either a successful Auth packet is passed back, or a Disconnect
 // is received.
 func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, error) {
@@ -657,6 +1200,12 @@ func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, erro
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for AUTH: %v", ctxErr))
 		return nil, ctxErr
 	case rp = <-authResp:
+	case <-c.done: // A DISCONNECT is passed to authResp before the client shuts down
+		select {
+		case rp = <-authResp:
+		default:
+			return nil, ErrConnectionLost
+		}
 	}
 
 	switch rp.Type {
@@ -671,11 +1220,68 @@ func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, erro
 	return nil, fmt.Errorf("error with Auth, didn't receive Auth or Disconnect")
 }
 
+// Reauthenticate initiates reauthentication of an established connection (e.g. to refresh a token that is due to
+// expire) by sending an AUTH packet with reason code Re-authenticate (0x19); a.ReasonCode is ignored. Any further AUTH
+// exchange is handled by the AuthHandler (or Authenticator). The returned AuthResponse reflects the server's response;
+// if the server rejects the credentials it will send a DISCONNECT, in which case Success will be false (and the
+// connection will be closed).
+func (c *Client) Reauthenticate(ctx context.Context, a *Auth) (*AuthResponse, error) {
+	if a == nil {
+		return nil, fmt.Errorf("%w: Auth must not be nil", ErrInvalidArguments)
+	}
+	ra := *a // Avoid modifying the callers Auth
+	ra.ReasonCode = packets.AuthReauthenticate
+	return c.Authenticate(ctx, &ra)
+}
+
+// authContinue builds the response to an AUTH packet received from the server using the Authenticator (if configured)
+// or AuthHandler.
+func (c *Client) authContinue(ap *packets.Auth) (*packets.Auth, error) {
+	if c.config.Authenticator == nil {
+		return c.config.AuthHandler.Authenticate(AuthFromPacketAuth(ap)).Packet(), nil
+	}
+	var authMethod string
+	var authData []byte
+	if ap.Properties != nil {
+		authMethod, authData = ap.Properties.AuthMethod, ap.Properties.AuthData
+	}
+	a, err := c.config.Authenticator.Authenticate(authData)
+	if err != nil {
+		return nil, fmt.Errorf("authenticator failed: %w", err)
+	}
+	if a == nil {
+		a = &Auth{}
+	}
+	resp := a.Packet()
+	if resp.ReasonCode == packets.AuthSuccess {
+		resp.ReasonCode = packets.AuthContinueAuthentication
+	}
+	if resp.Properties == nil {
+		resp.Properties = &packets.Properties{}
+	}
+	if resp.Properties.AuthMethod == "" {
+		resp.Properties.AuthMethod = authMethod
+	}
+	return resp, nil
+}
+
+// authenticated notifies the Authenticator/AuthHandler that authentication has completed successfully
+func (c *Client) authenticated() {
+	switch {
+	case c.config.Authenticator != nil:
+		go c.config.Authenticator.Authenticated()
+	case c.config.AuthHandler != nil:
+		go c.config.AuthHandler.Authenticated()
+	}
+}
+
 // Subscribe is used to send a Subscription request to the MQTT server.
 // It is passed a pre-prepared Subscribe packet and blocks waiting for
 // a response Suback, or for the timeout to fire. Any response Suback
-// is returned from the function, along with any errors.
-func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
+// is returned from the function, along with any errors. Options (e.g. WithUserProperty) may be
+// provided and will be applied to a copy of s.
+func (c *Client) Subscribe(ctx context.Context, s *Subscribe, opts ...OperationOption) (*Suback, error) {
+	s = s.withOptions(opts)
 	if !c.serverProps.WildcardSubAvailable {
 		for _, sub := range s.Subscriptions {
 			if strings.ContainsAny(sub.Topic, "#+") {
@@ -687,11 +1293,22 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 	if !c.serverProps.SubIDAvailable && s.Properties != nil && s.Properties.SubscriptionIdentifier != nil {
 		return nil, fmt.Errorf("%w: cannot send subscribe with subID set, server does not support subID", ErrInvalidArguments)
 	}
-	if !c.serverProps.SharedSubAvailable {
-		for _, sub := range s.Subscriptions {
-			if strings.HasPrefix(sub.Topic, "$share") {
-				return nil, fmt.Errorf("%w: cannont subscribe to %s, server does not support shared subscriptions", ErrInvalidArguments, sub.Topic)
-			}
+	if s.Properties != nil && s.Properties.SubscriptionIdentifier != nil {
+		id := *s.Properties.SubscriptionIdentifier
+		if !c.subscriptions.reserveID(id, c.config.MaxSubscriptionIdentifiers) {
+			return nil, fmt.Errorf("%w: cannot use subscription identifier %d, limit of %d identifiers reached", ErrInvalidArguments, id, c.config.MaxSubscriptionIdentifiers)
+		}
+		defer c.subscriptions.releaseID(id)
+	}
+	for _, sub := range s.Subscriptions {
+		if !IsSharedSubscription(sub.Topic) {
+			continue
+		}
+		if !c.serverProps.SharedSubAvailable {
+			return nil, fmt.Errorf("%w: cannont subscribe to %s, server does not support shared subscriptions", ErrInvalidArguments, sub.Topic)
+		}
+		if _, _, ok := ParseSharedSubscription(sub.Topic); !ok {
+			return nil, fmt.Errorf("%w: %s is not a valid shared subscription", ErrInvalidArguments, sub.Topic)
 		}
 	}
 
@@ -734,6 +1351,7 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 	c.debug.Println("received SUBACK")
 
 	sa := SubackFromPacketSuback(sap.Content.(*packets.Suback))
+	c.subscriptions.subscribed(s, sa.Reasons)
 	switch {
 	case len(sa.Reasons) == 1:
 		if sa.Reasons[0] >= 0x80 {
@@ -799,6 +1417,7 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 	c.debug.Println("received SUBACK")
 
 	ua := UnsubackFromPacketUnsuback(uap.Content.(*packets.Unsuback))
+	c.subscriptions.unsubscribed(u, ua.Reasons)
 	switch {
 	case len(ua.Reasons) == 1:
 		if ua.Reasons[0] >= 0x80 {
@@ -826,9 +1445,22 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 // A PublishResponse is returned, which is relevant for QOS1+. For QOS0, a default success response is returned.
 // Note that a message may still be delivered even if Publish times out (once the message is part of the session state,
 // it may even be delivered following an application restart).
+// Options (e.g. WithUserProperty) may be provided and will be applied to a copy of p.
 // Warning: Publish may outlive the connection when QOS1+ (managed in `session_state`)
-func (c *Client) Publish(ctx context.Context, p *Publish) (*PublishResponse, error) {
-	return c.PublishWithOptions(ctx, p, PublishOptions{})
+func (c *Client) Publish(ctx context.Context, p *Publish, opts ...OperationOption) (*PublishResponse, error) {
+	return c.PublishWithOptions(ctx, p.withOptions(opts), PublishOptions{})
+}
+
+// ProbeSubscribers publishes a zero-length, non-retained, QoS1 message to topic and returns true unless the server
+// responds with reason code 0x10 (No matching subscribers). This may be useful for health checks; note that servers
+// are not required to report 0x10 (so true does not guarantee that subscribers exist), and that any subscribers will
+// receive the empty message.
+func (c *Client) ProbeSubscribers(ctx context.Context, topic string) (bool, error) {
+	pr, err := c.Publish(ctx, &Publish{Topic: topic, QoS: 1})
+	if err != nil {
+		return false, err
+	}
+	return pr.ReasonCode != packets.PubackNoMatchingSubscribers, nil
 }
 
 type PublishMethod int
@@ -842,6 +1474,59 @@ const (
 type PublishOptions struct {
 	// Method enables a degree of control over how  PublishWithOptions operates
 	Method PublishMethod
+	// AckTimeout, if > 0, limits the time spent waiting for a QoS1/2 PUBLISH to be acknowledged (measured from when it
+	// is written to the connection). If it expires, the transaction is abandoned, freeing its packet identifier and
+	// in-flight slot (if the Session supports this, as state.State does), and ErrPublishAckTimeout returned.
+	AckTimeout time.Duration
+}
+
+// abandoner is implemented by Session implementations that can abandon a client-generated transaction (see
+// state.State.Abandon)
+type abandoner interface {
+	Abandon(packetID uint16) bool
+}
+
+// conditionalAbandoner is implemented by Session implementations that can abandon a specific client-generated
+// transaction (see state.State.AbandonIf)
+type conditionalAbandoner interface {
+	AbandonIf(packetID uint16, resp chan<- packets.ControlPacket) bool
+}
+
+// abandon abandons the transaction (packetID, resp), returning false if it has already completed (or been abandoned).
+// Returns true if the Session does not support abandoning transactions.
+func (c *Client) abandon(packetID uint16, resp chan<- packets.ControlPacket) bool {
+	switch a := c.config.Session.(type) {
+	case conditionalAbandoner:
+		return a.AbandonIf(packetID, resp)
+	case abandoner:
+		return a.Abandon(packetID)
+	}
+	return true
+}
+
+// expireInflight abandons the transaction (packetID, resp) if it is still in flight after MaxInflightDuration. The
+// returned channel is closed if this happens; the returned function stops the timer. Returns nil values if
+// MaxInflightDuration is not set, or not supported by the Session.
+func (c *Client) expireInflight(packetID uint16, resp chan<- packets.ControlPacket) (<-chan struct{}, func() bool) {
+	a, ok := c.config.Session.(conditionalAbandoner)
+	if c.config.MaxInflightDuration <= 0 || !ok {
+		return nil, nil
+	}
+	expired := make(chan struct{})
+	t := time.AfterFunc(c.config.MaxInflightDuration, func() {
+		if a.AbandonIf(packetID, resp) {
+			c.debug.Printf("abandoned PUBLISH %d; not acknowledged within MaxInflightDuration (%s)", packetID, c.config.MaxInflightDuration)
+			close(expired)
+		}
+	})
+	return expired, t.Stop
+}
+
+// PublishWithTimeout publishes p, abandoning the transaction and returning ErrPublishAckTimeout if a QoS1/2 message is
+// not acknowledged within ackTimeout (see PublishOptions.AckTimeout). This prevents a stalled server from holding a
+// packet identifier, and in-flight slot, indefinitely. Note that the server may still deliver an abandoned message.
+func (c *Client) PublishWithTimeout(ctx context.Context, p *Publish, ackTimeout time.Duration) (*PublishResponse, error) {
+	return c.PublishWithOptions(ctx, p, PublishOptions{AckTimeout: ackTimeout})
 }
 
 // PublishWithOptions is used to send a publication to the MQTT server (with options to customise its behaviour)
@@ -851,6 +1536,30 @@ type PublishOptions struct {
 // it may even be delivered following an application restart).
 // Warning: Publish may outlive the connection when QOS1+ (managed in `session_state`)
 func (c *Client) PublishWithOptions(ctx context.Context, p *Publish, o PublishOptions) (*PublishResponse, error) {
+	pb, err := c.preparePublish(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pb.QoS {
+	case 0:
+		c.debug.Println("sending QoS0 message")
+		if err := c.writePublish(pb); err != nil {
+			go c.error(err)
+			return nil, err
+		}
+		c.config.PingHandler.PacketSent()
+		return &PublishResponse{}, nil
+	case 1, 2:
+		return c.publishQoS12(ctx, pb, o)
+	}
+
+	return nil, fmt.Errorf("%w: QoS isn't 0, 1 or 2", ErrInvalidArguments)
+}
+
+// preparePublish validates p against the server limits, and returns the packet to send (with the PublishHook and
+// trace ID applied)
+func (c *Client) preparePublish(p *Publish) (*packets.Publish, error) {
 	if p.QoS > c.serverProps.MaximumQoS {
 		return nil, fmt.Errorf("%w: cannot send Publish with QoS %d, server maximum QoS is %d", ErrInvalidArguments, p.QoS, c.serverProps.MaximumQoS)
 	}
@@ -867,27 +1576,35 @@ func (c *Client) PublishWithOptions(ctx context.Context, p *Publish, o PublishOp
 	}
 
 	if c.config.PublishHook != nil {
+		p = p.hookCopy()
 		c.config.PublishHook(p)
 	}
 
 	c.debug.Printf("sending message to %s", p.Topic)
 
 	pb := p.Packet()
-
-	switch p.QoS {
-	case 0:
-		c.debug.Println("sending QoS0 message")
-		if _, err := pb.WriteTo(c.config.Conn); err != nil {
-			go c.error(err)
+	if c.config.TraceIDKey != "" {
+		if err := c.addTraceID(pb); err != nil {
 			return nil, err
 		}
-		c.config.PingHandler.PacketSent()
-		return &PublishResponse{}, nil
-	case 1, 2:
-		return c.publishQoS12(ctx, pb, o)
 	}
+	if err := c.checkPacketSize(pb, int64(len(pb.Payload))); err != nil {
+		return nil, err
+	}
+	return pb, nil
+}
 
-	return nil, fmt.Errorf("%w: QoS isn't 0, 1 or 2", ErrInvalidArguments)
+// checkPacketSize returns an error wrapping ErrPacketTooLarge if pb, with a payload of payloadSize bytes, would exceed
+// the servers Maximum Packet Size. Any topic alias is ignored (so the check is conservative where one is assigned
+// automatically).
+func (c *Client) checkPacketSize(pb *packets.Publish, payloadSize int64) error {
+	if c.serverProps.MaximumPacketSize == 0 {
+		return nil
+	}
+	if size := pb.SizeWithPayload(payloadSize); size > int64(c.serverProps.MaximumPacketSize) {
+		return fmt.Errorf("%w: %w: PUBLISH would be %d bytes, server maximum packet size is %d", ErrInvalidArguments, ErrPacketTooLarge, size, c.serverProps.MaximumPacketSize)
+	}
+	return nil
 }
 
 func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish, o PublishOptions) (*PublishResponse, error) {
@@ -895,14 +1612,22 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish, o Publis
 	pubCtx, cf := context.WithTimeout(ctx, c.config.PacketTimeout)
 	defer cf()
 
+	if c.config.AdaptivePublishThrottle {
+		if err := c.throttlePublish(pubCtx); err != nil {
+			return nil, err
+		}
+	}
+
 	ret := make(chan packets.ControlPacket, 1)
 	if err := c.config.Session.AddToSession(pubCtx, pb, ret); err != nil {
 		return nil, err
 	}
 
 	// From this point on the message is in store, and ret will receive something regardless of whether we succeed in
-	// writing the packet to the connection
-	if _, err := pb.WriteTo(c.config.Conn); err != nil {
+	// writing the packet to the connection (unless the transaction is abandoned)
+	expired, stopExpiry := c.expireInflight(pb.PacketID, ret)
+	sent := time.Now()
+	if err := c.writePublish(pb); err != nil {
 		c.debug.Printf("failed to write packet %d to connection: %s", pb.PacketID, err)
 		if o.Method == PublishMethod_AsyncSend {
 			return nil, ErrNetworkErrorAfterStored // Async send, so we don't wait for the response (may add callbacks in the future to enable user to obtain status)
@@ -914,18 +1639,41 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish, o Publis
 		return nil, nil // Async send, so we don't wait for the response (may add callbacks in the future to enable user to obtain status)
 	}
 
+	var ackTimeout <-chan time.Time
+	if o.AckTimeout > 0 {
+		t := time.NewTimer(o.AckTimeout)
+		defer t.Stop()
+		ackTimeout = t.C
+	}
+
 	var resp packets.ControlPacket
 	select {
 	case <-pubCtx.Done():
 		ctxErr := pubCtx.Err()
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for Publish ack: %v", ctxErr))
 		return nil, ctxErr
+	case <-ackTimeout:
+		if c.abandon(pb.PacketID, ret) {
+			c.debug.Printf("abandoned PUBLISH %d; not acknowledged within %s", pb.PacketID, o.AckTimeout)
+			return nil, ErrPublishAckTimeout
+		}
+		select { // The transaction completed, or expired, before it could be abandoned
+		case resp = <-ret:
+		case <-expired:
+			return nil, ErrPublishAckTimeout
+		}
+	case <-expired:
+		return nil, ErrPublishAckTimeout
 	case resp = <-ret:
 	}
+	if stopExpiry != nil {
+		stopExpiry()
+	}
 
 	if resp.Type == 0 { // default ControlPacket indicates we are shutting down
 		return nil, errors.New("PUBLISH transmitted but not fully acknowledged at time of shutdown")
 	}
+	c.publishLatency.record(time.Since(sent))
 
 	switch pb.QoS {
 	case 1:
@@ -957,34 +1705,72 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish, o Publis
 	return nil, fmt.Errorf("ended up with a non QoS1/2 message: %d", pb.QoS)
 }
 
-func (c *Client) expectConnack(packet chan<- *packets.Connack, errs chan<- error) {
+// throttlePublish delays (see AdaptivePublishThrottle) based upon the proportion of the send quota in use
+func (c *Client) throttlePublish(ctx context.Context) error {
+	s, ok := c.config.Session.(interface{ InFlight() (inFlight, limit int) })
+	if !ok {
+		return nil
+	}
+	inFlight, limit := s.InFlight()
+	if limit == 0 || inFlight*2 <= limit {
+		return nil
+	}
+	ratio := float64(inFlight*2-limit) / float64(limit) // 0 at half quota, 1 when fully used
+	if ratio > 1 {
+		ratio = 1
+	}
+	delay := time.Duration(ratio * float64(c.config.PublishThrottleMaxDelay))
+	c.debug.Printf("%d of %d in flight, delaying publish by %s", inFlight, limit, delay)
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expectConnack reads packets until a CONNACK is received (handling any AUTH exchange). If ctx is done (the connection
+// attempt has been abandoned) when a packet arrives, it is discarded without further processing.
+func (c *Client) expectConnack(ctx context.Context, packet chan<- *packets.Connack, errs chan<- error) {
 	recv, err := packets.ReadPacket(c.config.Conn)
+	if c.conn != nil {
+		c.conn.packetRead()
+	}
 	if err != nil {
 		errs <- err
 		return
 	}
+	if ctx.Err() != nil {
+		c.debug.Printf("connection attempt abandoned, discarding late %s", recv.PacketType())
+		errs <- ctx.Err()
+		return
+	}
 	switch r := recv.Content.(type) {
 	case *packets.Connack:
 		c.debug.Println("received CONNACK")
 		if r.ReasonCode == packets.ConnackSuccess && r.Properties != nil && r.Properties.AuthMethod != "" {
 			// Successful connack and AuthMethod is defined, must have successfully authed during connect
-			go c.config.AuthHandler.Authenticated()
+			c.authenticated()
 		}
 		packet <- r
 	case *packets.Auth:
 		c.debug.Println("received AUTH")
-		if c.config.AuthHandler == nil {
+		if c.config.AuthHandler == nil && c.config.Authenticator == nil {
 			errs <- fmt.Errorf("enhanced authentication flow started but no AuthHandler configured")
 			return
 		}
-		c.debug.Println("sending AUTH")
-		_, err := c.config.AuthHandler.Authenticate(AuthFromPacketAuth(r)).Packet().WriteTo(c.config.Conn)
+		resp, err := c.authContinue(r)
 		if err != nil {
+			errs <- err
+			return
+		}
+		c.debug.Println("sending AUTH")
+		if _, err = resp.WriteTo(c.config.Conn); err != nil {
 			errs <- fmt.Errorf("error sending authentication packet: %w", err)
 			return
 		}
 		// go round again, either another AUTH or CONNACK
-		go c.expectConnack(packet, errs)
+		go c.expectConnack(ctx, packet, errs)
 	default:
 		errs <- fmt.Errorf("received unexpected packet %v", recv.Type)
 	}
@@ -1004,6 +1790,21 @@ func (c *Client) Disconnect(d *Disconnect) error {
 	return err
 }
 
+// DisconnectGracefully waits for any handlers (OnPublishReceived callbacks) that are processing, or are queued to
+// process (e.g. awaiting a free worker), messages to complete and then calls Disconnect. If ctx is done before the handlers complete, the connection will be disconnected anyway
+// and an error wrapping ctx.Err() returned. Note that messages may continue to be received whilst waiting.
+func (c *Client) DisconnectGracefully(ctx context.Context, d *Disconnect) error {
+	c.debug.Println("waiting for handlers to complete before disconnecting")
+	waitErr := c.handlers.wait(ctx)
+	if err := c.Disconnect(d); err != nil && waitErr == nil {
+		return err
+	}
+	if waitErr != nil {
+		return fmt.Errorf("disconnected before handlers completed: %w", waitErr)
+	}
+	return nil
+}
+
 // AddOnPublishReceived adds a function that will be called when a PUBLISH is received
 // The new function will be called after any functions already in the list
 // Returns a function that can be called to remove the callback
@@ -1065,6 +1866,105 @@ func (c *Client) SetErrorLogger(l log.Logger) {
 	}
 }
 
+// SwapConn replaces the connection to the server with newConn; the old connection is closed. The read loop, pinger
+// and session state will use newConn from this point on.
+// This is EXPERIMENTAL and intended for advanced use (e.g. proxy failover); it requires that EnableConnSwap be set,
+// and assumes that newConn is connected to a server that holds the current session (the CONNECT/CONNACK exchange is
+// not repeated). Packets are never split across connections; ErrSwapMidPacket is returned if part of a packet has been
+// read from the old connection (the swap may be retried); if a packet starts to arrive whilst the swap is in progress,
+// SwapConn waits until it has been read in full.
+func (c *Client) SwapConn(newConn net.Conn) error {
+	if newConn == nil {
+		return fmt.Errorf("%w: newConn is nil", ErrInvalidArguments)
+	}
+	if !c.config.EnableConnSwap {
+		return fmt.Errorf("%w: EnableConnSwap is not set", ErrInvalidArguments)
+	}
+	c.connectCalledMu.Lock()
+	conn := c.conn
+	c.connectCalledMu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("connection can only be swapped after Connect has been called")
+	}
+	select {
+	case <-c.done:
+		return fmt.Errorf("client has shutdown")
+	default:
+	}
+	c.debug.Println("swapping connection")
+	old, err := conn.swap(newConn)
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// NegotiatedLimits returns a snapshot of the limits that apply to the connection. Only valid after Connect has
+// returned successfully.
+func (c *Client) NegotiatedLimits() NegotiatedLimits {
+	return NegotiatedLimits{
+		KeepAlive:                c.keepAlive,
+		ClientReceiveMaximum:     c.clientProps.ReceiveMaximum,
+		ServerReceiveMaximum:     c.serverProps.ReceiveMaximum,
+		MaximumQoS:               c.serverProps.MaximumQoS,
+		ClientMaximumPacketSize:  c.clientProps.MaximumPacketSize,
+		ServerMaximumPacketSize:  c.serverProps.MaximumPacketSize,
+		ClientTopicAliasMaximum:  c.clientProps.TopicAliasMaximum,
+		ServerTopicAliasMaximum:  c.serverProps.TopicAliasMaximum,
+		SubscriptionIDsAvailable: c.serverProps.SubIDAvailable,
+	}
+}
+
+// OutboundTopicAliasMaximum returns the maximum topic alias value that may be used in PUBLISH packets sent to the
+// server (the TopicAliasMaximum from the CONNACK). 0 means that the server does not accept topic aliases (this is
+// also the value before Connect has returned successfully).
+func (c *Client) OutboundTopicAliasMaximum() uint16 {
+	return c.serverProps.TopicAliasMaximum
+}
+
+// ExportSession returns a JSON encoded snapshot of the session state (pending packet IDs and details of stored
+// packets, but not payloads) for diagnostic purposes (e.g. attaching to bug reports). The Session must implement
+// `Export(includePayloads bool) ([]byte, error)` (as state.State does), otherwise ErrSessionExportNotSupported is returned.
+func (c *Client) ExportSession() ([]byte, error) {
+	return c.exportSession(false)
+}
+
+// ExportSessionWithPayloads is as ExportSession but includes message payloads (which may be sensitive)
+func (c *Client) ExportSessionWithPayloads() ([]byte, error) {
+	return c.exportSession(true)
+}
+
+func (c *Client) exportSession(includePayloads bool) ([]byte, error) {
+	e, ok := c.config.Session.(interface {
+		Export(includePayloads bool) ([]byte, error)
+	})
+	if !ok {
+		return nil, ErrSessionExportNotSupported
+	}
+	return e.Export(includePayloads)
+}
+
+// TLSConnectionState returns the state of the TLS connection to the server (peer certificates, cipher suite, version
+// etc.). The bool will be false if the connection does not use TLS.
+// Wrapped connections (e.g. packets.NewThreadSafeConn) are supported as long as they provide a `NetConn() net.Conn`
+// method returning the wrapped connection.
+func (c *Client) TLSConnectionState() (tls.ConnectionState, bool) {
+	c.connectCalledMu.Lock()
+	conn := c.config.Conn
+	c.connectCalledMu.Unlock()
+	for conn != nil {
+		if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+			return tc.ConnectionState(), true
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+	return tls.ConnectionState{}, false
+}
+
 // TerminateConnectionForTest closes the active connection (if any). This function is intended for testing only, it
 // simulates connection loss which supports testing QOS1 and 2 message delivery.
 func (c *Client) TerminateConnectionForTest() {
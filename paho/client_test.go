@@ -17,21 +17,31 @@ package paho
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/internal/testcert"
 	"github.com/rtalhouk/paho.golang/packets"
 	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/rtalhouk/paho.golang/paho/session/state"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 func TestNewClient(t *testing.T) {
@@ -1111,9 +1121,1986 @@ func TestAddOnPublishReceived(t *testing.T) {
 // performs the least configuration possible such that calling `close()` will cleanly shutdown
 func basicClientInitialisation(c *Client) context.Context {
 	ctx, cancelFunc := context.WithCancel(context.Background())
+	c.ctx = ctx
 	c.cancelFunc = cancelFunc
 	done := make(chan struct{})
 	c.done = done
 	context.AfterFunc(ctx, func() { c.shutdown(done) })
 	return ctx
 }
+
+// TestSwapConn confirms that, following SwapConn, the new connection is used for both sending and receiving
+func TestSwapConn(t *testing.T) {
+	ts1 := basictestserver.New(paholog.NewTestLogger(t, "TestServer1:"))
+	ts1.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: packets.ConnackSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts1.Run()
+	defer ts1.Stop()
+
+	// Only the second server responds to PUBLISH so the publish can only succeed if the new connection is used
+	ts2 := basictestserver.New(paholog.NewTestLogger(t, "TestServer2:"))
+	ts2.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts2.Run()
+	defer ts2.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:           ts1.ClientConn(),
+		EnableConnSwap: true,
+	})
+	require.NotNil(t, c)
+
+	require.ErrorIs(t, c.SwapConn(nil), ErrInvalidArguments)
+
+	ca, err := c.Connect(context.Background(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint8(packets.ConnackSuccess), ca.ReasonCode)
+
+	require.NoError(t, c.SwapConn(ts2.ClientConn()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		pa, err := c.Publish(ctx, &Publish{
+			Topic:   "test/1",
+			QoS:     1,
+			Payload: []byte("test payload"),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, uint8(packets.PubackSuccess), pa.ReasonCode)
+	}
+
+	select {
+	case <-c.Done():
+		t.Fatal("client should not have shutdown following SwapConn")
+	default:
+	}
+
+	require.NoError(t, c.Disconnect(&Disconnect{}))
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not shutdown following Disconnect")
+	}
+}
+
+// TestSwapConnDisabled confirms that the connection is only wrapped when EnableConnSwap is set
+func TestSwapConnDisabled(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	conn := ts.ClientConn()
+	c := NewClient(ClientConfig{Conn: conn})
+	require.NotNil(t, c)
+	defer c.close()
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, conn, c.config.Conn) // Not wrapped, so packets.ControlPacket.WriteTo can detect a net.TCPConn
+	assert.ErrorIs(t, c.SwapConn(ts.ClientConn()), ErrInvalidArguments)
+}
+
+// TestSwapConnMidPacket confirms that the connection cannot be swapped whilst a packet is partially read
+func TestSwapConnMidPacket(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	sc := newSwappableConn(cliConn)
+
+	go func() { _, _ = srvConn.Write([]byte{packets.PINGRESP << 4}) }() // First byte of PINGRESP only
+	b := make([]byte, 1)
+	_, err := sc.Read(b)
+	require.NoError(t, err)
+
+	newCli, newSrv := net.Pipe()
+	defer newCli.Close()
+	defer newSrv.Close()
+	_, err = sc.swap(newCli)
+	assert.ErrorIs(t, err, ErrSwapMidPacket)
+	assert.Equal(t, cliConn, sc.current())
+
+	sc.packetRead() // Packet complete, so swap is permitted
+	old, err := sc.swap(newCli)
+	require.NoError(t, err)
+	assert.Equal(t, cliConn, old)
+	assert.Equal(t, newCli, sc.current())
+}
+
+// dataOnDeadlineConn is a net.Conn whose Read returns whatever is sent on data; read deadlines are ignored (simulating
+// data arriving just before the deadline takes effect).
+type dataOnDeadlineConn struct {
+	net.Conn
+	data chan []byte
+}
+
+func (c *dataOnDeadlineConn) Read(b []byte) (int, error)      { return copy(b, <-c.data), nil }
+func (c *dataOnDeadlineConn) SetReadDeadline(time.Time) error { return nil }
+
+// TestSwapConnDuringRead confirms that, if a packet starts to arrive whilst a swap is unblocking a Read, the swap waits
+// until the whole packet has been read from the old connection
+func TestSwapConnDuringRead(t *testing.T) {
+	pipeCli, pipeSrv := net.Pipe()
+	defer pipeCli.Close()
+	defer pipeSrv.Close()
+	oldConn := &dataOnDeadlineConn{Conn: pipeCli, data: make(chan []byte)}
+	sc := newSwappableConn(oldConn)
+
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			sc.mu.Lock()
+			defer sc.mu.Unlock()
+			return cond()
+		}, time.Second, time.Millisecond)
+	}
+
+	b := make([]byte, 1)
+	readErr := make(chan error, 1)
+	go func() { _, err := sc.Read(b); readErr <- err }()
+	waitFor(func() bool { return sc.reading })
+
+	newCli, newSrv := net.Pipe()
+	defer newCli.Close()
+	defer newSrv.Close()
+	swapped := make(chan net.Conn, 1)
+	go func() {
+		old, err := sc.swap(newCli)
+		assert.NoError(t, err)
+		swapped <- old
+	}()
+	waitFor(func() bool { return sc.swapping })
+
+	oldConn.data <- []byte{packets.PINGRESP << 4} // First byte of PINGRESP arrives on the old connection
+	require.NoError(t, <-readErr)
+	assert.Equal(t, []byte{packets.PINGRESP << 4}, b)
+
+	select {
+	case <-swapped:
+		t.Fatal("swap should wait until the packet has been read")
+	case <-time.After(10 * time.Millisecond):
+	}
+	go func() { oldConn.data <- []byte{0} }() // The remainder of the packet must come from the old connection
+	_, err := sc.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0}, b)
+	assert.Equal(t, oldConn, sc.current())
+
+	sc.packetRead()
+	select {
+	case old := <-swapped:
+		assert.Equal(t, oldConn, old)
+	case <-time.After(time.Second):
+		t.Fatal("swap should complete once the packet has been read")
+	}
+	assert.Equal(t, newCli, sc.current())
+}
+
+// TestTLSConnectionState confirms that the peer certificate is available following a TLS connection
+func TestTLSConnectionState(t *testing.T) {
+	t.Run("default", func(t *testing.T) { testTLSConnectionState(t, 0) })
+	t.Run("coalesce", func(t *testing.T) { testTLSConnectionState(t, time.Millisecond) }) // conn wrapped by client
+}
+
+// testTLSConnectionState implements TestTLSConnectionState with the specified WriteCoalesceDelay
+func testTLSConnectionState(t *testing.T, coalesceDelay time.Duration) {
+	cert, pool, err := testcert.New("mqtt.example.com")
+	require.NoError(t, err)
+
+	cliConn, srvConn := net.Pipe()
+	srv := tls.Server(srvConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	srvDone := make(chan struct{})
+	go func() { // Minimal server; responds to the CONNECT and then reads until the connection is closed
+		defer close(srvDone)
+		defer srv.Close()
+		if _, err := packets.ReadPacket(srv); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srv); err != nil {
+			return
+		}
+		for {
+			if _, err := packets.ReadPacket(srv); err != nil {
+				return
+			}
+		}
+	}()
+
+	tlsConn := tls.Client(cliConn, &tls.Config{ServerName: "mqtt.example.com", RootCAs: pool})
+	require.NoError(t, tlsConn.Handshake())
+
+	// A connection not using TLS should return false
+	_, ok := NewClient(ClientConfig{Conn: cliConn}).TLSConnectionState()
+	assert.False(t, ok)
+
+	c := NewClient(ClientConfig{Conn: packets.NewThreadSafeConn(tlsConn), WriteCoalesceDelay: coalesceDelay})
+	_, err = c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	cs, ok := c.TLSConnectionState()
+	require.True(t, ok)
+	assert.True(t, cs.HandshakeComplete)
+	require.NotEmpty(t, cs.PeerCertificates)
+	assert.True(t, cs.PeerCertificates[0].Equal(cert.Leaf))
+
+	require.NoError(t, c.Disconnect(&Disconnect{}))
+	<-c.Done()
+	<-srvDone
+}
+
+// TestTraceID confirms that each PUBLISH is assigned a unique trace ID (unless one is already present)
+func TestTraceID(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	c := NewClient(ClientConfig{
+		Conn:       clientConn,
+		TraceIDKey: "trace-id",
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(paholog.NewTestLogger(t, "TraceID:"))
+	basicClientInitialisation(c)
+
+	received := make(chan *packets.Publish, 10)
+	go func() {
+		for {
+			recv, err := packets.ReadPacket(serverConn)
+			if err != nil {
+				close(received)
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				received <- p
+			}
+		}
+	}()
+
+	traceID := func(p *packets.Publish) []string {
+		var ids []string
+		for _, u := range p.Properties.User {
+			if u.Key == "trace-id" {
+				ids = append(ids, u.Value)
+			}
+		}
+		return ids
+	}
+
+	seen := make(map[string]struct{})
+	for i := 0; i < 5; i++ {
+		p := &Publish{Topic: "test/trace", Payload: []byte("test payload")}
+		_, err := c.Publish(context.Background(), p)
+		require.NoError(t, err)
+		assert.Nil(t, p.Properties) // the users Publish should not be modified
+
+		pb := <-received
+		ids := traceID(pb)
+		require.Len(t, ids, 1)
+		assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", ids[0])
+		assert.NotContains(t, seen, ids[0])
+		seen[ids[0]] = struct{}{}
+	}
+
+	// An existing trace ID should be retained
+	_, err := c.Publish(context.Background(), &Publish{
+		Topic:      "test/trace",
+		Payload:    []byte("test payload"),
+		Properties: &PublishProperties{User: UserProperties{{Key: "trace-id", Value: "existing"}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"existing"}, traceID(<-received))
+}
+
+// TestNegotiatedLimits confirms that NegotiatedLimits combines the values from the CONNECT and CONNACK
+func TestNegotiatedLimits(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: packets.ConnackSuccess,
+		Properties: &packets.Properties{
+			MaximumPacketSize: Uint32(12345),
+			MaximumQOS:        Byte(1),
+			ReceiveMaximum:    Uint16(500),
+			TopicAliasMaximum: Uint16(20),
+			ServerKeepAlive:   Uint16(45),
+		},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+		Properties: &ConnectProperties{
+			ReceiveMaximum:    Uint16(200),
+			MaximumPacketSize: Uint32(54321),
+			TopicAliasMaximum: Uint16(10),
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, NegotiatedLimits{
+		KeepAlive:                45,
+		ClientReceiveMaximum:     200,
+		ServerReceiveMaximum:     500,
+		MaximumQoS:               1,
+		ClientMaximumPacketSize:  54321,
+		ServerMaximumPacketSize:  12345,
+		ClientTopicAliasMaximum:  10,
+		ServerTopicAliasMaximum:  20,
+		SubscriptionIDsAvailable: true,
+	}, c.NegotiatedLimits())
+}
+
+// TestOutboundTopicAliasMaximum confirms that OutboundTopicAliasMaximum reflects the TopicAliasMaximum in the CONNACK
+func TestOutboundTopicAliasMaximum(t *testing.T) {
+	for _, tam := range []*uint16{nil, Uint16(25)} {
+		t.Run(fmt.Sprintf("set=%v", tam != nil), func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{
+				ReasonCode: packets.ConnackSuccess,
+				Properties: &packets.Properties{TopicAliasMaximum: tam},
+			})
+			go ts.Run()
+			defer ts.Stop()
+
+			c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+			require.NotNil(t, c)
+			defer c.close()
+			assert.Equal(t, uint16(0), c.OutboundTopicAliasMaximum())
+
+			_, err := c.Connect(context.Background(), &Connect{
+				ClientID:   "testClient",
+				CleanStart: true,
+				Properties: &ConnectProperties{TopicAliasMaximum: Uint16(10)}, // Inbound limit; should have no impact
+			})
+			require.NoError(t, err)
+
+			var want uint16
+			if tam != nil {
+				want = *tam
+			}
+			assert.Equal(t, want, c.OutboundTopicAliasMaximum())
+		})
+	}
+}
+
+// TestAckWorkers confirms that all received messages are acknowledged when a bounded pool of workers is used
+func TestAckWorkers(t *testing.T) {
+	const msgCount = 200
+	clientLogger := paholog.NewTestLogger(t, "AckWorkers:")
+
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode:     0,
+		SessionPresent: false,
+		Properties:     &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	var received sync.WaitGroup
+	received.Add(msgCount)
+	c := NewClient(ClientConfig{
+		Conn:                       ts.ClientConn(),
+		ParallelizePublishReceived: true,
+		AckWorkers:                 4,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received.Done()
+				return true, nil
+			}},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	_, err := c.Connect(context.Background(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+
+	for i := 1; i <= msgCount; i++ {
+		require.NoError(t, ts.SendPacket(&packets.Publish{
+			PacketID: uint16(i),
+			Topic:    "test/ack",
+			Payload:  []byte("test payload"),
+			QoS:      1,
+		}))
+	}
+	require.False(t, waitTimeout(&received, 5*time.Second), "timeout waiting for messages")
+	require.Eventually(t,
+		func() bool { return len(ts.ReceivedPubacks()) == msgCount },
+		5*time.Second,
+		10*time.Millisecond,
+	)
+}
+
+// TestMaxConcurrentHandlers floods the client with messages and confirms that the number of handlers running
+// concurrently never exceeds MaxConcurrentHandlers
+func TestMaxConcurrentHandlers(t *testing.T) {
+	const msgCount = 200
+	const maxHandlers = 3
+
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode:     0,
+		SessionPresent: false,
+		Properties:     &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	var running, peak atomic.Int32
+	var received sync.WaitGroup
+	received.Add(msgCount)
+	c := NewClient(ClientConfig{
+		Conn:                       ts.ClientConn(),
+		ParallelizePublishReceived: true,
+		MaxConcurrentHandlers:      maxHandlers,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				defer received.Done()
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond) // simulate some work so handlers overlap
+				return true, nil
+			}},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+
+	for i := 1; i <= msgCount; i++ {
+		require.NoError(t, ts.SendPacket(&packets.Publish{
+			Topic:   "test/flood",
+			Payload: []byte("test payload"),
+			QoS:     0,
+		}))
+	}
+	require.False(t, waitTimeout(&received, 5*time.Second), "timeout waiting for messages")
+	assert.LessOrEqual(t, peak.Load(), int32(maxHandlers))
+	assert.Greater(t, peak.Load(), int32(1)) // handlers should still run concurrently
+}
+
+// TestDisconnectGracefully confirms that DisconnectGracefully waits for active handlers (within the context deadline)
+func TestDisconnectGracefully(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		timeout  time.Duration
+		complete bool // handler expected to complete before DisconnectGracefully returns
+	}{
+		{name: "waits", timeout: 5 * time.Second, complete: true},
+		{name: "deadline", timeout: 50 * time.Millisecond, complete: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{
+				ReasonCode: packets.ConnackSuccess,
+				Properties: &packets.Properties{},
+			})
+			go ts.Run()
+			defer ts.Stop()
+
+			started := make(chan struct{})
+			var completed atomic.Bool
+			c := NewClient(ClientConfig{
+				Conn:                       ts.ClientConn(),
+				ParallelizePublishReceived: true,
+				OnPublishReceived: []func(PublishReceived) (bool, error){
+					func(pr PublishReceived) (bool, error) {
+						close(started)
+						time.Sleep(500 * time.Millisecond) // slow handler
+						completed.Store(true)
+						return true, nil
+					}},
+			})
+			require.NotNil(t, c)
+
+			_, err := c.Connect(context.Background(), &Connect{
+				KeepAlive:  30,
+				ClientID:   "testClient",
+				CleanStart: true,
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, ts.SendPacket(&packets.Publish{
+				Topic:   "test/slow",
+				Payload: []byte("test payload"),
+			}))
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler not called")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			err = c.DisconnectGracefully(ctx, &Disconnect{ReasonCode: packets.DisconnectNormalDisconnection})
+			assert.Equal(t, tc.complete, completed.Load())
+			if tc.complete {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			}
+			select {
+			case <-c.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("client did not shut down")
+			}
+		})
+	}
+}
+
+// TestDisconnectGracefullyQueued confirms that DisconnectGracefully waits for messages that have been dispatched, but
+// whose handlers have not yet started (because the maximum number of handlers/workers are busy)
+func TestDisconnectGracefullyQueued(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  ClientConfig
+	}{
+		{name: "maxConcurrentHandlers", cfg: ClientConfig{ParallelizePublishReceived: true, MaxConcurrentHandlers: 1}},
+		{name: "ackWorkers", cfg: ClientConfig{ParallelizePublishReceived: true, AckWorkers: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{
+				ReasonCode: packets.ConnackSuccess,
+				Properties: &packets.Properties{},
+			})
+			go ts.Run()
+			defer ts.Stop()
+
+			started := make(chan struct{}, 2)
+			var completed atomic.Int32
+			cfg := tc.cfg
+			cfg.Conn = ts.ClientConn()
+			cfg.OnPublishReceived = []func(PublishReceived) (bool, error){
+				func(pr PublishReceived) (bool, error) {
+					started <- struct{}{}
+					time.Sleep(200 * time.Millisecond) // slow handler
+					completed.Add(1)
+					return true, nil
+				}}
+			c := NewClient(cfg)
+			require.NotNil(t, c)
+
+			_, err := c.Connect(context.Background(), &Connect{
+				KeepAlive:  30,
+				ClientID:   "testClient",
+				CleanStart: true,
+			})
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				require.NoError(t, ts.SendPacket(&packets.Publish{
+					Topic:   "test/slow",
+					Payload: []byte("test payload"),
+				}))
+			}
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler not called")
+			}
+			time.Sleep(50 * time.Millisecond) // allow second message to be dispatched (its handler cannot start yet)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, c.DisconnectGracefully(ctx, &Disconnect{ReasonCode: packets.DisconnectNormalDisconnection}))
+			assert.Equal(t, int32(2), completed.Load())
+			select {
+			case <-c.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("client did not shut down")
+			}
+		})
+	}
+}
+
+// TestExportSession confirms that the session export includes details of pending packets
+func TestExportSession(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: packets.ConnackSuccess,
+		Properties: &packets.Properties{},
+	}) // No PUBACK response so messages remain in the session
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+
+	for _, topic := range []string{"test/1", "test/2"} {
+		_, err := c.PublishWithOptions(context.Background(), &Publish{
+			Topic:   topic,
+			QoS:     1,
+			Payload: []byte("secret"),
+		}, PublishOptions{Method: PublishMethod_AsyncSend})
+		require.NoError(t, err)
+	}
+
+	b, err := c.ExportSession()
+	require.NoError(t, err)
+	var e state.ExportedSession
+	require.NoError(t, json.Unmarshal(b, &e))
+	assert.True(t, e.Connected)
+	assert.Empty(t, e.ServerPackets)
+	require.Len(t, e.ClientPackets, 2)
+	for i, p := range e.ClientPackets {
+		assert.Equal(t, uint16(i+1), p.PacketID)
+		assert.Equal(t, "PUBLISH", p.Type)
+		assert.True(t, p.Stored)
+		assert.Equal(t, fmt.Sprintf("test/%d", i+1), p.Topic)
+		assert.Equal(t, byte(1), p.QoS)
+		assert.Equal(t, 6, p.PayloadSize)
+		assert.Nil(t, p.Payload)
+	}
+	assert.NotContains(t, string(b), "secret")
+
+	b, err = c.ExportSessionWithPayloads()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &e))
+	assert.Equal(t, []byte("secret"), e.ClientPackets[0].Payload)
+}
+
+// TestAdaptivePublishThrottle checks that, when the server is slow to acknowledge messages, publishing slows as the
+// number of messages in flight approaches the servers Receive Maximum.
+func TestAdaptivePublishThrottle(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: 0,
+		Properties: &packets.Properties{
+			ReceiveMaximum: Uint16(10),
+		},
+	})
+	// No PUBACK response is set; the server never acknowledges, so the in-flight count keeps rising
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:                    ts.ClientConn(),
+		AdaptivePublishThrottle: true,
+		PublishThrottleMaxDelay: 200 * time.Millisecond,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	ctx := context.Background()
+	ca, err := c.Connect(ctx, &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), ca.ReasonCode)
+
+	durations := make([]time.Duration, 10)
+	for i := range durations {
+		start := time.Now()
+		_, err := c.PublishWithOptions(ctx, &Publish{Topic: "test/0", QoS: 1, Payload: []byte("test")},
+			PublishOptions{Method: PublishMethod_AsyncSend})
+		require.NoError(t, err)
+		durations[i] = time.Since(start)
+	}
+
+	// Up to half the quota in use there should be no delay
+	for i := 0; i <= 5; i++ {
+		assert.Less(t, durations[i], 50*time.Millisecond, "publish %d", i)
+	}
+	// After that the delay should increase with each publish
+	for i := 7; i < len(durations); i++ {
+		assert.Greater(t, durations[i], durations[i-1], "publish %d", i)
+	}
+	assert.Greater(t, durations[9], 100*time.Millisecond)
+}
+
+// TestDisableInitialPing confirms that ClientConfig.DisableInitialPing delays the first PINGREQ until keepalive
+func TestDisableInitialPing(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable=%v", disable), func(t *testing.T) {
+			cliConn, srvConn := net.Pipe()
+			defer srvConn.Close()
+			pingReq := make(chan time.Time, 10)
+			go func() { // Minimal server; responds to the CONNECT and PINGREQ
+				for {
+					recv, err := packets.ReadPacket(srvConn)
+					if err != nil {
+						return
+					}
+					switch recv.Type {
+					case packets.CONNECT:
+						_, err = (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn)
+					case packets.PINGREQ:
+						pingReq <- time.Now()
+						_, err = packets.NewControlPacket(packets.PINGRESP).WriteTo(srvConn)
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			c := NewClient(ClientConfig{Conn: cliConn, DisableInitialPing: disable})
+			require.NotNil(t, c)
+			defer c.close()
+
+			start := time.Now()
+			_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true, KeepAlive: 1})
+			require.NoError(t, err)
+
+			select {
+			case sent := <-pingReq:
+				if disable {
+					assert.GreaterOrEqual(t, sent.Sub(start), 900*time.Millisecond)
+				} else {
+					assert.Less(t, sent.Sub(start), 500*time.Millisecond)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("PINGREQ not received")
+			}
+		})
+	}
+}
+
+// TestLateConnack confirms that, when Connect times out waiting for the CONNACK, the connection is closed and a CONNACK
+// arriving later is discarded.
+func TestLateConnack(t *testing.T) {
+	var authenticated atomic.Bool
+	auth := &TestAuth{
+		auther:        func(a *Auth) *Auth { return a },
+		authenticated: func() { authenticated.Store(true) },
+	}
+	lateConnack := &packets.Connack{Properties: &packets.Properties{AuthMethod: "TEST"}}
+
+	t.Run("connect", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		defer srvConn.Close()
+		writeErr := make(chan error, 1)
+		go func() {
+			if _, err := packets.ReadPacket(srvConn); err != nil {
+				writeErr <- err
+				return
+			}
+			time.Sleep(200 * time.Millisecond) // Exceeds the Connect timeout
+			_, err := lateConnack.WriteTo(srvConn)
+			writeErr <- err
+		}()
+
+		c := NewClient(ClientConfig{Conn: cliConn, AuthHandler: auth})
+		require.NotNil(t, c)
+		c.SetDebugLogger(paholog.NewTestLogger(t, "LateConnack:"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := c.Connect(ctx, &Connect{ClientID: "testClient", CleanStart: true})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		select {
+		case err := <-writeErr:
+			assert.ErrorIs(t, err, io.ErrClosedPipe) // The socket should have been closed
+		case <-time.After(time.Second):
+			t.Fatal("server did not complete")
+		}
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("client not done")
+		}
+		assert.False(t, authenticated.Load())
+	})
+
+	// If the CONNACK is read after the attempt is abandoned (but before the socket is closed) it must be discarded
+	t.Run("expectConnack", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		defer srvConn.Close()
+		defer cliConn.Close()
+		go func() { _, _ = lateConnack.WriteTo(srvConn) }()
+
+		c := NewClient(ClientConfig{Conn: cliConn, AuthHandler: auth})
+		require.NotNil(t, c)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		caPacketCh := make(chan *packets.Connack, 1)
+		caPacketErr := make(chan error, 1)
+		c.expectConnack(ctx, caPacketCh, caPacketErr)
+
+		assert.ErrorIs(t, <-caPacketErr, context.Canceled)
+		assert.Empty(t, caPacketCh)
+		time.Sleep(10 * time.Millisecond) // Authenticated is called in a goroutine
+		assert.False(t, authenticated.Load())
+	})
+}
+
+// TestPublishReceivedContext confirms that the Context passed to handlers is cancelled when the connection drops
+func TestPublishReceivedContext(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	go func() { // Minimal server; responds to the CONNECT and then reads until the connection is closed
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			if _, err := packets.ReadPacket(srvConn); err != nil {
+				return
+			}
+		}
+	}()
+
+	handlerStarted := make(chan struct{})
+	handlerDone := make(chan error, 1)
+	c := NewClient(ClientConfig{
+		Conn: cliConn,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				close(handlerStarted)
+				select {
+				case <-pr.Context.Done():
+					handlerDone <- pr.Context.Err()
+				case <-time.After(time.Second):
+					handlerDone <- errors.New("context not cancelled")
+				}
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	_, err = (&packets.Publish{Topic: "test/ctx", Payload: []byte("test"), Properties: &packets.Properties{}}).WriteTo(srvConn)
+	require.NoError(t, err)
+	select {
+	case <-handlerStarted:
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+
+	require.NoError(t, srvConn.Close()) // Connection drops
+	assert.ErrorIs(t, <-handlerDone, context.Canceled)
+	<-c.Done()
+}
+
+// BenchmarkAckWorkers reports the peak number of goroutines observed whilst processing a burst of QoS1 messages
+func BenchmarkAckWorkers(b *testing.B) {
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("AckWorkers=%d", workers), func(b *testing.B) {
+			var peak int64
+			var peakMu sync.Mutex
+			var received sync.WaitGroup
+			ts := basictestserver.New(paholog.NOOPLogger{})
+			ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+			go ts.Run()
+			defer ts.Stop()
+
+			c := NewClient(ClientConfig{
+				Conn:                       ts.ClientConn(),
+				ParallelizePublishReceived: true,
+				AckWorkers:                 workers,
+				OnPublishReceived: []func(PublishReceived) (bool, error){
+					func(pr PublishReceived) (bool, error) {
+						time.Sleep(time.Millisecond) // simulate some work so goroutines overlap
+						peakMu.Lock()
+						if n := int64(runtime.NumGoroutine()); n > peak {
+							peak = n
+						}
+						peakMu.Unlock()
+						received.Done()
+						return true, nil
+					}},
+			})
+			defer c.close()
+			if _, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "bench", CleanStart: true}); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				received.Add(1)
+				if err := ts.SendPacket(&packets.Publish{
+					PacketID: uint16(i%65535) + 1,
+					Topic:    "bench",
+					Payload:  []byte("payload"),
+					QoS:      1,
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			received.Wait()
+			b.ReportMetric(float64(peak), "peak-goroutines")
+		})
+	}
+}
+
+// TestClose confirms that Close shuts down the client, can be called multiple times, and that all goroutines exit
+func TestClose(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	t.Run("connected", func(t *testing.T) {
+		ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+		ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+		go ts.Run()
+		defer ts.Stop()
+
+		c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+		require.NotNil(t, c)
+		c.SetDebugLogger(paholog.NewTestLogger(t, "Close:"))
+
+		_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+		require.NoError(t, err)
+
+		require.NoError(t, c.Close())
+		select {
+		case <-c.Done():
+		default:
+			t.Fatal("Close returned before client shutdown")
+		}
+		require.NoError(t, c.Close())   // Second call should return immediately
+		_ = c.Disconnect(&Disconnect{}) // Disconnect after Close must not panic (the error is expected)
+	})
+
+	t.Run("notConnected", func(t *testing.T) {
+		cliConn, srvConn := net.Pipe()
+		defer srvConn.Close()
+		c := NewClient(ClientConfig{Conn: cliConn})
+		require.NotNil(t, c)
+		require.NoError(t, c.Close())
+		require.NoError(t, c.Close())
+		<-c.Done()
+		_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient"})
+		assert.Error(t, err)
+	})
+}
+
+// TestNoGoroutineLeak runs many connect/disconnect cycles and confirms that the number of goroutines does not grow
+// (i.e. that the read loop, pinger, ack workers etc. all exit when the client shuts down).
+func TestNoGoroutineLeak(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  func(*ClientConfig)
+	}{
+		{name: "default", cfg: func(*ClientConfig) {}},
+		{name: "manualAck", cfg: func(c *ClientConfig) { c.EnableManualAcknowledgment = true }},
+		{name: "ackWorkers", cfg: func(c *ClientConfig) { c.AckWorkers = 4 }},
+		{name: "parallel", cfg: func(c *ClientConfig) { c.ParallelizePublishReceived = true }},
+		{name: "maxConcurrentHandlers", cfg: func(c *ClientConfig) {
+			c.ParallelizePublishReceived = true
+			c.MaxConcurrentHandlers = 2
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const cycles = 20
+			cycle := func(i int, disconnect bool) {
+				ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+				ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+				go ts.Run()
+				defer ts.Stop()
+
+				received := make(chan struct{}, 1)
+				cfg := ClientConfig{
+					Conn: ts.ClientConn(),
+					OnPublishReceived: []func(PublishReceived) (bool, error){
+						func(PublishReceived) (bool, error) {
+							received <- struct{}{}
+							return true, nil
+						},
+					},
+				}
+				tt.cfg(&cfg)
+				c := NewClient(cfg)
+				require.NotNil(t, c)
+				_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+				require.NoError(t, err)
+
+				// Exercise the handlers (and acknowledgement) path
+				require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/leak", QoS: 1, PacketID: uint16(i + 1), Payload: []byte("x")}))
+				select {
+				case <-received:
+				case <-time.After(time.Second):
+					t.Fatal("message not received")
+				}
+
+				if disconnect {
+					require.NoError(t, c.Disconnect(&Disconnect{}))
+				} else {
+					c.TerminateConnectionForTest() // Simulate connection loss
+					select {
+					case <-c.Done():
+					case <-time.After(time.Second):
+						t.Fatal("client did not shut down following connection loss")
+					}
+				}
+			}
+
+			cycle(0, true) // Ensure any lazily started goroutines (e.g. in the runtime) are running before the baseline
+			before := runtime.NumGoroutine()
+			for i := 0; i < cycles; i++ {
+				cycle(i, i%2 == 0)
+			}
+
+			// Goroutines may take a short time to exit after shutdown completes
+			var after int
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if after = runtime.NumGoroutine(); after <= before {
+					return
+				}
+			}
+			t.Fatalf("goroutine leak; %d goroutines before %d cycles, %d after", before, cycles, after)
+		})
+	}
+}
+
+// stuckConn is a net.Conn whose Read does not return when the connection is closed (until release is closed)
+type stuckConn struct {
+	net.Conn
+	release chan struct{}
+	reads   atomic.Int32 // number of calls to Read
+}
+
+func (c *stuckConn) Read(b []byte) (int, error) {
+	c.reads.Add(1)
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		<-c.release
+	}
+	return n, err
+}
+
+// recordingLogger records messages passed to Printf
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) Println(v ...interface{}) {}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+// TestReadLoopDrainTimeout confirms that shutdown does not block indefinitely if the read loop does not exit when
+// the connection is closed (and that a warning is logged).
+func TestReadLoopDrainTimeout(t *testing.T) {
+	const drainTimeout = 200 * time.Millisecond
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	conn := &stuckConn{Conn: ts.ClientConn(), release: make(chan struct{})}
+	c := NewClient(ClientConfig{Conn: conn, ReadLoopDrainTimeout: drainTimeout})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ReadLoopDrainTimeout:"))
+	errLog := &recordingLogger{}
+	c.SetErrorLogger(errLog)
+
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	// Wait until the read loop is blocked in Read
+	readsAtConnect := conn.reads.Load()
+	require.Eventually(t, func() bool { return conn.reads.Load() > readsAtConnect }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, c.Disconnect(&Disconnect{}))
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, drainTimeout)
+	assert.Less(t, elapsed, drainTimeout+time.Second)
+
+	var warned bool
+	for _, m := range errLog.Messages() {
+		if strings.Contains(m, "read loop did not exit") {
+			warned = true
+		}
+	}
+	assert.True(t, warned, "expected warning to be logged")
+
+	// Once the Read returns, the read loop (and the publish loop it feeds) should exit
+	close(conn.release)
+	readersDone := make(chan struct{})
+	go func() {
+		c.readers.Wait()
+		close(readersDone)
+	}()
+	select {
+	case <-readersDone:
+	case <-time.After(time.Second):
+		t.Fatal("read loop did not exit following release")
+	}
+}
+
+// writeCountingConn counts calls to Write
+type writeCountingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// TestCoalesceAcks confirms that, with CoalesceAcks enabled, acknowledgements from parallel handlers are combined
+// into fewer writes, and that all PUBACKs are received by the server.
+func TestCoalesceAcks(t *testing.T) {
+	const messages = 50
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	var started sync.WaitGroup
+	started.Add(messages + 1) // includes a QoS0 message (which must not disrupt the batch)
+	release := make(chan struct{})
+	conn := &writeCountingConn{Conn: ts.ClientConn()}
+	c := NewClient(ClientConfig{
+		Conn:                       conn,
+		ParallelizePublishReceived: true,
+		CoalesceAcks:               true,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(PublishReceived) (bool, error) {
+				started.Done()
+				<-release // hold until all handlers are running so the acknowledgements are ready together
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "CoalesceAcks:"))
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	for i := 1; i <= messages; i++ {
+		require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/coalesce", QoS: 1, PacketID: uint16(i), Payload: []byte("x")}))
+		if i == messages/2 {
+			require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/coalesce", QoS: 0, Payload: []byte("x")}))
+		}
+	}
+	started.Wait()
+	writesBefore := conn.writes.Load()
+	close(release)
+
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == messages }, time.Second, 10*time.Millisecond)
+	ids := make(map[uint16]bool)
+	for _, pa := range ts.ReceivedPubacks() {
+		ids[pa.PacketID] = true
+	}
+	assert.Len(t, ids, messages)
+	ackWrites := conn.writes.Load() - writesBefore
+	assert.Less(t, ackWrites, int32(messages), "expected acknowledgements to be combined into fewer writes")
+}
+
+// TestValidateConnect confirms that, when ValidateConnect is set, an invalid Connect is rejected before anything is
+// sent (and that the Client can then be used with a valid Connect)
+func TestValidateConnect(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	conn := &writeCountingConn{Conn: ts.ClientConn()}
+	c := NewClient(ClientConfig{Conn: conn, ValidateConnect: true})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ValidateConnect:"))
+	defer c.close()
+
+	cp := &Connect{ClientID: "testClient", CleanStart: true, KeepAlive: 30, Password: []byte("secret")}
+	_, err := c.Connect(context.Background(), cp)
+	require.ErrorIs(t, err, ErrInvalidArguments)
+	assert.Zero(t, conn.writes.Load(), "nothing should be sent when the Connect is invalid")
+
+	cp.PasswordFlag = true
+	_, err = c.Connect(context.Background(), cp)
+	require.NoError(t, err)
+}
+
+func TestValidateClientID(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	errInvalidID := errors.New("client id must be alphanumeric")
+	conn := &writeCountingConn{Conn: ts.ClientConn()}
+	c := NewClient(ClientConfig{
+		Conn: conn,
+		ValidateClientID: func(id string) error {
+			for _, r := range id {
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					return errInvalidID
+				}
+			}
+			return nil
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ValidateClientID:"))
+	defer c.close()
+
+	cp := &Connect{ClientID: "test/client", CleanStart: true, KeepAlive: 30}
+	_, err := c.Connect(context.Background(), cp)
+	require.ErrorIs(t, err, errInvalidID)
+	assert.Zero(t, conn.writes.Load(), "nothing should be sent when the ClientID is invalid")
+
+	cp.ClientID = "testClient"
+	_, err = c.Connect(context.Background(), cp)
+	require.NoError(t, err)
+}
+
+// TestValidateClientIDGenerated confirms that ValidateClientID is passed the generated ClientID (the one that is
+// actually sent) when AutoGenerateClientID applies
+func TestValidateClientIDGenerated(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	validated := make(chan string, 1)
+	c := NewClient(ClientConfig{
+		Conn:                 ts.ClientConn(),
+		AutoGenerateClientID: true,
+		ClientIDPrefix:       "gen-",
+		ValidateClientID: func(id string) error {
+			validated <- id
+			return nil
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ValidateClientIDGenerated:"))
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{CleanStart: true, KeepAlive: 30})
+	require.NoError(t, err)
+	id := <-validated
+	assert.True(t, strings.HasPrefix(id, "gen-"), "expected generated ClientID, got %q", id)
+	assert.Equal(t, id, c.ClientID())
+}
+
+// TestMaxInboundPayloadSize confirms that messages with payloads exceeding MaxInboundPayloadSize are acknowledged,
+// reported via OnPayloadTooLarge, and not passed to the handlers.
+func TestMaxInboundPayloadSize(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	received := make(chan *Publish, 2)
+	dropped := make(chan *Publish, 2)
+	c := NewClient(ClientConfig{
+		Conn:                  ts.ClientConn(),
+		MaxInboundPayloadSize: 10,
+		OnPayloadTooLarge:     func(p *Publish) { dropped <- p },
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "MaxInboundPayloadSize:"))
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/big", QoS: 1, PacketID: 1, Payload: []byte("this payload is too large")}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/small", QoS: 1, PacketID: 2, Payload: []byte("small")}))
+
+	select {
+	case p := <-dropped:
+		assert.Equal(t, "test/big", p.Topic)
+	case <-time.After(time.Second):
+		t.Fatal("OnPayloadTooLarge not called")
+	}
+	select {
+	case p := <-received:
+		assert.Equal(t, "test/small", p.Topic)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	assert.Empty(t, received) // the oversized message must not reach the handler
+	// Both messages should be acknowledged (in order)
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 2 }, time.Second, 10*time.Millisecond)
+	acks := ts.ReceivedPubacks()
+	assert.Equal(t, uint16(1), acks[0].PacketID)
+	assert.Equal(t, uint16(2), acks[1].PacketID)
+}
+
+func TestConnectedSince(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ConnectedSince:"))
+
+	_, ok := c.ConnectedSince()
+	assert.False(t, ok, "not connected before Connect")
+
+	before := time.Now()
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	since, ok := c.ConnectedSince()
+	require.True(t, ok)
+	assert.False(t, since.Before(before))
+	assert.False(t, since.After(time.Now()))
+
+	require.NoError(t, c.Disconnect(&Disconnect{}))
+	_, ok = c.ConnectedSince()
+	assert.False(t, ok, "not connected after Disconnect")
+}
+
+// testAuthenticator implements Authenticator; responses are looked up by the AuthData received
+type testAuthenticator struct {
+	responses     map[string]string
+	authenticated chan struct{}
+}
+
+func (t *testAuthenticator) Authenticate(authData []byte) (*Auth, error) {
+	resp, ok := t.responses[string(authData)]
+	if !ok {
+		return nil, fmt.Errorf("unexpected challenge %q", authData)
+	}
+	return &Auth{Properties: &AuthProperties{AuthData: []byte(resp)}}, nil
+}
+
+func (t *testAuthenticator) Authenticated() { close(t.authenticated) }
+
+// TestAuthenticatorMultiStep runs a two round AUTH exchange (as used by SCRAM) on connect
+func TestAuthenticatorMultiStep(t *testing.T) {
+	run := func(t *testing.T, auth *testAuthenticator) (*Connack, error, []*packets.Auth) {
+		cliConn, srvConn := net.Pipe()
+		defer srvConn.Close()
+		received := make(chan []*packets.Auth, 1)
+		go func() { // Server issues two challenges before accepting the connection
+			var auths []*packets.Auth
+			defer func() { received <- auths }()
+			if _, err := packets.ReadPacket(srvConn); err != nil {
+				return
+			}
+			for _, challenge := range []string{"server-first", "server-final"} {
+				ap := &packets.Auth{
+					ReasonCode: packets.AuthContinueAuthentication,
+					Properties: &packets.Properties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte(challenge)},
+				}
+				if _, err := ap.WriteTo(srvConn); err != nil {
+					return
+				}
+				recv, err := packets.ReadPacket(srvConn)
+				if err != nil {
+					return
+				}
+				auths = append(auths, recv.Content.(*packets.Auth))
+			}
+			ca := &packets.Connack{Properties: &packets.Properties{AuthMethod: "SCRAM-SHA-256"}}
+			_, _ = ca.WriteTo(srvConn)
+		}()
+
+		c := NewClient(ClientConfig{Conn: cliConn, Authenticator: auth})
+		require.NotNil(t, c)
+		c.SetDebugLogger(paholog.NewTestLogger(t, "AuthenticatorMultiStep:"))
+		ca, err := c.Connect(context.Background(), &Connect{
+			ClientID:   "testClient",
+			CleanStart: true,
+			Properties: &ConnectProperties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte("client-first")},
+		})
+		auths := <-received
+		srvConn.Close()
+		_ = c.Disconnect(&Disconnect{})
+		return ca, err, auths
+	}
+
+	t.Run("success", func(t *testing.T) {
+		auth := &testAuthenticator{
+			responses:     map[string]string{"server-first": "client-final", "server-final": ""},
+			authenticated: make(chan struct{}),
+		}
+		ca, err, auths := run(t, auth)
+		require.NoError(t, err)
+		assert.Equal(t, byte(packets.ConnackSuccess), ca.ReasonCode)
+		require.Len(t, auths, 2)
+		for i, want := range []string{"client-final", ""} {
+			assert.Equal(t, byte(packets.AuthContinueAuthentication), auths[i].ReasonCode)
+			assert.Equal(t, "SCRAM-SHA-256", auths[i].Properties.AuthMethod) // Taken from the servers AUTH
+			assert.Equal(t, want, string(auths[i].Properties.AuthData))
+		}
+		select {
+		case <-auth.authenticated:
+		case <-time.After(time.Second):
+			t.Fatal("Authenticated not called")
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		auth := &testAuthenticator{
+			responses:     map[string]string{"server-first": "client-final"},
+			authenticated: make(chan struct{}),
+		}
+		_, err, auths := run(t, auth)
+		require.ErrorContains(t, err, "unexpected challenge")
+		assert.Len(t, auths, 1)
+		select {
+		case <-auth.authenticated:
+			t.Fatal("Authenticated should not be called")
+		default:
+		}
+	})
+}
+
+// TestReauthenticate confirms that Reauthenticate sends an AUTH with reason code Re-authenticate and handles both
+// acceptance (following a further AUTH exchange) and rejection (DISCONNECT) by the server.
+func TestReauthenticate(t *testing.T) {
+	// connect establishes a connection to a server that runs serve once the CONNACK has been sent
+	connect := func(t *testing.T, serve func(net.Conn)) *Client {
+		cliConn, srvConn := net.Pipe()
+		t.Cleanup(func() { srvConn.Close() })
+		go func() {
+			if _, err := packets.ReadPacket(srvConn); err != nil {
+				return
+			}
+			if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+				return
+			}
+			serve(srvConn)
+			_, _ = io.Copy(io.Discard, srvConn)
+		}()
+		authenticated := make(chan struct{}, 1)
+		c := NewClient(ClientConfig{
+			Conn: cliConn,
+			AuthHandler: &TestAuth{
+				auther: func(a *Auth) *Auth {
+					return &Auth{
+						ReasonCode: packets.AuthContinueAuthentication,
+						Properties: &AuthProperties{AuthMethod: "TEST", AuthData: []byte("response")},
+					}
+				},
+				authenticated: func() { authenticated <- struct{}{} },
+			},
+		})
+		require.NotNil(t, c)
+		c.SetDebugLogger(paholog.NewTestLogger(t, "Reauthenticate:"))
+		_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = c.Disconnect(&Disconnect{}) })
+		return c
+	}
+	readAuth := func(conn net.Conn) *packets.Auth {
+		for {
+			recv, err := packets.ReadPacket(conn)
+			if err != nil {
+				return nil
+			}
+			if ap, ok := recv.Content.(*packets.Auth); ok {
+				return ap
+			}
+		}
+	}
+	auth := &Auth{ // ReasonCode deliberately left as 0
+		Properties: &AuthProperties{AuthMethod: "TEST", AuthData: []byte("new token")},
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		serverAuths := make(chan *packets.Auth, 2)
+		c := connect(t, func(conn net.Conn) {
+			ap := readAuth(conn)
+			serverAuths <- ap
+			challenge := &packets.Auth{
+				ReasonCode: packets.AuthContinueAuthentication,
+				Properties: &packets.Properties{AuthMethod: "TEST", AuthData: []byte("challenge")},
+			}
+			if _, err := challenge.WriteTo(conn); err != nil {
+				return
+			}
+			serverAuths <- readAuth(conn)
+			_, _ = (&packets.Auth{ReasonCode: packets.AuthSuccess, Properties: &packets.Properties{}}).WriteTo(conn)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ar, err := c.Reauthenticate(ctx, auth)
+		require.NoError(t, err)
+		assert.True(t, ar.Success)
+		assert.Equal(t, byte(packets.AuthSuccess), ar.ReasonCode)
+		assert.Equal(t, byte(0), auth.ReasonCode) // callers Auth must not be modified
+
+		ap := <-serverAuths
+		assert.Equal(t, byte(packets.AuthReauthenticate), ap.ReasonCode)
+		assert.Equal(t, "new token", string(ap.Properties.AuthData))
+		ap = <-serverAuths
+		assert.Equal(t, byte(packets.AuthContinueAuthentication), ap.ReasonCode)
+		assert.Equal(t, "response", string(ap.Properties.AuthData))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		c := connect(t, func(conn net.Conn) {
+			if readAuth(conn) == nil {
+				return
+			}
+			_, _ = (&packets.Disconnect{
+				ReasonCode: packets.DisconnectNotAuthorized,
+				Properties: &packets.Properties{ReasonString: "token expired"},
+			}).WriteTo(conn)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ar, err := c.Reauthenticate(ctx, auth)
+		require.NoError(t, err)
+		assert.False(t, ar.Success)
+		assert.Equal(t, byte(packets.DisconnectNotAuthorized), ar.ReasonCode)
+		assert.Equal(t, "token expired", ar.Properties.ReasonString)
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("client should shutdown after DISCONNECT")
+		}
+	})
+
+	t.Run("nilAuth", func(t *testing.T) {
+		_, err := NewClient(ClientConfig{}).Reauthenticate(context.Background(), nil)
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+	})
+}
+
+// TestPublishWithTimeout confirms that a PUBLISH that is not acknowledged is abandoned (releasing the in-flight slot)
+// when the ack timeout expires.
+func TestPublishWithTimeout(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	published := make(chan *packets.Publish, 2)
+	go func() { // Server with a receive maximum of 1 that never acknowledges PUBLISH packets
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		receiveMaximum := uint16(1)
+		if _, err := (&packets.Connack{Properties: &packets.Properties{ReceiveMaximum: &receiveMaximum}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				published <- p
+			}
+		}
+	}()
+
+	sess := state.NewInMemory()
+	c := NewClient(ClientConfig{Conn: cliConn, Session: sess})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "PublishWithTimeout:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	// As the receive maximum is 1, the second publish would block indefinitely if the slot were not released
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		start := time.Now()
+		_, err = c.PublishWithTimeout(ctx, &Publish{Topic: "test/timeout", QoS: 1, Payload: []byte("x")}, 50*time.Millisecond)
+		cancel()
+		require.ErrorIs(t, err, ErrPublishAckTimeout)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		inFlight, limit := sess.InFlight()
+		assert.Equal(t, 0, inFlight)
+		assert.Equal(t, 1, limit)
+		select {
+		case <-published:
+		case <-time.After(time.Second):
+			t.Fatal("PUBLISH not received by server")
+		}
+	}
+}
+
+// TestOnFlowControlBlocked confirms that OnFlowControlBlocked is called when a publish has to wait for an in-flight slot
+func TestOnFlowControlBlocked(t *testing.T) {
+	const ackDelay = 50 * time.Millisecond
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	published := make(chan uint16, 2)
+	go func() { // Server with a receive maximum of 1 that delays acknowledging PUBLISH packets
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		receiveMaximum := uint16(1)
+		if _, err := (&packets.Connack{Properties: &packets.Properties{ReceiveMaximum: &receiveMaximum}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				published <- p.PacketID
+				time.Sleep(ackDelay)
+				if _, err = (&packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var calls atomic.Int32
+	waited := make(chan time.Duration, 2)
+	c := NewClient(ClientConfig{
+		Conn: cliConn,
+		OnFlowControlBlocked: func(d time.Duration) {
+			calls.Add(1)
+			waited <- d
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "OnFlowControlBlocked:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := c.Publish(ctx, &Publish{Topic: "test/flow", QoS: 1, Payload: []byte("first")})
+		firstErr <- err
+	}()
+	<-published // The first publish now holds the only slot
+
+	_, err = c.Publish(ctx, &Publish{Topic: "test/flow", QoS: 1, Payload: []byte("second")})
+	require.NoError(t, err)
+	require.NoError(t, <-firstErr)
+
+	assert.Equal(t, int32(1), calls.Load(), "only the second publish should have been blocked")
+	select {
+	case d := <-waited:
+		assert.Greater(t, d, time.Duration(0))
+		assert.GreaterOrEqual(t, d, ackDelay/2)
+	default:
+		t.Fatal("OnFlowControlBlocked not called")
+	}
+}
+
+// TestPublishPacketTooLarge confirms that a PUBLISH exceeding the servers Maximum Packet Size is rejected without
+// being sent
+func TestPublishPacketTooLarge(t *testing.T) {
+	const maxPacketSize = 100
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		Properties: &packets.Properties{MaximumPacketSize: Uint32(maxPacketSize)},
+	})
+	ts.SetResponse(packets.PUBACK, &packets.Puback{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: packets.NewThreadSafeConn(ts.ClientConn())})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "PacketTooLarge:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	// Fixed header (2 bytes), topic (2 + 6), packet ID (2) and property length (1) leave 87 bytes for the payload
+	p := &Publish{Topic: "test/1", QoS: 1, Payload: make([]byte, 87)}
+	require.Equal(t, int64(maxPacketSize), p.Packet().Size())
+	_, err = c.Publish(context.Background(), p)
+	require.NoError(t, err)
+
+	p.Payload = make([]byte, 88)
+	_, err = c.Publish(context.Background(), p)
+	assert.ErrorIs(t, err, ErrPacketTooLarge)
+	assert.ErrorIs(t, err, ErrInvalidArguments)
+
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 0, Payload: make([]byte, 200)})
+	assert.ErrorIs(t, err, ErrPacketTooLarge)
+
+	_, err = c.PublishReader(context.Background(), "test/1", 0, strings.NewReader(strings.Repeat("x", 200)), 200)
+	assert.ErrorIs(t, err, ErrPacketTooLarge)
+}
+
+// TestReceiveMaximumQoS0NotGated confirms that, whilst a QoS1 publish is blocked because the servers Receive Maximum
+// has been reached, QoS0 publishes proceed, and that the blocked publish proceeds once a PUBACK is received
+func TestReceiveMaximumQoS0NotGated(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	published := make(chan *packets.Publish, 3)
+	go func() { // Server with a receive maximum of 1 that does not acknowledge PUBLISH packets
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		receiveMaximum := uint16(1)
+		if _, err := (&packets.Connack{Properties: &packets.Properties{ReceiveMaximum: &receiveMaximum}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				published <- p
+			}
+		}
+	}()
+
+	c := NewClient(ClientConfig{Conn: packets.NewThreadSafeConn(cliConn)})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ReceiveMaximumQoS0NotGated:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pubErr := make(chan error, 2)
+	publish := func(payload string) {
+		_, err := c.Publish(ctx, &Publish{Topic: "test/flow", QoS: 1, Payload: []byte(payload)})
+		pubErr <- err
+	}
+	go publish("first")
+	first := <-published // The first publish now holds the only slot
+	go publish("second")
+	select {
+	case p := <-published:
+		t.Fatalf("received %q whilst receive maximum reached", p.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = c.Publish(ctx, &Publish{Topic: "test/flow", QoS: 0, Payload: []byte("qos0")})
+	require.NoError(t, err)
+	select {
+	case p := <-published:
+		assert.Equal(t, "qos0", string(p.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("QoS0 publish blocked by receive maximum")
+	}
+
+	// Acknowledging the first publish should free the slot for the second
+	_, err = (&packets.Puback{PacketID: first.PacketID, Properties: &packets.Properties{}}).WriteTo(srvConn)
+	require.NoError(t, err)
+	require.NoError(t, <-pubErr)
+	select {
+	case p := <-published:
+		assert.Equal(t, "second", string(p.Payload))
+		_, err = (&packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(srvConn)
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("second publish not sent following PUBACK")
+	}
+	require.NoError(t, <-pubErr)
+}
+
+// TestMaxInflightDuration confirms that QoS1 messages that are never acknowledged fail, and free their in-flight
+// slot, once MaxInflightDuration has passed (regardless of the per-call timeout or publish method)
+func TestMaxInflightDuration(t *testing.T) {
+	const maxInflight = 100 * time.Millisecond
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	published := make(chan *packets.Publish, 3)
+	go func() { // Server with a receive maximum of 1 that never acknowledges PUBLISH packets
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		receiveMaximum := uint16(1)
+		if _, err := (&packets.Connack{Properties: &packets.Properties{ReceiveMaximum: &receiveMaximum}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				published <- p
+			}
+		}
+	}()
+
+	sess := state.NewInMemory()
+	c := NewClient(ClientConfig{Conn: cliConn, Session: sess, MaxInflightDuration: maxInflight})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "MaxInflightDuration:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	// Blocking publish fails with a timeout error after MaxInflightDuration
+	start := time.Now()
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/inflight", QoS: 1, Payload: []byte("1")})
+	require.ErrorIs(t, err, ErrPublishAckTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), maxInflight)
+	assert.Less(t, time.Since(start), 5*maxInflight)
+	inFlight, _ := sess.InFlight()
+	assert.Equal(t, 0, inFlight)
+
+	// Async publish; the slot must be freed even though nothing is waiting on the response
+	_, err = c.PublishWithOptions(context.Background(), &Publish{Topic: "test/inflight", QoS: 1, Payload: []byte("2")},
+		PublishOptions{Method: PublishMethod_AsyncSend})
+	require.NoError(t, err)
+	inFlight, _ = sess.InFlight()
+	assert.Equal(t, 1, inFlight)
+
+	// As the receive maximum is 1, this can only be sent once the async publish has expired
+	ctx, cancel := context.WithTimeout(context.Background(), 10*maxInflight)
+	start = time.Now()
+	_, err = c.Publish(ctx, &Publish{Topic: "test/inflight", QoS: 1, Payload: []byte("3")})
+	cancel()
+	require.ErrorIs(t, err, ErrPublishAckTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), maxInflight)
+	inFlight, _ = sess.InFlight()
+	assert.Equal(t, 0, inFlight)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-published:
+		case <-time.After(time.Second):
+			t.Fatal("PUBLISH not received by server")
+		}
+	}
+}
+
+// TestProbeSubscribers confirms that ProbeSubscribers reports subscribers based upon the PUBACK reason code
+func TestProbeSubscribers(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	reasons := map[string]byte{
+		"has/subscribers": packets.PubackSuccess,
+		"no/subscribers":  packets.PubackNoMatchingSubscribers,
+		"not/authorized":  packets.PubackNotAuthorized,
+	}
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				if p.QoS != 1 || len(p.Payload) != 0 || p.Retain {
+					t.Errorf("unexpected probe PUBLISH: %s", p)
+				}
+				if _, err = (&packets.Puback{PacketID: p.PacketID, ReasonCode: reasons[p.Topic], Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	c := NewClient(ClientConfig{Conn: cliConn})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ProbeSubscribers:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	found, err := c.ProbeSubscribers(ctx, "has/subscribers")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = c.ProbeSubscribers(ctx, "no/subscribers")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = c.ProbeSubscribers(ctx, "not/authorized")
+	assert.Error(t, err)
+}
+
+// TestKeepAliveTimeoutDisconnect confirms that a DISCONNECT with reason code 0x8D results in ErrKeepAliveTimeout
+func TestKeepAliveTimeoutDisconnect(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Disconnect{ReasonCode: packets.DisconnectKeepAliveTimeout, Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			if _, err := packets.ReadPacket(srvConn); err != nil {
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	c := NewClient(ClientConfig{
+		Conn:          cliConn,
+		OnClientError: func(err error) { errs <- err },
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "KeepAliveTimeoutDisconnect:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	select {
+	case err = <-errs:
+		assert.ErrorIs(t, err, ErrKeepAliveTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("OnClientError not called")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not shutdown")
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// clientIDRandomBytes is the number of random bytes in an ID generated by GenerateClientID (each byte is encoded as
+// two hex characters).
+const clientIDRandomBytes = 8
+
+// GenerateClientID returns a random client ID consisting of prefix followed by 16 hex characters (generated using
+// crypto/rand). Note that servers are only required to accept client IDs of up to 23 characters (MQTT-3.1.3-5), so
+// a prefix of up to 7 characters is recommended.
+func GenerateClientID(prefix string) string {
+	id, err := GenerateClientIDFrom(prefix, rand.Reader)
+	if err != nil {
+		panic("paho: unable to read random bytes: " + err.Error()) // crypto/rand should never fail
+	}
+	return id
+}
+
+// GenerateClientIDFrom is GenerateClientID using the random source r (e.g. a deterministic source for testing).
+func GenerateClientIDFrom(prefix string, r io.Reader) (string, error) {
+	b := make([]byte, clientIDRandomBytes)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", fmt.Errorf("unable to read random bytes: %w", err)
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
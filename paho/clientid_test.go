@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateClientID(t *testing.T) {
+	seen := make(map[string]struct{})
+	for i := 0; i < 1000; i++ {
+		id := GenerateClientID("test-")
+		require.True(t, strings.HasPrefix(id, "test-"), "id %s missing prefix", id)
+		assert.Len(t, id, len("test-")+2*clientIDRandomBytes)
+		assert.NotContains(t, seen, id)
+		seen[id] = struct{}{}
+	}
+	assert.Len(t, GenerateClientID(""), 2*clientIDRandomBytes)
+}
+
+// TestGenerateClientIDFrom confirms that a user-provided random source is used (and errors from it are returned)
+func TestGenerateClientIDFrom(t *testing.T) {
+	id, err := GenerateClientIDFrom("test-", bytes.NewReader([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8}))
+	require.NoError(t, err)
+	assert.Equal(t, "test-0001020304050607", id)
+
+	_, err = GenerateClientIDFrom("test-", bytes.NewReader([]byte{0, 1, 2})) // insufficient random data
+	assert.Error(t, err)
+}
+
+func TestAutoGenerateClientID(t *testing.T) {
+	tests := []struct {
+		name       string
+		clientID   string
+		cleanStart bool
+		generate   bool
+		rand       io.Reader // ClientIDRand
+		want       string    // expected generated ID (if known)
+	}{
+		{name: "generated", cleanStart: true, generate: true},
+		{name: "notCleanStart", cleanStart: false},
+		{name: "clientIDProvided", clientID: "provided", cleanStart: true},
+		{name: "userRand", cleanStart: true, generate: true, rand: bytes.NewReader([]byte("\xde\xad\xbe\xef\xde\xad\xbe\xef")), want: "auto-deadbeefdeadbeef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{
+				ReasonCode: packets.ConnackSuccess,
+				Properties: &packets.Properties{},
+			})
+			go ts.Run()
+			defer ts.Stop()
+
+			c := NewClient(ClientConfig{
+				Conn:                 ts.ClientConn(),
+				AutoGenerateClientID: true,
+				ClientIDPrefix:       "auto-",
+				ClientIDRand:         tt.rand,
+			})
+			require.NotNil(t, c)
+			defer c.close()
+
+			cp := &Connect{ClientID: tt.clientID, CleanStart: tt.cleanStart}
+			_, err := c.Connect(context.Background(), cp)
+			require.NoError(t, err)
+			assert.Equal(t, tt.clientID, cp.ClientID) // Users Connect should not be modified
+			if tt.generate {
+				assert.True(t, strings.HasPrefix(c.ClientID(), "auto-"))
+				assert.Len(t, c.ClientID(), len("auto-")+2*clientIDRandomBytes)
+				if tt.want != "" {
+					assert.Equal(t, tt.want, c.ClientID())
+				}
+			} else {
+				assert.Equal(t, tt.clientID, c.ClientID())
+			}
+		})
+	}
+}
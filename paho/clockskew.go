@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// clockSkewTracker holds the most recently observed clock skew (see ClientConfig.ClockSkewTimestampKey)
+type clockSkewTracker struct {
+	mu       sync.Mutex
+	skew     time.Duration
+	observed bool
+}
+
+// parseTimestamp parses a timestamp in either Unix milliseconds or RFC 3339 format
+func parseTimestamp(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// observeClockSkew calculates the clock skew using the timestamp user property in pb (if present)
+func (c *Client) observeClockSkew(pb *packets.Publish) {
+	if pb.Properties == nil {
+		return
+	}
+	for _, u := range pb.Properties.User {
+		if u.Key != c.config.ClockSkewTimestampKey {
+			continue
+		}
+		ts, err := parseTimestamp(u.Value)
+		if err != nil {
+			c.debug.Printf("invalid timestamp (%s) in PUBLISH to %s: %s", u.Value, pb.Topic, err)
+			return
+		}
+		skew := time.Since(ts)
+		c.clockSkew.mu.Lock()
+		c.clockSkew.skew, c.clockSkew.observed = skew, true
+		c.clockSkew.mu.Unlock()
+		c.debug.Printf("observed clock skew of %s (PUBLISH to %s)", skew, pb.Topic)
+		return
+	}
+}
+
+// ClockSkew returns the difference between the local clock and the timestamp in the most recently received message
+// containing the user property specified in ClientConfig.ClockSkewTimestampKey (local time minus message timestamp; so
+// this includes any transmission delay). The bool will be false if no such message has been received.
+func (c *Client) ClockSkew() (time.Duration, bool) {
+	c.clockSkew.mu.Lock()
+	defer c.clockSkew.mu.Unlock()
+	return c.clockSkew.skew, c.clockSkew.observed
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkew(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:                  ts.ClientConn(),
+		ClockSkewTimestampKey: "ts",
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	clientCtx := basicClientInitialisation(c)
+	c.publishPackets = make(chan *packets.Publish, 10)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+
+	_, ok := c.ClockSkew()
+	assert.False(t, ok)
+
+	send := func(timestamp string) {
+		var props packets.Properties
+		if timestamp != "" {
+			props.User = []packets.User{{Key: "ts", Value: timestamp}}
+		}
+		require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/skew", Properties: &props}))
+		<-c.publishPackets // wait for the message to be processed
+	}
+
+	// Remote clock 10 minutes behind (Unix milliseconds)
+	send(strconv.FormatInt(time.Now().Add(-10*time.Minute).UnixMilli(), 10))
+	skew, ok := c.ClockSkew()
+	require.True(t, ok)
+	assert.InDelta(t, 10*time.Minute, skew, float64(time.Second))
+
+	// Remote clock 5 minutes ahead (RFC 3339)
+	send(time.Now().Add(5 * time.Minute).Format(time.RFC3339Nano))
+	skew, ok = c.ClockSkew()
+	require.True(t, ok)
+	assert.InDelta(t, -5*time.Minute, skew, float64(time.Second))
+
+	// Messages without (or with an invalid) timestamp do not change the reported skew
+	send("")
+	send("not a timestamp")
+	skew, _ = c.ClockSkew()
+	assert.InDelta(t, -5*time.Minute, skew, float64(time.Second))
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrSwapMidPacket is returned by SwapConn if part of a packet has been read from the current connection (swapping
+// at that point would corrupt the inbound stream)
+var ErrSwapMidPacket = errors.New("connection cannot be swapped whilst a packet is being read")
+
+// swappableConn is a net.Conn that passes all calls through to an underlying connection which may be replaced
+// whilst the client is running (see Client.SwapConn). All writes are serialised; swappableConn implements
+// sync.Locker so that packets.ControlPacket.WriteTo will write each packet atomically.
+type swappableConn struct {
+	mu          sync.RWMutex // protects all fields other than writeMu
+	cond        *sync.Cond   // signalled (with mu held) when reading, midPacket or swapping change
+	conn        net.Conn
+	reading     bool // true whilst a Read on conn is in progress
+	midPacket   bool // true if part of a packet has been read (cleared by packetRead)
+	swapping    bool // true whilst swap is waiting for the current packet to be read
+	interrupted bool // true if swap set a read deadline to unblock the in-progress Read
+
+	writeMu sync.Mutex // held whilst a packet is being written (and when the connection is being swapped)
+}
+
+// newSwappableConn wraps conn
+func newSwappableConn(conn net.Conn) *swappableConn {
+	s := &swappableConn{conn: conn}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// current returns the connection currently in use
+func (s *swappableConn) current() net.Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+// swap replaces the underlying connection and returns the previous one. ErrSwapMidPacket is returned if a packet has
+// been partially read. A Read blocked waiting for the next packet is unblocked and continues on newConn; if that
+// Read returns part of a packet, swap waits until packetRead is called (so the packet is read in full from the old
+// connection).
+func (s *swappableConn) swap(newConn net.Conn) (net.Conn, error) {
+	s.mu.Lock()
+	for s.swapping {
+		s.cond.Wait()
+	}
+	if s.midPacket {
+		s.mu.Unlock()
+		return nil, ErrSwapMidPacket
+	}
+	s.swapping = true // Read will not start on a new packet until the swap completes
+	for s.reading || s.midPacket {
+		if !s.midPacket && !s.interrupted {
+			s.interrupted = true
+			_ = s.conn.SetReadDeadline(time.Now()) // Unblock the in-progress Read
+		}
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+
+	s.writeMu.Lock() // Ensure we don't swap part way through writing a packet
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	old := s.conn
+	s.conn = newConn
+	s.swapping = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return old, nil
+}
+
+// packetRead is called when a complete packet has been read (or reading failed); until then the connection cannot be
+// swapped.
+func (s *swappableConn) packetRead() {
+	s.mu.Lock()
+	s.midPacket = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Read reads from the current connection. If the connection is swapped whilst Read is blocked waiting for a packet,
+// the read will be retried on the new connection.
+func (s *swappableConn) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		for s.swapping && !s.midPacket {
+			s.cond.Wait() // Do not start reading a packet from a connection that is about to be swapped out
+		}
+		conn := s.conn
+		s.reading = true // Set before reading so that swap cannot miss data returned by this Read
+		s.mu.Unlock()
+
+		n, err := conn.Read(b)
+
+		s.mu.Lock()
+		s.reading = false
+		if n > 0 {
+			s.midPacket = true
+		}
+		interrupted := s.interrupted
+		s.interrupted = false
+		if interrupted && n > 0 {
+			_ = conn.SetReadDeadline(time.Time{}) // Data arrived before the deadline; the packet must be read from conn
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if interrupted && n == 0 {
+			continue // Read was unblocked by swap; retry on the new connection
+		}
+		return n, err
+	}
+}
+
+// NetConn returns the connection currently in use (matching tls.Conn)
+func (s *swappableConn) NetConn() net.Conn { return s.current() }
+
+// Write writes to the current connection
+func (s *swappableConn) Write(b []byte) (int, error) { return s.current().Write(b) }
+
+// Lock implements sync.Locker (used by packets.ControlPacket.WriteTo to ensure packets are written atomically)
+func (s *swappableConn) Lock() { s.writeMu.Lock() }
+
+// Unlock implements sync.Locker
+func (s *swappableConn) Unlock() { s.writeMu.Unlock() }
+
+func (s *swappableConn) Close() error                       { return s.current().Close() }
+func (s *swappableConn) LocalAddr() net.Addr                { return s.current().LocalAddr() }
+func (s *swappableConn) RemoteAddr() net.Addr               { return s.current().RemoteAddr() }
+func (s *swappableConn) SetDeadline(t time.Time) error      { return s.current().SetDeadline(t) }
+func (s *swappableConn) SetReadDeadline(t time.Time) error  { return s.current().SetReadDeadline(t) }
+func (s *swappableConn) SetWriteDeadline(t time.Time) error { return s.current().SetWriteDeadline(t) }
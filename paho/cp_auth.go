@@ -50,7 +50,9 @@ func (a *Auth) InitProperties(p *packets.Properties) {
 // returns a paho library Auth
 func AuthFromPacketAuth(a *packets.Auth) *Auth {
 	v := &Auth{ReasonCode: a.ReasonCode}
-	v.InitProperties(a.Properties)
+	if a.Properties != nil {
+		v.InitProperties(a.Properties)
+	}
 
 	return v
 }
@@ -83,25 +85,31 @@ type AuthResponse struct {
 // AuthResponseFromPacketAuth takes a packets library Auth and
 // returns a paho library AuthResponse
 func AuthResponseFromPacketAuth(a *packets.Auth) *AuthResponse {
-	return &AuthResponse{
+	ar := &AuthResponse{
 		Success:    true,
 		ReasonCode: a.ReasonCode,
-		Properties: &AuthProperties{
-			ReasonString: a.Properties.ReasonString,
-			User:         UserPropertiesFromPacketUser(a.Properties.User),
-		},
+		Properties: &AuthProperties{},
+	}
+	if a.Properties != nil {
+		ar.Properties.AuthMethod = a.Properties.AuthMethod
+		ar.Properties.AuthData = a.Properties.AuthData
+		ar.Properties.ReasonString = a.Properties.ReasonString
+		ar.Properties.User = UserPropertiesFromPacketUser(a.Properties.User)
 	}
+	return ar
 }
 
 // AuthResponseFromPacketDisconnect takes a packets library Disconnect and
-// returns a paho library AuthResponse
+// returns a paho library AuthResponse (Success is false)
 func AuthResponseFromPacketDisconnect(d *packets.Disconnect) *AuthResponse {
-	return &AuthResponse{
-		Success:    true,
+	ar := &AuthResponse{
+		Success:    false, // The server disconnects when authentication fails
 		ReasonCode: d.ReasonCode,
-		Properties: &AuthProperties{
-			ReasonString: d.Properties.ReasonString,
-			User:         UserPropertiesFromPacketUser(d.Properties.User),
-		},
+		Properties: &AuthProperties{},
+	}
+	if d.Properties != nil { // A DISCONNECT may have no properties
+		ar.Properties.ReasonString = d.Properties.ReasonString
+		ar.Properties.User = UserPropertiesFromPacketUser(d.Properties.User)
 	}
+	return ar
 }
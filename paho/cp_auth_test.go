@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAuthResponseFromPacketAuth confirms that AuthMethod and AuthData survive decoding and conversion of an AUTH
+func TestAuthResponseFromPacketAuth(t *testing.T) {
+	var b bytes.Buffer
+	_, err := (&packets.Auth{
+		ReasonCode: packets.AuthContinueAuthentication,
+		Properties: &packets.Properties{
+			AuthMethod:   "SCRAM-SHA-256",
+			AuthData:     []byte{0x00, 0x01, 0xfe, 0xff},
+			ReasonString: "challenge",
+		},
+	}).WriteTo(&b)
+	require.NoError(t, err)
+
+	recv, err := packets.ReadPacket(&b)
+	require.NoError(t, err)
+	ar := AuthResponseFromPacketAuth(recv.Content.(*packets.Auth))
+	assert.Equal(t, byte(packets.AuthContinueAuthentication), ar.ReasonCode)
+	require.NotNil(t, ar.Properties)
+	assert.Equal(t, "SCRAM-SHA-256", ar.Properties.AuthMethod)
+	assert.Equal(t, []byte{0x00, 0x01, 0xfe, 0xff}, ar.Properties.AuthData)
+	assert.Equal(t, "challenge", ar.Properties.ReasonString)
+}
+
+// TestAuthResponseNilProperties confirms that packets without properties do not lead to a panic
+func TestAuthResponseNilProperties(t *testing.T) {
+	ar := AuthResponseFromPacketDisconnect(&packets.Disconnect{ReasonCode: packets.DisconnectNotAuthorized})
+	assert.False(t, ar.Success)
+	assert.Equal(t, byte(packets.DisconnectNotAuthorized), ar.ReasonCode)
+	assert.Equal(t, &AuthProperties{}, ar.Properties)
+
+	ar = AuthResponseFromPacketAuth(&packets.Auth{ReasonCode: packets.AuthSuccess})
+	assert.True(t, ar.Success)
+	assert.Equal(t, &AuthProperties{}, ar.Properties)
+
+	a := AuthFromPacketAuth(&packets.Auth{ReasonCode: packets.AuthContinueAuthentication})
+	assert.Equal(t, byte(packets.AuthContinueAuthentication), a.ReasonCode)
+	assert.Nil(t, a.Properties)
+}
@@ -45,7 +45,7 @@ type (
 		TopicAliasMaximum     *uint16
 		ServerKeepAlive       *uint16
 		MaximumQoS            *byte
-		User                  UserProperties
+		User                  UserProperties // User properties sent by the server (e.g. a broker node identifier)
 		WildcardSubAvailable  bool
 		SubIDAvailable        bool
 		SharedSubAvailable    bool
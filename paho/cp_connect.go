@@ -15,7 +15,11 @@
 
 package paho
 
-import "github.com/rtalhouk/paho.golang/packets"
+import (
+	"fmt"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
 
 type (
 	// Connect is a representation of the MQTT Connect packet
@@ -66,7 +70,7 @@ func (c *Connect) InitProperties(p *packets.Properties) {
 	}
 
 	if p.RequestResponseInfo != nil {
-		c.Properties.RequestResponseInfo = *p.RequestProblemInfo == 1
+		c.Properties.RequestResponseInfo = *p.RequestResponseInfo == 1
 	}
 	if p.RequestProblemInfo != nil {
 		c.Properties.RequestProblemInfo = *p.RequestProblemInfo == 1
@@ -114,6 +118,51 @@ func ConnectFromPacketConnect(p *packets.Connect) *Connect {
 	return v
 }
 
+// AddUserProperty adds a user property to the ConnectProperties (initialising User if needed)
+func (p *ConnectProperties) AddUserProperty(key, value string) *ConnectProperties {
+	p.User.Add(key, value)
+	return p
+}
+
+// AddUserProperty adds a user property to the Connect, creating Properties if they are nil (in which case
+// RequestProblemInfo will be set to true, matching the default when no properties are sent). The Connect is returned
+// so calls can be chained.
+func (c *Connect) AddUserProperty(key, value string) *Connect {
+	if c.Properties == nil {
+		c.Properties = &ConnectProperties{RequestProblemInfo: true}
+	}
+	c.Properties.AddUserProperty(key, value)
+	return c
+}
+
+// Validate checks the Connect for combinations of fields that would result in an invalid (or misleading) CONNECT
+// packet. The error returned wraps ErrInvalidArguments and names the offending field. Checks include:
+//   - Properties.AuthData set without Properties.AuthMethod (MQTT-3.1.2-32 - the server would reject the CONNECT)
+//   - WillProperties set without a WillMessage (the properties would not be sent)
+//   - Password set but PasswordFlag false (the password would not be sent); similarly Username/UsernameFlag
+//   - WillMessage.QoS greater than 2
+//
+// Checks that depend upon the servers limits (e.g. a retained Will where the server has RetainAvailable=0) can only
+// be performed once the CONNACK has been received; see ValidateWill and Client.WillAccepted.
+func (c *Connect) Validate() error {
+	if c.Properties != nil && len(c.Properties.AuthData) > 0 && c.Properties.AuthMethod == "" {
+		return fmt.Errorf("%w: Properties.AuthData is set but Properties.AuthMethod is empty (MQTT-3.1.2-32)", ErrInvalidArguments)
+	}
+	if c.WillProperties != nil && c.WillMessage == nil {
+		return fmt.Errorf("%w: WillProperties is set but WillMessage is nil", ErrInvalidArguments)
+	}
+	if c.WillMessage != nil && c.WillMessage.QoS > 2 {
+		return fmt.Errorf("%w: WillMessage.QoS %d is invalid", ErrInvalidArguments, c.WillMessage.QoS)
+	}
+	if !c.PasswordFlag && len(c.Password) > 0 {
+		return fmt.Errorf("%w: Password is set but PasswordFlag is false", ErrInvalidArguments)
+	}
+	if !c.UsernameFlag && c.Username != "" {
+		return fmt.Errorf("%w: Username is set but UsernameFlag is false", ErrInvalidArguments)
+	}
+	return nil
+}
+
 // Packet returns a packets library Connect from the paho Connect
 // on which it is called
 func (c *Connect) Packet() *packets.Connect {
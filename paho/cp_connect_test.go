@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectAddUserProperty(t *testing.T) {
+	c := (&Connect{ClientID: "testClient"}).
+		AddUserProperty("auth-hint", "token").
+		AddUserProperty("region", "eu")
+	require.NotNil(t, c.Properties)
+	c.Properties.AddUserProperty("region", "us")
+
+	p := c.Packet()
+	require.NotNil(t, p.Properties)
+	assert.Equal(t, []packets.User{
+		{Key: "auth-hint", Value: "token"},
+		{Key: "region", Value: "eu"},
+		{Key: "region", Value: "us"},
+	}, p.Properties.User)
+	assert.Nil(t, p.Properties.RequestProblemInfo) // Default (true) should not be sent
+
+	var cp ConnectProperties
+	cp.AddUserProperty("key", "value")
+	assert.Equal(t, UserProperties{{Key: "key", Value: "value"}}, cp.User)
+}
+
+// TestConnectRequestInfoRoundTrip confirms that RequestResponseInfo and RequestProblemInfo are decoded independently
+func TestConnectRequestInfoRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name                  string
+		responseInfo, problem byte
+	}{
+		{name: "responseOnly", responseInfo: 1, problem: 0},
+		{name: "problemOnly", responseInfo: 0, problem: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ConnectFromPacketConnect(&packets.Connect{
+				ClientID: "testClient",
+				Properties: &packets.Properties{
+					RequestResponseInfo: Byte(tt.responseInfo),
+					RequestProblemInfo:  Byte(tt.problem),
+				},
+			})
+			require.NotNil(t, c.Properties)
+			assert.Equal(t, tt.responseInfo == 1, c.Properties.RequestResponseInfo)
+			assert.Equal(t, tt.problem == 1, c.Properties.RequestProblemInfo)
+
+			// and back again
+			p := c.Packet()
+			if tt.responseInfo == 1 {
+				require.NotNil(t, p.Properties.RequestResponseInfo)
+				assert.Equal(t, byte(1), *p.Properties.RequestResponseInfo)
+			} else {
+				assert.Nil(t, p.Properties.RequestResponseInfo)
+			}
+			if tt.problem == 0 {
+				require.NotNil(t, p.Properties.RequestProblemInfo)
+				assert.Equal(t, byte(0), *p.Properties.RequestProblemInfo)
+			} else {
+				assert.Nil(t, p.Properties.RequestProblemInfo) // Default (true) is not sent
+			}
+		})
+	}
+}
+
+func TestConnectValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		connect Connect
+		field   string // expected to be named in the error ("" = valid)
+	}{
+		{name: "valid", connect: Connect{
+			ClientID:     "testClient",
+			UsernameFlag: true, Username: "user",
+			PasswordFlag: true, Password: []byte("pass"),
+			Properties:     &ConnectProperties{AuthMethod: "SCRAM-SHA-1", AuthData: []byte("data")},
+			WillMessage:    &WillMessage{Topic: "will", QoS: 1},
+			WillProperties: &WillProperties{ContentType: "text/plain"},
+		}},
+		{name: "authDataWithoutMethod", connect: Connect{Properties: &ConnectProperties{AuthData: []byte("data")}}, field: "AuthMethod"},
+		{name: "willPropertiesWithoutWill", connect: Connect{WillProperties: &WillProperties{}}, field: "WillMessage"},
+		{name: "invalidWillQoS", connect: Connect{WillMessage: &WillMessage{Topic: "will", QoS: 3}}, field: "WillMessage.QoS"},
+		{name: "passwordWithoutFlag", connect: Connect{Password: []byte("pass")}, field: "PasswordFlag"},
+		{name: "usernameWithoutFlag", connect: Connect{Username: "user"}, field: "UsernameFlag"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.connect.Validate()
+			if tt.field == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidArguments)
+			assert.Contains(t, err.Error(), tt.field)
+		})
+	}
+}
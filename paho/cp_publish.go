@@ -18,6 +18,7 @@ package paho
 import (
 	"bytes"
 	"fmt"
+	"io"
 
 	"github.com/rtalhouk/paho.golang/packets"
 )
@@ -32,6 +33,12 @@ type (
 		Topic      string
 		Properties *PublishProperties
 		Payload    []byte
+
+		// PayloadReader is set (and Payload nil) when a received message is streamed (see
+		// ClientConfig.StreamPayloadThreshold); PayloadSize is the payload length in bytes. The reader is only valid until
+		// the OnPublishReceived callback returns (any unread bytes are then discarded).
+		PayloadReader io.Reader
+		PayloadSize   int64
 	}
 
 	// PublishProperties is a struct of the properties that can be set
@@ -74,12 +81,26 @@ func PublishFromPacketPublish(p *packets.Publish) *Publish {
 		Retain:    p.Retain,
 		Topic:     p.Topic,
 		Payload:   p.Payload,
+
+		PayloadReader: p.PayloadReader,
+		PayloadSize:   p.PayloadSize,
 	}
 	v.InitProperties(p.Properties)
 
 	return v
 }
 
+// hookCopy returns a copy of p (including Properties) that may be modified without affecting p (used for PublishHook)
+func (p *Publish) hookCopy() *Publish {
+	cp := *p
+	if p.Properties != nil {
+		props := *p.Properties
+		props.User = append(UserProperties(nil), p.Properties.User...)
+		cp.Properties = &props
+	}
+	return &cp
+}
+
 // Duplicate returns true if the duplicate flag is set (the server sets this if the message has
 // been sent previously; this does not necessarily mean the client has previously processed the message).
 func (p *Publish) Duplicate() bool {
@@ -62,6 +62,16 @@ func (u UserProperties) GetAll(key string) []string {
 	return ret
 }
 
+// Range calls f for each entry in the UserProperties (in order), stopping if f returns false. Unlike GetAll, this
+// does not allocate, so is suited to performance sensitive code.
+func (u UserProperties) Range(f func(key, value string) bool) {
+	for _, v := range u {
+		if !f(v.Key, v.Value) {
+			return
+		}
+	}
+}
+
 // ToPacketProperties converts a UserProperties to a slice
 // of packets.User which is used internally in the packets
 // library for user properties
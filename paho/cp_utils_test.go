@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserPropertiesRange(t *testing.T) {
+	u := UserProperties{{"a", "1"}, {"b", "2"}, {"a", "3"}}
+
+	var got []UserProperty
+	u.Range(func(k, v string) bool {
+		got = append(got, UserProperty{k, v})
+		return true
+	})
+	assert.Equal(t, []UserProperty(u), got)
+
+	// Returning false stops the iteration
+	var count int
+	u.Range(func(k, v string) bool {
+		count++
+		return k != "b"
+	})
+	assert.Equal(t, 2, count)
+
+	// An empty UserProperties should not call f
+	UserProperties(nil).Range(func(string, string) bool {
+		t.Fatal("unexpected call")
+		return true
+	})
+
+	allocs := testing.AllocsPerRun(100, func() {
+		u.Range(func(k, v string) bool { return k != "" })
+	})
+	assert.Zero(t, allocs)
+}
+
+// BenchmarkUserPropertiesRange should report zero allocations
+func BenchmarkUserPropertiesRange(b *testing.B) {
+	u := UserProperties{{"trace-id", "8d3c5a3e"}, {"span-id", "7a43"}, {"sampled", "1"}}
+	var found string
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		u.Range(func(k, v string) bool {
+			if k == "span-id" {
+				found = v
+				return false
+			}
+			return true
+		})
+	}
+	if found != "7a43" {
+		b.Fatal("span-id not found")
+	}
+	if allocs := testing.AllocsPerRun(10, func() { u.Range(func(k, v string) bool { return true }) }); allocs != 0 {
+		b.Fatalf("expected zero allocations, got %v", allocs)
+	}
+}
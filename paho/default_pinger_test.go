@@ -17,7 +17,9 @@ package paho
 
 import (
 	"context"
+	"io"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -398,3 +400,528 @@ func TestDefaultPingerContextCancelled(t *testing.T) {
 		t.Error("expected DefaultPinger to exit when context is cancelled")
 	}
 }
+
+// countingLogger counts calls to Println (used to check that a message was logged)
+type countingLogger struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (l *countingLogger) Println(...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+}
+
+func (l *countingLogger) Printf(string, ...interface{}) {}
+
+func (l *countingLogger) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func TestDefaultPingerUnsolicitedPingResp(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    UnsolicitedPingRespPolicy
+		wantLog   bool
+		wantError bool
+	}{
+		{name: "ignore", policy: UnsolicitedPingRespIgnore},
+		{name: "log", policy: UnsolicitedPingRespLog, wantLog: true},
+		{name: "disconnect", policy: UnsolicitedPingRespDisconnect, wantLog: true, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClientConn, fakeServerConn := net.Pipe()
+			defer fakeServerConn.Close()
+
+			logger := &countingLogger{}
+			pinger := NewDefaultPinger()
+			pinger.SetDebug(logger)
+			pinger.SetUnsolicitedPingRespPolicy(tt.policy)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pingResult := make(chan error, 1)
+			go func() {
+				pingResult <- pinger.Run(ctx, fakeClientConn, 30)
+			}()
+
+			// The first PINGREQ is sent immediately; respond to it (this PINGRESP is expected)
+			recv, err := packets.ReadPacket(fakeServerConn)
+			require.NoError(t, err)
+			require.Equal(t, packets.PINGREQ, recv.Type)
+			pinger.PingResp()
+			assert.Equal(t, 0, logger.Count())
+
+			pinger.PingResp() // unsolicited
+			if tt.wantLog {
+				assert.Equal(t, 1, logger.Count())
+			} else {
+				assert.Equal(t, 0, logger.Count())
+			}
+
+			select {
+			case err := <-pingResult:
+				if !tt.wantError {
+					t.Fatalf("expected DefaultPinger to continue running, got %v", err)
+				}
+				assert.EqualError(t, err, "unsolicited PINGRESP received")
+			case <-time.After(500 * time.Millisecond):
+				if tt.wantError {
+					t.Fatal("expected DefaultPinger to return an error")
+				}
+				cancel()
+				require.NoError(t, <-pingResult)
+			}
+		})
+	}
+}
+
+// TestDefaultPingerInitialGracePeriod confirms that a delayed response to the first PINGREQ is tolerated when within
+// the grace period (and results in a timeout otherwise).
+func TestDefaultPingerInitialGracePeriod(t *testing.T) {
+	const firstRespDelay = 1500 * time.Millisecond // keepalive is 1s
+
+	for _, tt := range []struct {
+		name        string
+		gracePeriod time.Duration
+		wantTimeout bool
+	}{
+		{name: "withinGracePeriod", gracePeriod: time.Second},
+		{name: "noGracePeriod", wantTimeout: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			fakeClientConn, fakeServerConn := net.Pipe()
+			defer fakeServerConn.Close()
+
+			pinger := NewDefaultPinger()
+			pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+			pinger.SetInitialPingGracePeriod(tt.gracePeriod)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pingResult := make(chan error, 1)
+			go func() {
+				pingResult <- pinger.Run(ctx, fakeClientConn, 1)
+			}()
+
+			// Delay the response to the first PINGREQ (simulating a server that is slow following connection), then
+			// respond promptly.
+			go func() {
+				first := true
+				for {
+					recv, err := packets.ReadPacket(fakeServerConn)
+					if err != nil {
+						return
+					}
+					if recv.Type == packets.PINGREQ {
+						if first {
+							first = false
+							time.Sleep(firstRespDelay)
+						}
+						pinger.PingResp()
+					}
+				}
+			}()
+
+			select {
+			case err := <-pingResult:
+				if !tt.wantTimeout {
+					t.Fatalf("expected DefaultPinger to not return error, got %v", err)
+				}
+				assert.EqualError(t, err, "PINGRESP timed out")
+			case <-time.After(3 * time.Second):
+				if tt.wantTimeout {
+					t.Fatal("expected DefaultPinger to time out")
+				}
+			}
+		})
+	}
+}
+
+// TestDefaultPingerRTT confirms that the round trip time metrics are updated when a PINGRESP is received
+func TestDefaultPingerRTT(t *testing.T) {
+	const respDelay = 50 * time.Millisecond
+	fakeClientConn, fakeServerConn := net.Pipe()
+	defer fakeServerConn.Close()
+
+	pinger := NewDefaultPinger()
+	pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+	assert.Zero(t, pinger.LastRTT())
+	assert.Zero(t, pinger.AverageRTT())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pingResult := make(chan error, 1)
+	go func() {
+		pingResult <- pinger.Run(ctx, fakeClientConn, 1)
+	}()
+	defer func() {
+		cancel()
+		<-pingResult
+	}()
+
+	gotResp := make(chan struct{}, 1)
+	go func() {
+		for {
+			recv, err := packets.ReadPacket(fakeServerConn)
+			if err != nil {
+				return
+			}
+			if recv.Type == packets.PINGREQ {
+				time.Sleep(respDelay)
+				pinger.PingResp()
+				select {
+				case gotResp <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-gotResp:
+	case <-time.After(time.Second):
+		t.Fatal("PINGREQ not received")
+	}
+	assert.GreaterOrEqual(t, pinger.LastRTT(), respDelay)
+	assert.Equal(t, pinger.LastRTT(), pinger.AverageRTT()) // First sample becomes the average
+}
+
+// TestDefaultPingerRTTReconnect confirms that the RTT metrics from a previous connection are cleared when Run is called
+// for a new connection
+func TestDefaultPingerRTTReconnect(t *testing.T) {
+	pinger := NewDefaultPinger()
+	pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+
+	// First connection; respond to the initial PINGREQ so that RTT metrics are recorded
+	fakeClientConn, fakeServerConn := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	pingResult := make(chan error, 1)
+	go func() { pingResult <- pinger.Run(ctx, fakeClientConn, 1) }()
+	recv, err := packets.ReadPacket(fakeServerConn)
+	require.NoError(t, err)
+	require.Equal(t, packets.PINGREQ, recv.Type)
+	time.Sleep(10 * time.Millisecond)
+	pinger.PingResp()
+	require.NotZero(t, pinger.LastRTT())
+	require.NotZero(t, pinger.AverageRTT())
+	cancel()
+	<-pingResult
+	fakeServerConn.Close()
+
+	// Second connection; no PINGRESP has been received, so the metrics should be zero
+	fakeClientConn, fakeServerConn = net.Pipe()
+	defer fakeServerConn.Close()
+	pinger.SetSendInitialPing(false)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { pingResult <- pinger.Run(ctx, fakeClientConn, 10) }()
+	defer func() {
+		cancel()
+		<-pingResult
+	}()
+	assert.Eventually(t, func() bool { return pinger.LastRTT() == 0 && pinger.AverageRTT() == 0 }, time.Second,
+		time.Millisecond)
+}
+
+// TestDefaultPingerAverageRTT checks the moving average calculation
+func TestDefaultPingerAverageRTT(t *testing.T) {
+	p := NewDefaultPinger()
+	p.SetRTTAlpha(0)   // ignored
+	p.SetRTTAlpha(1.5) // ignored
+	assert.Equal(t, defaultRTTAlpha, p.rttAlpha)
+	p.SetRTTAlpha(0.5)
+
+	p.mu.Lock()
+	p.recordRTT(100 * time.Millisecond)
+	p.mu.Unlock()
+	assert.Equal(t, 100*time.Millisecond, p.LastRTT())
+	assert.Equal(t, 100*time.Millisecond, p.AverageRTT())
+
+	p.mu.Lock()
+	p.recordRTT(200 * time.Millisecond)
+	p.mu.Unlock()
+	assert.Equal(t, 200*time.Millisecond, p.LastRTT())
+	assert.Equal(t, 150*time.Millisecond, p.AverageRTT())
+
+	// An unsolicited PINGRESP does not update the metrics
+	p.PingResp()
+	assert.Equal(t, 200*time.Millisecond, p.LastRTT())
+}
+
+// TestDefaultPingerStatsHandler confirms that the stats handler is called when a PINGREQ is sent, and PINGRESP
+// received, and that missed pings are counted.
+func TestDefaultPingerStatsHandler(t *testing.T) {
+	pinger := NewDefaultPinger()
+	pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+	statsCh := make(chan PingerStats, 10)
+	pinger.SetStatsHandler(func(s PingerStats) {
+		_ = pinger.LastRTT() // Calling back into the pinger must not deadlock
+		statsCh <- s
+	})
+	nextStats := func() PingerStats {
+		t.Helper()
+		select {
+		case s := <-statsCh:
+			return s
+		case <-time.After(time.Second):
+			t.Fatal("stats handler not called")
+		}
+		return PingerStats{}
+	}
+
+	// First connection; the server does not respond, so the PINGREQ will time out
+	silentClientConn, silentServerConn := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, silentServerConn) }()
+	err := pinger.Run(context.Background(), silentClientConn, 1)
+	assert.EqualError(t, err, "PINGRESP timed out")
+	s := nextStats()
+	assert.False(t, s.LastPingSent.IsZero())
+	assert.True(t, s.LastPingResponse.IsZero())
+	assert.Zero(t, s.MissedPings)
+	silentServerConn.Close()
+
+	// Second connection; the server responds
+	fakeClientConn, fakeServerConn := net.Pipe()
+	defer fakeServerConn.Close()
+	go func() {
+		for {
+			recv, err := packets.ReadPacket(fakeServerConn)
+			if err != nil {
+				return
+			}
+			if recv.Type == packets.PINGREQ {
+				pinger.PingResp()
+			}
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	pingResult := make(chan error, 1)
+	go func() {
+		pingResult <- pinger.Run(ctx, fakeClientConn, 1)
+	}()
+	defer func() {
+		cancel()
+		<-pingResult
+	}()
+
+	s = nextStats() // PINGREQ sent
+	assert.Equal(t, uint64(1), s.MissedPings)
+	pingSent := s.LastPingSent
+	s = nextStats() // PINGRESP received
+	assert.Equal(t, pingSent, s.LastPingSent)
+	assert.False(t, s.LastPingResponse.Before(pingSent))
+	assert.Equal(t, uint64(1), s.MissedPings)
+}
+
+// TestDefaultPingerJitter confirms that, with jitter enabled, the interval between PINGREQ packets varies but the
+// PINGRESP timeout is still based on the nominal keepalive.
+func TestDefaultPingerJitter(t *testing.T) {
+	t.Run("intervalVaries", func(t *testing.T) {
+		t.Parallel()
+		fakeClientConn, fakeServerConn := net.Pipe()
+		defer fakeServerConn.Close()
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+		pinger.SetJitter(0.5)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		pingResult := make(chan error, 1)
+		go func() {
+			pingResult <- pinger.Run(ctx, fakeClientConn, 1)
+		}()
+		defer func() {
+			cancel()
+			<-pingResult
+		}()
+
+		const pings = 5
+		pingTimes := make(chan time.Time, pings)
+		go func() {
+			for {
+				recv, err := packets.ReadPacket(fakeServerConn)
+				if err != nil {
+					return
+				}
+				if recv.Type == packets.PINGREQ {
+					pinger.PingResp()
+					select {
+					case pingTimes <- time.Now():
+					default:
+					}
+				}
+			}
+		}()
+
+		var last time.Time
+		varied := false
+		for i := 0; i < pings; i++ {
+			select {
+			case pt := <-pingTimes:
+				if !last.IsZero() {
+					interval := pt.Sub(last)
+					assert.GreaterOrEqual(t, interval, 450*time.Millisecond)
+					assert.LessOrEqual(t, interval, 1600*time.Millisecond)
+					if interval < 950*time.Millisecond || interval > 1050*time.Millisecond {
+						varied = true
+					}
+				}
+				last = pt
+			case <-time.After(2 * time.Second):
+				t.Fatal("PINGREQ not received")
+			}
+		}
+		assert.True(t, varied, "expected the interval between PINGREQ packets to vary")
+	})
+
+	t.Run("nominalTimeout", func(t *testing.T) {
+		t.Parallel()
+		fakeClientConn, fakeServerConn := net.Pipe()
+		defer fakeServerConn.Close()
+		go func() { _, _ = io.Copy(io.Discard, fakeServerConn) }() // PINGREQ will not be answered
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+		pinger.SetJitter(2) // ignored
+		pinger.SetJitter(0.9)
+		start := time.Now()
+		err := pinger.Run(context.Background(), fakeClientConn, 1)
+		assert.EqualError(t, err, "PINGRESP timed out")
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(t, elapsed, time.Second)
+		assert.Less(t, elapsed, 1500*time.Millisecond)
+	})
+}
+
+// TestDefaultPingerResponseTimeout confirms that SetResponseTimeout extends the time allowed for a PINGRESP
+func TestDefaultPingerResponseTimeout(t *testing.T) {
+	const responseTimeout = 2500 * time.Millisecond // keepalive is 1s
+
+	t.Run("delayedResponse", func(t *testing.T) {
+		t.Parallel()
+		fakeClientConn, fakeServerConn := net.Pipe()
+		defer fakeServerConn.Close()
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+		pinger.SetResponseTimeout(responseTimeout)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pingResult := make(chan error, 1)
+		go func() {
+			pingResult <- pinger.Run(ctx, fakeClientConn, 1)
+		}()
+
+		pingReqs := make(chan time.Time, 10)
+		go func() {
+			first := true
+			for {
+				recv, err := packets.ReadPacket(fakeServerConn)
+				if err != nil {
+					return
+				}
+				if recv.Type == packets.PINGREQ {
+					pingReqs <- time.Now()
+					if first {
+						first = false
+						time.Sleep(1800 * time.Millisecond) // longer than keepalive but within the response timeout
+					}
+					pinger.PingResp()
+				}
+			}
+		}()
+
+		select {
+		case err := <-pingResult:
+			t.Fatalf("expected DefaultPinger to not return error, got %v", err)
+		case <-time.After(3 * time.Second):
+		}
+		// No PINGREQ should be sent whilst a response is outstanding
+		first := <-pingReqs
+		second := <-pingReqs
+		assert.GreaterOrEqual(t, second.Sub(first), 1800*time.Millisecond)
+	})
+
+	t.Run("noResponse", func(t *testing.T) {
+		t.Parallel()
+		fakeClientConn, fakeServerConn := net.Pipe()
+		defer fakeServerConn.Close()
+		go func() { _, _ = io.Copy(io.Discard, fakeServerConn) }() // PINGREQ will not be answered
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+		pinger.SetResponseTimeout(responseTimeout)
+		start := time.Now()
+		err := pinger.Run(context.Background(), fakeClientConn, 1)
+		assert.EqualError(t, err, "PINGRESP timed out")
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(t, elapsed, responseTimeout)
+		assert.Less(t, elapsed, responseTimeout+500*time.Millisecond)
+	})
+}
+
+// TestDefaultPingerUpdateKeepAlive confirms that UpdateKeepAlive changes the interval used by an active Run
+func TestDefaultPingerUpdateKeepAlive(t *testing.T) {
+	fakeClientConn, fakeServerConn := net.Pipe()
+	defer fakeServerConn.Close()
+
+	pinger := NewDefaultPinger()
+	pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+	pinger.UpdateKeepAlive(1) // Run not in progress so should be ignored
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pingResult := make(chan error, 1)
+	go func() {
+		pingResult <- pinger.Run(ctx, fakeClientConn, 30)
+	}()
+	defer func() {
+		cancel()
+		<-pingResult
+	}()
+
+	pingReqs := make(chan time.Time, 10)
+	go func() {
+		for {
+			recv, err := packets.ReadPacket(fakeServerConn)
+			if err != nil {
+				return
+			}
+			if recv.Type == packets.PINGREQ {
+				pinger.PingResp()
+				pingReqs <- time.Now()
+			}
+		}
+	}()
+
+	select {
+	case <-pingReqs: // Initial PINGREQ (sent immediately)
+	case <-time.After(time.Second):
+		t.Fatal("initial PINGREQ not received")
+	}
+	select {
+	case <-pingReqs:
+		t.Fatal("unexpected PINGREQ (keepalive is 30s)")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// Reducing the keepalive to 1s should result in a PINGREQ being sent promptly (as 1s has already passed)
+	updated := time.Now()
+	pinger.UpdateKeepAlive(1)
+	pinger.UpdateKeepAlive(0) // ignored
+	select {
+	case pt := <-pingReqs:
+		assert.Less(t, pt.Sub(updated), 500*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("PINGREQ not received following keepalive update")
+	}
+	select { // and then every second
+	case <-pingReqs:
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("PINGREQ not received within updated keepalive")
+	}
+}
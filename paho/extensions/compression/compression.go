@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package compression provides negotiation (via user properties in the CONNECT/CONNACK) of payload compression, and
+// an interceptor that compresses outbound, and decompresses inbound, payloads.
+//
+// Compression is not part of the MQTT specification; this extension relies on a convention that the server (or, more
+// likely, the applications exchanging messages) must also follow:
+//   - The client lists the algorithms it supports in the CONNECT user property OfferKey (comma separated).
+//   - The server indicates the algorithm selected in the CONNACK user property SelectedKey.
+//   - A compressed PUBLISH carries the user property EncodingKey identifying the algorithm used.
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/paho"
+)
+
+const (
+	OfferKey    = "compression-offer" // CONNECT user property listing supported algorithms
+	SelectedKey = "compression"       // CONNACK user property holding the algorithm selected by the server
+	EncodingKey = "content-encoding"  // PUBLISH user property identifying the algorithm used to compress the payload
+
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// DefaultMaxDecompressedSize is the default limit on the size of a decompressed payload (see SetMaxDecompressedSize)
+const DefaultMaxDecompressedSize = 16 * 1024 * 1024
+
+var (
+	// ErrUnsupportedAlgorithm is returned when a compression algorithm is not supported by this package
+	ErrUnsupportedAlgorithm = errors.New("unsupported compression algorithm")
+	// ErrDecompressedTooLarge is returned when a decompressed payload would exceed the configured maximum size
+	ErrDecompressedTooLarge = errors.New("decompressed payload exceeds maximum size")
+)
+
+// Offer adds the OfferKey user property, listing algorithms (in order of preference), to the CONNECT packet
+func Offer(cp *paho.Connect, algorithms ...string) {
+	cp.AddUserProperty(OfferKey, strings.Join(algorithms, ","))
+}
+
+// Selected returns the algorithm selected by the server (from the CONNACK user properties); "" if none
+func Selected(ca *paho.Connack) string {
+	if ca == nil || ca.Properties == nil {
+		return ""
+	}
+	return ca.Properties.User.Get(SelectedKey)
+}
+
+// Interceptor compresses the payload of outbound messages (when an algorithm has been configured) and decompresses
+// inbound messages that include the EncodingKey user property. PublishHook should be set as the ClientConfig
+// PublishHook, and OnPublishReceived added as the first OnPublishReceived handler.
+type Interceptor struct {
+	mu                  sync.RWMutex
+	algorithm           string // "" means outbound messages are not compressed
+	maxDecompressedSize int64  // inbound payloads that decompress to more than this are rejected
+}
+
+// NewInterceptor creates an Interceptor; outbound compression is disabled until Configure is called
+func NewInterceptor() *Interceptor {
+	return &Interceptor{maxDecompressedSize: DefaultMaxDecompressedSize}
+}
+
+// SetMaxDecompressedSize sets the maximum size, in bytes, of a decompressed inbound payload (defaults to
+// DefaultMaxDecompressedSize). This protects against "decompression bombs" (small messages that decompress to
+// a very large payload).
+func (i *Interceptor) SetMaxDecompressedSize(n int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.maxDecompressedSize = n
+}
+
+// Configure sets the algorithm used to compress outbound messages ("" disables compression)
+func (i *Interceptor) Configure(algorithm string) error {
+	if algorithm != "" && algorithm != Gzip && algorithm != Deflate {
+		return fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.algorithm = algorithm
+	return nil
+}
+
+// ConfigureFromConnack configures the Interceptor to use the algorithm selected by the server (see Selected); should
+// be called following each successful connection (e.g. from autopaho OnConnectionUp).
+func (i *Interceptor) ConfigureFromConnack(ca *paho.Connack) error {
+	return i.Configure(Selected(ca))
+}
+
+// Algorithm returns the algorithm used to compress outbound messages ("" if none)
+func (i *Interceptor) Algorithm() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.algorithm
+}
+
+// PublishHook compresses the payload of p (if an algorithm has been configured) and adds the EncodingKey user
+// property. Messages that already have an EncodingKey property are not modified. If compression fails the message is
+// sent uncompressed. The Payload is replaced (not modified in place) and the client passes the hook a copy of the
+// Publish, so the callers Publish is not changed.
+func (i *Interceptor) PublishHook(p *paho.Publish) {
+	alg := i.Algorithm()
+	if alg == "" || len(p.Payload) == 0 {
+		return
+	}
+	if p.Properties != nil && p.Properties.User.Get(EncodingKey) != "" {
+		return
+	}
+	compressed, err := compress(alg, p.Payload)
+	if err != nil {
+		return
+	}
+	if p.Properties == nil {
+		p.Properties = &paho.PublishProperties{}
+	}
+	p.Properties.User.Add(EncodingKey, alg)
+	p.Payload = compressed
+}
+
+// OnPublishReceived decompresses the payload of received messages that have the EncodingKey user property (the
+// property is retained, allowing later handlers to see that the message was compressed). It does not handle the
+// message (returns false) and returns an error if decompression fails.
+func (i *Interceptor) OnPublishReceived(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	if p.Properties == nil {
+		return false, nil
+	}
+	alg := p.Properties.User.Get(EncodingKey)
+	if alg == "" {
+		return false, nil
+	}
+	i.mu.RLock()
+	limit := i.maxDecompressedSize
+	i.mu.RUnlock()
+	payload, err := decompress(alg, p.Payload, limit)
+	if err != nil {
+		return false, fmt.Errorf("failed to decompress message on %s: %w", p.Topic, err)
+	}
+	p.Payload = payload
+	return false, nil
+}
+
+// compress compresses data using algorithm
+func compress(algorithm string, data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch algorithm {
+	case Gzip:
+		w = gzip.NewWriter(&b)
+	case Deflate:
+		var err error
+		if w, err = flate.NewWriter(&b, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decompress decompresses data that was compressed using algorithm; ErrDecompressedTooLarge is returned if the
+// result would exceed limit bytes
+func decompress(algorithm string, data []byte, limit int64) ([]byte, error) {
+	var r io.ReadCloser
+	switch algorithm {
+	case Gzip:
+		var err error
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	case Deflate:
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrDecompressedTooLarge, limit)
+	}
+	return out, nil
+}
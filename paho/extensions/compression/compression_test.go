@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	"github.com/rtalhouk/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNegotiation simulates a server that selects gzip and confirms the interceptor compresses/decompresses messages
+func TestNegotiation(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+
+	payload := bytes.Repeat([]byte("compressible "), 50)
+	offer := make(chan string, 1)
+	serverReceived := make(chan *packets.Publish, 1)
+	go func() { // Minimal server; selects gzip and records the PUBLISH received
+		recv, err := packets.ReadPacket(srvConn)
+		if err != nil {
+			return
+		}
+		for _, u := range recv.Content.(*packets.Connect).Properties.User {
+			if u.Key == OfferKey {
+				offer <- u.Value
+			}
+		}
+		ca := &packets.Connack{Properties: &packets.Properties{User: []packets.User{{Key: SelectedKey, Value: Gzip}}}}
+		if _, err := ca.WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				serverReceived <- p
+			}
+		}
+	}()
+
+	interceptor := NewInterceptor()
+	received := make(chan []byte, 1)
+	c := paho.NewClient(paho.ClientConfig{
+		Conn:        cliConn,
+		PublishHook: interceptor.PublishHook,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			interceptor.OnPublishReceived,
+			func(pr paho.PublishReceived) (bool, error) {
+				received <- pr.Packet.Payload
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+
+	cp := &paho.Connect{ClientID: "testClient", CleanStart: true}
+	Offer(cp, Gzip, Deflate)
+	ca, err := c.Connect(context.Background(), cp)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip,deflate", <-offer)
+
+	assert.Equal(t, "", interceptor.Algorithm())
+	require.NoError(t, interceptor.ConfigureFromConnack(ca))
+	assert.Equal(t, Gzip, interceptor.Algorithm())
+
+	// Outbound messages should be compressed
+	pub := &paho.Publish{Topic: "test/compression", Payload: payload}
+	_, err = c.Publish(context.Background(), pub)
+	require.NoError(t, err)
+	assert.Equal(t, payload, pub.Payload) // callers Publish must not be modified
+	assert.Nil(t, pub.Properties)
+	var sp *packets.Publish
+	select {
+	case sp = <-serverReceived:
+	case <-time.After(time.Second):
+		t.Fatal("publish not received by server")
+	}
+	require.Len(t, sp.Properties.User, 1)
+	assert.Equal(t, packets.User{Key: EncodingKey, Value: Gzip}, sp.Properties.User[0])
+	assert.Less(t, len(sp.Payload), len(payload))
+	zr, err := gzip.NewReader(bytes.NewReader(sp.Payload))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decompressed)
+
+	// Inbound compressed messages should be decompressed before reaching later handlers
+	_, err = sp.WriteTo(srvConn)
+	require.NoError(t, err)
+	select {
+	case p := <-received:
+		assert.Equal(t, payload, p)
+	case <-time.After(time.Second):
+		t.Fatal("publish not received by client")
+	}
+
+	require.NoError(t, c.Disconnect(&paho.Disconnect{}))
+}
+
+func TestConfigure(t *testing.T) {
+	i := NewInterceptor()
+	assert.ErrorIs(t, i.Configure("lz4"), ErrUnsupportedAlgorithm)
+	require.NoError(t, i.ConfigureFromConnack(&paho.Connack{})) // No selection; compression disabled
+	assert.Equal(t, "", i.Algorithm())
+
+	// Round trip using deflate
+	require.NoError(t, i.Configure(Deflate))
+	p := &paho.Publish{Topic: "test", Payload: []byte("hello hello hello hello")}
+	i.PublishHook(p)
+	assert.Equal(t, Deflate, p.Properties.User.Get(EncodingKey))
+	_, err := i.OnPublishReceived(paho.PublishReceived{Packet: p})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello hello hello hello"), p.Payload)
+
+	// Corrupt data results in an error
+	p.Payload = []byte("not compressed")
+	_, err = i.OnPublishReceived(paho.PublishReceived{Packet: p})
+	assert.Error(t, err)
+}
+
+// TestDecompressionLimit confirms that payloads decompressing to more than the configured maximum are rejected
+func TestDecompressionLimit(t *testing.T) {
+	bomb, err := compress(Gzip, make([]byte, 1024*1024)) // 1MiB of zeros compresses to ~1KiB
+	require.NoError(t, err)
+
+	newPublish := func() *paho.Publish {
+		p := &paho.Publish{Topic: "test", Payload: bomb, Properties: &paho.PublishProperties{}}
+		p.Properties.User.Add(EncodingKey, Gzip)
+		return p
+	}
+
+	i := NewInterceptor()
+	i.SetMaxDecompressedSize(1024)
+	p := newPublish()
+	_, err = i.OnPublishReceived(paho.PublishReceived{Packet: p})
+	assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+	assert.Equal(t, bomb, p.Payload) // Payload unchanged on error
+
+	i.SetMaxDecompressedSize(1024 * 1024) // Exactly the decompressed size is permitted
+	p = newPublish()
+	_, err = i.OnPublishReceived(paho.PublishReceived{Packet: p})
+	require.NoError(t, err)
+	assert.Len(t, p.Payload, 1024*1024)
+}
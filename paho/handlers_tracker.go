@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"sync"
+)
+
+// handlersTracker tracks the number of messages that have been dispatched to, and not yet completed processing by, the
+// handlers (OnPublishReceived callbacks), enabling a caller to wait until all have completed. Messages are counted
+// from the point they are handed off for processing (so those awaiting a free worker are included).
+type handlersTracker struct {
+	mx     sync.Mutex
+	active int
+	idle   chan struct{} // closed when active drops to 0 (nil if nobody is waiting)
+}
+
+// start records that a message has been dispatched for processing
+func (t *handlersTracker) start() {
+	t.mx.Lock()
+	t.active++
+	t.mx.Unlock()
+}
+
+// done records that processing of a message has completed
+func (t *handlersTracker) done() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.active--
+	if t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// wait blocks until no handlers are active or the context is done
+func (t *handlersTracker) wait(ctx context.Context) error {
+	t.mx.Lock()
+	if t.active == 0 {
+		t.mx.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mx.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import "io"
+
+// defaultMalformedPacketCaptureLimit is the default maximum number of bytes passed to OnMalformedPacket
+const defaultMalformedPacketCaptureLimit = 4096
+
+// packetCapture wraps the connection, retaining the bytes read for the current packet (up to limit) so they can be
+// passed to OnMalformedPacket should the packet fail to decode.
+type packetCapture struct {
+	r       io.Reader
+	limit   int
+	buf     []byte
+	readErr error // error returned by r (if any); used to distinguish connection errors from decoding errors
+}
+
+// Read implements io.Reader
+func (p *packetCapture) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if space := p.limit - len(p.buf); space > 0 {
+		p.buf = append(p.buf, b[:min(n, space)]...)
+	}
+	if err != nil {
+		p.readErr = err
+	}
+	return n, err
+}
+
+// reset prepares for a new packet to be read
+func (p *packetCapture) reset() {
+	p.buf = p.buf[:0]
+	p.readErr = nil
+}
+
+// malformed returns a copy of the bytes captured, and true, if the most recent read failed for a reason other than
+// an error returned by the underlying connection (i.e. the packet could not be decoded)
+func (p *packetCapture) malformed() ([]byte, bool) {
+	if p.readErr != nil || len(p.buf) == 0 {
+		return nil, false
+	}
+	return append([]byte(nil), p.buf...), true
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOnMalformedPacket confirms that the raw bytes of a packet that cannot be decoded are passed to OnMalformedPacket
+func TestOnMalformedPacket(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+
+	// PUBLISH with a remaining length of 2 holding a topic length of 5 (but no topic)
+	malformed := []byte{0x30, 0x02, 0x00, 0x05}
+
+	go func() { // Minimal server; responds to the CONNECT and then sends the malformed packet
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		if _, err := srvConn.Write(malformed); err != nil {
+			return
+		}
+		for {
+			if _, err := packets.ReadPacket(srvConn); err != nil {
+				return
+			}
+		}
+	}()
+
+	type malformedPacket struct {
+		raw []byte
+		err error
+	}
+	received := make(chan malformedPacket, 1)
+	c := NewClient(ClientConfig{
+		Conn: cliConn,
+		OnMalformedPacket: func(raw []byte, err error) {
+			received <- malformedPacket{raw: raw, err: err}
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "OnMalformedPacket:"))
+
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	select {
+	case mp := <-received:
+		assert.Equal(t, malformed, mp.raw)
+		assert.Error(t, mp.err)
+	case <-time.After(time.Second):
+		t.Fatal("OnMalformedPacket not called")
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not shutdown following malformed packet")
+	}
+}
+
+// TestPacketCaptureLimit confirms that packetCapture retains no more than limit bytes, and does not report
+// connection errors as malformed packets
+func TestPacketCaptureLimit(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	pc := &packetCapture{r: cliConn, limit: 3}
+
+	go func() {
+		// PUBLISH to topic "a" with an invalid property identifier (0x62)
+		_, _ = srvConn.Write([]byte{0x30, 0x06, 0x00, 0x01, 0x61, 0x01, 0x62, 0x63})
+		srvConn.Close()
+	}()
+	_, err := packets.ReadPacket(pc)
+	require.Error(t, err)
+	raw, ok := pc.malformed()
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x30, 0x06, 0x00}, raw)
+
+	pc.reset()
+	_, err = packets.ReadPacket(pc)
+	require.Error(t, err)
+	_, ok = pc.malformed()
+	assert.False(t, ok)
+}
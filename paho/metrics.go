@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// Metrics is a snapshot of metrics collected by the Client (see Client.Metrics)
+	Metrics struct {
+		// PublishLatency is the time between a QoS1/2 PUBLISH being sent and the final acknowledgement (PUBACK/PUBCOMP)
+		// being received. Only collected if ClientConfig.PublishLatencyMetrics is true.
+		PublishLatency LatencyPercentiles
+	}
+
+	// LatencyPercentiles summarises a set of latency measurements. Percentiles are approximate (within
+	// approximately 10% of the actual value).
+	LatencyPercentiles struct {
+		Count uint64 // Number of measurements
+		P50   time.Duration
+		P95   time.Duration
+		P99   time.Duration
+	}
+)
+
+const (
+	latencyHistogramMin     = time.Microsecond // Measurements below this are recorded in the first bucket
+	latencyHistogramGrowth  = 1.1              // Each bucket covers durations up to 10% longer than the previous one
+	latencyHistogramBuckets = 200              // 1µs * 1.1^200 is ~2 days; anything longer goes in the last bucket
+)
+
+// latencyHistogram is a lightweight streaming histogram using exponentially sized buckets; this enables
+// percentiles to be estimated using a fixed amount of memory.
+type latencyHistogram struct {
+	mu      sync.Mutex
+	buckets [latencyHistogramBuckets]uint64
+	count   uint64
+}
+
+// bucket returns the index of the bucket that d falls into
+func (h *latencyHistogram) bucket(d time.Duration) int {
+	if d <= latencyHistogramMin {
+		return 0
+	}
+	b := int(math.Ceil(math.Log(float64(d)/float64(latencyHistogramMin)) / math.Log(latencyHistogramGrowth)))
+	if b >= latencyHistogramBuckets {
+		return latencyHistogramBuckets - 1
+	}
+	return b
+}
+
+// bucketUpper returns the upper bound of bucket b
+func (h *latencyHistogram) bucketUpper(b int) time.Duration {
+	return time.Duration(float64(latencyHistogramMin) * math.Pow(latencyHistogramGrowth, float64(b)))
+}
+
+// record adds a measurement to the histogram (h may be nil, in which case this is a no-op)
+func (h *latencyHistogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	b := h.bucket(d)
+	h.mu.Lock()
+	h.buckets[b]++
+	h.count++
+	h.mu.Unlock()
+}
+
+// percentiles returns the estimated percentiles (h may be nil, in which case zero values are returned)
+func (h *latencyHistogram) percentiles() LatencyPercentiles {
+	if h == nil {
+		return LatencyPercentiles{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lp := LatencyPercentiles{Count: h.count}
+	if h.count == 0 {
+		return lp
+	}
+	targets := []struct {
+		q float64
+		d *time.Duration
+	}{{0.50, &lp.P50}, {0.95, &lp.P95}, {0.99, &lp.P99}}
+	var cumulative uint64
+	t := 0
+	for b, n := range h.buckets {
+		cumulative += n
+		for t < len(targets) && float64(cumulative) >= targets[t].q*float64(h.count) {
+			*targets[t].d = h.bucketUpper(b)
+			t++
+		}
+		if t == len(targets) {
+			break
+		}
+	}
+	return lp
+}
+
+// Metrics returns a snapshot of the metrics collected by the client
+func (c *Client) Metrics() Metrics {
+	return Metrics{
+		PublishLatency: c.publishLatency.percentiles(),
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h *latencyHistogram
+	h.record(time.Second) // nil histogram should be a noop
+	assert.Equal(t, LatencyPercentiles{}, h.percentiles())
+
+	h = &latencyHistogram{}
+	assert.Equal(t, LatencyPercentiles{}, h.percentiles())
+
+	// 1ms to 1000ms in 1ms steps; exact p50 = 500ms, p95 = 950ms, p99 = 990ms
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	p := h.percentiles()
+	assert.Equal(t, uint64(1000), p.Count)
+	assert.InEpsilon(t, float64(500*time.Millisecond), float64(p.P50), 0.1)
+	assert.InEpsilon(t, float64(950*time.Millisecond), float64(p.P95), 0.1)
+	assert.InEpsilon(t, float64(990*time.Millisecond), float64(p.P99), 0.1)
+
+	// Extremes should be captured by the first and last buckets
+	h = &latencyHistogram{}
+	h.record(0)
+	assert.Equal(t, latencyHistogramMin, h.percentiles().P99)
+	h.record(1000 * time.Hour)
+	assert.Equal(t, h.bucketUpper(latencyHistogramBuckets-1), h.percentiles().P99)
+}
+
+func TestPublishLatencyMetrics(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: packets.ConnackSuccess,
+		Properties: &packets.Properties{},
+	})
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:                  ts.ClientConn(),
+		PublishLatencyMetrics: true,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = c.Publish(context.Background(), &Publish{Topic: "test/latency", QoS: 1, Payload: []byte("test")})
+		require.NoError(t, err)
+	}
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/latency", QoS: 0, Payload: []byte("test")})
+	require.NoError(t, err)
+
+	m := c.Metrics()
+	assert.Equal(t, uint64(10), m.PublishLatency.Count) // QoS0 messages are not included
+	assert.Greater(t, m.PublishLatency.P50, time.Duration(0))
+	assert.LessOrEqual(t, m.PublishLatency.P50, m.PublishLatency.P95)
+	assert.LessOrEqual(t, m.PublishLatency.P95, m.PublishLatency.P99)
+}
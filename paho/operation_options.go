@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+// OperationOption modifies an outbound Publish or Subscribe (e.g. WithUserProperty). Options are applied to a copy,
+// so the Publish/Subscribe passed by the caller is not modified.
+type OperationOption func(*operationOptions)
+
+// operationOptions holds the result of applying OperationOptions
+type operationOptions struct {
+	user UserProperties
+}
+
+// WithUserProperty adds a user property to the Publish or Subscribe
+func WithUserProperty(key, value string) OperationOption {
+	return func(o *operationOptions) {
+		o.user.Add(key, value)
+	}
+}
+
+// applyOperationOptions returns the result of applying the provided options
+func applyOperationOptions(opts []OperationOption) operationOptions {
+	var o operationOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// withOptions returns a copy of p with opts applied (p is returned unchanged if there are no options)
+func (p *Publish) withOptions(opts []OperationOption) *Publish {
+	if len(opts) == 0 {
+		return p
+	}
+	o := applyOperationOptions(opts)
+	cp := *p
+	var props PublishProperties
+	if p.Properties != nil {
+		props = *p.Properties
+	}
+	props.User = append(append(UserProperties{}, props.User...), o.user...)
+	cp.Properties = &props
+	return &cp
+}
+
+// withOptions returns a copy of s with opts applied (s is returned unchanged if there are no options)
+func (s *Subscribe) withOptions(opts []OperationOption) *Subscribe {
+	if len(opts) == 0 {
+		return s
+	}
+	o := applyOperationOptions(opts)
+	cp := *s
+	var props SubscribeProperties
+	if s.Properties != nil {
+		props = *s.Properties
+	}
+	props.User = append(append(UserProperties{}, props.User...), o.user...)
+	cp.Properties = &props
+	return &cp
+}
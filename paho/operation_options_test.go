@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishWithUserProperty(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	c := NewClient(ClientConfig{
+		Conn: clientConn,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	basicClientInitialisation(c)
+
+	received := make(chan *packets.Publish, 1)
+	go func() {
+		defer close(received)
+		for {
+			recv, err := packets.ReadPacket(serverConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				received <- p
+			}
+		}
+	}()
+
+	p := &Publish{
+		Topic:      "test/opts",
+		Payload:    []byte("test payload"),
+		Properties: &PublishProperties{User: UserProperties{{Key: "existing", Value: "1"}}},
+	}
+	_, err := c.Publish(context.Background(), p, WithUserProperty("a", "b"), WithUserProperty("c", "d"))
+	require.NoError(t, err)
+	assert.Equal(t, UserProperties{{Key: "existing", Value: "1"}}, p.Properties.User) // the users Publish should not be modified
+
+	pb := <-received
+	assert.Equal(t, []packets.User{
+		{Key: "existing", Value: "1"},
+		{Key: "a", Value: "b"},
+		{Key: "c", Value: "d"},
+	}, pb.Properties.User)
+}
+
+func TestSubscribeWithUserProperty(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons:    []byte{1},
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	clientCtx := basicClientInitialisation(c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	s := &Subscribe{Subscriptions: []SubscribeOptions{{Topic: "test/opts", QoS: 1}}}
+	_, err := c.Subscribe(context.Background(), s, WithUserProperty("a", "b"))
+	require.NoError(t, err)
+	assert.Nil(t, s.Properties) // the users Subscribe should not be modified
+
+	subs := ts.ReceivedSubscribes()
+	require.Len(t, subs, 1)
+	assert.Equal(t, []packets.User{{Key: "a", Value: "b"}}, subs[0].Properties.User)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// ErrDuplicatePacketID is passed to OnClientError when the server sends a PUBLISH (without the DUP flag set) using
+// a packet identifier that is still in use by an earlier, unacknowledged, PUBLISH (see DisconnectOnDuplicatePacketID).
+var ErrDuplicatePacketID = errors.New("received PUBLISH reusing an in-use packet identifier")
+
+// inboundIDTracker tracks the packet identifiers of QoS1/2 PUBLISH packets received from the server that have not
+// been fully acknowledged
+type inboundIDTracker struct {
+	mu  sync.Mutex
+	ids map[uint16]struct{}
+}
+
+// add records id as being in use; returns false if it is already in use
+func (t *inboundIDTracker) add(id uint16) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.ids[id]; ok {
+		return false
+	}
+	if t.ids == nil {
+		t.ids = make(map[uint16]struct{})
+	}
+	t.ids[id] = struct{}{}
+	return true
+}
+
+// remove records that id is no longer in use
+func (t *inboundIDTracker) remove(id uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.ids, id)
+}
+
+// checkInboundPacketID records the packet identifier of a received QoS1/2 PUBLISH, returning false (after initiating
+// a disconnection with reason code 0x82) if the identifier is in use and the DUP flag is not set.
+func (c *Client) checkInboundPacketID(pb *packets.Publish) bool {
+	if c.inboundIDs.add(pb.PacketID) || pb.Duplicate {
+		return true
+	}
+	c.debug.Printf("received PUBLISH with in-use packet identifier %d (DUP not set), disconnecting", pb.PacketID)
+	d := packets.Disconnect{ReasonCode: packets.DisconnectProtocolError}
+	if _, err := d.WriteTo(c.config.Conn); err != nil {
+		c.debug.Printf("failed to send DISCONNECT: %s", err)
+	}
+	// This is called from the incoming goroutine (which close waits on) so shutdown is initiated without waiting for
+	// it to complete; the error is reported immediately because handlers may be holding up the shutdown.
+	c.cancelFunc()
+	go c.config.OnClientError(fmt.Errorf("%w: %d", ErrDuplicatePacketID, pb.PacketID))
+	return false
+}
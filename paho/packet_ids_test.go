@@ -17,6 +17,7 @@ package paho
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -67,3 +68,88 @@ func TestPackedIdNoExhaustion(t *testing.T) {
 // Note: We no longer test for Packet Id Exhaustion because the way the CONNACK Receive Maximum now works makes
 // this impossible (the semaphore will lock on the 65536th request and only unlock when a response is received
 // which would also mean an ID is available).
+
+// TestDuplicateInboundPacketID confirms that, with DisconnectOnDuplicatePacketID set, a PUBLISH reusing the packet
+// identifier of an unacknowledged PUBLISH (without DUP set) is treated as a protocol violation
+func TestDuplicateInboundPacketID(t *testing.T) {
+	tests := []struct {
+		name      string
+		duplicate bool // DUP flag on second PUBLISH
+		ackFirst  bool // Acknowledge the first PUBLISH before sending the second
+		wantErr   bool
+	}{
+		{"violation", false, false, true},
+		{"dupFlagSet", true, false, false},
+		{"afterAck", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+			go ts.Run()
+			defer ts.Stop()
+
+			release := make(chan struct{})
+			received := make(chan uint16, 2)
+			clientErr := make(chan error, 10)
+			c := NewClient(ClientConfig{
+				Conn:                          ts.ClientConn(),
+				DisconnectOnDuplicatePacketID: true,
+				OnPublishReceived: []func(PublishReceived) (bool, error){
+					func(pr PublishReceived) (bool, error) {
+						received <- pr.Packet.PacketID
+						<-release // Delay acknowledgement
+						return true, nil
+					},
+				},
+				OnClientError: func(err error) { clientErr <- err },
+			})
+			require.NotNil(t, c)
+			defer c.close()
+			var releaseOnce sync.Once
+			releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+			defer releaseAll() // handlers must be released before c.close can complete
+			_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+			require.NoError(t, err)
+
+			require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 5, QoS: 1, Topic: "test/1", Properties: &packets.Properties{}}))
+			assert.Equal(t, uint16(5), <-received)
+			if tt.ackFirst {
+				release <- struct{}{}
+				require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 1 }, time.Second, 10*time.Millisecond)
+			}
+			require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 5, QoS: 1, Duplicate: tt.duplicate, Topic: "test/2", Properties: &packets.Properties{}}))
+
+			if tt.wantErr {
+				select {
+				case err := <-clientErr:
+					assert.ErrorIs(t, err, ErrDuplicatePacketID)
+				case <-time.After(time.Second):
+					t.Fatal("expected ErrDuplicatePacketID")
+				}
+				releaseAll()
+				select {
+				case <-c.Done():
+				case <-time.After(time.Second):
+					t.Fatal("client did not shutdown")
+				}
+				return
+			}
+			if !tt.ackFirst {
+				release <- struct{}{}
+			}
+			select {
+			case id := <-received:
+				assert.Equal(t, uint16(5), id)
+			case <-time.After(time.Second):
+				t.Fatal("second PUBLISH not received")
+			}
+			releaseAll()
+			select {
+			case err := <-clientErr:
+				t.Fatalf("unexpected error: %s", err)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// JSONContentType is the ContentType set by PublishJSON
+const JSONContentType = "application/json"
+
+// PayloadFormatUTF8 is the PayloadFormat value indicating that the payload is UTF-8 encoded character data
+const PayloadFormatUTF8 byte = 1
+
+var (
+	ErrPayloadFormatNotUTF8 = errors.New("payload format indicator is not UTF-8") // The PayloadFormat property is not set to 1
+	ErrPayloadInvalidUTF8   = errors.New("payload is not valid UTF-8")
+)
+
+// PayloadDecoder provides helpers for decoding the payload of received messages
+type PayloadDecoder struct {
+	// RequireFormatIndicator, if true, causes decoding to fail (with ErrPayloadFormatNotUTF8) unless the message has
+	// the PayloadFormat property set to 1 (UTF-8). If false, the indicator is not checked.
+	RequireFormatIndicator bool
+}
+
+// IsUTF8 returns true if the PayloadFormat property indicates that the payload is UTF-8 encoded character data
+func (p *Publish) IsUTF8() bool {
+	return p.Properties != nil && p.Properties.PayloadFormat != nil && *p.Properties.PayloadFormat == PayloadFormatUTF8
+}
+
+// checkUTF8 confirms that the payload of p is UTF-8 (and that the indicator is set, if required)
+func (d PayloadDecoder) checkUTF8(p *Publish) error {
+	if d.RequireFormatIndicator && !p.IsUTF8() {
+		return fmt.Errorf("%w (topic %s)", ErrPayloadFormatNotUTF8, p.Topic)
+	}
+	if !utf8.Valid(p.Payload) {
+		return fmt.Errorf("%w (topic %s)", ErrPayloadInvalidUTF8, p.Topic)
+	}
+	return nil
+}
+
+// String returns the payload of p as a string (an error is returned if the payload is not valid UTF-8)
+func (d PayloadDecoder) String(p *Publish) (string, error) {
+	if err := d.checkUTF8(p); err != nil {
+		return "", err
+	}
+	return string(p.Payload), nil
+}
+
+// JSON unmarshals the payload of p into v
+func (d PayloadDecoder) JSON(p *Publish, v any) error {
+	if err := d.checkUTF8(p); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(p.Payload, v); err != nil {
+		return fmt.Errorf("failed to decode JSON payload (topic %s): %w", p.Topic, err)
+	}
+	return nil
+}
+
+// PublishJSON encodes v as JSON and publishes it using the other details in p (any Payload in p is ignored).
+// Unless ClientConfig.DisableJSONPublishProperties is set, the ContentType and PayloadFormat properties will be set
+// to "application/json" and 1 (UTF-8) respectively, where they are not already set. p is not modified.
+func (c *Client) PublishJSON(ctx context.Context, p *Publish, v any) (*PublishResponse, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JSON payload: %w", err)
+	}
+	pub := *p
+	pub.Payload = payload
+	if !c.config.DisableJSONPublishProperties {
+		var props PublishProperties
+		if p.Properties != nil {
+			props = *p.Properties
+		}
+		if props.ContentType == "" {
+			props.ContentType = JSONContentType
+		}
+		if props.PayloadFormat == nil {
+			props.PayloadFormat = Byte(PayloadFormatUTF8)
+		}
+		pub.Properties = &props
+	}
+	return c.Publish(ctx, &pub)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// payloadStream supplies the payload of a received PUBLISH directly from the connection (see
+// ClientConfig.StreamPayloadThreshold)
+type payloadStream struct {
+	r    io.Reader
+	once sync.Once
+	done chan struct{} // closed once the payload has been fully read (and the next packet can be read)
+}
+
+// newPayloadStream wraps the PayloadReader in pb (which will be replaced)
+func newPayloadStream(pb *packets.Publish) *payloadStream {
+	ps := &payloadStream{r: pb.PayloadReader, done: make(chan struct{})}
+	pb.PayloadReader = ps
+	return ps
+}
+
+// Read implements io.Reader
+func (ps *payloadStream) Read(p []byte) (int, error) {
+	return ps.r.Read(p)
+}
+
+// finish discards any of the payload that has not been read, and signals that the next packet can be read
+func (ps *payloadStream) finish() {
+	ps.once.Do(func() {
+		_, _ = io.Copy(io.Discard, ps.r) // an error will also be encountered when reading the next packet
+		close(ps.done)
+	})
+}
+
+// finishPayloadStream calls finish if pb has a streamed payload
+func finishPayloadStream(pb *packets.Publish) {
+	if ps, ok := pb.PayloadReader.(*payloadStream); ok {
+		ps.finish()
+	}
+}
+
+// receiveStream passes a PUBLISH with a streamed payload on for processing (as with any other PUBLISH), and then waits
+// until the payload has been consumed, so that the next packet can be read. Returns false if the client is shutting
+// down.
+func (c *Client) receiveStream(ctx context.Context, recv *packets.ControlPacket, stream *payloadStream) bool {
+	defer func() {
+		if c.conn != nil {
+			c.conn.packetRead() // the connection may now be swapped
+		}
+	}()
+	pb := recv.Content.(*packets.Publish)
+	c.debug.Printf("received QoS%d PUBLISH with %d byte streamed payload", pb.QoS, pb.PayloadSize)
+	if pb.QoS > 0 {
+		if c.config.DisconnectOnDuplicatePacketID && !c.checkInboundPacketID(pb) {
+			return false
+		}
+		// The session may not pass the message on (e.g. a duplicate of a QoS2 message already received), in which
+		// case the payload is discarded here.
+		fwd := make(chan *packets.Publish, 1)
+		c.config.Session.PacketReceived(recv, fwd)
+		select {
+		case pb = <-fwd:
+		default:
+			stream.finish()
+			return true
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case c.publishPackets <- pb:
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-stream.done:
+		return true
+	}
+}
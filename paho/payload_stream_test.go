@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamPayload delivers a large payload as a stream, and confirms that the handler reads every byte before the
+// message is acknowledged (and that subsequent packets are read correctly)
+func TestStreamPayload(t *testing.T) {
+	const size = 5 * 1024 * 1024
+	payload := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(payload)
+	wantSum := sha256.Sum256(payload)
+
+	var handlerRead atomic.Int64 // bytes read by the handler when it returned
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	pubackRead := make(chan int64, 1)
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		go func() { // net.Pipe is synchronous so packets must be written concurrently with reading
+			_, _ = (&packets.Publish{PacketID: 1, QoS: 1, Topic: "test/large", Payload: payload, Properties: &packets.Properties{}}).WriteTo(srvConn)
+			_, _ = (&packets.Publish{Topic: "test/small", Payload: []byte("small"), Properties: &packets.Properties{}}).WriteTo(srvConn)
+		}()
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if recv.Type == packets.PUBACK {
+				pubackRead <- handlerRead.Load()
+			}
+		}
+	}()
+
+	type result struct {
+		topic string
+		size  int64
+		sum   []byte
+		small []byte
+	}
+	results := make(chan result, 2)
+	c := NewClient(ClientConfig{
+		Conn:                   cliConn,
+		StreamPayloadThreshold: 1024,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				p := pr.Packet
+				if p.PayloadReader == nil {
+					results <- result{topic: p.Topic, small: p.Payload}
+					return true, nil
+				}
+				h := sha256.New()
+				n, err := io.Copy(h, p.PayloadReader)
+				if err != nil {
+					t.Errorf("failed to read payload: %s", err)
+				}
+				time.Sleep(10 * time.Millisecond) // the PUBACK must not be sent until the handler returns
+				handlerRead.Store(n)
+				results <- result{topic: p.Topic, size: p.PayloadSize, sum: h.Sum(nil)}
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "StreamPayload:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	select {
+	case r := <-results:
+		assert.Equal(t, "test/large", r.topic)
+		assert.Equal(t, int64(size), r.size)
+		assert.True(t, bytes.Equal(wantSum[:], r.sum), "payload read does not match that sent")
+	case <-time.After(5 * time.Second):
+		t.Fatal("large message not received")
+	}
+	select {
+	case n := <-pubackRead:
+		assert.Equal(t, int64(size), n, "PUBACK sent before handler read the payload")
+	case <-time.After(time.Second):
+		t.Fatal("PUBACK not received")
+	}
+	select {
+	case r := <-results:
+		assert.Equal(t, "test/small", r.topic)
+		assert.Equal(t, []byte("small"), r.small)
+	case <-time.After(time.Second):
+		t.Fatal("small message not received")
+	}
+}
+
+// TestStreamPayloadUnread confirms that a payload the handler does not read is discarded
+func TestStreamPayloadUnread(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		go func() {
+			_, _ = (&packets.Publish{Topic: "test/ignored", Payload: make([]byte, 100000), Properties: &packets.Properties{}}).WriteTo(srvConn)
+			_, _ = (&packets.Publish{Topic: "test/next", Payload: make([]byte, 2000), Properties: &packets.Properties{}}).WriteTo(srvConn)
+		}()
+		_, _ = io.Copy(io.Discard, srvConn)
+	}()
+
+	received := make(chan *Publish, 2)
+	c := NewClient(ClientConfig{
+		Conn:                   cliConn,
+		StreamPayloadThreshold: 1024,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "StreamPayloadUnread:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	for _, topic := range []string{"test/ignored", "test/next"} {
+		select {
+		case p := <-received:
+			assert.Equal(t, topic, p.Topic)
+		case <-time.After(time.Second):
+			t.Fatalf("%s not received", topic)
+		}
+	}
+}
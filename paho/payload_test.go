@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/packets"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadDecoder(t *testing.T) {
+	type msg struct {
+		Value int `json:"value"`
+	}
+	withIndicator := &Publish{
+		Topic:      "test/json",
+		Payload:    []byte(`{"value":42}`),
+		Properties: &PublishProperties{PayloadFormat: Byte(PayloadFormatUTF8)},
+	}
+	withoutIndicator := &Publish{
+		Topic:   "test/json",
+		Payload: []byte(`{"value":42}`),
+	}
+	assert.True(t, withIndicator.IsUTF8())
+	assert.False(t, withoutIndicator.IsUTF8())
+
+	// Indicator not required; both should decode
+	var d PayloadDecoder
+	for _, p := range []*Publish{withIndicator, withoutIndicator} {
+		var m msg
+		require.NoError(t, d.JSON(p, &m))
+		assert.Equal(t, 42, m.Value)
+		s, err := d.String(p)
+		require.NoError(t, err)
+		assert.Equal(t, `{"value":42}`, s)
+	}
+
+	// Indicator required
+	d = PayloadDecoder{RequireFormatIndicator: true}
+	var m msg
+	require.NoError(t, d.JSON(withIndicator, &m))
+	assert.Equal(t, 42, m.Value)
+	assert.ErrorIs(t, d.JSON(withoutIndicator, &m), ErrPayloadFormatNotUTF8)
+	_, err := d.String(withoutIndicator)
+	assert.ErrorIs(t, err, ErrPayloadFormatNotUTF8)
+
+	// Invalid UTF-8 and invalid JSON
+	invalid := &Publish{Topic: "test/json", Payload: []byte{0xff, 0xfe}, Properties: &PublishProperties{PayloadFormat: Byte(PayloadFormatUTF8)}}
+	assert.ErrorIs(t, d.JSON(invalid, &m), ErrPayloadInvalidUTF8)
+	notJSON := &Publish{Topic: "test/json", Payload: []byte("not json"), Properties: &PublishProperties{PayloadFormat: Byte(PayloadFormatUTF8)}}
+	assert.Error(t, d.JSON(notJSON, &m))
+}
+
+func TestPublishJSON(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		clientConn, serverConn := net.Pipe()
+
+		c := NewClient(ClientConfig{
+			Conn:                         clientConn,
+			DisableJSONPublishProperties: disable,
+		})
+		require.NotNil(t, c)
+		basicClientInitialisation(c)
+
+		received := make(chan *packets.Publish, 1)
+		go func() {
+			defer close(received)
+			for {
+				recv, err := packets.ReadPacket(serverConn)
+				if err != nil {
+					return
+				}
+				if p, ok := recv.Content.(*packets.Publish); ok {
+					received <- p
+				}
+			}
+		}()
+
+		p := &Publish{Topic: "test/json"}
+		_, err := c.PublishJSON(context.Background(), p, map[string]int{"value": 42})
+		require.NoError(t, err)
+		assert.Nil(t, p.Properties) // the users Publish should not be modified
+		assert.Nil(t, p.Payload)
+
+		pb := <-received
+		assert.JSONEq(t, `{"value":42}`, string(pb.Payload))
+		if disable {
+			assert.Empty(t, pb.Properties.ContentType)
+			assert.Nil(t, pb.Properties.PayloadFormat)
+		} else {
+			assert.Equal(t, JSONContentType, pb.Properties.ContentType)
+			require.NotNil(t, pb.Properties.PayloadFormat)
+			assert.Equal(t, PayloadFormatUTF8, *pb.Properties.PayloadFormat)
+		}
+		c.close()
+		serverConn.Close()
+	}
+}
@@ -18,6 +18,7 @@ package paho
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -47,11 +48,38 @@ type Pinger interface {
 	SetDebug(log.Logger)
 }
 
+// UnsolicitedPingRespPolicy determines how DefaultPinger handles a PINGRESP that is received when no PINGREQ is
+// outstanding (this may indicate a broker bug or tampering with the connection).
+type UnsolicitedPingRespPolicy int
+
+const (
+	UnsolicitedPingRespIgnore     UnsolicitedPingRespPolicy = iota // Treat the PINGRESP as normal (default)
+	UnsolicitedPingRespLog                                         // Log the PINGRESP (to the debug logger)
+	UnsolicitedPingRespDisconnect                                  // Run returns an error (which will close the connection)
+)
+
 // DefaultPinger is the default implementation of Pinger.
 type DefaultPinger struct {
 	lastPacketSent     time.Time
 	lastPacketReceived time.Time
 	lastPingResponse   time.Time
+	lastPingSent       time.Time // time the most recent PINGREQ was written
+	pingOutstanding    bool      // true if a PINGREQ has been sent and the PINGRESP not yet received
+
+	lastRTT    time.Duration // round trip time of the most recent PINGREQ/PINGRESP exchange (0 = no response yet)
+	averageRTT time.Duration // exponentially weighted moving average of the round trip time
+	rttAlpha   float64       // weight given to the most recent sample when calculating averageRTT
+
+	missedPings  uint64            // number of PINGREQ for which no PINGRESP was received in time
+	statsHandler func(PingerStats) // called (without p.mu held) when a PINGREQ is sent or a PINGRESP received
+
+	unsolicitedPingRespPolicy UnsolicitedPingRespPolicy
+	initialGracePeriod        time.Duration // Additional time allowed for the response to the first PINGREQ
+	noInitialPing             bool          // If true the first PINGREQ is sent after keepalive (rather than immediately)
+	jitter                    float64       // Fraction by which the interval between PINGREQs is randomly varied (0 = none)
+	responseTimeout           time.Duration // Time allowed for a PINGRESP to be received (0 = keepalive interval)
+	unsolicitedPingResp       chan error    // Used to pass an error to Run when UnsolicitedPingRespDisconnect is in use
+	keepAliveUpdate           chan uint16   // Used to pass a new keepalive to Run (see UpdateKeepAlive)
 
 	debug log.Logger
 
@@ -60,10 +88,25 @@ type DefaultPinger struct {
 	mu sync.Mutex // Protects all of the above
 }
 
+// PingerStats provides a snapshot of the DefaultPinger state (passed to the handler set with SetStatsHandler)
+type PingerStats struct {
+	LastPacketSent     time.Time // When a packet was last sent to the server
+	LastPacketReceived time.Time // When a packet was last received from the server
+	LastPingSent       time.Time // When the most recent PINGREQ was sent
+	LastPingResponse   time.Time // When the most recent PINGRESP was received
+	MissedPings        uint64    // The number of PINGREQ that timed out (cumulative over all calls to Run)
+}
+
+// defaultRTTAlpha is the default weight given to each new sample when calculating AverageRTT (as per TCP's SRTT)
+const defaultRTTAlpha = 0.125
+
 // NewDefaultPinger creates a DefaultPinger
 func NewDefaultPinger() *DefaultPinger {
 	return &DefaultPinger{
-		debug: log.NOOPLogger{},
+		debug:               log.NOOPLogger{},
+		unsolicitedPingResp: make(chan error, 1),
+		keepAliveUpdate:     make(chan uint16, 1),
+		rttAlpha:            defaultRTTAlpha,
 	}
 }
 
@@ -82,6 +125,16 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 		return fmt.Errorf("Run() already in progress")
 	}
 	p.running = true
+	p.pingOutstanding = false
+	p.lastRTT, p.averageRTT = 0, 0 // RTT metrics are per connection
+	select {
+	case <-p.unsolicitedPingResp: // discard any error from a previous connection
+	default:
+	}
+	select {
+	case <-p.keepAliveUpdate: // discard any update intended for a previous connection
+	default:
+	}
 	p.mu.Unlock()
 	defer func() {
 		p.mu.Lock()
@@ -90,10 +143,26 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 	}()
 
 	interval := time.Duration(keepAlive) * time.Second
-	timer := time.NewTimer(0) // Immediately send first pingreq
+	p.mu.Lock()
+	gracePeriod := p.initialGracePeriod // only applies to the first PINGREQ
+	var firstPing time.Duration         // By default, immediately send first pingreq
+	if p.noInitialPing {
+		firstPing = interval
+	}
+	configuredResponseTimeout := p.responseTimeout
+	responseTimeout := configuredResponseTimeout
+	if responseTimeout == 0 {
+		responseTimeout = interval
+	}
+	p.mu.Unlock()
+	runStart := time.Now()
+	timer := time.NewTimer(firstPing)
 	// If timer is not stopped, it cannot be garbage collected until it fires.
 	defer timer.Stop()
 	var lastPingSent time.Time
+	var pingDeadline time.Time      // PINGRESP must be received by this time (response timeout; not jittered)
+	var nextPing time.Time          // the next PINGREQ should not be sent before this time (may be jittered)
+	var lastPingGrace time.Duration // grace period that applied to the PINGREQ sent at lastPingSent
 	// errCh should be buffered, so that the goroutine sending the error does not block if the context is cancelled
 	errCh := make(chan error, 1)
 	for {
@@ -116,16 +185,35 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 			p.mu.Unlock()
 
 			if !lastPingSent.IsZero() && lastPingSent.After(lastPingResponse) {
+				if t.Before(pingDeadline) { // timer was jittered; the response is not yet overdue
+					timer.Reset(pingDeadline.Sub(t))
+					continue
+				}
+				p.mu.Lock()
+				p.missedPings++
+				p.mu.Unlock()
 				p.debug.Printf("DefaultPinger PINGRESP timeout")
 				return fmt.Errorf("PINGRESP timed out")
 			}
 
+			if t.Before(nextPing) { // timer fired at the response deadline; wait for the (jittered) time the ping is due
+				timer.Reset(nextPing.Sub(t))
+				continue
+			}
 			if t.Before(pingDue) {
 				// A Control Packet has been sent since we last checked, meaning the ping can be delayed
-				timer.Reset(pingDue.Sub(t))
+				timer.Reset(p.jittered(pingDue.Sub(t)))
 				continue
 			}
 			lastPingSent = time.Now()
+			p.mu.Lock()
+			p.pingOutstanding = true
+			p.lastPingSent = lastPingSent
+			handler, stats := p.statsHandler, p.stats()
+			p.mu.Unlock()
+			if handler != nil {
+				handler(stats)
+			}
 			go func() {
 				// WriteTo may not complete within KeepAlive period due to slow/unstable network.
 				// For instance, if a huge message is sent over a very slow link at the same time as PINGREQ packet,
@@ -136,9 +224,37 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 					errCh <- fmt.Errorf("failed to send PINGREQ: %w", err)
 				}
 			}()
-			timer.Reset(interval)
+			// The response must be received within the response timeout (by default the nominal keepalive period), but the
+			// next PINGREQ may be sent earlier or later if jitter is in use. The timer fires at whichever comes first
+			// (if the response is still outstanding when the next PINGREQ is due, it will be delayed until the deadline).
+			lastPingGrace = gracePeriod
+			pingDeadline = lastPingSent.Add(responseTimeout + gracePeriod)
+			nextPing = lastPingSent.Add(p.jittered(interval) + gracePeriod)
+			if nextPing.Before(pingDeadline) {
+				timer.Reset(nextPing.Sub(lastPingSent))
+			} else {
+				timer.Reset(pingDeadline.Sub(lastPingSent))
+			}
+			gracePeriod = 0
+		case ka := <-p.keepAliveUpdate:
+			p.debug.Printf("DefaultPinger keepalive updated to %d seconds", ka)
+			interval = time.Duration(ka) * time.Second
+			if configuredResponseTimeout == 0 {
+				responseTimeout = interval
+			}
+			if lastPingSent.IsZero() {
+				if firstPing > 0 { // first PINGREQ has not been sent yet (SetSendInitialPing(false))
+					nextPing = runStart.Add(interval)
+				}
+			} else {
+				pingDeadline = lastPingSent.Add(responseTimeout + lastPingGrace)
+				nextPing = lastPingSent.Add(p.jittered(interval) + lastPingGrace)
+			}
+			timer.Reset(0) // the timer handler will work out when the next PINGREQ is due
 		case err := <-errCh:
 			return err
+		case err := <-p.unsolicitedPingResp:
+			return err
 		}
 	}
 }
@@ -157,8 +273,190 @@ func (p *DefaultPinger) PacketReceived() {
 
 func (p *DefaultPinger) PingResp() {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	if !p.pingResp() {
+		p.mu.Unlock()
+		return
+	}
+	handler, stats := p.statsHandler, p.stats()
+	p.mu.Unlock()
+	if handler != nil {
+		handler(stats) // must not be called with p.mu held (the handler may call back into the pinger)
+	}
+}
+
+// pingResp processes a PINGRESP; returns false if the response was rejected (due to the unsolicited PINGRESP policy)
+// caller must hold p.mu
+func (p *DefaultPinger) pingResp() bool {
+	if !p.pingOutstanding {
+		switch p.unsolicitedPingRespPolicy {
+		case UnsolicitedPingRespLog:
+			p.debug.Println("DefaultPinger received unsolicited PINGRESP")
+		case UnsolicitedPingRespDisconnect:
+			p.debug.Println("DefaultPinger received unsolicited PINGRESP; disconnecting")
+			select {
+			case p.unsolicitedPingResp <- fmt.Errorf("unsolicited PINGRESP received"):
+			default: // error already pending
+			}
+			return false
+		}
+	}
+	if p.pingOutstanding && !p.lastPingSent.IsZero() {
+		p.recordRTT(time.Since(p.lastPingSent))
+	}
+	p.pingOutstanding = false
 	p.lastPingResponse = time.Now()
+	return true
+}
+
+// stats returns a snapshot of the pinger state
+// caller must hold p.mu
+func (p *DefaultPinger) stats() PingerStats {
+	return PingerStats{
+		LastPacketSent:     p.lastPacketSent,
+		LastPacketReceived: p.lastPacketReceived,
+		LastPingSent:       p.lastPingSent,
+		LastPingResponse:   p.lastPingResponse,
+		MissedPings:        p.missedPings,
+	}
+}
+
+// recordRTT updates the round trip time metrics with a new sample
+// caller must hold p.mu
+func (p *DefaultPinger) recordRTT(rtt time.Duration) {
+	p.lastRTT = rtt
+	if p.averageRTT == 0 {
+		p.averageRTT = rtt // first sample
+		return
+	}
+	p.averageRTT = time.Duration(p.rttAlpha*float64(rtt) + (1-p.rttAlpha)*float64(p.averageRTT))
+}
+
+// LastRTT returns the round trip time of the most recent PINGREQ/PINGRESP exchange (the time between the PINGREQ
+// being sent and PingResp being called). Zero is returned if no PINGRESP has been received on the current connection.
+func (p *DefaultPinger) LastRTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastRTT
+}
+
+// AverageRTT returns an exponentially weighted moving average of the PINGREQ/PINGRESP round trip time (see
+// SetRTTAlpha). Zero is returned if no PINGRESP has been received on the current connection.
+func (p *DefaultPinger) AverageRTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.averageRTT
+}
+
+// SetRTTAlpha sets the weight (0 < alpha <= 1) given to each new sample when calculating AverageRTT; higher values
+// make the average more responsive to change. Defaults to 0.125. Values outside the permitted range are ignored.
+func (p *DefaultPinger) SetRTTAlpha(alpha float64) {
+	if alpha <= 0 || alpha > 1 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rttAlpha = alpha
+}
+
+// SetInitialPingGracePeriod sets an additional period, beyond keepalive, that the server is allowed to respond to
+// the first PINGREQ (which is sent as soon as Run is called). This may be useful where the server is slow to respond
+// immediately following connection.
+// It is not thread-safe and must be called before Run() to avoid race conditions.
+func (p *DefaultPinger) SetInitialPingGracePeriod(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initialGracePeriod = d
+}
+
+// SetSendInitialPing determines whether a PINGREQ is sent as soon as Run is called (the default). If false, the first
+// PINGREQ will be sent once the keepalive period has elapsed (and then only if required). This is a
+// broker-compatibility option; some brokers handle a PINGREQ immediately following the CONNECT poorly.
+// It is not thread-safe and must be called before Run() to avoid race conditions.
+func (p *DefaultPinger) SetSendInitialPing(send bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.noInitialPing = !send
+}
+
+// SetJitter sets the fraction (0 <= jitter < 1) by which the interval between PINGREQ packets is randomly varied
+// (e.g. 0.1 varies the interval by up to ±10%). The interval is recalculated each time the timer is reset, meaning
+// that clients that connected at the same time (e.g. following a server restart) will gradually desynchronise.
+// Jitter does not impact the PINGRESP timeout (a response must still be received within the keepalive period).
+// Defaults to 0 (no jitter); values outside the permitted range are ignored.
+// It is not thread-safe and must be called before Run() to avoid race conditions.
+func (p *DefaultPinger) SetJitter(jitter float64) {
+	if jitter < 0 || jitter >= 1 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jitter = jitter
+}
+
+// UpdateKeepAlive changes the keepalive interval used by an active call to Run, and recalculates when the next
+// PINGREQ is due. It is intended for use where a keepalive other than that passed to Run needs to be applied, for
+// example where the CONNACK (which may include a Server Keep Alive that overrides the keepalive requested in the
+// CONNECT) is processed after Run has been called; it should be called from the CONNACK handling path. Note that
+// paho.Client already passes the Server Keep Alive (if any) to Run, so there is no need to call this when using Client.
+// A keepAlive of 0 is ignored (pinging cannot be disabled once Run has been called), as are calls made when Run is not
+// in progress.
+func (p *DefaultPinger) UpdateKeepAlive(keepAlive uint16) {
+	if keepAlive == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return
+	}
+	select { // replace any pending update (only the most recent value matters)
+	case <-p.keepAliveUpdate:
+	default:
+	}
+	p.keepAliveUpdate <- keepAlive
+}
+
+// SetResponseTimeout sets the time allowed for a PINGRESP to be received following a PINGREQ being sent (after which
+// Run will return an error, leading to the connection being closed). Whilst a PINGRESP is outstanding, no further
+// PINGREQ will be sent. A longer timeout may be useful on high latency links (e.g. satellite), but note that the
+// server may close the connection if it receives no packets within 1.5 times the keepalive period.
+// Defaults to 0, meaning the keepalive interval is used (so a PINGRESP must be received before the next PINGREQ is due).
+// It is not thread-safe and must be called before Run() to avoid race conditions.
+func (p *DefaultPinger) SetResponseTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responseTimeout = d
+}
+
+// jittered returns d randomly adjusted by up to ±jitter (see SetJitter)
+func (p *DefaultPinger) jittered(d time.Duration) time.Duration {
+	p.mu.Lock()
+	jitter := p.jitter
+	p.mu.Unlock()
+	if jitter == 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// SetUnsolicitedPingRespPolicy sets how a PINGRESP received when no PINGREQ is outstanding will be handled
+// (defaults to UnsolicitedPingRespIgnore).
+// It is not thread-safe and must be called before Run() to avoid race conditions.
+func (p *DefaultPinger) SetUnsolicitedPingRespPolicy(policy UnsolicitedPingRespPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unsolicitedPingRespPolicy = policy
+}
+
+// SetStatsHandler sets a function that will be called with a snapshot of the pinger state each time a PINGREQ is
+// sent, and each time PingResp is called. The handler is not called while internal locks are held, so it may call
+// other DefaultPinger methods, but it should return quickly (it is called from the goroutine running Run or calling
+// PingResp). Pass nil to remove the handler.
+// It is not thread-safe and must be called before Run() to avoid race conditions.
+func (p *DefaultPinger) SetStatsHandler(handler func(PingerStats)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statsHandler = handler
 }
 
 func (p *DefaultPinger) SetDebug(debug log.Logger) {
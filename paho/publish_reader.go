@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// PublishReader publishes a message to topic with a payload of size bytes read from r. For QoS 0 the payload is
+// streamed from r directly to the connection, so it need not be held in memory (the PublishHook, if any, is passed a
+// Publish with a nil Payload, and outbound topic aliases are not applied). Streaming requires multiple writes, so is
+// only possible where ClientConfig.Conn implements sync.Locker (e.g. packets.NewThreadSafeConn, or EnableConnSwap is
+// set); otherwise other packets could be interleaved with the payload. QoS 1 and 2 messages must be retained in the
+// session state until acknowledged (so they can be retransmitted). In these cases the payload is read into memory and
+// the message published as with Publish.
+// If r returns fewer than size bytes, a QoS 0 message will have been partially written, so the connection is closed
+// (and the error will be passed to OnClientError).
+func (c *Client) PublishReader(ctx context.Context, topic string, qos byte, r io.Reader, size int64) (*PublishResponse, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: payload size %d is negative", ErrInvalidArguments, size)
+	}
+	if _, ok := c.config.Conn.(sync.Locker); qos > 0 || !ok {
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, fmt.Errorf("failed to read payload: %w", err)
+		}
+		return c.Publish(ctx, &Publish{Topic: topic, QoS: qos, Payload: payload})
+	}
+
+	pb, err := c.preparePublish(&Publish{Topic: topic})
+	if err != nil {
+		return nil, err
+	}
+	if pb.QoS != 0 {
+		return nil, fmt.Errorf("%w: PublishHook cannot change the QoS of a streamed message", ErrInvalidArguments)
+	}
+	if err := c.checkPacketSize(pb, size); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.debug.Printf("streaming %d byte QoS0 message", size)
+	if _, err := pb.WriteStreamTo(c.config.Conn, r, size); err != nil {
+		if errors.Is(err, packets.ErrPayloadSize) { // Nothing has been written
+			return nil, fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+		}
+		go c.error(err)
+		return nil, err
+	}
+	c.config.PingHandler.PacketSent()
+	return &PublishResponse{}, nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPublishReader publishes large payloads from an io.Reader and confirms the server receives every byte
+func TestPublishReader(t *testing.T) {
+	t.Run("stream", func(t *testing.T) { testPublishReader(t, true) })
+	t.Run("buffer", func(t *testing.T) { testPublishReader(t, false) }) // Connection does not support streaming
+}
+
+// testPublishReader implements TestPublishReader; if threadSafe the connection supports streaming
+func testPublishReader(t *testing.T, threadSafe bool) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	received := make(chan *packets.Publish, 1)
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				if p.QoS == 1 {
+					if _, err = (&packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+						return
+					}
+				}
+				received <- p
+			}
+		}
+	}()
+
+	var conn net.Conn = cliConn
+	if threadSafe {
+		conn = packets.NewThreadSafeConn(cliConn)
+	}
+	c := NewClient(ClientConfig{Conn: conn})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "PublishReader:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	const size = 5 * 1024 * 1024
+	for _, qos := range []byte{0, 1} {
+		h := sha256.New()
+		r := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(int64(qos))), size), h)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := c.PublishReader(ctx, "test/large", qos, r, size)
+		cancel()
+		require.NoError(t, err)
+
+		select {
+		case p := <-received:
+			assert.Equal(t, "test/large", p.Topic)
+			assert.Equal(t, qos, p.QoS)
+			require.Len(t, p.Payload, size)
+			sum := sha256.Sum256(p.Payload)
+			assert.True(t, bytes.Equal(sum[:], h.Sum(nil)), "payload received does not match that sent")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("QoS%d PUBLISH not received", qos)
+		}
+	}
+
+	_, err = c.PublishReader(context.Background(), "test/large", 0, bytes.NewReader(nil), -1)
+	assert.ErrorIs(t, err, ErrInvalidArguments)
+}
+
+// TestPublishReaderShort confirms that the connection is closed if the reader does not supply the specified number of
+// bytes (a partial packet has been written)
+func TestPublishReaderShort(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, srvConn)
+	}()
+
+	clientErr := make(chan error, 1)
+	c := NewClient(ClientConfig{
+		Conn:          packets.NewThreadSafeConn(cliConn),
+		OnClientError: func(err error) { clientErr <- err },
+	})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "PublishReaderShort:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	_, err = c.PublishReader(context.Background(), "test/short", 0, bytes.NewReader([]byte("short")), 100)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	select {
+	case err := <-clientErr:
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	case <-time.After(time.Second):
+		t.Fatal("OnClientError not called")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not shut down")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// ErrReceiveMaximumExceeded is passed to OnClientError when the server sends a QoS1/2 PUBLISH whilst the number of
+// unacknowledged QoS1/2 PUBLISH packets it has sent equals the ReceiveMaximum from the CONNECT (see
+// ReceiveMaximumPolicy).
+var ErrReceiveMaximumExceeded = errors.New("server exceeded receive maximum")
+
+// defaultReceiveMaximumBufferTimeout is used when ReceiveMaximumBufferTimeout is 0
+const defaultReceiveMaximumBufferTimeout = time.Second
+
+// ReceiveMaximumPolicy determines how a QoS1/2 PUBLISH received when the server has exceeded the clients Receive
+// Maximum (i.e. no inbound capacity remains) is handled.
+type ReceiveMaximumPolicy int
+
+const (
+	// ReceiveMaximumIgnore passes messages on regardless of the Receive Maximum (this is the default)
+	ReceiveMaximumIgnore ReceiveMaximumPolicy = iota
+	// ReceiveMaximumDisconnect treats a PUBLISH exceeding the Receive Maximum as a protocol violation; the connection
+	// is closed (reason code 0x93) and ErrReceiveMaximumExceeded passed to OnClientError.
+	ReceiveMaximumDisconnect
+	// ReceiveMaximumBuffer holds messages exceeding the Receive Maximum (up to Receive Maximum of them) until capacity
+	// becomes available (as earlier messages are acknowledged), at which point they are processed in the order
+	// received. If capacity does not become available within ReceiveMaximumBufferTimeout (or the buffer is full) the
+	// connection is closed as with ReceiveMaximumDisconnect.
+	ReceiveMaximumBuffer
+)
+
+// bufferedPublish is a PUBLISH held until inbound capacity becomes available
+type bufferedPublish struct {
+	recv     *packets.ControlPacket
+	deadline time.Time
+}
+
+// inboundQuota tracks QoS1/2 PUBLISH packets received from the server that have not been fully acknowledged, in
+// order to enforce the Receive Maximum sent in the CONNECT (see ReceiveMaximumPolicy).
+type inboundQuota struct {
+	mu       sync.Mutex
+	max      int
+	ids      map[uint16]struct{} // packet IDs of messages passed to the session and not yet fully acknowledged
+	pending  []bufferedPublish   // messages awaiting capacity (ReceiveMaximumBuffer only)
+	running  bool                // true whilst releaseBuffered is running
+	released chan struct{}       // signalled when capacity may have become available
+}
+
+// reset prepares the quota for a new connection
+func (q *inboundQuota) reset(max uint16) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.max = int(max)
+	q.ids = make(map[uint16]struct{})
+	q.pending = nil
+	q.released = make(chan struct{}, 1)
+}
+
+// admit returns true, having recorded the packet identifier, if a PUBLISH with id can be passed to the session. A
+// message already being tracked (i.e. a retransmission) is always admitted. Returns false if no capacity remains, or
+// earlier messages are buffered (so must be processed first).
+func (q *inboundQuota) admit(id uint16) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.ids[id]; ok {
+		return true
+	}
+	if len(q.pending) > 0 || len(q.ids) >= q.max {
+		return false
+	}
+	q.ids[id] = struct{}{}
+	return true
+}
+
+// buffer adds recv to the messages awaiting capacity, returning false if the buffer is full. start will be true if
+// releaseBuffered needs to be started.
+func (q *inboundQuota) buffer(recv *packets.ControlPacket, timeout time.Duration) (ok bool, start bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= q.max {
+		return false, false
+	}
+	q.pending = append(q.pending, bufferedPublish{recv: recv, deadline: time.Now().Add(timeout)})
+	start = !q.running
+	q.running = true
+	return true, start
+}
+
+// remove records that the message with the specified id has been fully acknowledged
+func (q *inboundQuota) remove(id uint16) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.ids[id]; !ok {
+		return
+	}
+	delete(q.ids, id)
+	select {
+	case q.released <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the first buffered message, and whether there is capacity to process it (in which case its
+// identifier is recorded). The message remains buffered (so later messages are not processed ahead of it) until
+// dispatched is called. Returns nil (and flags that releaseBuffered has exited) if nothing is buffered.
+func (q *inboundQuota) next() (*bufferedPublish, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		q.running = false
+		return nil, false
+	}
+	bp := &q.pending[0]
+	if len(q.ids) >= q.max {
+		return bp, false
+	}
+	q.ids[bp.recv.PacketID()] = struct{}{}
+	return bp, true
+}
+
+// dispatched removes the first buffered message (which has been passed to the session)
+func (q *inboundQuota) dispatched() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = q.pending[1:]
+}
+
+// stop flags that releaseBuffered has exited without processing the buffer
+func (q *inboundQuota) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running = false
+}
+
+// checkInboundQuota applies the ReceiveMaximumPolicy to a QoS1/2 PUBLISH received from the server, returning true if
+// the message should be passed to the session now. Otherwise the message has been buffered (only if canBuffer is
+// true), and will be passed to the session by releaseBuffered (which must be started in a new goroutine if start is
+// true), or the connection is being closed.
+func (c *Client) checkInboundQuota(recv *packets.ControlPacket, canBuffer bool) (ok bool, start bool) {
+	if c.inboundQuota.admit(recv.PacketID()) {
+		return true, false
+	}
+	if canBuffer && c.config.ReceiveMaximumPolicy == ReceiveMaximumBuffer {
+		timeout := c.config.ReceiveMaximumBufferTimeout
+		if timeout <= 0 {
+			timeout = defaultReceiveMaximumBufferTimeout
+		}
+		var buffered bool
+		if buffered, start = c.inboundQuota.buffer(recv, timeout); buffered {
+			c.debug.Printf("received PUBLISH %d exceeding receive maximum, buffering", recv.PacketID())
+			return false, start
+		}
+	}
+	c.receiveMaximumExceeded(recv.PacketID())
+	return false, false
+}
+
+// releaseBuffered passes buffered messages to the session as capacity becomes available, closing the connection if
+// a message remains buffered beyond its deadline. Exits when the buffer is empty, or stop is closed.
+func (c *Client) releaseBuffered(stop <-chan struct{}) {
+	for {
+		bp, ok := c.inboundQuota.next()
+		if bp == nil {
+			return
+		}
+		if ok {
+			c.debug.Printf("receive maximum capacity available, processing buffered PUBLISH %d", bp.recv.PacketID())
+			c.config.Session.PacketReceived(bp.recv, c.publishPackets)
+			c.inboundQuota.dispatched()
+			continue
+		}
+		timer := time.NewTimer(time.Until(bp.deadline))
+		select {
+		case <-stop:
+			timer.Stop()
+			c.inboundQuota.stop()
+			return
+		case <-c.inboundQuota.released:
+			timer.Stop()
+		case <-timer.C:
+			c.inboundQuota.stop()
+			c.receiveMaximumExceeded(bp.recv.PacketID())
+			return
+		}
+	}
+}
+
+// receiveMaximumExceeded initiates a disconnection with reason code 0x93 (Receive Maximum exceeded)
+func (c *Client) receiveMaximumExceeded(id uint16) {
+	c.debug.Printf("received PUBLISH %d exceeding receive maximum, disconnecting", id)
+	d := packets.Disconnect{ReasonCode: packets.DisconnectReceiveMaximumExceeded}
+	if _, err := d.WriteTo(c.config.Conn); err != nil {
+		c.debug.Printf("failed to send DISCONNECT: %s", err)
+	}
+	// This may be called from the incoming goroutine (which close waits on) so shutdown is initiated without waiting
+	// for it to complete.
+	c.cancelFunc()
+	go c.config.OnClientError(fmt.Errorf("%w: %d", ErrReceiveMaximumExceeded, id))
+}
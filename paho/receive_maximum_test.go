@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReceiveMaximumPolicy confirms that a QoS2 PUBLISH received when the server has exceeded the Receive Maximum
+// sent in the CONNECT is handled in accordance with the ReceiveMaximumPolicy
+func TestReceiveMaximumPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ReceiveMaximumPolicy
+		release bool // send PUBREL for the first message (freeing capacity)
+		wantErr bool
+	}{
+		{"disconnect", ReceiveMaximumDisconnect, false, true},
+		{"buffer", ReceiveMaximumBuffer, true, false},
+		{"bufferTimeout", ReceiveMaximumBuffer, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+			go ts.Run()
+			defer ts.Stop()
+
+			received := make(chan uint16, 2)
+			clientErr := make(chan error, 10)
+			c := NewClient(ClientConfig{
+				Conn:                        ts.ClientConn(),
+				ReceiveMaximumPolicy:        tt.policy,
+				ReceiveMaximumBufferTimeout: 200 * time.Millisecond,
+				OnPublishReceived: []func(PublishReceived) (bool, error){
+					func(pr PublishReceived) (bool, error) {
+						received <- pr.Packet.PacketID
+						return true, nil
+					},
+				},
+				OnClientError: func(err error) { clientErr <- err },
+			})
+			require.NotNil(t, c)
+			defer c.close()
+			_, err := c.Connect(context.Background(), &Connect{
+				ClientID:   "testClient",
+				CleanStart: true,
+				Properties: &ConnectProperties{ReceiveMaximum: Uint16(1)},
+			})
+			require.NoError(t, err)
+
+			for _, id := range []uint16{1, 2} {
+				require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: id, QoS: 2, Topic: "test/1", Properties: &packets.Properties{}}))
+			}
+			assert.Equal(t, uint16(1), <-received)
+			require.Eventually(t, func() bool { return len(ts.ReceivedPubrecs()) == 1 }, time.Second, 10*time.Millisecond)
+
+			if tt.release {
+				select {
+				case id := <-received:
+					t.Fatalf("PUBLISH %d exceeding receive maximum processed before capacity available", id)
+				case <-time.After(50 * time.Millisecond):
+				}
+				require.NoError(t, ts.SendPacket(&packets.Pubrel{PacketID: 1, Properties: &packets.Properties{}}))
+			}
+
+			if tt.wantErr {
+				select {
+				case err := <-clientErr:
+					assert.ErrorIs(t, err, ErrReceiveMaximumExceeded)
+				case <-time.After(time.Second):
+					t.Fatal("expected ErrReceiveMaximumExceeded")
+				}
+				select {
+				case <-c.Done():
+				case <-time.After(time.Second):
+					t.Fatal("client did not shutdown")
+				}
+				assert.Len(t, received, 0)
+				return
+			}
+			select {
+			case id := <-received:
+				assert.Equal(t, uint16(2), id)
+			case <-time.After(time.Second):
+				t.Fatal("buffered PUBLISH not received")
+			}
+			require.Eventually(t, func() bool { return len(ts.ReceivedPubrecs()) == 2 }, time.Second, 10*time.Millisecond)
+			select {
+			case err := <-clientErr:
+				t.Fatalf("unexpected error: %s", err)
+			default:
+			}
+		})
+	}
+}
@@ -16,8 +16,13 @@
 package paho
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rtalhouk/paho.golang/packets"
 	"github.com/rtalhouk/paho.golang/paho/log"
@@ -28,38 +33,116 @@ import (
 // MessageHandlers should complete quickly (start a go routine for
 // long-running processes) and should not call functions within the
 // paho instance that triggered them (due to potential deadlocks).
+// The QoS at which the message was delivered (from the PUBLISH fixed header; this may be lower than the QoS requested
+// when subscribing) is available in Publish.QoS (see also QoSMessageHandler).
 type MessageHandler func(*Publish)
 
+// QoSMessageHandler is a MessageHandler that is also passed the QoS at which the message was delivered (taken from the
+// PUBLISH fixed header, so reflecting any downgrade by the server, rather than the QoS requested when subscribing).
+type QoSMessageHandler func(qos byte, p *Publish)
+
+// ErrHandlerPanic is wrapped by the HandlerError passed to the StandardRouter's handler error callback when a
+// MessageHandler panics
+var ErrHandlerPanic = errors.New("message handler panicked")
+
+// HandlerError reports a failure in a MessageHandler called by StandardRouter (see SetHandlerErrorCallback)
+type HandlerError struct {
+	Topic    string
+	PacketID uint16
+	Err      error
+}
+
+// Error implements error
+func (e HandlerError) Error() string {
+	return fmt.Sprintf("handler for message %d on topic %s failed: %s", e.PacketID, e.Topic, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e HandlerError) Unwrap() error {
+	return e.Err
+}
+
 // Router is an interface of the functions for a struct that is
 // used to handle invoking MessageHandlers depending on the
 // the topic the message was published on.
 // RegisterHandler() takes a string of the topic, and a MessageHandler
-// to be invoked when Publishes are received that match that topic
+// to be invoked when Publishes are received that match that topic, and
+// returns a HandlerHandle that can be used to remove that handler
 // UnregisterHandler() takes a string of the topic to remove
 // MessageHandlers for
 // Route() takes a Publish message and determines which MessageHandlers
 // should be invoked
 type Router interface {
-	RegisterHandler(string, MessageHandler)
+	RegisterHandler(string, MessageHandler) HandlerHandle
 	UnregisterHandler(string)
 	Route(*packets.Publish)
 	SetDebugLogger(log.Logger)
 }
 
+// HandlerHandle identifies a MessageHandler registered with a Router
+type HandlerHandle interface {
+	// Unregister removes the handler (other handlers registered for the same topic filter are unaffected). Calling
+	// Unregister more than once has no effect.
+	Unregister()
+}
+
+// RouteMode determines which handlers StandardRouter calls when a message matches multiple topic filters
+type RouteMode int
+
+const (
+	// RouteAll calls the handlers for every matching filter, in the order in which the filters were first registered
+	// (this is the default).
+	RouteAll RouteMode = iota
+	// RouteAllBySpecificity calls the handlers for every matching filter, most specific filter first (see
+	// RouteMostSpecific). Filters of equal specificity are called in the order in which they were first registered.
+	RouteAllBySpecificity
+	// RouteMostSpecific calls only the handlers for the most specific matching filter. Filters are compared level by
+	// level, from the left, with an exact level being more specific than "+" (single-level wildcard), which is more
+	// specific than "#" (multi-level wildcard); so "sensors/kitchen/temp" > "sensors/+/temp" > "sensors/#".
+	RouteMostSpecific
+)
+
 // StandardRouter is a library provided implementation of a Router that
-// allows for unique and multiple MessageHandlers per topic
+// allows for unique and multiple MessageHandlers per topic.
+// Handlers are registered against MQTT topic filters, so may use the "+" (single level) and "#" (multi-level)
+// wildcards; filters starting with a wildcard do not match topics beginning with "$" (e.g. "$SYS/...").
+// Where a message matches multiple topic filters, handlers are called in the order in which the filters were first
+// registered (and, for each filter, in the order the handlers were registered); use SetRouteMode to change this.
+// Handlers registered with RegisterSubscriptionHandler are, where possible, selected using the Subscription Identifier
+// in the PUBLISH rather than by topic matching.
 type StandardRouter struct {
 	sync.RWMutex
 	defaultHandler MessageHandler
-	subscriptions  map[string][]MessageHandler
+	subscriptions  map[string][]routeHandler
+	order          []string // keys of subscriptions in the order they were registered
+	mode           RouteMode
+	nextID         uint64 // used to identify handlers (so they can be individually unregistered)
+	noSubIDs       bool   // true if the server does not support Subscription Identifiers (see SetSubscriptionIDsAvailable)
 	aliases        map[uint16]string
+	unsubscriber   Unsubscriber // if set, filters are unsubscribed from when their last handler is removed
+	onHandlerError func(HandlerError)
+	ordered        orderedDelivery // see SetOrderedDelivery
 	debug          log.Logger
 }
 
+// Unsubscriber is implemented by Client (and autopaho.ConnectionManager); see StandardRouter.UnsubscribeOnUnregister
+type Unsubscriber interface {
+	Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, error)
+}
+
+// subscriptionIDRouter is implemented by Routers (e.g. StandardRouter) that need to know whether the server supports
+// Subscription Identifiers
+type subscriptionIDRouter interface {
+	SetSubscriptionIDsAvailable(available bool)
+}
+
+// routerUnsubscribeTimeout limits the time spent on an UNSUBSCRIBE sent due to a handler being unregistered
+const routerUnsubscribeTimeout = 10 * time.Second
+
 // NewStandardRouter instantiates and returns an instance of a StandardRouter
 func NewStandardRouter() *StandardRouter {
 	return &StandardRouter{
-		subscriptions: make(map[string][]MessageHandler),
+		subscriptions: make(map[string][]routeHandler),
 		aliases:       make(map[uint16]string),
 		debug:         log.NOOPLogger{},
 	}
@@ -74,65 +157,266 @@ func NewStandardRouterWithDefault(h MessageHandler) *StandardRouter {
 	return r
 }
 
+// routeHandler is a MessageHandler registered with a StandardRouter
+type routeHandler struct {
+	id      uint64
+	subID   int // Subscription Identifier (0 = none); see RegisterSubscriptionHandler
+	handler MessageHandler
+}
+
+// standardRouterHandle is the HandlerHandle returned by StandardRouter.RegisterHandler
+type standardRouterHandle struct {
+	r     *StandardRouter
+	topic string
+	id    uint64
+}
+
+// Unregister implements HandlerHandle
+func (h *standardRouterHandle) Unregister() {
+	h.r.debug.Println("unregistering single handler for:", h.topic)
+	h.r.Lock()
+	defer h.r.Unlock()
+
+	h.r.ordered.stop(h.id)
+	handlers := slices.DeleteFunc(h.r.subscriptions[h.topic], func(rh routeHandler) bool { return rh.id == h.id })
+	if len(handlers) == 0 {
+		h.r.removeTopic(h.topic)
+		return
+	}
+	h.r.subscriptions[h.topic] = handlers
+}
+
 // RegisterHandler is the library provided StandardRouter's
 // implementation of the required interface function()
-func (r *StandardRouter) RegisterHandler(topic string, h MessageHandler) {
+func (r *StandardRouter) RegisterHandler(topic string, h MessageHandler) HandlerHandle {
 	r.debug.Println("registering handler for:", topic)
+	return r.register(topic, 0, h)
+}
+
+// RegisterSubscriptionHandler registers h for messages delivered due to the subscription to topic made with the
+// Subscription Identifier subID (SubscribeProperties.SubscriptionIdentifier, which must be greater than 0). When a
+// PUBLISH carries a Subscription Identifier for which handlers have been registered, only those handlers are called
+// (in the order in which they were registered, regardless of the RouteMode); this avoids the ambiguity inherent in
+// matching overlapping topic filters. Otherwise (including where the server does not support Subscription
+// Identifiers; see SetSubscriptionIDsAvailable) h is selected by matching topic, as with RegisterHandler.
+func (r *StandardRouter) RegisterSubscriptionHandler(subID int, topic string, h MessageHandler) HandlerHandle {
+	r.debug.Printf("registering handler for: %s (subscription identifier %d)", topic, subID)
+	return r.register(topic, subID, h)
+}
+
+// register adds h as a handler for topic (and, if not 0, subID)
+func (r *StandardRouter) register(topic string, subID int, h MessageHandler) HandlerHandle {
 	r.Lock()
 	defer r.Unlock()
 
-	r.subscriptions[topic] = append(r.subscriptions[topic], h)
+	if _, ok := r.subscriptions[topic]; !ok {
+		r.order = append(r.order, topic)
+	}
+	r.nextID++
+	r.subscriptions[topic] = append(r.subscriptions[topic], routeHandler{id: r.nextID, subID: subID, handler: h})
+	return &standardRouterHandle{r: r, topic: topic, id: r.nextID}
+}
+
+// SetSubscriptionIDsAvailable informs the router whether the server supports Subscription Identifiers (as indicated
+// in the CONNACK); when false, handlers are always selected by topic matching. Client calls this when the connection
+// is established.
+func (r *StandardRouter) SetSubscriptionIDsAvailable(available bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.noSubIDs = !available
+}
+
+// RegisterQoSHandler registers h (as RegisterHandler) for messages matching topic; h is passed the QoS at which each
+// message was delivered.
+func (r *StandardRouter) RegisterQoSHandler(topic string, h QoSMessageHandler) HandlerHandle {
+	return r.RegisterHandler(topic, func(p *Publish) { h(p.QoS, p) })
 }
 
 // UnregisterHandler is the library provided StandardRouter's
 // implementation of the required interface function()
+// All handlers for topic are removed (calling this for a topic with no handlers has no effect). This may be called
+// concurrently with Route (including from within a handler); messages already being routed may still be delivered
+// to the removed handlers.
 func (r *StandardRouter) UnregisterHandler(topic string) {
 	r.debug.Println("unregistering handler for:", topic)
 	r.Lock()
 	defer r.Unlock()
 
+	r.removeTopic(topic)
+}
+
+// removeTopic removes all handlers for topic, along with any topic aliases that are no longer needed, and unsubscribes
+// (if UnsubscribeOnUnregister has been called); r must be locked
+func (r *StandardRouter) removeTopic(topic string) {
+	if _, ok := r.subscriptions[topic]; !ok {
+		return
+	}
+	for _, rh := range r.subscriptions[topic] {
+		r.ordered.stop(rh.id)
+	}
 	delete(r.subscriptions, topic)
+	for i, t := range r.order {
+		if t == topic {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	if r.defaultHandler == nil { // aliases for topics that will no longer be routed anywhere are not needed
+		for alias, aliasTopic := range r.aliases {
+			if match(topic, aliasTopic) && !slices.ContainsFunc(r.order, func(f string) bool { return match(f, aliasTopic) }) {
+				delete(r.aliases, alias)
+			}
+		}
+	}
+	if u := r.unsubscriber; u != nil {
+		go func() { // Must not block (we may have been called from a handler)
+			ctx, cancel := context.WithTimeout(context.Background(), routerUnsubscribeTimeout)
+			defer cancel()
+			if _, err := u.Unsubscribe(ctx, &Unsubscribe{Topics: []string{topic}}); err != nil {
+				r.debug.Printf("failed to unsubscribe from %s: %s", topic, err)
+			}
+		}()
+	}
+}
+
+// UnsubscribeOnUnregister requests that, when the last handler for a topic filter is removed (by UnregisterHandler or
+// HandlerHandle.Unregister), an UNSUBSCRIBE for that filter be sent using u (pass nil to disable). The UNSUBSCRIBE is
+// sent asynchronously, and failures are logged to the debug logger.
+func (r *StandardRouter) UnsubscribeOnUnregister(u Unsubscriber) {
+	r.Lock()
+	defer r.Unlock()
+	r.unsubscriber = u
 }
 
 // Route is the library provided StandardRouter's implementation
 // of the required interface function()
+// Handlers are called after the router's lock has been released, so may register/unregister handlers.
+// A panic in a handler is recovered (so remaining handlers, and subsequent messages, are still dispatched), logged to
+// the debug logger, and passed to the function set with SetHandlerErrorCallback (if any).
 func (r *StandardRouter) Route(pb *packets.Publish) {
 	r.debug.Println("routing message for:", pb.Topic)
+	m := PublishFromPacketPublish(pb)
+	for _, d := range r.handlers(pb) {
+		if d.queue != nil {
+			d.queue.push(m)
+			continue
+		}
+		r.callHandler(d.handler, m)
+	}
+}
+
+// callHandler calls h, recovering from any panic
+func (r *StandardRouter) callHandler(h MessageHandler, m *Publish) {
+	defer func() {
+		if v := recover(); v != nil {
+			err, ok := v.(error)
+			if ok {
+				err = fmt.Errorf("%w: %w", ErrHandlerPanic, err)
+			} else {
+				err = fmt.Errorf("%w: %v", ErrHandlerPanic, v)
+			}
+			he := HandlerError{Topic: m.Topic, PacketID: m.PacketID, Err: err}
+			r.debug.Println(he.Error())
+			r.handlerError(he)
+		}
+	}()
+	h(m)
+}
+
+// handlerError passes he to the function set with SetHandlerErrorCallback (if any)
+func (r *StandardRouter) handlerError(he HandlerError) {
 	r.RLock()
-	defer r.RUnlock()
+	onError := r.onHandlerError
+	r.RUnlock()
+	if onError != nil {
+		onError(he)
+	}
+}
 
-	m := PublishFromPacketPublish(pb)
+// SetHandlerErrorCallback sets a function that will be called (from the goroutine calling the handler) when a handler
+// fails (currently this means that it panicked) or a message is dropped (see SetOrderedDelivery); pass nil to unset.
+// The function should not block.
+func (r *StandardRouter) SetHandlerErrorCallback(f func(HandlerError)) {
+	r.Lock()
+	defer r.Unlock()
+	r.onHandlerError = f
+}
+
+// dispatch is a handler to be called for a message; if queue is not nil the message should be added to it (rather than
+// calling handler directly)
+type dispatch struct {
+	handler MessageHandler
+	queue   *handlerQueue
+}
+
+// handlers returns the handlers to be called for pb (registering any topic alias)
+func (r *StandardRouter) handlers(pb *packets.Publish) []dispatch {
+	r.Lock() // Not RLock because aliases may be updated
+	defer r.Unlock()
 
 	var topic string
 	if pb.Properties.TopicAlias != nil {
 		r.debug.Println("message is using topic aliasing")
 		if pb.Topic != "" {
 			// Register new alias
-			r.debug.Printf("registering new topic alias '%d' for topic '%s'", *pb.Properties.TopicAlias, m.Topic)
+			r.debug.Printf("registering new topic alias '%d' for topic '%s'", *pb.Properties.TopicAlias, pb.Topic)
 			r.aliases[*pb.Properties.TopicAlias] = pb.Topic
 		}
 		if t, ok := r.aliases[*pb.Properties.TopicAlias]; ok {
-			r.debug.Printf("aliased topic '%d' translates to '%s'", *pb.Properties.TopicAlias, m.Topic)
+			r.debug.Printf("aliased topic '%d' translates to '%s'", *pb.Properties.TopicAlias, t)
 			topic = t
 		}
 	} else {
-		topic = m.Topic
+		topic = pb.Topic
 	}
 
-	handlerCalled := false
-	for route, handlers := range r.subscriptions {
+	if pb.Properties.SubscriptionIdentifier != nil && !r.noSubIDs {
+		if handlers := r.subIDHandlers(*pb.Properties.SubscriptionIdentifier); len(handlers) > 0 {
+			return handlers
+		}
+	}
+
+	var routes []string
+	for _, route := range r.order {
 		if match(route, topic) {
-			r.debug.Println("found handler for:", route)
-			for _, handler := range handlers {
-				handler(m)
-				handlerCalled = true
-			}
+			routes = append(routes, route)
+		}
+	}
+	if r.mode != RouteAll && len(routes) > 1 {
+		slices.SortStableFunc(routes, compareSpecificity)
+		if r.mode == RouteMostSpecific {
+			routes = slices.DeleteFunc(routes, func(route string) bool { return compareSpecificity(routes[0], route) != 0 })
 		}
 	}
 
-	if !handlerCalled && r.defaultHandler != nil {
-		r.defaultHandler(m)
+	var handlers []dispatch
+	for _, route := range routes {
+		r.debug.Println("found handler for:", route)
+		for _, rh := range r.subscriptions[route] {
+			handlers = append(handlers, dispatch{handler: rh.handler, queue: r.ordered.queue(r, rh)})
+		}
 	}
+
+	if len(handlers) == 0 && r.defaultHandler != nil {
+		rh := routeHandler{id: defaultHandlerID, handler: r.defaultHandler}
+		handlers = append(handlers, dispatch{handler: rh.handler, queue: r.ordered.queue(r, rh)})
+	}
+	return handlers
+}
+
+// subIDHandlers returns the handlers registered (with RegisterSubscriptionHandler) for the Subscription Identifier
+// subID; r must be locked
+func (r *StandardRouter) subIDHandlers(subID int) []dispatch {
+	var handlers []dispatch
+	for _, route := range r.order {
+		for _, rh := range r.subscriptions[route] {
+			if rh.subID == subID {
+				r.debug.Printf("found handler for: %s (subscription identifier %d)", route, subID)
+				handlers = append(handlers, dispatch{handler: rh.handler, queue: r.ordered.queue(r, rh)})
+			}
+		}
+	}
+	return handlers
 }
 
 // SetDebugLogger sets the logger l to be used for printing debug
@@ -141,17 +425,66 @@ func (r *StandardRouter) SetDebugLogger(l log.Logger) {
 	r.debug = l
 }
 
+// SetRouteMode sets the RouteMode, which determines the handlers called when a message matches multiple topic filters
+func (r *StandardRouter) SetRouteMode(mode RouteMode) {
+	r.Lock()
+	defer r.Unlock()
+	r.mode = mode
+}
+
 // DefaultHandler sets handler to be called for messages that don't trigger another handler
 // Pass nil to unset.
 func (r *StandardRouter) DefaultHandler(h MessageHandler) {
 	r.debug.Println("registering default handler")
 	r.Lock()
 	defer r.Unlock()
+	r.ordered.stop(defaultHandlerID)
 	r.defaultHandler = h
 }
 
+// match returns true if the topic filter route matches topic. Invalid filters ("#" not the last level, or "+"/"#" not
+// occupying an entire level) match nothing, and filters starting with a wildcard do not match topics beginning with
+// "$" (MQTT-4.7.2-1).
 func match(route, topic string) bool {
-	return route == topic || routeIncludesTopic(route, topic)
+	return routeIncludesTopic(route, topic)
+}
+
+// compareSpecificity compares two topic filters (that match the same topic), returning a negative number if a is more
+// specific than b, a positive number if b is more specific than a, and 0 if they are equally specific (see
+// RouteMostSpecific).
+func compareSpecificity(a, b string) int {
+	rank := func(level string) int {
+		switch level {
+		case "+":
+			return 1
+		case "#":
+			return 2
+		}
+		return 0
+	}
+	as, bs := routeSplit(a), routeSplit(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if d := rank(as[i]) - rank(bs[i]); d != 0 {
+			return d
+		}
+	}
+	return len(as) - len(bs) // e.g. "a/b" is more specific than "a/b/#"
+}
+
+// validRoute returns true if the wildcards in the (split) topic filter are used correctly (MQTT-4.7.1-1/2)
+func validRoute(route []string) bool {
+	for i, level := range route {
+		switch {
+		case level == "#":
+			if i != len(route)-1 {
+				return false
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
 }
 
 func matchDeep(route []string, topic []string) bool {
@@ -174,20 +507,24 @@ func matchDeep(route []string, topic []string) bool {
 }
 
 func routeIncludesTopic(route, topic string) bool {
-	return matchDeep(routeSplit(route), topicSplit(topic))
+	rs, ts := routeSplit(route), topicSplit(topic)
+	if !validRoute(rs) {
+		return false
+	}
+	if len(rs) > 0 && len(ts) > 0 && (rs[0] == "#" || rs[0] == "+") && strings.HasPrefix(ts[0], "$") {
+		return false
+	}
+	return matchDeep(rs, ts)
 }
 
 func routeSplit(route string) []string {
 	if len(route) == 0 {
 		return nil
 	}
-	var result []string
-	if strings.HasPrefix(route, "$share") {
-		result = strings.Split(route, "/")[2:]
-	} else {
-		result = strings.Split(route, "/")
+	if _, filter, ok := ParseSharedSubscription(route); ok {
+		route = filter
 	}
-	return result
+	return strings.Split(route, "/")
 }
 
 func topicSplit(topic string) []string {
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrMessageDropped is passed (within a HandlerError) to the StandardRouter's handler error callback when a message is
+// discarded because a handler's queue is full (see SetOrderedDelivery and OrderedQueueDropOldest)
+var ErrMessageDropped = errors.New("message dropped because handler queue is full")
+
+// OrderedQueuePolicy determines what happens when a message is routed to a handler whose queue is full (see
+// StandardRouter.SetOrderedDelivery)
+type OrderedQueuePolicy int
+
+const (
+	OrderedQueueBlock      OrderedQueuePolicy = iota // Route blocks until there is space in the queue (default)
+	OrderedQueueDropOldest                           // The oldest queued message is discarded (reported as ErrMessageDropped)
+)
+
+// defaultHandlerID is the id used for the default handler's queue (ids assigned by RegisterHandler start at 1)
+const defaultHandlerID = 0
+
+// orderedDelivery holds the per-handler queues used when ordered delivery is enabled (protected by the routers lock)
+type orderedDelivery struct {
+	depth  int // 0 = disabled
+	policy OrderedQueuePolicy
+	queues map[uint64]*handlerQueue // keyed by handler id
+}
+
+// queue returns the queue for rh, creating it if needed; returns nil if ordered delivery is disabled
+func (o *orderedDelivery) queue(r *StandardRouter, rh routeHandler) *handlerQueue {
+	if o.depth == 0 {
+		return nil
+	}
+	if q, ok := o.queues[rh.id]; ok {
+		return q
+	}
+	if o.queues == nil {
+		o.queues = make(map[uint64]*handlerQueue)
+	}
+	q := newHandlerQueue(r, rh.handler, o.depth, o.policy)
+	o.queues[rh.id] = q
+	return q
+}
+
+// stop closes the queue for the handler with id (if any); messages already queued will still be delivered
+func (o *orderedDelivery) stop(id uint64) {
+	if q, ok := o.queues[id]; ok {
+		q.close()
+		delete(o.queues, id)
+	}
+}
+
+// SetOrderedDelivery enables (depth > 0) or disables (depth == 0) ordered delivery. When enabled, each handler is
+// called from its own goroutine, with messages queued (up to depth per handler) so that each handler receives
+// messages in order, and one at a time, whilst different handlers run concurrently. policy determines what happens
+// when a handler's queue is full; note that OrderedQueueBlock will block Route (and so the receipt of further
+// messages). As Route returns once the message has been queued, messages may be acknowledged before they are handled.
+// Changing the settings (including disabling) closes existing queues; messages already queued are still delivered.
+func (r *StandardRouter) SetOrderedDelivery(depth int, policy OrderedQueuePolicy) {
+	r.Lock()
+	defer r.Unlock()
+	for id := range r.ordered.queues {
+		r.ordered.stop(id)
+	}
+	r.ordered.depth = max(depth, 0)
+	r.ordered.policy = policy
+}
+
+// handlerQueue delivers messages, in order, to a single handler (from a dedicated goroutine)
+type handlerQueue struct {
+	r       *StandardRouter
+	handler MessageHandler
+	depth   int
+	policy  OrderedQueuePolicy
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when items or closed change
+	items  []*Publish
+	closed bool
+	done   chan struct{} // closed when the goroutine exits
+}
+
+// newHandlerQueue creates a handlerQueue and starts its goroutine
+func newHandlerQueue(r *StandardRouter, h MessageHandler, depth int, policy OrderedQueuePolicy) *handlerQueue {
+	q := &handlerQueue{r: r, handler: h, depth: depth, policy: policy, done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push adds m to the queue, applying the policy if the queue is full
+func (q *handlerQueue) push(m *Publish) {
+	q.mu.Lock()
+	for len(q.items) >= q.depth && !q.closed {
+		if q.policy == OrderedQueueDropOldest {
+			dropped := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			q.r.debug.Printf("handler queue full; dropped message %d on topic %s", dropped.PacketID, dropped.Topic)
+			q.r.handlerError(HandlerError{Topic: dropped.Topic, PacketID: dropped.PacketID, Err: ErrMessageDropped})
+			q.mu.Lock()
+			continue
+		}
+		q.cond.Wait()
+	}
+	if !q.closed { // The handler has been removed
+		q.items = append(q.items, m)
+		q.cond.Broadcast()
+	}
+	q.mu.Unlock()
+}
+
+// close stops the queue; the goroutine exits once messages already queued have been delivered
+func (q *handlerQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// run delivers queued messages to the handler
+func (q *handlerQueue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		m := q.items[0]
+		q.items = q.items[1:]
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		q.r.callHandler(q.handler, m)
+	}
+}
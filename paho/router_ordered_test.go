@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// recorder is a MessageHandler that records payloads, optionally blocking until released
+type recorder struct {
+	mu       sync.Mutex
+	payloads []string
+	release  chan struct{} // if not nil, each call waits for a value (or close)
+	received chan string   // receives payload when the handler is called
+}
+
+func newRecorder(block bool) *recorder {
+	r := &recorder{received: make(chan string, 100)}
+	if block {
+		r.release = make(chan struct{})
+	}
+	return r
+}
+
+func (r *recorder) handle(p *Publish) {
+	r.received <- string(p.Payload)
+	if r.release != nil {
+		<-r.release
+	}
+	r.mu.Lock()
+	r.payloads = append(r.payloads, string(p.Payload))
+	r.mu.Unlock()
+}
+
+func (r *recorder) await(t *testing.T, payload string) {
+	t.Helper()
+	select {
+	case got := <-r.received:
+		if got != payload {
+			t.Fatalf("handler received %q, expected %q", got, payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for %q", payload)
+	}
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.payloads...)
+}
+
+func routePayload(r *StandardRouter, topic, payload string) {
+	r.Route(&packets.Publish{Topic: topic, Payload: []byte(payload), Properties: &packets.Properties{}})
+}
+
+// Test_orderedDelivery confirms that each handler receives messages in order whilst other handlers run concurrently
+func Test_orderedDelivery(t *testing.T) {
+	r := NewStandardRouter()
+	r.SetOrderedDelivery(10, OrderedQueueBlock)
+	a, b := newRecorder(true), newRecorder(false)
+	r.RegisterHandler("a", a.handle)
+	r.RegisterHandler("b", b.handle)
+
+	for _, p := range []string{"a1", "a2", "a3"} {
+		routePayload(r, "a", p)
+	}
+	routePayload(r, "b", "b1")
+	a.await(t, "a1")
+	b.await(t, "b1") // Handler b is not held up by handler a
+	select {
+	case p := <-a.received:
+		t.Fatalf("handler a called concurrently (received %q)", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(a.release)
+	a.await(t, "a2")
+	a.await(t, "a3")
+
+	r.RLock()
+	queues := make([]*handlerQueue, 0, len(r.ordered.queues))
+	for _, q := range r.ordered.queues {
+		queues = append(queues, q)
+	}
+	r.RUnlock()
+	r.SetOrderedDelivery(0, OrderedQueueBlock) // Closes the queues (goroutines exit once they are empty)
+	for _, q := range queues {
+		select {
+		case <-q.done:
+		case <-time.After(time.Second):
+			t.Fatal("queue goroutine did not exit")
+		}
+	}
+	if got := a.get(); !reflect.DeepEqual(got, []string{"a1", "a2", "a3"}) {
+		t.Fatalf("handler a received %v", got)
+	}
+
+	routePayload(r, "b", "b2") // Now delivered synchronously
+	if got := b.get(); !reflect.DeepEqual(got, []string{"b1", "b2"}) {
+		t.Fatalf("handler b received %v", got)
+	}
+}
+
+// Test_orderedDeliveryDropOldest confirms that the oldest queued message is dropped, and reported, when the queue fills
+func Test_orderedDeliveryDropOldest(t *testing.T) {
+	var mu sync.Mutex
+	var dropped []string
+	r := NewStandardRouter()
+	r.SetHandlerErrorCallback(func(he HandlerError) {
+		if !errors.Is(he, ErrMessageDropped) {
+			t.Errorf("unexpected error: %s", he)
+		}
+		mu.Lock()
+		dropped = append(dropped, he.Topic)
+		mu.Unlock()
+	})
+	r.SetOrderedDelivery(1, OrderedQueueDropOldest)
+	h := newRecorder(true)
+	r.RegisterHandler("#", h.handle)
+
+	routePayload(r, "1", "m1")
+	h.await(t, "m1") // m1 is being handled so the queue is empty
+	routePayload(r, "2", "m2")
+	routePayload(r, "3", "m3") // queue is full, so m2 is dropped
+	close(h.release)
+	h.await(t, "m3")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(dropped, []string{"2"}) {
+		t.Fatalf("expected m2 to be dropped, got %v", dropped)
+	}
+}
+
+// Test_orderedDeliveryBlock confirms that Route blocks when the queue is full
+func Test_orderedDeliveryBlock(t *testing.T) {
+	r := NewStandardRouter()
+	r.SetOrderedDelivery(1, OrderedQueueBlock)
+	h := newRecorder(true)
+	handle := r.RegisterHandler("#", h.handle)
+
+	routePayload(r, "t", "m1")
+	h.await(t, "m1")
+	routePayload(r, "t", "m2") // queued
+	routed := make(chan struct{})
+	go func() {
+		routePayload(r, "t", "m3")
+		close(routed)
+	}()
+	select {
+	case <-routed:
+		t.Fatal("Route should block whilst the queue is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	h.release <- struct{}{} // m1 completes, so m2 is taken from the queue, making space for m3
+	select {
+	case <-routed:
+	case <-time.After(time.Second):
+		t.Fatal("Route should return once there is space in the queue")
+	}
+	close(h.release)
+	h.await(t, "m2")
+	h.await(t, "m3")
+
+	r.RLock()
+	q := r.ordered.queues[1]
+	r.RUnlock()
+	handle.Unregister()
+	select {
+	case <-q.done:
+	case <-time.After(time.Second):
+		t.Fatal("queue goroutine should exit once the handler is unregistered")
+	}
+}
@@ -16,8 +16,13 @@
 package paho
 
 import (
+	"context"
+	"errors"
+	"io"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rtalhouk/paho.golang/packets"
 )
@@ -60,7 +65,26 @@ func Test_routeIncludesTopic(t *testing.T) {
 		args args
 		want bool
 	}{
-		// TODO: Add test cases.
+		{"plusLevel", args{"sensors/+/temp", "sensors/kitchen/temp"}, true},
+		{"plusNotLevel", args{"sensors/+/temp", "sensors/kitchen/hall/temp"}, false},
+		{"plusEmptyLevel", args{"sensors/+/temp", "sensors//temp"}, true},
+		{"hashParent", args{"sensors/#", "sensors"}, true},
+		{"hashMulti", args{"sensors/#", "sensors/kitchen/temp"}, true},
+		{"hashOther", args{"sensors/#", "actuators/kitchen"}, false},
+		{"hashNotLast", args{"sensors/#/temp", "sensors/kitchen/temp"}, false},
+		{"hashNotLastExact", args{"sensors/#/temp", "sensors/#/temp"}, false},
+		{"hashPartLevel", args{"sensors#", "sensors"}, false},
+		{"hashPartLevel2", args{"sensors/kitchen#", "sensors/kitchen"}, false},
+		{"plusPartLevel", args{"sensors/kitchen+/temp", "sensors/kitchen1/temp"}, false},
+		{"plusPartLevelExact", args{"sensors/+kitchen", "sensors/+kitchen"}, false},
+		{"dollarHash", args{"#", "$SYS/broker/uptime"}, false},
+		{"dollarPlus", args{"+/broker/uptime", "$SYS/broker/uptime"}, false},
+		{"dollarExplicit", args{"$SYS/#", "$SYS/broker/uptime"}, true},
+		{"dollarExplicitPlus", args{"$SYS/+/uptime", "$SYS/broker/uptime"}, true},
+		{"dollarExact", args{"$SYS/broker/uptime", "$SYS/broker/uptime"}, true},
+		{"dollarNotFirst", args{"a/#", "a/$b"}, true},
+		{"dollarShared", args{"$share/group/#", "$SYS/broker/uptime"}, false},
+		{"shared", args{"$share/group/sensors/+/temp", "sensors/kitchen/temp"}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -91,6 +115,36 @@ func Test_routeSplit(t *testing.T) {
 	}
 }
 
+// Test_routeWildcards confirms that StandardRouter uses MQTT topic filter matching when selecting handlers
+func Test_routeWildcards(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"exact", "sensors/kitchen/temp", "sensors/kitchen/temp", true},
+		{"plus", "sensors/+/temp", "sensors/kitchen/temp", true},
+		{"hash", "sensors/#", "sensors/kitchen/temp", true},
+		{"hashNotLast", "sensors/#/temp", "sensors/kitchen/temp", false},
+		{"plusPartLevel", "sensors/k+/temp", "sensors/kitchen/temp", false},
+		{"dollarHash", "#", "$SYS/broker/uptime", false},
+		{"dollarPlus", "+/broker/uptime", "$SYS/broker/uptime", false},
+		{"dollarExplicit", "$SYS/#", "$SYS/broker/uptime", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called, defaultCalled bool
+			r := NewStandardRouterWithDefault(func(p *Publish) { defaultCalled = true })
+			r.RegisterHandler(tt.filter, func(p *Publish) { called = true })
+			r.Route(&packets.Publish{Topic: tt.topic, Properties: &packets.Properties{}})
+			if called != tt.want || defaultCalled == tt.want {
+				t.Errorf("handler called: %v, default called: %v, want handler called: %v", called, defaultCalled, tt.want)
+			}
+		})
+	}
+}
+
 func Test_routeDefault(t *testing.T) {
 	var r1Count, r2Count int
 
@@ -127,3 +181,326 @@ func Test_routeDefault(t *testing.T) {
 	}
 
 }
+
+func Test_routeOrder(t *testing.T) {
+	var called []string
+	handler := func(name string) MessageHandler {
+		return func(p *Publish) { called = append(called, name) }
+	}
+
+	r := NewStandardRouter()
+	r.RegisterHandler("a/#", handler("a/#"))
+	r.RegisterHandler("a/b/c", handler("a/b/c"))
+	r.RegisterHandler("+/b/+", handler("+/b/+"))
+	r.RegisterHandler("a/+/c", handler("a/+/c"))
+	r.RegisterHandler("#", handler("#"))
+	r.RegisterHandler("a/#", handler("a/# (2)")) // Should be called immediately after the first "a/#" handler
+
+	expected := []string{"a/#", "a/# (2)", "a/b/c", "+/b/+", "a/+/c", "#"}
+	for i := 0; i < 100; i++ { // map iteration order is randomised so repeat to confirm order is stable
+		called = nil
+		r.Route(&packets.Publish{Topic: "a/b/c", Properties: &packets.Properties{}})
+		if !reflect.DeepEqual(called, expected) {
+			t.Fatalf("handlers called in unexpected order: %v, expected %v", called, expected)
+		}
+	}
+
+	r.UnregisterHandler("a/b/c")
+	r.RegisterHandler("a/b/c", handler("a/b/c")) // Re-registering moves the filter to the end
+	called = nil
+	r.Route(&packets.Publish{Topic: "a/b/c", Properties: &packets.Properties{}})
+	expected = []string{"a/#", "a/# (2)", "+/b/+", "a/+/c", "#", "a/b/c"}
+	if !reflect.DeepEqual(called, expected) {
+		t.Fatalf("handlers called in unexpected order: %v, expected %v", called, expected)
+	}
+}
+
+// Test_routeMode confirms the handlers called, and the order in which they are called, for a message matching three
+// overlapping filters in each RouteMode
+func Test_routeMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     RouteMode
+		expected []string
+	}{
+		{"all", RouteAll, []string{"sensors/#", "sensors/+/temp", "sensors/kitchen/temp"}},
+		{"allBySpecificity", RouteAllBySpecificity, []string{"sensors/kitchen/temp", "sensors/+/temp", "sensors/#"}},
+		{"mostSpecific", RouteMostSpecific, []string{"sensors/kitchen/temp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called []string
+			handler := func(name string) MessageHandler {
+				return func(p *Publish) { called = append(called, name) }
+			}
+			r := NewStandardRouter()
+			r.SetRouteMode(tt.mode)
+			r.RegisterHandler("sensors/#", handler("sensors/#"))
+			r.RegisterHandler("sensors/+/temp", handler("sensors/+/temp"))
+			r.RegisterHandler("sensors/kitchen/temp", handler("sensors/kitchen/temp"))
+			r.RegisterHandler("other/#", handler("other/#"))
+
+			for i := 0; i < 10; i++ {
+				called = nil
+				r.Route(&packets.Publish{Topic: "sensors/kitchen/temp", Properties: &packets.Properties{}})
+				if !reflect.DeepEqual(called, tt.expected) {
+					t.Fatalf("handlers called in unexpected order: %v, expected %v", called, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_routeSubscriptionIdentifier(t *testing.T) {
+	var called []string
+	handler := func(name string) MessageHandler {
+		return func(p *Publish) { called = append(called, name) }
+	}
+	r := NewStandardRouter()
+	r.RegisterSubscriptionHandler(1, "sensors/#", handler("sub1"))
+	r.RegisterSubscriptionHandler(2, "sensors/+/temp", handler("sub2"))
+	r.RegisterHandler("sensors/kitchen/temp", handler("topic"))
+
+	subID := func(id int) *int { return &id }
+	tests := []struct {
+		name      string
+		available bool
+		id        *int
+		expected  []string
+	}{
+		{"subID1", true, subID(1), []string{"sub1"}},
+		{"subID2", true, subID(2), []string{"sub2"}},
+		{"noSubID", true, nil, []string{"sub1", "sub2", "topic"}},
+		{"unknownSubID", true, subID(3), []string{"sub1", "sub2", "topic"}},
+		{"unavailable", false, subID(1), []string{"sub1", "sub2", "topic"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = nil
+			r.SetSubscriptionIDsAvailable(tt.available)
+			r.Route(&packets.Publish{Topic: "sensors/kitchen/temp", Properties: &packets.Properties{SubscriptionIdentifier: tt.id}})
+			if !reflect.DeepEqual(called, tt.expected) {
+				t.Fatalf("unexpected handlers called: %v, expected %v", called, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_compareSpecificity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int // sign only
+	}{
+		{"a/b/c", "a/+/c", -1},
+		{"a/+/c", "a/#", -1},
+		{"a/b/c", "a/#", -1},
+		{"+/b/c", "a/+/c", 1}, // Leftmost level takes priority
+		{"a/b", "a/b/#", -1},
+		{"a/+", "a/+", 0},
+		{"$share/group/a/b", "a/b", 0},
+	}
+	for _, tt := range tests {
+		got := compareSpecificity(tt.a, tt.b)
+		if (got < 0 && tt.want >= 0) || (got > 0 && tt.want <= 0) || (got == 0 && tt.want != 0) {
+			t.Errorf("compareSpecificity(%q, %q) = %d, want sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Test_routeHandle confirms that a HandlerHandle removes only the handler it was returned for
+func Test_routeHandle(t *testing.T) {
+	var called []string
+	handler := func(name string) MessageHandler {
+		return func(p *Publish) { called = append(called, name) }
+	}
+	r := NewStandardRouter()
+	h1 := r.RegisterHandler("a/#", handler("1"))
+	r.RegisterHandler("a/#", handler("2"))
+	r.RegisterHandler("a/b", handler("3"))
+
+	h1.Unregister()
+	h1.Unregister() // Second call should have no effect
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if expected := []string{"2", "3"}; !reflect.DeepEqual(called, expected) {
+		t.Fatalf("handlers called: %v, expected %v", called, expected)
+	}
+
+	r.UnregisterHandler("a/#")
+	h4 := r.RegisterHandler("a/#", handler("4"))
+	called = nil
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if expected := []string{"3", "4"}; !reflect.DeepEqual(called, expected) {
+		t.Fatalf("handlers called: %v, expected %v", called, expected)
+	}
+
+	h4.Unregister() // Last handler for filter, so filter should be removed
+	r.RLock()
+	_, ok := r.subscriptions["a/#"]
+	order := r.order
+	r.RUnlock()
+	if ok || !reflect.DeepEqual(order, []string{"a/b"}) {
+		t.Fatalf("filter should have been removed (order: %v)", order)
+	}
+}
+
+// Test_routeQoSHandler confirms that a QoSMessageHandler receives the QoS from the PUBLISH fixed header
+func Test_routeQoSHandler(t *testing.T) {
+	type delivery struct {
+		qos   byte
+		topic string
+	}
+	var got []delivery
+	r := NewStandardRouter()
+	h := r.RegisterQoSHandler("sensors/#", func(qos byte, p *Publish) {
+		if p.QoS != qos {
+			t.Errorf("qos %d does not match Publish.QoS %d", qos, p.QoS)
+		}
+		got = append(got, delivery{qos: qos, topic: p.Topic})
+	})
+
+	r.Route(&packets.Publish{Topic: "sensors/telemetry", QoS: 0, Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "sensors/command", QoS: 1, PacketID: 1, Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "sensors/command", QoS: 2, PacketID: 2, Properties: &packets.Properties{}})
+	expected := []delivery{{0, "sensors/telemetry"}, {1, "sensors/command"}, {2, "sensors/command"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+
+	h.Unregister()
+	got = nil
+	r.Route(&packets.Publish{Topic: "sensors/telemetry", Properties: &packets.Properties{}})
+	if len(got) != 0 {
+		t.Fatalf("handler called after Unregister: %v", got)
+	}
+}
+
+// fakeUnsubscriber records the topics passed to Unsubscribe
+type fakeUnsubscriber chan []string
+
+func (f fakeUnsubscriber) Unsubscribe(_ context.Context, u *Unsubscribe) (*Unsuback, error) {
+	f <- u.Topics
+	return &Unsuback{}, nil
+}
+
+// Test_routeUnregister confirms that UnregisterHandler cleans up aliases and, optionally, unsubscribes
+func Test_routeUnregister(t *testing.T) {
+	unsub := make(fakeUnsubscriber, 10)
+	r := NewStandardRouter()
+	r.UnregisterHandler("unknown") // Should be a no-op
+	r.UnsubscribeOnUnregister(unsub)
+
+	var called []string
+	handler := func(name string) MessageHandler {
+		return func(p *Publish) { called = append(called, name) }
+	}
+	r.RegisterHandler("a/#", handler("a/#"))
+	h := r.RegisterHandler("a/b", handler("a/b"))
+	r.RegisterHandler("a/b", handler("a/b (2)"))
+	r.RegisterHandler("c", handler("c"))
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{TopicAlias: Uint16(1)}})
+	r.Route(&packets.Publish{Topic: "c", Properties: &packets.Properties{TopicAlias: Uint16(2)}})
+
+	h.Unregister() // Another handler remains, so no UNSUBSCRIBE
+	r.UnregisterHandler("c")
+	r.UnregisterHandler("c") // Second call should be a no-op
+	select {
+	case topics := <-unsub:
+		if !reflect.DeepEqual(topics, []string{"c"}) {
+			t.Fatalf("unexpected unsubscribe: %v", topics)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for unsubscribe")
+	}
+
+	r.RLock()
+	_, alias1 := r.aliases[1]
+	_, alias2 := r.aliases[2]
+	r.RUnlock()
+	if !alias1 || alias2 {
+		t.Fatalf("alias 1 (a/b) should remain (still matched by a/#), alias 2 (c) should have been removed")
+	}
+
+	// Unregistering from within a handler must not deadlock
+	r.RegisterHandler("d", func(p *Publish) { r.UnregisterHandler("d") })
+	r.Route(&packets.Publish{Topic: "d", Properties: &packets.Properties{}})
+	select {
+	case topics := <-unsub:
+		if !reflect.DeepEqual(topics, []string{"d"}) {
+			t.Fatalf("unexpected unsubscribe: %v", topics)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for unsubscribe")
+	}
+	select {
+	case topics := <-unsub:
+		t.Fatalf("unexpected unsubscribe: %v", topics)
+	default:
+	}
+
+	called = nil
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if expected := []string{"a/#", "a/b (2)"}; !reflect.DeepEqual(called, expected) {
+		t.Fatalf("handlers called: %v, expected %v", called, expected)
+	}
+}
+
+// Test_routeConcurrentUnregister confirms that handlers can be registered/unregistered whilst messages are being
+// routed (run with -race)
+func Test_routeConcurrentUnregister(t *testing.T) {
+	r := NewStandardRouter()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		h := r.RegisterHandler("a/+", func(p *Publish) {})
+		r.RegisterHandler("a/b", func(p *Publish) {})
+		h.Unregister()
+		r.UnregisterHandler("a/b")
+	}
+	wg.Wait()
+}
+
+// Test_routeHandlerPanic confirms that a panicking handler does not prevent other handlers (or subsequent messages)
+// being dispatched, and that the failure is reported
+func Test_routeHandlerPanic(t *testing.T) {
+	var errs []HandlerError
+	var called []string
+	r := NewStandardRouter()
+	r.SetHandlerErrorCallback(func(he HandlerError) { errs = append(errs, he) })
+	r.RegisterHandler("a/#", func(p *Publish) { panic("bad handler") })
+	r.RegisterHandler("a/#", func(p *Publish) { called = append(called, p.Topic) })
+	r.RegisterHandler("a/err", func(p *Publish) { panic(io.ErrUnexpectedEOF) })
+
+	r.Route(&packets.Publish{Topic: "a/b", PacketID: 1, QoS: 1, Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "a/err", PacketID: 2, QoS: 1, Properties: &packets.Properties{}})
+
+	if expected := []string{"a/b", "a/err"}; !reflect.DeepEqual(called, expected) {
+		t.Fatalf("handlers called for: %v, expected %v", called, expected)
+	}
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %d: %v", len(errs), errs)
+	}
+	for i, e := range []struct {
+		topic    string
+		packetID uint16
+	}{{"a/b", 1}, {"a/err", 2}, {"a/err", 2}} {
+		if errs[i].Topic != e.topic || errs[i].PacketID != e.packetID || !errors.Is(errs[i], ErrHandlerPanic) {
+			t.Errorf("unexpected error %d: %v", i, errs[i])
+		}
+	}
+	if !errors.Is(errs[2], io.ErrUnexpectedEOF) {
+		t.Errorf("panic error should be wrapped: %v", errs[2])
+	}
+
+	// Without a callback the panic is still recovered
+	r.SetHandlerErrorCallback(nil)
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if len(called) != 3 {
+		t.Fatalf("handler not called following panic")
+	}
+}
@@ -31,6 +31,7 @@ import (
 var (
 	ErrNoConnection               = errors.New("no connection available")       // We are not in-between a call to ConAckReceived and ConnectionLost
 	ErrPacketIdentifiersExhausted = errors.New("all packet identifiers in use") // There are no available Packet IDs
+	ErrStoreFull                  = errors.New("session store full")            // The maximum number of stored messages has been reached
 )
 
 // Packet provides sufficient functionality to enable a packet to be transmitted with a packet identifier
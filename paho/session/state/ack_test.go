@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package state
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+)
+
+// countingWriter records the data written and the number of calls to Write
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// receivePublishes passes PUBLISH packets (with the specified QoS's) to the State and returns them for acknowledgement
+func receivePublishes(tb testing.TB, s *State, qos ...byte) []*packets.Publish {
+	tb.Helper()
+	pubChan := make(chan *packets.Publish, len(qos))
+	pbs := make([]*packets.Publish, 0, len(qos))
+	for i, q := range qos {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pb := pcp.Content.(*packets.Publish)
+		pb.QoS = q
+		pb.PacketID = uint16(i + 1)
+		pb.Topic = "test"
+		if err := s.PacketReceived(pcp, pubChan); err != nil {
+			tb.Fatalf("PacketReceived failed: %s", err)
+		}
+		pbs = append(pbs, <-pubChan)
+	}
+	return pbs
+}
+
+// TestAckBatch confirms that AckBatch sends the same packets as Ack, in order, using a single write
+func TestAckBatch(t *testing.T) {
+	var w countingWriter
+	s := NewInMemory()
+	s.SetErrorLogger(paholog.NewTestLogger(t, "error:"))
+	if err := s.ConAckReceived(&w, &packets.Connect{}, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+	pbs := receivePublishes(t, s, 1, 2, 1)
+	if err := s.AckBatch(pbs); err != nil {
+		t.Fatalf("AckBatch failed: %s", err)
+	}
+	if w.writes != 1 {
+		t.Errorf("expected 1 write, got %d", w.writes)
+	}
+
+	want := []struct {
+		pt byte
+		id uint16
+	}{{packets.PUBACK, 1}, {packets.PUBREC, 2}, {packets.PUBACK, 3}}
+	for _, p := range want {
+		cp, err := packets.ReadPacket(&w.Buffer)
+		if err != nil {
+			t.Fatalf("failed to read packet: %s", err)
+		}
+		if cp.Type != p.pt || cp.PacketID() != p.id {
+			t.Errorf("expected packet type %d id %d, got type %d id %d", p.pt, p.id, cp.Type, cp.PacketID())
+		}
+	}
+	if w.Len() != 0 {
+		t.Errorf("unexpected data following acknowledgements (%d bytes)", w.Len())
+	}
+
+	// The PUBREC must be recorded (so a duplicate PUBLISH is not passed to the application)
+	s.mu.Lock()
+	pt, ok := s.serverPackets[2]
+	s.mu.Unlock()
+	if !ok || pt != packets.PUBREC {
+		t.Errorf("PUBREC not recorded in session state")
+	}
+}
+
+// lockingShortWriter is a sync.Locker that writes at most 5 bytes per call, recording any write made whilst unlocked
+type lockingShortWriter struct {
+	bytes.Buffer
+	locked   bool
+	unlocked int // number of writes made without the lock held
+}
+
+func (w *lockingShortWriter) Lock()   { w.locked = true }
+func (w *lockingShortWriter) Unlock() { w.locked = false }
+
+func (w *lockingShortWriter) Write(p []byte) (int, error) {
+	if !w.locked {
+		w.unlocked++
+	}
+	return w.Buffer.Write(p[:min(len(p), 5)])
+}
+
+// TestAckBatchLockedShortWrite confirms that AckBatch holds the connections lock whilst writing, and completes the
+// write where the connection accepts fewer bytes than requested
+func TestAckBatchLockedShortWrite(t *testing.T) {
+	var w lockingShortWriter
+	s := NewInMemory()
+	s.SetErrorLogger(paholog.NewTestLogger(t, "error:"))
+	if err := s.ConAckReceived(&w, &packets.Connect{}, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+	if err := s.AckBatch(receivePublishes(t, s, 1, 1, 2)); err != nil {
+		t.Fatalf("AckBatch failed: %s", err)
+	}
+	if w.unlocked != 0 {
+		t.Errorf("%d writes made without the lock held", w.unlocked)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := packets.ReadPacket(&w.Buffer); err != nil {
+			t.Fatalf("failed to read acknowledgement %d: %s", i+1, err)
+		}
+	}
+	if w.Len() != 0 {
+		t.Errorf("unexpected data following acknowledgements (%d bytes)", w.Len())
+	}
+}
+
+// BenchmarkAck compares the number of writes needed to acknowledge a burst of QoS1 messages individually and as a
+// batch (reported as writes/msg); all PUBACKs are sent in both cases.
+func BenchmarkAck(b *testing.B) {
+	const burst = 100
+	for _, bm := range []struct {
+		name string
+		ack  func(s *State, pbs []*packets.Publish) error
+	}{
+		{name: "individual", ack: func(s *State, pbs []*packets.Publish) error {
+			for _, pb := range pbs {
+				if err := s.Ack(pb); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{name: "batch", ack: func(s *State, pbs []*packets.Publish) error { return s.AckBatch(pbs) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			qos := bytes.Repeat([]byte{1}, burst)
+			var w countingWriter
+			var pubacks int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				w.Reset()
+				s := NewInMemory()
+				if err := s.ConAckReceived(&w, &packets.Connect{}, &packets.Connack{}); err != nil {
+					b.Fatalf("ConAckReceived failed: %s", err)
+				}
+				pbs := receivePublishes(b, s, qos...)
+				b.StartTimer()
+				if err := bm.ack(s, pbs); err != nil {
+					b.Fatalf("ack failed: %s", err)
+				}
+				b.StopTimer()
+				for w.Len() > 0 {
+					if _, err := packets.ReadPacket(&w.Buffer); err != nil {
+						b.Fatalf("failed to read packet: %s", err)
+					}
+					pubacks++
+				}
+				b.StartTimer()
+			}
+			if pubacks != burst*b.N {
+				b.Fatalf("expected %d PUBACKs, got %d", burst*b.N, pubacks)
+			}
+			b.ReportMetric(float64(w.writes)/float64(burst*b.N), "writes/msg")
+		})
+	}
+}
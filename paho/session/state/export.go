@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+type (
+	// ExportedSession is a snapshot of the session state intended for diagnostic purposes (e.g. attaching to bug reports)
+	ExportedSession struct {
+		Connected             bool             `json:"connected"`
+		SessionExpiryInterval uint32           `json:"sessionExpiryInterval"`
+		LastPacketID          uint16           `json:"lastPacketId"`
+		ClientPackets         []ExportedPacket `json:"clientPackets"` // Transactions initiated by the client
+		ServerPackets         []ExportedPacket `json:"serverPackets"` // Transactions initiated by the server
+	}
+
+	// ExportedPacket holds information on a packet that forms part of the session state
+	ExportedPacket struct {
+		PacketID    uint16 `json:"packetId"`
+		Type        string `json:"type"`             // Type of the last packet sent/received with this ID
+		Stored      bool   `json:"stored"`           // true if the packet is in the store
+		Topic       string `json:"topic,omitempty"`  // PUBLISH only
+		QoS         byte   `json:"qos,omitempty"`    // PUBLISH only
+		Retain      bool   `json:"retain,omitempty"` // PUBLISH only
+		PayloadSize int    `json:"payloadSize,omitempty"`
+		Payload     []byte `json:"payload,omitempty"` // Only included if requested
+		Error       string `json:"error,omitempty"`   // Set if the stored packet could not be read
+	}
+)
+
+// Snapshot holds counts describing the session state at a point in time (see State.Snapshot)
+type Snapshot struct {
+	InflightOutgoing   int    // QOS1/2 PUBLISH transactions initiated by the client that are incomplete
+	InflightIncoming   int    // QOS1/2 PUBLISH transactions initiated by the server that are incomplete (including those not yet acknowledged)
+	AllocatedPacketIDs int    // Packet identifiers allocated by the client (includes those used for SUBSCRIBE/UNSUBSCRIBE)
+	HighestPacketID    uint16 // The highest packet identifier allocated by the client (0 if none are allocated)
+}
+
+// Snapshot returns counts describing the current session state (e.g. for metrics). The values are read under a
+// single lock, so are consistent with each other; the store is not accessed, so the lock is held only briefly.
+func (s *State) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ss Snapshot
+	for id, cg := range s.clientPackets {
+		switch cg.packetType {
+		case packets.PUBLISH, packets.PUBREL, 0: // 0 = loaded from the store
+			ss.InflightOutgoing++
+		}
+		ss.HighestPacketID = max(ss.HighestPacketID, id)
+	}
+	ss.AllocatedPacketIDs = len(s.clientPackets)
+	ss.InflightIncoming = len(s.serverPackets)
+	for id := range s.unacked {
+		if _, ok := s.serverPackets[id]; !ok {
+			ss.InflightIncoming++
+		}
+	}
+	return ss
+}
+
+// Export returns a JSON encoded snapshot of the session state (see ExportedSession). Payloads are only included if
+// includePayloads is true (they may contain sensitive information).
+func (s *State) Export(includePayloads bool) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := ExportedSession{
+		Connected:             s.conn != nil,
+		SessionExpiryInterval: s.sessionExpiryInterval,
+		LastPacketID:          s.lastMid,
+	}
+	var err error
+	clientPackets := make(map[uint16]byte, len(s.clientPackets))
+	for id, cg := range s.clientPackets {
+		clientPackets[id] = cg.packetType
+	}
+	if e.ClientPackets, err = exportPackets(clientPackets, s.clientStore, includePayloads); err != nil {
+		return nil, fmt.Errorf("failed to export client session: %w", err)
+	}
+	if e.ServerPackets, err = exportPackets(s.serverPackets, s.serverStore, includePayloads); err != nil {
+		return nil, fmt.Errorf("failed to export server session: %w", err)
+	}
+	return json.Marshal(e)
+}
+
+// exportPackets returns details of the packets in the passed in map and store (ordered by packet ID)
+func exportPackets(inMem map[uint16]byte, store storer, includePayloads bool) ([]ExportedPacket, error) {
+	stored, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list store: %w", err)
+	}
+	exported := make(map[uint16]*ExportedPacket)
+	for id, pt := range inMem {
+		exported[id] = &ExportedPacket{PacketID: id, Type: packetTypeName(pt)}
+	}
+	for _, id := range stored {
+		ep, ok := exported[id]
+		if !ok {
+			ep = &ExportedPacket{PacketID: id}
+			exported[id] = ep
+		}
+		ep.Stored = true
+		r, err := store.Get(id)
+		if err != nil {
+			ep.Error = err.Error()
+			continue
+		}
+		p, err := packets.ReadPacket(r)
+		_ = r.Close()
+		if err != nil {
+			ep.Error = err.Error()
+			continue
+		}
+		ep.Type = p.PacketType()
+		if pub, ok := p.Content.(*packets.Publish); ok {
+			ep.Topic = pub.Topic
+			ep.QoS = pub.QoS
+			ep.Retain = pub.Retain
+			ep.PayloadSize = len(pub.Payload)
+			if includePayloads {
+				ep.Payload = pub.Payload
+			}
+		}
+	}
+	ret := make([]ExportedPacket, 0, len(exported))
+	for _, ep := range exported {
+		ret = append(ret, *ep)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].PacketID < ret[j].PacketID })
+	return ret, nil
+}
+
+// packetTypeName returns the name of the packet type (e.g. "PUBLISH")
+func packetTypeName(pt byte) string {
+	if pt == 0 {
+		return "" // unknown (not yet loaded from the store)
+	}
+	return (&packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: pt}}).PacketType()
+}
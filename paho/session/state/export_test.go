@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package state
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// TestSnapshot confirms that Snapshot reports inflight transactions in each direction
+func TestSnapshot(t *testing.T) {
+	s := NewInMemory()
+	if ss := s.Snapshot(); ss != (Snapshot{}) {
+		t.Fatalf("expected empty snapshot, got %+v", ss)
+	}
+	receiveMax := uint16(10)
+	if err := s.ConAckReceived(io.Discard, &packets.Connect{}, &packets.Connack{
+		Properties: &packets.Properties{ReceiveMaximum: &receiveMax},
+	}); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+
+	// Client initiated: PUBLISH QOS1 (1), QOS2 (2), QOS1 (3) and a SUBSCRIBE (4)
+	for _, qos := range []byte{1, 2, 1} {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).QoS = qos
+		pcp.Content.(*packets.Publish).Topic = "test"
+		if err := s.AddToSession(context.Background(), pcp.Content.(*packets.Publish), make(chan packets.ControlPacket, 1)); err != nil {
+			t.Fatalf("AddToSession failed: %s", err)
+		}
+	}
+	sub := packets.NewControlPacket(packets.SUBSCRIBE).Content.(*packets.Subscribe)
+	if err := s.AddToSession(context.Background(), sub, make(chan packets.ControlPacket, 1)); err != nil {
+		t.Fatalf("AddToSession failed: %s", err)
+	}
+	// 1 completes, 2 moves on to PUBREL
+	for _, cp := range []*packets.ControlPacket{
+		{FixedHeader: packets.FixedHeader{Type: packets.PUBACK}, Content: &packets.Puback{PacketID: 1}},
+		{FixedHeader: packets.FixedHeader{Type: packets.PUBREC}, Content: &packets.Pubrec{PacketID: 2}},
+	} {
+		if err := s.PacketReceived(cp, nil); err != nil {
+			t.Fatalf("PacketReceived failed: %s", err)
+		}
+	}
+
+	// Server initiated: QOS1 (1) and QOS2 (2) received, 2 acknowledged (PUBREC sent)
+	pbs := receivePublishes(t, s, 1, 2)
+	if err := s.Ack(pbs[1]); err != nil {
+		t.Fatalf("Ack failed: %s", err)
+	}
+
+	want := Snapshot{InflightOutgoing: 2, InflightIncoming: 2, AllocatedPacketIDs: 3, HighestPacketID: 4}
+	if ss := s.Snapshot(); ss != want {
+		t.Errorf("expected %+v, got %+v", want, ss)
+	}
+
+	// Complete the server initiated transactions
+	if err := s.Ack(pbs[0]); err != nil {
+		t.Fatalf("Ack failed: %s", err)
+	}
+	if err := s.PacketReceived(&packets.ControlPacket{
+		FixedHeader: packets.FixedHeader{Type: packets.PUBREL},
+		Content:     &packets.Pubrel{PacketID: 2},
+	}, nil); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	want.InflightIncoming = 0
+	if ss := s.Snapshot(); ss != want {
+		t.Errorf("expected %+v, got %+v", want, ss)
+	}
+	s.Close()
+}
+
+// TestSnapshotConcurrent calls Snapshot whilst messages are being published (run with -race)
+func TestSnapshotConcurrent(t *testing.T) {
+	s := NewInMemory()
+	receiveMax := uint16(100)
+	if err := s.ConAckReceived(io.Discard, &packets.Connect{}, &packets.Connack{
+		Properties: &packets.Properties{ReceiveMaximum: &receiveMax},
+	}); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			pcp := packets.NewControlPacket(packets.PUBLISH)
+			pcp.Content.(*packets.Publish).QoS = 1
+			pcp.Content.(*packets.Publish).Topic = "test"
+			if err := s.AddToSession(context.Background(), pcp.Content.(*packets.Publish), make(chan packets.ControlPacket, 1)); err != nil {
+				t.Errorf("AddToSession failed: %s", err)
+				return
+			}
+		}
+	}()
+	last := 0
+	for last < 100 {
+		ss := s.Snapshot()
+		if ss.InflightOutgoing < last || ss.InflightOutgoing != ss.AllocatedPacketIDs || int(ss.HighestPacketID) != ss.AllocatedPacketIDs {
+			t.Fatalf("inconsistent snapshot %+v (previous inflight %d)", ss, last)
+		}
+		last = ss.InflightOutgoing
+	}
+	wg.Wait()
+	s.Close()
+}
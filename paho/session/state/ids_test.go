@@ -16,6 +16,7 @@
 package state
 
 import (
+	"context"
 	"math"
 	"math/rand"
 	"testing"
@@ -158,3 +159,62 @@ func TestPAcketIdsFreeZeroID(t *testing.T) {
 	}
 	assert.NotPanics(t, func() { assert.NoError(t, ss.endClientGenerated(0, &resp)) })
 }
+
+// TestPacketIdWait confirms that, with SetWaitForPacketID(true), allocation blocks when all packet identifiers are in
+// use until one is freed or the context is done
+func TestPacketIdWait(t *testing.T) {
+	ss := NewInMemory()
+	ss.clientPackets = make(map[uint16]clientGenerated)
+	ss.inflight = newSendQuota(200) // not testing this but its needed for endClientGenerated to work
+
+	cpChan := make(chan packets.ControlPacket, 1)
+	for i := uint16(1); i != 0; i++ {
+		v, _ := ss.allocateNextPacketId(packets.PUBLISH, cpChan)
+		assert.Equal(t, i, v)
+	}
+
+	// By default exhaustion results in an error
+	_, err := ss.waitForPacketId(context.Background(), packets.PUBLISH, cpChan)
+	assert.ErrorIs(t, err, session.ErrPacketIdentifiersExhausted)
+
+	ss.SetWaitForPacketID(true)
+	type result struct {
+		id  uint16
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		id, err := ss.waitForPacketId(context.Background(), packets.PUBLISH, cpChan)
+		res <- result{id, err}
+	}()
+	select {
+	case r := <-res:
+		t.Fatalf("allocation did not wait (id: %d, err: %v)", r.id, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	resp := packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: packets.PUBACK}}
+	assert.NoError(t, ss.endClientGenerated(1234, &resp))
+	<-cpChan
+	select {
+	case r := <-res:
+		assert.NoError(t, r.err)
+		assert.Equal(t, uint16(1234), r.id)
+	case <-time.After(time.Second):
+		t.Fatal("allocation did not complete when packet identifier freed")
+	}
+
+	// Cancelling the context should terminate the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		id, err := ss.waitForPacketId(ctx, packets.PUBLISH, cpChan)
+		res <- result{id, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case r := <-res:
+		assert.ErrorIs(t, r.err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("allocation did not terminate when context cancelled")
+	}
+}
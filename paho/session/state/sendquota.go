@@ -18,7 +18,6 @@ package state
 import (
 	"context"
 	"errors"
-	"fmt"
 	"sync"
 )
 
@@ -71,6 +70,28 @@ func (s *sendQuota) Acquire(ctx context.Context) error {
 	return s.acquire(ctx, false)
 }
 
+// TryAcquire takes a slot if one is immediately available (returning false if not)
+func (s *sendQuota) TryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota > 0 && len(s.waiters) == 0 {
+		s.quota--
+		return true
+	}
+	return false
+}
+
+// Usage returns the number of slots in use and the initial quota
+func (s *sendQuota) Usage() (used, quota int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used = int(s.initialQuota) - int(s.quota)
+	if used < 0 || used > int(s.initialQuota) { // quota may have wrapped following Retransmit
+		used = int(s.initialQuota)
+	}
+	return used + len(s.waiters), int(s.initialQuota)
+}
+
 // acquire attempts to allocate a slot for a message to be published
 // If noWait is true quota will be ignored and the call will return immediately, otherwise acquire will block
 // until a slot is available.
@@ -97,7 +118,6 @@ func (s *sendQuota) acquire(ctx context.Context, noWait bool) error {
 			// Acquired the semaphore after we were cancelled. Rather than trying to
 			// fix up the queue, just pretend we didn't notice the cancellation.
 			err = nil
-			fmt.Println("quota released entry but ready so nil error ", s.quota)
 		default:
 			// Remove ourselves from the list of waiters
 			for i, r := range s.waiters {
@@ -16,6 +16,7 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -101,14 +102,24 @@ type State struct {
 	clientPackets map[uint16]clientGenerated // Store relating to messages sent TO the server
 	clientStore   storer                     // Used to store session state that survives connection loss
 	lastMid       uint16                     // The message ID most recently issued
+	waitForID     bool                       // if true AddToSession waits, rather than erroring, when all packet IDs are in use
+	idFreed       *sync.Cond                 // broadcast (with s.mu held) when a packet ID is freed (created on first use)
 
 	// server store - holds packets where the message ID was generated on the server
-	serverPackets map[uint16]byte // The last packet received from the server with this ID (cleared when the transaction is complete)
-	serverStore   storer          // Used to store session state that survives connection loss
+	serverPackets map[uint16]byte     // The last packet received from the server with this ID (cleared when the transaction is complete)
+	serverStore   storer              // Used to store session state that survives connection loss
+	unacked       map[uint16]struct{} // QOS1/2 PUBLISH packets passed to the client but not yet acknowledged (see Snapshot)
 
 	// The number of messages in flight needs to be limited, as per receive maximum received from the server.
 	inflight *sendQuota
 
+	// maxStored, if > 0, limits the number of PUBLISH transactions held in the client store (see SetMaxStoredMessages)
+	maxStored       uint16
+	errorWhenFull   bool // if true AddToSession returns ErrStoreFull, rather than blocking, when the store is full
+	inflightIsStore bool // true if inflight is limited by maxStored (rather than the servers receive maximum)
+
+	onFlowControlBlocked func(waited time.Duration) // called when AddToSession had to wait for an in-flight slot
+
 	debug  paholog.Logger
 	errors paholog.Logger
 }
@@ -133,6 +144,49 @@ func NewInMemory() *State {
 	}
 }
 
+// SetMaxStoredMessages limits the number of QOS1/2 PUBLISH transactions held in the client store (0 = no limit beyond
+// the servers receive maximum). When the limit is reached, AddToSession will block until a transaction completes or,
+// if errorWhenFull is true, return session.ErrStoreFull. Messages retransmitted from an existing session count towards
+// the limit. Takes effect from the next call to ConAckReceived (so should be called before connecting).
+func (s *State) SetMaxStoredMessages(max uint16, errorWhenFull bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxStored = max
+	s.errorWhenFull = errorWhenFull
+}
+
+// SetWaitForPacketID determines what AddToSession does when all packet identifiers are in use (i.e. 65535
+// transactions are awaiting acknowledgement). By default session.ErrPacketIdentifiersExhausted is returned; if wait is
+// true AddToSession will block until an identifier is freed, its context is cancelled, or the connection is lost.
+func (s *State) SetWaitForPacketID(wait bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitForID = wait
+}
+
+// SetFlowControlBlockedHandler sets a function that will be called, with the time spent waiting, whenever a PUBLISH
+// had to wait for an in-flight slot (i.e. the servers Receive Maximum, or the limit set via SetMaxStoredMessages, had
+// been reached). The function is called from the goroutine calling AddToSession, so should not block.
+func (s *State) SetFlowControlBlockedHandler(f func(waited time.Duration)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onFlowControlBlocked = f
+}
+
+// InFlight returns the number of QOS1/2 PUBLISH transactions in flight (including those waiting for a slot) and the
+// maximum permitted (the servers Receive Maximum or the limit set via SetMaxStoredMessages). Both will be 0 if there
+// is no connection.
+func (s *State) InFlight() (inFlight, limit int) {
+	s.mu.Lock()
+	q := s.inflight
+	connected := s.conn != nil
+	s.mu.Unlock()
+	if !connected || q == nil {
+		return 0, 0
+	}
+	return q.Usage()
+}
+
 // Close closes the session state
 func (s *State) Close() error {
 	s.mu.Lock()
@@ -142,6 +196,7 @@ func (s *State) Close() error {
 		cg.responseChan <- packets.ControlPacket{} // Default control packet indicates that we are shutting down (TODO: better solution?)
 		delete(s.clientPackets, packetID)
 	}
+	s.packetIdFreed()
 	return nil
 }
 
@@ -203,6 +258,10 @@ func (s *State) ConAckReceived(conn io.Writer, cp *packets.Connect, ca *packets.
 	if ca.Properties != nil && ca.Properties.ReceiveMaximum != nil {
 		recvMax = *ca.Properties.ReceiveMaximum
 	}
+	s.inflightIsStore = s.maxStored > 0 && s.maxStored < recvMax
+	if s.inflightIsStore {
+		recvMax = s.maxStored
+	}
 	s.inflight = newSendQuota(recvMax)
 
 	// Now we need to resend any packets in the store; this must happen in order, the simplest approach is to complete
@@ -361,6 +420,7 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 	}
 	// If the connection is lost whilst we are waiting, then in Acquire should terminate.
 	connCtx := s.connCtx
+	errorWhenFull := s.errorWhenFull && s.inflightIsStore
 	s.mu.Unlock()
 
 	// If the connection drops while waiting we should abort
@@ -375,13 +435,24 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 	pt := packet.Type()
 
 	// Ensure only "RECEIVE MAXIMUM" PUBLISH transactions are in flight at any time
-	if pt == packets.PUBLISH {
+	if pt == packets.PUBLISH && errorWhenFull {
+		if !s.inflight.TryAcquire() {
+			return session.ErrStoreFull
+		}
+	} else if pt == packets.PUBLISH && !s.inflight.TryAcquire() {
+		start := time.Now()
 		if err := s.inflight.Acquire(ctx); err != nil {
 			if connCtx.Err() != nil {
 				return session.ErrNoConnection
 			}
 			return err // Allow user to confirm if it was their context that led to termination
 		}
+		s.mu.Lock()
+		onBlocked := s.onFlowControlBlocked
+		s.mu.Unlock()
+		if onBlocked != nil {
+			onBlocked(time.Since(start))
+		}
 	}
 
 	// We have a slot, so acquire a Message ID
@@ -389,8 +460,11 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 	//     its a lot of messages
 	//     receive max often defaults to a fairly low value
 	//     Maximum recieve max is 65535 which matches the number of slots (so would also need a SUB/UNSUB in flight).
-	packetID, err := s.allocateNextPacketId(pt, resp)
+	packetID, err := s.waitForPacketId(ctx, pt, resp)
 	if err != nil {
+		if connCtx.Err() != nil {
+			err = session.ErrNoConnection
+		}
 		if pt == packets.PUBLISH {
 			if qErr := s.inflight.Release(); qErr != nil {
 				s.errors.Printf("quota release due to packet id issue: %s", qErr)
@@ -400,9 +474,10 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 	}
 	packet.SetIdentifier(packetID)
 	if pt == packets.PUBLISH {
-		if err = s.clientStore.Put(packetID, pt, packet); err != nil {
+		if err = s.putClientPacket(ctx, connCtx, packetID, pt, packet); err != nil {
 			s.mu.Lock()
 			delete(s.clientPackets, packetID)
+			s.packetIdFreed()
 			s.mu.Unlock()
 			if qErr := s.inflight.Release(); qErr != nil {
 				s.errors.Printf("quota release due to store issue: %s", qErr)
@@ -414,6 +489,26 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 	return nil
 }
 
+// putClientPacket stores a client-generated packet. If the store is full, and supports it (see spaceWaiter), this
+// waits until space is available, ctx is done, or the connection (connCtx) is lost; s.mu must NOT be held.
+func (s *State) putClientPacket(ctx, connCtx context.Context, packetID uint16, pt byte, w io.WriterTo) error {
+	for {
+		err := s.clientStore.Put(packetID, pt, w)
+		sw, ok := s.clientStore.(spaceWaiter)
+		if !errors.Is(err, session.ErrStoreFull) || !ok {
+			return err
+		}
+		s.debug.Printf("store full; waiting for space to store %d", packetID)
+		err = sw.WaitForSpace(ctx)
+		if connCtx.Err() != nil { // connection loss may clean the session (freeing space)
+			return session.ErrNoConnection
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // endClientGenerated should be called when a client-generated transaction has been fully acknowledged
 // (or if, due to connection loss, it will never be acknowledged).
 func (s *State) endClientGenerated(packetID uint16, recv *packets.ControlPacket) error {
@@ -422,6 +517,7 @@ func (s *State) endClientGenerated(packetID uint16, recv *packets.ControlPacket)
 	if cg, ok := s.clientPackets[packetID]; ok {
 		cg.responseChan <- *recv
 		delete(s.clientPackets, packetID)
+		s.packetIdFreed()
 		// Outgoing publish messages will be in the store (replaced with PUBREL that is sent)
 		if cg.packetType == packets.PUBLISH || cg.packetType == packets.PUBREL {
 			if qErr := s.inflight.Release(); qErr != nil {
@@ -437,6 +533,43 @@ func (s *State) endClientGenerated(packetID uint16, recv *packets.ControlPacket)
 	return nil // TODO: Should we return errors here (not much that could be done with them)
 }
 
+// Abandon removes the client-generated transaction with packetID from the session, freeing the packet identifier and
+// in-flight slot, without notifying the requester. It returns false if the transaction is not found (e.g. because it
+// has already completed). Note that the server may still deliver (and acknowledge) an abandoned message; any such
+// acknowledgement will be ignored unless the packet identifier has been reused, in which case it may be taken to
+// acknowledge the new transaction.
+func (s *State) Abandon(packetID uint16) bool {
+	return s.abandon(packetID, nil)
+}
+
+// AbandonIf is Abandon, but only abandons the transaction if it is the one for which resp was passed to AddToSession
+// (so a transaction that has completed, and had its packet identifier reused, will not be abandoned in error).
+func (s *State) AbandonIf(packetID uint16, resp chan<- packets.ControlPacket) bool {
+	return s.abandon(packetID, resp)
+}
+
+// abandon implements Abandon and AbandonIf (resp == nil means abandon regardless of the response channel)
+func (s *State) abandon(packetID uint16, resp chan<- packets.ControlPacket) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cg, ok := s.clientPackets[packetID]
+	if !ok || (resp != nil && cg.responseChan != resp) {
+		return false
+	}
+	delete(s.clientPackets, packetID)
+	s.packetIdFreed()
+	if cg.packetType == packets.PUBLISH || cg.packetType == packets.PUBREL {
+		if qErr := s.inflight.Release(); qErr != nil {
+			s.errors.Printf("quota release due to abandon: %s", qErr)
+		}
+		if err := s.clientStore.Delete(packetID); err != nil {
+			s.errors.Printf("failed to remove message %d from store: %s", packetID, err)
+		}
+	}
+	s.debug.Printf("abandoned transaction %d", packetID)
+	return true
+}
+
 // Ack is called when the client message handlers have completed (or, if manual acknowledgements are enabled, when
 // `client.ACK()` has been called - this may happen some time after the message was received and it is conceivable that
 // the connection may have been dropped and reestablished in the interim).
@@ -455,49 +588,102 @@ func (s *State) Ack(pb *packets.Publish) error {
 func (s *State) ack(pb *packets.Publish) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	var err error
-	switch pb.QoS {
-	case 1:
-		pa := packets.Puback{
-			Properties: &packets.Properties{},
-			PacketID:   pb.PacketID,
+	resp, name, err := s.ackPacket(pb)
+	if err != nil {
+		return err
+	}
+	if s.conn == nil {
+		s.debug.Printf("%s not sent because connection down", name)
+		return nil
+	}
+	s.debug.Printf("sending %s", name)
+	if _, err = resp.WriteTo(s.conn); err != nil {
+		s.errors.Printf("failed to send %s for %d: %s", name, pb.PacketID, err)
+	}
+	return err
+}
+
+// AckBatch acknowledges multiple `PUBLISH` packets (in the order provided) using a single write to the connection.
+// The packets sent are identical to those that would be sent by calling Ack for each message, but sending them
+// together reduces the number of system calls when many messages are acknowledged at once.
+// This function will only return comms related errors (so caller can assume connection has been lost).
+func (s *State) AckBatch(pbs []*packets.Publish) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	for _, pb := range pbs {
+		resp, _, err := s.ackPacket(pb)
+		if err != nil {
+			return err
 		}
-		if s.conn != nil {
-			s.debug.Println("sending PUBACK")
-			_, err = pa.WriteTo(s.conn)
-			if err != nil {
-				s.errors.Printf("failed to send PUBACK for %d: %s", pb.PacketID, err)
-			}
-		} else {
-			s.debug.Println("PUBACK not send because connection down")
+		if _, err = resp.WriteTo(&buf); err != nil {
+			return err
+		}
+	}
+	if s.conn == nil {
+		s.debug.Printf("%d acknowledgements not sent because connection down", len(pbs))
+		return nil
+	}
+	s.debug.Printf("sending %d acknowledgements", len(pbs))
+	if err := writeAtomic(s.conn, buf.Bytes()); err != nil {
+		s.errors.Printf("failed to send %d acknowledgements: %s", len(pbs), err)
+		return err
+	}
+	return nil
+}
+
+// writeAtomic writes all of b to w. As with packets.ControlPacket.WriteTo, if w implements sync.Locker it is locked
+// whilst writing (so the data cannot be interleaved with a packet being written by another goroutine).
+func writeAtomic(w io.Writer, b []byte) error {
+	if l, ok := w.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
 		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// ackPacket returns the packet (and its name) that acknowledges the `PUBLISH`; for QOS2 the session state is updated
+// to reflect the PUBREC being sent.
+// `s.mu` must be locked when this is called.
+func (s *State) ackPacket(pb *packets.Publish) (io.WriterTo, string, error) {
+	delete(s.unacked, pb.PacketID)
+	switch pb.QoS {
+	case 1:
 		// We don't store outbound PUBACK. The server will retransmit the PUBLISH if the connection is reestablished
 		// before it receives the ACK. Unfortunately, there is no definitive way to determine if
 		// such messages are duplicates or not (so we are forced to treat them all as if they are new).
+		return &packets.Puback{
+			Properties: &packets.Properties{},
+			PacketID:   pb.PacketID,
+		}, "PUBACK", nil
 	case 2:
 		pr := packets.Pubrec{
 			Properties: &packets.Properties{},
 			PacketID:   pb.PacketID,
 		}
-		if s.conn != nil {
-			s.debug.Printf("sending PUBREC")
-			_, err = pr.WriteTo(s.conn)
-			if err != nil {
-				s.errors.Printf("failed to send PUBREC for %d: %s", pb.PacketID, err)
-			}
-		} else {
-			s.debug.Println("PUBREC not send because connection down")
-		}
-
 		// We need to record the fact that a PUBREC has been sent so we can detect receipt of a duplicate `PUBLISH`
 		// (which should not be passed to the client app)
 		cp := pr.ToControlPacket()
-		s.serverStore.Put(pb.PacketID, packets.PUBREC, cp)
+		if pErr := s.serverStore.Put(pb.PacketID, packets.PUBREC, cp); pErr != nil {
+			// Not fatal; the PUBREC is tracked in memory, but a duplicate PUBLISH would not be detected following
+			// a restart (we cannot wait for space here as s.mu is held).
+			s.errors.Printf("failed to store PUBREC for %d: %s", pb.PacketID, pErr)
+		}
 		s.serverPackets[pb.PacketID] = cp.Type
+		return &pr, "PUBREC", nil
 	default:
-		err = errors.New("ack called but publish not QOS 1 or 2")
+		return nil, "", errors.New("ack called but publish not QOS 1 or 2")
 	}
-	return err
 }
 
 // PacketReceived should be called whenever one of the following is received:
@@ -593,6 +779,14 @@ func (s *State) PacketReceived(recv *packets.ControlPacket, pubChan chan<- *pack
 				s.mu.Unlock()
 			}
 		}
+		if rp.QoS > 0 {
+			s.mu.Lock()
+			if s.unacked == nil {
+				s.unacked = make(map[uint16]struct{})
+			}
+			s.unacked[rp.PacketID] = struct{}{}
+			s.mu.Unlock()
+		}
 		pubChan <- rp // the message will be passed to router (and thus the end user app)
 		return nil
 	case *packets.Pubrel:
@@ -636,12 +830,53 @@ func (s *State) PacketReceived(recv *packets.ControlPacket, pubChan chan<- *pack
 func (s *State) allocateNextPacketId(forPacketType byte, resp chan<- packets.ControlPacket) (uint16, error) {
 	s.mu.Lock() // There may be a delay waiting for semaphore so check for connection before and after
 	defer s.mu.Unlock()
+	return s.nextPacketId(clientGenerated{packetType: forPacketType, responseChan: resp})
+}
 
-	cg := clientGenerated{
-		packetType:   forPacketType,
-		responseChan: resp,
+// waitForPacketId assigns the next available packet ID; if none are available, and SetWaitForPacketID(true) has been
+// called, it waits until one is freed or ctx is done (in which case ctx.Err() is returned).
+// Callers must NOT hold lock on s.mu
+func (s *State) waitForPacketId(ctx context.Context, forPacketType byte, resp chan<- packets.ControlPacket) (uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cg := clientGenerated{packetType: forPacketType, responseChan: resp}
+	id, err := s.nextPacketId(cg)
+	if err == nil || !s.waitForID {
+		return id, err
 	}
+	if s.idFreed == nil {
+		s.idFreed = sync.NewCond(&s.mu)
+	}
+	cond := s.idFreed
+	stop := context.AfterFunc(ctx, func() { // wake the waiter so it can return
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		cond.Broadcast()
+	})
+	defer stop()
+	s.debug.Println("all packet identifiers in use, waiting for one to be freed")
+	for {
+		cond.Wait()
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if id, err = s.nextPacketId(cg); err == nil {
+			return id, nil
+		}
+	}
+}
 
+// packetIdFreed wakes any calls to waitForPacketId (call after removing an entry from s.clientPackets)
+// caller is responsible for locking s.mu
+func (s *State) packetIdFreed() {
+	if s.idFreed != nil {
+		s.idFreed.Broadcast()
+	}
+}
+
+// nextPacketId assigns the next available packet ID to cg
+// caller is responsible for locking s.mu
+func (s *State) nextPacketId(cg clientGenerated) (uint16, error) {
 	// Scan from lastMid to end of range.
 	for i := s.lastMid + 1; i != 0; i++ {
 		if _, ok := s.clientPackets[i]; ok {
@@ -677,6 +912,8 @@ func (s *State) clean() {
 	s.debug.Println("State.clean() called")
 	s.serverPackets = make(map[uint16]byte)
 	s.clientPackets = make(map[uint16]clientGenerated)
+	s.packetIdFreed()
+	s.unacked = nil
 
 	s.serverStore.Reset()
 	s.clientStore.Reset()
@@ -713,6 +950,7 @@ func (s *State) tidy(trigger *packets.ControlPacket) {
 			p.responseChan <- packets.ControlPacket{}
 		}
 	}
+	s.packetIdFreed()
 }
 
 // SetDebugLogger takes an instance of the paho Logger interface
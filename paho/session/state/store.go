@@ -16,6 +16,7 @@
 package state
 
 import (
+	"context"
 	"io"
 )
 
@@ -33,3 +34,9 @@ type storer interface {
 	List() ([]uint16, error) // Returns packet IDs in the order they were Put
 	Reset() error            // Clears the store (deleting all messages)
 }
+
+// spaceWaiter may be implemented by a storer that has a maximum capacity (Put returning session.ErrStoreFull when
+// full); WaitForSpace should block until space is available or the context is done.
+type spaceWaiter interface {
+	WaitForSpace(ctx context.Context) error
+}
@@ -18,12 +18,18 @@ package state
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/rtalhouk/paho.golang/internal/testserver"
 	"github.com/rtalhouk/paho.golang/packets"
 	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/rtalhouk/paho.golang/paho/session"
+	"github.com/rtalhouk/paho.golang/paho/store/file"
 	"github.com/rtalhouk/paho.golang/paho/store/memory"
 )
 
@@ -147,3 +153,241 @@ func TestLoadExistingSession(t *testing.T) {
 		t.Fatalf("expected PUBLISH in the client side state, got %d", sp)
 	}
 }
+
+// TestFileSessionRecovery confirms that a session persisted using file stores can be rehydrated after a crash (the
+// State is never closed), with inflight messages retransmitted and corrupt records skipped.
+func TestFileSessionRecovery(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	stores := func() (*file.Store, *file.Store) {
+		cs, err := file.New(dir, "cli", ".pkt")
+		if err != nil {
+			t.Fatalf("failed to create client store: %s", err)
+		}
+		ss, err := file.New(dir, "srv", ".pkt")
+		if err != nil {
+			t.Fatalf("failed to create server store: %s", err)
+		}
+		return cs, ss
+	}
+	receiveMax := uint16(10)
+	ca := &packets.Connack{SessionPresent: true, Properties: &packets.Properties{ReceiveMaximum: &receiveMax}}
+
+	cs, ss := stores()
+	s := New(cs, ss)
+	if err := s.ConAckReceived(io.Discard, &packets.Connect{}, ca); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+	for _, qos := range []byte{1, 2, 2, 1} { // Will be allocated packet IDs 1-4
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).QoS = qos
+		pcp.Content.(*packets.Publish).Topic = "test"
+		if err := s.AddToSession(context.Background(), pcp.Content.(*packets.Publish), make(chan packets.ControlPacket, 1)); err != nil {
+			t.Fatalf("AddToSession failed: %s", err)
+		}
+	}
+	// 2 moves on to PUBREL, 4 is complete and a QOS2 message from the server is received (and PUBREC sent)
+	for _, cp := range []*packets.ControlPacket{
+		{FixedHeader: packets.FixedHeader{Type: packets.PUBREC}, Content: &packets.Pubrec{PacketID: 2}},
+		{FixedHeader: packets.FixedHeader{Type: packets.PUBACK}, Content: &packets.Puback{PacketID: 4}},
+		{FixedHeader: packets.FixedHeader{Type: packets.PUBLISH, Flags: 4}, Content: &packets.Publish{PacketID: 7, QoS: 2, Topic: "test"}},
+	} {
+		if err := s.PacketReceived(cp, make(chan *packets.Publish, 1)); err != nil {
+			t.Fatalf("PacketReceived failed: %s", err)
+		}
+	}
+	if err := s.Ack(&packets.Publish{PacketID: 7, QoS: 2}); err != nil {
+		t.Fatalf("Ack failed: %s", err)
+	}
+
+	// Crash (s is abandoned) and corrupt the record for packet 3
+	fn := filepath.Join(dir, "cli3.pkt")
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("failed to read file: %s", err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(fn, data, 0666); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	cs, ss = stores()
+	s = New(cs, ss)
+	var sent bytes.Buffer
+	if err := s.ConAckReceived(&sent, &packets.Connect{}, ca); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+	retransmitted := make(map[uint16]byte)
+	for sent.Len() > 0 {
+		cp, err := packets.ReadPacket(&sent)
+		if err != nil {
+			t.Fatalf("failed to read retransmitted packet: %s", err)
+		}
+		if p, ok := cp.Content.(*packets.Publish); ok && !p.Duplicate {
+			t.Errorf("retransmitted PUBLISH %d should be a duplicate", p.PacketID)
+		}
+		retransmitted[cp.PacketID()] = cp.Type
+	}
+	if len(retransmitted) != 2 || retransmitted[1] != packets.PUBLISH || retransmitted[2] != packets.PUBREL {
+		t.Errorf("expected PUBLISH 1 and PUBREL 2 to be retransmitted, got %v", retransmitted)
+	}
+	if _, ok := s.clientPackets[3]; ok {
+		t.Errorf("corrupt packet 3 should not be in the client side state")
+	}
+	if sp, ok := s.serverPackets[7]; !ok || sp != packets.PUBREC {
+		t.Errorf("expected PUBREC for packet 7 in the server side state, got %v", s.serverPackets)
+	}
+	s.Close()
+}
+
+// TestMaxStoredMessages confirms that the number of messages in the client store is limited as expected
+func TestMaxStoredMessages(t *testing.T) {
+	t.Parallel()
+
+	for _, errorWhenFull := range []bool{false, true} {
+		s := New(memory.New(), memory.New())
+		s.SetMaxStoredMessages(2, errorWhenFull)
+
+		receiveMax := uint16(10) // Greater than the store limit
+		if err := s.ConAckReceived(io.Discard, &packets.Connect{}, &packets.Connack{
+			Properties: &packets.Properties{ReceiveMaximum: &receiveMax},
+		}); err != nil {
+			t.Fatalf("ConAckReceived failed: %s", err)
+		}
+
+		publish := func(ctx context.Context) error {
+			pcp := packets.NewControlPacket(packets.PUBLISH)
+			pcp.Content.(*packets.Publish).QoS = 1
+			pcp.Content.(*packets.Publish).Topic = "test"
+			return s.AddToSession(ctx, pcp.Content.(*packets.Publish), make(chan packets.ControlPacket, 1))
+		}
+		for i := 0; i < 2; i++ {
+			if err := publish(context.Background()); err != nil {
+				t.Fatalf("publish %d failed: %s", i, err)
+			}
+		}
+		if ids, err := s.clientStore.List(); err != nil || len(ids) != 2 {
+			t.Fatalf("expected 2 stored messages, got %v (%v)", ids, err)
+		}
+
+		// The store is full so the next publish should error or block
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := publish(ctx)
+		cancel()
+		if errorWhenFull {
+			if !errors.Is(err, session.ErrStoreFull) {
+				t.Errorf("expected ErrStoreFull, got %v", err)
+			}
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected publish to block until context deadline, got %v", err)
+		}
+		if ids, err := s.clientStore.List(); err != nil || len(ids) != 2 {
+			t.Errorf("expected 2 stored messages, got %v (%v)", ids, err)
+		}
+
+		// Completing a transaction should free a slot
+		if err := s.PacketReceived(&packets.ControlPacket{
+			FixedHeader: packets.FixedHeader{Type: packets.PUBACK},
+			Content:     &packets.Puback{PacketID: 1},
+		}, nil); err != nil {
+			t.Fatalf("PacketReceived failed: %s", err)
+		}
+		if err := publish(context.Background()); err != nil {
+			t.Errorf("publish after PUBACK failed: %s", err)
+		}
+		s.Close()
+	}
+}
+
+// TestBoundedStoreFull confirms that full bounded stores do not deadlock the state (e.g. when acknowledging a QOS2
+// PUBLISH, or when the connection is lost whilst a publish is awaiting space)
+func TestBoundedStoreFull(t *testing.T) {
+	t.Parallel()
+	s := New(memory.NewBounded(1), memory.NewBounded(1))
+	s.SetErrorLogger(paholog.NewTestLogger(t, "error:"))
+
+	receiveMax := uint16(10) // Greater than the store limit
+	if err := s.ConAckReceived(io.Discard, &packets.Connect{}, &packets.Connack{
+		Properties: &packets.Properties{ReceiveMaximum: &receiveMax},
+	}); err != nil {
+		t.Fatalf("ConAckReceived failed: %s", err)
+	}
+
+	// Server store: the second PUBREC cannot be stored, but this must not block
+	pubChan := make(chan *packets.Publish, 2)
+	acked := make(chan error, 1)
+	go func() {
+		for id := uint16(1); id <= 2; id++ {
+			pcp := packets.NewControlPacket(packets.PUBLISH)
+			pb := pcp.Content.(*packets.Publish)
+			pb.QoS = 2
+			pb.PacketID = id
+			pb.Topic = "test"
+			if err := s.PacketReceived(pcp, pubChan); err != nil {
+				acked <- err
+				return
+			}
+			if err := s.Ack(<-pubChan); err != nil {
+				acked <- err
+				return
+			}
+		}
+		acked <- nil
+	}()
+	select {
+	case err := <-acked:
+		if err != nil {
+			t.Fatalf("failed to receive/ack PUBLISH: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acknowledging PUBLISH blocked when server store full")
+	}
+
+	// Client store: the second publish will wait for space; losing the connection should end the wait
+	publish := func() error {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).QoS = 1
+		pcp.Content.(*packets.Publish).Topic = "test"
+		return s.AddToSession(context.Background(), pcp.Content.(*packets.Publish), make(chan packets.ControlPacket, 1))
+	}
+	if err := publish(); err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+	published := make(chan error, 1)
+	go func() { published <- publish() }()
+	select {
+	case err := <-published:
+		t.Fatalf("publish should have waited for space (err: %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		s.ConnectionLost(nil)
+		close(lost)
+	}()
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("ConnectionLost blocked when stores full")
+	}
+	select {
+	case err := <-published:
+		if !errors.Is(err, session.ErrNoConnection) {
+			t.Errorf("expected ErrNoConnection, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish did not return following connection loss")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked when stores full")
+	}
+}
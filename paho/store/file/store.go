@@ -16,7 +16,11 @@
 package file
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -31,10 +35,21 @@ const (
 	filePermissions   = os.FileMode(0666)
 	tmpExtension      = ".tmp"
 	corruptExtension  = ".CORRUPT" // quarantined files will be given this extension
+
+	// Each file begins with a header containing checksumMarker followed by the CRC32 (IEEE, big endian) of the
+	// packet. A valid MQTT packet cannot begin with 0x00, so files written before checksums were introduced can still
+	// be read (without verification).
+	checksumMarker = byte(0x00)
+	headerLen      = 5
 )
 
+// ErrChecksumMismatch is returned by Get when a stored packet fails checksum verification (the file will be quarantined)
+var ErrChecksumMismatch = errors.New("stored packet checksum mismatch")
+
 // New creates a file Store. Note that a file is written, read and deleted as part of this process to check that the
-// path is usable.
+// path is usable. Any temporary files left in path by a crash part way through a Put are removed.
+// Each change (Put, Delete, Quarantine) is flushed to disk (including the folder entry) before returning, so a
+// session rehydrated from the store after a crash reflects every state transition that completed.
 // NOTE: Order is maintained using file ModTime, so there may be issues if the interval between messages is less than
 // the file system ModTime resolution.
 func New(path string, prefix string, extension string) (*Store, error) {
@@ -66,9 +81,13 @@ func New(path string, prefix string, extension string) (*Store, error) {
 	if err := os.Remove(fn); err != nil {
 		return nil, fmt.Errorf("failed to remove test file from specified folder: %w", err)
 	}
+	if err := removeTempFiles(path, prefix, extension); err != nil {
+		return nil, err
+	}
 
 	return &Store{
 		path:      path,
+		tempPath:  path,
 		prefix:    prefix,
 		extension: extension,
 	}, nil
@@ -80,27 +99,73 @@ type Store struct {
 	// server store - holds packets where the message ID was generated on the server
 	sync.Mutex // Is this needed?
 	path       string
+	tempPath   string // folder in which files are written prior to being renamed into path
 	prefix     string
 	extension  string
 }
 
+// SetTempDir sets the folder used for temporary files (by default the store folder is used). Files are written to the
+// temporary folder and then atomically renamed into place, so a crash mid-write never leaves a partial packet file in
+// the store (any temporary files left behind are ignored). The folder MUST be on the same filesystem as the store;
+// this is checked by writing and renaming a test file.
+func (s *Store) SetTempDir(dir string) error {
+	s.Lock()
+	defer s.Unlock()
+	f, err := os.CreateTemp(dir, s.prefix+"TEST-*"+s.extension+tmpExtension)
+	if err != nil {
+		return fmt.Errorf("failed to create test file in temp folder: %w", err)
+	}
+	tmpFn := f.Name()
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmpFn)
+		return fmt.Errorf("failed to close test file in temp folder: %w", err)
+	}
+	fn := filepath.Join(s.path, s.prefix+"TEST"+s.extension)
+	if err = os.Rename(tmpFn, fn); err != nil {
+		_ = os.Remove(tmpFn)
+		return fmt.Errorf("failed to rename test file from temp folder (must be on the same filesystem): %w", err)
+	}
+	if err = os.Remove(fn); err != nil {
+		return fmt.Errorf("failed to remove test file from specified folder: %w", err)
+	}
+	if err = removeTempFiles(dir, s.prefix, s.extension); err != nil {
+		return err
+	}
+	s.tempPath = dir
+	return nil
+}
+
 // Put stores the packet
-// The store is performed via a temporary file to reduce the chance that a partially written file will
-// cause issues.
+// The store is performed via a temporary file (see SetTempDir) which is renamed into place, so a crash part way
+// through will not leave a partially written file in the store.
 func (s *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 	s.Lock()
 	defer s.Unlock()
 
-	f, err := os.CreateTemp(s.path, s.fileNamePrefix(packetID)+"-*"+s.extension+tmpExtension)
+	f, err := os.CreateTemp(s.tempPath, s.fileNamePrefix(packetID)+"-*"+s.extension+tmpExtension)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 	tmpFn := f.Name()
-	if _, err = w.WriteTo(f); err != nil {
+	header := make([]byte, headerLen) // written first as a placeholder; the checksum is filled in once known
+	header[0] = checksumMarker
+	if _, err = f.Write(header); err != nil {
+		f.Close()
+		_ = os.Remove(tmpFn)
+		return fmt.Errorf("failed to write header to temp file: %w", err)
+	}
+	crc := crc32.NewIEEE()
+	if _, err = w.WriteTo(io.MultiWriter(f, crc)); err != nil {
 		f.Close()
 		_ = os.Remove(tmpFn)
 		return fmt.Errorf("failed to write packet to temp file: %w", err)
 	}
+	binary.BigEndian.PutUint32(header[1:], crc.Sum32())
+	if _, err = f.WriteAt(header, 0); err != nil {
+		f.Close()
+		_ = os.Remove(tmpFn)
+		return fmt.Errorf("failed to write checksum to temp file: %w", err)
+	}
 	f.Sync() // want timestamps to be as accurate as possible (close and rename do not imply sync)
 	if err = f.Close(); err != nil {
 		_ = os.Remove(tmpFn)
@@ -110,19 +175,29 @@ func (s *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 		_ = os.Remove(tmpFn)
 		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
-	return nil
+	return syncDir(s.path)
 }
 
 // Get retrieves the requested packet
 // Note that callers MUST close the returned ReadCloser
+// If the checksum does not match then the file is quarantined and an error wrapping ErrChecksumMismatch returned.
 func (s *Store) Get(packetID uint16) (io.ReadCloser, error) {
 	s.Lock()
 	defer s.Unlock()
-	f, err := os.OpenFile(s.filePathForId(packetID), os.O_RDONLY, 0)
+	data, err := os.ReadFile(s.filePathForId(packetID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open packet file: %w", err)
 	}
-	return f, nil
+	if len(data) == 0 || data[0] != checksumMarker { // written prior to the introduction of checksums
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if len(data) < headerLen || binary.BigEndian.Uint32(data[1:headerLen]) != crc32.ChecksumIEEE(data[headerLen:]) {
+		if qErr := s.quarantine(packetID); qErr != nil {
+			return nil, fmt.Errorf("%w (packet %d); quarantine failed: %s", ErrChecksumMismatch, packetID, qErr)
+		}
+		return nil, fmt.Errorf("%w (packet %d)", ErrChecksumMismatch, packetID)
+	}
+	return io.NopCloser(bytes.NewReader(data[headerLen:])), nil
 }
 
 // Delete removes the message with the specified store ID
@@ -137,6 +212,12 @@ func (s *Store) Delete(id uint16) error {
 func (s *Store) Quarantine(id uint16) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.quarantine(id)
+}
+
+// quarantine moves the file for the specified packet into quarantine
+// caller must lock mutex
+func (s *Store) quarantine(id uint16) error {
 	f, err := os.CreateTemp(s.path, s.fileNamePrefix(id)+"-*"+s.extension+corruptExtension)
 	if err != nil {
 		s.delete(id) // delete the file (otherwise it may be sent on every reconnection)
@@ -151,7 +232,7 @@ func (s *Store) Quarantine(id uint16) error {
 		s.delete(id) // delete the file (otherwise it may be sent on every reconnection)
 		return fmt.Errorf("failed to move packet into quarantine: %w", err)
 	}
-	return nil
+	return syncDir(s.path)
 }
 
 type idAndModTime struct {
@@ -221,7 +302,7 @@ func (s *Store) list() ([]uint16, error) {
 	sort.Slice(ids, func(i, j int) bool {
 		return ids[i].modTime.Before(ids[j].modTime)
 	})
-	ret := make([]uint16, len(entries))
+	ret := make([]uint16, len(ids))
 	for i := range ids {
 		ret[i] = ids[i].id
 	}
@@ -234,6 +315,37 @@ func (s *Store) delete(id uint16) error {
 	if err := os.Remove(s.filePathForId(id)); err != nil {
 		return fmt.Errorf("failed to remove packet file: %w", err)
 	}
+	return syncDir(s.path)
+}
+
+// syncDir flushes the folder dir to disk, so that files created, renamed or removed within it persist through a crash
+// (syncing the file itself does not guarantee this). Not all platforms support syncing a folder (e.g. Windows), so
+// failures are ignored where this is the case.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open folder for sync: %w", err)
+	}
+	err = d.Sync()
+	_ = d.Close()
+	if err != nil && !errors.Is(err, os.ErrPermission) && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("failed to sync folder: %w", err)
+	}
+	return nil
+}
+
+// removeTempFiles removes temporary files (written by Put) from dir; these will only exist if a crash occurred between
+// a file being written and renamed into place (so the packet was never stored).
+func removeTempFiles(dir, prefix, extension string) error {
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, prefix+"*"+extension+tmpExtension))
+	if err != nil {
+		return fmt.Errorf("failed to find temp files: %w", err)
+	}
+	for _, fn := range tmpFiles {
+		if err := os.Remove(fn); err != nil {
+			return fmt.Errorf("failed to remove temp file %s: %w", fn, err)
+		}
+	}
 	return nil
 }
 
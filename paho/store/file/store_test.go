@@ -17,8 +17,10 @@ package file
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -148,6 +150,163 @@ func TestFileStoreNaming(t *testing.T) {
 
 }
 
+// TestFileStoreChecksum checks that a corrupted file is detected (and quarantined) when the store is reloaded
+func TestFileStoreChecksum(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, err := New(dir, "foo", ".ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint16{1, 2} {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).PacketID = id
+		pcp.Content.(*packets.Publish).QoS = 1
+		pcp.Content.(*packets.Publish).Payload = []byte(fmt.Sprintf("payload %d", id))
+		if err := s.Put(id, packets.PUBLISH, pcp); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+	}
+
+	// Corrupt the last byte of packet 1's payload
+	fn := s.filePathForId(1)
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("failed to read file: %s", err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(fn, data, filePermissions); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	// A file written before checksums were introduced should still be readable
+	pcp := packets.NewControlPacket(packets.PUBLISH)
+	pcp.Content.(*packets.Publish).PacketID = 3
+	pcp.Content.(*packets.Publish).QoS = 1
+	var legacy bytes.Buffer
+	if _, err := pcp.WriteTo(&legacy); err != nil {
+		t.Fatalf("failed to write packet: %s", err)
+	}
+	if err := os.WriteFile(s.filePathForId(3), legacy.Bytes(), filePermissions); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	// Reload the store
+	s, err = New(dir, "foo", ".ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(1); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	for _, id := range []uint16{2, 3} {
+		rp, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("failed to get %d: %s", id, err)
+		}
+		p, err := packets.ReadPacket(rp)
+		if err != nil {
+			t.Fatalf("error decoding packet %d: %s", id, err)
+		}
+		rp.Close()
+		if p.PacketID() != id {
+			t.Fatalf("unexpected packet id returned: %d", p.PacketID())
+		}
+	}
+
+	// The corrupt file should have been quarantined so will no longer be listed
+	ids, err := s.List()
+	if err != nil {
+		t.Fatalf("failed to list: %s", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected packets 2 and 3 to be listed, got %v", ids)
+	}
+	for _, id := range ids {
+		if id == 1 {
+			t.Fatalf("corrupt packet still listed: %v", ids)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %s", err)
+	}
+	var quarantined bool
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "foo1-") && strings.HasSuffix(e.Name(), corruptExtension) {
+			quarantined = true
+		}
+	}
+	if !quarantined {
+		t.Errorf("corrupt file was not quarantined: %v", entries)
+	}
+}
+
+// TestFileStoreTempDir checks that files are written via the temp folder and that a temp file left behind by a crash
+// (between write and rename) is ignored, and removed, on reload
+func TestFileStoreTempDir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	tmpDir := t.TempDir()
+	s, err := New(dir, "foo", ".ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTempDir(tmpDir); err != nil {
+		t.Fatalf("failed to set temp dir: %s", err)
+	}
+	if err := s.SetTempDir(filepath.Join(tmpDir, "missing")); err == nil {
+		t.Fatal("setting a missing temp dir should fail")
+	}
+
+	pcp := packets.NewControlPacket(packets.PUBLISH)
+	pcp.Content.(*packets.Publish).PacketID = 1
+	pcp.Content.(*packets.Publish).QoS = 1
+	pcp.Content.(*packets.Publish).Payload = []byte("good")
+	if err := s.Put(1, packets.PUBLISH, pcp); err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+	if entries, err := os.ReadDir(tmpDir); err != nil || len(entries) != 0 {
+		t.Fatalf("temp dir should be empty; got %v (%v)", entries, err)
+	}
+
+	// Simulate a crash whilst replacing packet 1 (the new version was written but not renamed into place)
+	partial := filepath.Join(tmpDir, s.fileNamePrefix(1)+"-123"+s.extension+tmpExtension)
+	if err := os.WriteFile(partial, []byte{checksumMarker, 1, 2}, filePermissions); err != nil {
+		t.Fatalf("failed to write temp file: %s", err)
+	}
+
+	s, err = New(dir, "foo", ".ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTempDir(tmpDir); err != nil {
+		t.Fatalf("failed to set temp dir: %s", err)
+	}
+	if entries, err := os.ReadDir(tmpDir); err != nil || len(entries) != 0 {
+		t.Fatalf("temp file left by crash should have been removed; got %v (%v)", entries, err)
+	}
+	ids, err := s.List()
+	if err != nil {
+		t.Fatalf("failed to list: %s", err)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected [1], got %v", ids)
+	}
+	rp, err := s.Get(1)
+	if err != nil {
+		t.Fatalf("failed to get: %s", err)
+	}
+	p, err := packets.ReadPacket(rp)
+	if err != nil {
+		t.Fatalf("error decoding packet: %s", err)
+	}
+	rp.Close()
+	if payload := p.Content.(*packets.Publish).Payload; !bytes.Equal(payload, []byte("good")) {
+		t.Fatalf("unexpected payload returned: %s", payload)
+	}
+}
+
 // TestFileStoreBig creates a fully populated Store and checks things work
 // Adding messages would make the structure bigger but should have no impact on the struct functions.
 // Commenting this out as it's very slow!
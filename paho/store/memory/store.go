@@ -17,16 +17,19 @@ package memory
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"sync"
 
 	"github.com/rtalhouk/paho.golang/packets"
+	"github.com/rtalhouk/paho.golang/paho/session"
 )
 
 var (
 	ErrNotInStore = errors.New("the requested ID was not found in the store") // Returned when requested ID not found
+	ErrStoreFull  = session.ErrStoreFull                                      // Returned by Put when a bounded store is full
 )
 
 // memoryPacket is an element in the memory store
@@ -43,18 +46,60 @@ func New() *Store {
 
 }
 
+// NewBounded creates a Store that holds, at most, maxPackets packets. When the store is full, Put will return
+// ErrStoreFull (replacing an existing packet is always permitted). This provides predictable memory use; callers
+// wishing to apply backpressure (e.g. to a QOS1/2 publish) can use WaitForSpace (the session state does this).
+func NewBounded(maxPackets int) *Store {
+	m := New()
+	m.max = maxPackets
+	m.space = make(chan struct{})
+	return m
+}
+
 // Store is an implementation of a Store that stores the data in memory
 type Store struct {
 	// server store - holds packets where the message ID was generated on the server
 	sync.Mutex
 	data map[uint16]memoryPacket // Holds messages initiated by the server (i.e. we will receive the PUBLISH)
 	c    int                     // sequence counter used to maintain message order
+
+	max           int           // maximum number of packets held (0 = unbounded)
+	space         chan struct{} // closed (and replaced) when a packet is removed (only set if max > 0)
+	size          int           // total size, in bytes, of the stored packets
+	highWaterMark int           // the maximum number of packets held at any one time
+}
+
+// Stats holds metrics relating to a memory Store
+type Stats struct {
+	Count         int // Number of packets currently held
+	Bytes         int // Total size of the packets currently held
+	HighWaterMark int // Maximum number of packets held at any one time
+	Max           int // Maximum number of packets that can be held (0 = unbounded)
+}
+
+// Stats returns the current metrics for the store
+func (m *Store) Stats() Stats {
+	m.Lock()
+	defer m.Unlock()
+	return Stats{
+		Count:         len(m.data),
+		Bytes:         m.size,
+		HighWaterMark: m.highWaterMark,
+		Max:           m.max,
+	}
 }
 
 // Put stores the packet
+// If the Store is bounded (see NewBounded) and full, then ErrStoreFull is returned (Put never blocks; it may be
+// called whilst the caller holds locks)
 func (m *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 	m.Lock()
 	defer m.Unlock()
+	if m.max > 0 {
+		if _, ok := m.data[packetID]; !ok && len(m.data) >= m.max {
+			return ErrStoreFull
+		}
+	}
 	var buff bytes.Buffer
 
 	_, err := w.WriteTo(&buff)
@@ -62,11 +107,16 @@ func (m *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 		panic(err)
 	}
 
+	m.size -= len(m.data[packetID].p) // in case we are replacing an existing packet
 	m.data[packetID] = memoryPacket{
 		c: m.c,
 		p: buff.Bytes(),
 	}
 	m.c++
+	m.size += buff.Len()
+	if len(m.data) > m.highWaterMark {
+		m.highWaterMark = len(m.data)
+	}
 	return nil
 }
 
@@ -84,11 +134,14 @@ func (m *Store) Get(packetID uint16) (io.ReadCloser, error) {
 func (m *Store) Delete(id uint16) error {
 	m.Lock()
 	defer m.Unlock()
-	if _, ok := m.data[id]; !ok {
+	d, ok := m.data[id]
+	if !ok {
 		// This could be ignored, but reporting it may help reveal other issues
 		return fmt.Errorf("request to delete packet %d; packet not found", id)
 	}
 	delete(m.data, id)
+	m.size -= len(d.p)
+	m.spaceAvailable()
 	return nil
 }
 
@@ -128,9 +181,40 @@ func (m *Store) Reset() error {
 	m.Lock()
 	defer m.Unlock()
 	m.data = make(map[uint16]memoryPacket)
+	m.size = 0
+	m.spaceAvailable()
 	return nil
 }
 
+// WaitForSpace blocks until the store has space for a new packet, or ctx is done (in which case ctx.Err() is
+// returned). It returns immediately if the store is not bounded. Note that space may have been used by another
+// caller by the time Put is called (so ErrStoreFull remains possible).
+func (m *Store) WaitForSpace(ctx context.Context) error {
+	for {
+		m.Lock()
+		if m.max <= 0 || len(m.data) < m.max {
+			m.Unlock()
+			return nil
+		}
+		space := m.space
+		m.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// spaceAvailable wakes any WaitForSpace calls waiting for space
+// caller must lock mutex
+func (m *Store) spaceAvailable() {
+	if m.space != nil {
+		close(m.space)
+		m.space = make(chan struct{})
+	}
+}
+
 // String is for debugging purposes; it dumps the content of the store in a readable format
 func (m *Store) String() string {
 	var b bytes.Buffer
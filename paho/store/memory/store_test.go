@@ -17,9 +17,11 @@ package memory
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/rtalhouk/paho.golang/packets"
 )
@@ -92,6 +94,85 @@ func TestMemoryStore(t *testing.T) {
 
 }
 
+// TestMemoryStoreBounded checks that a bounded store rejects packets when full (with WaitForSpace enabling
+// backpressure) and that Stats are accurate
+func TestMemoryStoreBounded(t *testing.T) {
+	s := NewBounded(2)
+
+	put := func(id uint16) error {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).PacketID = id
+		pcp.Content.(*packets.Publish).QoS = 1
+		pcp.Content.(*packets.Publish).Payload = []byte(fmt.Sprintf("%d", id))
+		return s.Put(id, packets.PUBLISH, pcp)
+	}
+	for _, id := range []uint16{1, 2} {
+		if err := put(id); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+	}
+	if err := put(2); err != nil { // Replacing an existing packet should not block
+		t.Fatalf("failed to replace: %s", err)
+	}
+
+	// The store is full so the next Put should fail; WaitForSpace should block until a packet is deleted
+	if err := put(3); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForSpace(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected WaitForSpace to block until context done, got %v", err)
+	}
+	waitDone := make(chan error, 1)
+	go func() { waitDone <- s.WaitForSpace(context.Background()) }()
+	select {
+	case err := <-waitDone:
+		t.Fatalf("WaitForSpace should have blocked (err: %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := s.Delete(1); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	select {
+	case err := <-waitDone:
+		if err != nil {
+			t.Fatalf("WaitForSpace failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSpace did not return after delete")
+	}
+	if err := put(3); err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+
+	if err := s.Delete(2); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	stats := s.Stats()
+	if stats.Count != 1 || stats.HighWaterMark != 2 || stats.Max != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	rp, err := s.Get(3)
+	if err != nil {
+		t.Fatalf("failed to get: %s", err)
+	}
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(rp); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if stats.Bytes != b.Len() {
+		t.Errorf("expected %d bytes, got %d", b.Len(), stats.Bytes)
+	}
+
+	if err := s.Reset(); err != nil {
+		t.Fatalf("failed to reset: %s", err)
+	}
+	if stats = s.Stats(); stats.Count != 0 || stats.Bytes != 0 || stats.HighWaterMark != 2 {
+		t.Errorf("unexpected stats following reset: %+v", stats)
+	}
+}
+
 // TestMemoryStoreBig creates a fully populated Store and checks things work
 // Adding messages would make the structure bigger but should have no impact on the struct functions.
 func TestMemoryStoreBig(t *testing.T) {
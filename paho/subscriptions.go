@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// UnsubscribedPublishPolicy determines what happens when a PUBLISH is received on a topic that does not match any
+// tracked subscription (see Client.Subscriptions). This may occur due to a server bug, or a race following Unsubscribe.
+type UnsubscribedPublishPolicy int
+
+const (
+	UnsubscribedPublishDeliver       UnsubscribedPublishPolicy = iota // Pass the message to the OnPublishReceived handlers (default)
+	UnsubscribedPublishDrop                                           // Acknowledge the message (if QoS > 0) without passing it to the handlers
+	UnsubscribedPublishProtocolError                                  // Treat as a protocol violation (disconnect with reason code 0x82)
+)
+
+// ErrUnsubscribedPublish is passed to OnClientError when a PUBLISH is received on a topic that does not match any
+// subscription and UnsubscribedPublishPolicy is UnsubscribedPublishProtocolError
+var ErrUnsubscribedPublish = errors.New("received PUBLISH that matches no subscription")
+
+// Subscription is an active subscription as reported by Client.Subscriptions
+type Subscription struct {
+	SubscribeOptions
+	SubscriptionIdentifier *int // The Subscription Identifier sent with the SUBSCRIBE (if any)
+}
+
+// subscriptionTracker maintains the set of active subscriptions (based upon SUBACK/UNSUBACK reason codes)
+type subscriptionTracker struct {
+	mu        sync.Mutex
+	subs      map[string]Subscription // keyed by topic filter
+	pendingID map[int]int             // Subscription Identifiers in SUBSCRIBE requests awaiting a SUBACK (value is count)
+}
+
+// seed adds the provided subscriptions to the tracked set
+func (t *subscriptionTracker) seed(subs []Subscription) {
+	if len(subs) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subs == nil {
+		t.subs = make(map[string]Subscription)
+	}
+	for _, s := range subs {
+		t.subs[s.Topic] = s
+	}
+}
+
+// subscribed records the subscriptions in s that were accepted by the server (as per the reason codes in the SUBACK).
+// Where accepted, the QoS recorded will be that granted by the server.
+func (t *subscriptionTracker) subscribed(s *Subscribe, reasons []byte) {
+	var subID *int
+	if s.Properties != nil && s.Properties.SubscriptionIdentifier != nil {
+		id := *s.Properties.SubscriptionIdentifier
+		subID = &id
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, so := range s.Subscriptions {
+		if i >= len(reasons) || reasons[i] >= 0x80 {
+			continue
+		}
+		if t.subs == nil {
+			t.subs = make(map[string]Subscription)
+		}
+		so.QoS = reasons[i] // Reason codes 0-2 are the granted QoS
+		t.subs[so.Topic] = Subscription{SubscribeOptions: so, SubscriptionIdentifier: subID}
+	}
+}
+
+// unsubscribed removes the topics in u that the server reported as successfully unsubscribed
+func (t *subscriptionTracker) unsubscribed(u *Unsubscribe, reasons []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, topic := range u.Topics {
+		if i >= len(reasons) || reasons[i] >= 0x80 {
+			continue
+		}
+		delete(t.subs, topic)
+	}
+}
+
+// matches returns true if topic matches the filter of any tracked subscription
+func (t *subscriptionTracker) matches(topic string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for filter := range t.subs {
+		if match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownID returns true if id has been requested (and is either awaiting a SUBACK or in use by an active subscription)
+func (t *subscriptionTracker) knownID(id int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.knownIDLocked(id)
+}
+
+// knownIDLocked is knownID for use when mu is held
+func (t *subscriptionTracker) knownIDLocked(id int) bool {
+	if t.pendingID[id] > 0 {
+		return true
+	}
+	for _, s := range t.subs {
+		if s.SubscriptionIdentifier != nil && *s.SubscriptionIdentifier == id {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveID records that a SUBSCRIBE using Subscription Identifier id is about to be sent. If max > 0, and id is not
+// already known, false will be returned if max identifiers are already in use. releaseID must be called (once the
+// SUBACK has been processed) if true is returned.
+func (t *subscriptionTracker) reserveID(id int, max int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max > 0 && !t.knownIDLocked(id) {
+		ids := make(map[int]struct{}, len(t.pendingID))
+		for pid := range t.pendingID {
+			ids[pid] = struct{}{}
+		}
+		for _, s := range t.subs {
+			if s.SubscriptionIdentifier != nil {
+				ids[*s.SubscriptionIdentifier] = struct{}{}
+			}
+		}
+		if len(ids) >= max {
+			return false
+		}
+	}
+	if t.pendingID == nil {
+		t.pendingID = make(map[int]int)
+	}
+	t.pendingID[id]++
+	return true
+}
+
+// releaseID is called when a SUBSCRIBE, for which reserveID was called, has completed (successfully or otherwise)
+func (t *subscriptionTracker) releaseID(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pendingID[id]--; t.pendingID[id] <= 0 {
+		delete(t.pendingID, id)
+	}
+}
+
+// list returns the active subscriptions ordered by topic filter
+func (t *subscriptionTracker) list() []Subscription {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subs := make([]Subscription, 0, len(t.subs))
+	for _, s := range t.subs {
+		if s.SubscriptionIdentifier != nil {
+			id := *s.SubscriptionIdentifier
+			s.SubscriptionIdentifier = &id
+		}
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	return subs
+}
+
+// Subscriptions returns the subscriptions currently believed to be active (ordered by topic filter). This is
+// maintained by tracking the results of Subscribe and Unsubscribe calls; note that the server may drop subscriptions
+// (e.g. if the session is not present upon reconnection) without this being reflected here.
+func (c *Client) Subscriptions() []Subscription {
+	return c.subscriptions.list()
+}
+
+// checkSubscribed applies UnsubscribedPublishPolicy to a received PUBLISH, returning false if the message should not
+// be passed to the handlers.
+func (c *Client) checkSubscribed(pb *packets.Publish) bool {
+	if c.config.UnsubscribedPublishPolicy == UnsubscribedPublishDeliver ||
+		pb.Topic == "" || // Topic alias without a topic; we cannot tell what this relates to
+		c.subscriptions.matches(pb.Topic) {
+		return true
+	}
+	switch c.config.UnsubscribedPublishPolicy {
+	case UnsubscribedPublishDrop:
+		c.debug.Printf("dropping PUBLISH to %s (no matching subscription)", pb.Topic)
+		c.ackDropped(pb)
+	case UnsubscribedPublishProtocolError:
+		c.debug.Printf("received PUBLISH to %s (no matching subscription), disconnecting", pb.Topic)
+		d := packets.Disconnect{ReasonCode: packets.DisconnectProtocolError}
+		if _, err := d.WriteTo(c.config.Conn); err != nil {
+			c.debug.Printf("failed to send DISCONNECT: %s", err)
+		}
+		go c.error(fmt.Errorf("%w: %s", ErrUnsubscribedPublish, pb.Topic))
+	}
+	return false
+}
+
+// checkSubscriptionIdentifier removes, and logs, a Subscription Identifier in a received PUBLISH that does not
+// correspond to any identifier requested by this client (see ValidateSubscriptionIdentifiers).
+func (c *Client) checkSubscriptionIdentifier(pb *packets.Publish) {
+	if pb.Properties == nil || pb.Properties.SubscriptionIdentifier == nil {
+		return
+	}
+	if id := *pb.Properties.SubscriptionIdentifier; !c.subscriptions.knownID(id) {
+		c.errors.Println("received PUBLISH to", pb.Topic, "with unrequested subscription identifier", id, "(identifier ignored)")
+		pb.Properties.SubscriptionIdentifier = nil
+	}
+}
+
+// ResyncSubscriptions resubscribes to the tracked subscriptions (see Subscriptions) where the server may have lost
+// them. Servers do not report their subscriptions, so this relies on the tracked set and the SessionPresent flag in the
+// CONNACK; if the session was present then the server should hold the subscriptions and nothing is sent, otherwise
+// all tracked subscriptions are requested (one SUBSCRIBE per Subscription Identifier). Only valid after Connect has
+// returned successfully.
+func (c *Client) ResyncSubscriptions(ctx context.Context) error {
+	if c.sessionPresent {
+		c.debug.Println("session present, subscriptions do not need to be resynced")
+		return nil
+	}
+	var order []*int
+	groups := make(map[int][]SubscribeOptions) // keyed by subscription identifier (0 = none)
+	for _, s := range c.Subscriptions() {
+		var id int
+		if s.SubscriptionIdentifier != nil {
+			id = *s.SubscriptionIdentifier
+		}
+		if _, ok := groups[id]; !ok {
+			order = append(order, s.SubscriptionIdentifier)
+		}
+		groups[id] = append(groups[id], s.SubscribeOptions)
+	}
+	for _, subID := range order {
+		var id int
+		sub := &Subscribe{}
+		if subID != nil {
+			id = *subID
+			sub.Properties = &SubscribeProperties{SubscriptionIdentifier: subID}
+		}
+		sub.Subscriptions = groups[id]
+		c.debug.Printf("resyncing subscriptions %+v", sub.Subscriptions)
+		if _, err := c.Subscribe(ctx, sub); err != nil {
+			return fmt.Errorf("failed to resync subscriptions: %w", err)
+		}
+	}
+	return nil
+}
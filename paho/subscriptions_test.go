@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptions(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	clientCtx := basicClientInitialisation(c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	assert.Empty(t, c.Subscriptions())
+	subID := 5
+
+	// The server grants a lower QoS for test/2 and rejects test/4
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons:    []byte{1, 1, 0, packets.SubackNotauthorized},
+		Properties: &packets.Properties{},
+	})
+	_, err := c.Subscribe(context.Background(), &Subscribe{
+		Subscriptions: []SubscribeOptions{
+			{Topic: "test/1", QoS: 1},
+			{Topic: "test/2", QoS: 2, NoLocal: true},
+			{Topic: "test/3", QoS: 0, RetainAsPublished: true},
+			{Topic: "test/4", QoS: 1},
+		},
+	})
+	require.Error(t, err) // test/4 was rejected
+
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons:    []byte{2},
+		Properties: &packets.Properties{},
+	})
+	_, err = c.Subscribe(context.Background(), &Subscribe{
+		Properties:    &SubscribeProperties{SubscriptionIdentifier: &subID},
+		Subscriptions: []SubscribeOptions{{Topic: "test/5", QoS: 2, RetainHandling: 2}},
+	})
+	require.NoError(t, err)
+
+	ts.SetResponse(packets.UNSUBACK, &packets.Unsuback{
+		Reasons:    []byte{packets.UnsubackSuccess},
+		Properties: &packets.Properties{},
+	})
+	_, err = c.Unsubscribe(context.Background(), &Unsubscribe{Topics: []string{"test/1"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Subscription{
+		{SubscribeOptions: SubscribeOptions{Topic: "test/2", QoS: 1, NoLocal: true}},
+		{SubscribeOptions: SubscribeOptions{Topic: "test/3", QoS: 0, RetainAsPublished: true}},
+		{SubscribeOptions: SubscribeOptions{Topic: "test/5", QoS: 2, RetainHandling: 2}, SubscriptionIdentifier: &subID},
+	}, c.Subscriptions())
+}
+
+func TestResyncSubscriptions(t *testing.T) {
+	subID := 7
+	tracked := []Subscription{
+		{SubscribeOptions: SubscribeOptions{Topic: "test/1", QoS: 1}},
+		{SubscribeOptions: SubscribeOptions{Topic: "test/2", QoS: 2, NoLocal: true}},
+		{SubscribeOptions: SubscribeOptions{Topic: "test/3", QoS: 0}, SubscriptionIdentifier: &subID},
+	}
+
+	for _, sessionPresent := range []bool{false, true} {
+		ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+		ts.SetResponse(packets.CONNACK, &packets.Connack{
+			ReasonCode:     packets.ConnackSuccess,
+			SessionPresent: sessionPresent,
+			Properties:     &packets.Properties{},
+		})
+		go ts.Run()
+
+		c := NewClient(ClientConfig{
+			Conn:                 ts.ClientConn(),
+			InitialSubscriptions: tracked,
+		})
+		require.NotNil(t, c)
+		assert.Equal(t, tracked, c.Subscriptions())
+
+		_, err := c.Connect(context.Background(), &Connect{
+			KeepAlive: 30,
+			ClientID:  "testClient",
+		})
+		require.NoError(t, err)
+
+		// The SUBACK will be used for both SUBSCRIBE packets so include enough reason codes
+		ts.SetResponse(packets.SUBACK, &packets.Suback{
+			Reasons:    []byte{1, 2},
+			Properties: &packets.Properties{},
+		})
+		require.NoError(t, c.ResyncSubscriptions(context.Background()))
+
+		subs := ts.ReceivedSubscribes()
+		if sessionPresent {
+			assert.Empty(t, subs)
+		} else {
+			require.Len(t, subs, 2)
+			require.Len(t, subs[0].Subscriptions, 2)
+			assert.Equal(t, "test/1", subs[0].Subscriptions[0].Topic)
+			assert.Equal(t, byte(1), subs[0].Subscriptions[0].QoS)
+			assert.Equal(t, "test/2", subs[0].Subscriptions[1].Topic)
+			assert.True(t, subs[0].Subscriptions[1].NoLocal)
+			assert.Nil(t, subs[0].Properties.SubscriptionIdentifier)
+			require.Len(t, subs[1].Subscriptions, 1)
+			assert.Equal(t, "test/3", subs[1].Subscriptions[0].Topic)
+			require.NotNil(t, subs[1].Properties.SubscriptionIdentifier)
+			assert.Equal(t, subID, *subs[1].Properties.SubscriptionIdentifier)
+		}
+		c.close()
+		ts.Stop()
+	}
+}
+
+// TestUnsubscribedPublishPolicy confirms the handling of a PUBLISH that matches no subscription under each policy
+func TestUnsubscribedPublishPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        UnsubscribedPublishPolicy
+		wantDelivered []string
+		wantAcks      []uint16
+		wantErr       bool
+	}{
+		{"deliver", UnsubscribedPublishDeliver, []string{"other/topic", "sub/a"}, []uint16{1, 2}, false},
+		{"drop", UnsubscribedPublishDrop, []string{"sub/a"}, []uint16{1, 2}, false},
+		{"protocolError", UnsubscribedPublishProtocolError, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+			go ts.Run()
+			defer ts.Stop()
+
+			var mu sync.Mutex
+			var delivered []string
+			clientErr := make(chan error, 10)
+			c := NewClient(ClientConfig{
+				Conn:                      ts.ClientConn(),
+				InitialSubscriptions:      []Subscription{{SubscribeOptions: SubscribeOptions{Topic: "sub/#", QoS: 1}}},
+				UnsubscribedPublishPolicy: tt.policy,
+				OnPublishReceived: []func(PublishReceived) (bool, error){
+					func(pr PublishReceived) (bool, error) {
+						mu.Lock()
+						delivered = append(delivered, pr.Packet.Topic)
+						mu.Unlock()
+						return true, nil
+					},
+				},
+				OnClientError: func(err error) {
+					select {
+					case clientErr <- err:
+					default:
+					}
+				},
+			})
+			require.NotNil(t, c)
+			defer c.close()
+
+			_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+			require.NoError(t, err)
+
+			require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 1, Topic: "other/topic", QoS: 1, Properties: &packets.Properties{}}))
+			if tt.wantErr {
+				timeout := time.After(time.Second)
+			errLoop:
+				for { // Other errors (e.g. connection closed) may also be reported
+					select {
+					case err := <-clientErr:
+						if errors.Is(err, ErrUnsubscribedPublish) {
+							break errLoop
+						}
+					case <-timeout:
+						t.Fatal("expected ErrUnsubscribedPublish")
+					}
+				}
+				<-c.Done()
+				mu.Lock()
+				assert.Empty(t, delivered)
+				mu.Unlock()
+				assert.Empty(t, ts.ReceivedPubacks())
+				return
+			}
+			require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 2, Topic: "sub/a", QoS: 1, Properties: &packets.Properties{}}))
+
+			require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == len(tt.wantAcks) }, time.Second, 10*time.Millisecond)
+			var acks []uint16
+			for _, pa := range ts.ReceivedPubacks() {
+				acks = append(acks, pa.PacketID)
+			}
+			assert.Equal(t, tt.wantAcks, acks)
+			mu.Lock()
+			assert.Equal(t, tt.wantDelivered, delivered)
+			mu.Unlock()
+		})
+	}
+}
+
+// TestUnsubscribedPublishDropManualAck confirms that, with manual acknowledgment enabled, the acknowledgment of a
+// dropped PUBLISH is not sent before that of an earlier PUBLISH the application has yet to acknowledge
+func TestUnsubscribedPublishDropManualAck(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	received := make(chan *Publish, 1)
+	c := NewClient(ClientConfig{
+		Conn:                       ts.ClientConn(),
+		InitialSubscriptions:       []Subscription{{SubscribeOptions: SubscribeOptions{Topic: "sub/#", QoS: 1}}},
+		UnsubscribedPublishPolicy:  UnsubscribedPublishDrop,
+		EnableManualAcknowledgment: true,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 1, Topic: "sub/a", QoS: 1, Properties: &packets.Properties{}}))
+	pb := <-received
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 2, Topic: "other/topic", QoS: 1, Properties: &packets.Properties{}}))
+
+	time.Sleep(3 * defaultSendAckInterval) // Allow time for an (incorrect) acknowledgment of the dropped message
+	assert.Empty(t, ts.ReceivedPubacks())
+
+	require.NoError(t, c.Ack(pb))
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 2 }, time.Second, 10*time.Millisecond)
+	var acks []uint16
+	for _, pa := range ts.ReceivedPubacks() {
+		acks = append(acks, pa.PacketID)
+	}
+	assert.Equal(t, []uint16{1, 2}, acks)
+}
+
+// TestSubscriptionIdentifierValidation confirms that an unrequested Subscription Identifier in a received PUBLISH is
+// logged and removed, and that MaxSubscriptionIdentifiers is enforced
+func TestSubscriptionIdentifierValidation(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	ts.SetResponse(packets.SUBACK, &packets.Suback{Reasons: []byte{1}, Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	received := make(chan *Publish, 2)
+	c := NewClient(ClientConfig{
+		Conn:                            ts.ClientConn(),
+		MaxSubscriptionIdentifiers:      1,
+		ValidateSubscriptionIdentifiers: true,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	errLog := &countingLogger{}
+	c.SetErrorLogger(errLog)
+
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	subID := 5
+	_, err = c.Subscribe(context.Background(), &Subscribe{
+		Subscriptions: []SubscribeOptions{{Topic: "test/#", QoS: 1}},
+		Properties:    &SubscribeProperties{SubscriptionIdentifier: &subID},
+	})
+	require.NoError(t, err)
+
+	// A second identifier exceeds MaxSubscriptionIdentifiers
+	otherID := 6
+	_, err = c.Subscribe(context.Background(), &Subscribe{
+		Subscriptions: []SubscribeOptions{{Topic: "other/#", QoS: 1}},
+		Properties:    &SubscribeProperties{SubscriptionIdentifier: &otherID},
+	})
+	require.ErrorIs(t, err, ErrInvalidArguments)
+
+	// The requested identifier is passed through
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/a", Properties: &packets.Properties{SubscriptionIdentifier: &subID}}))
+	select {
+	case p := <-received:
+		require.NotNil(t, p.Properties.SubscriptionIdentifier)
+		assert.Equal(t, subID, *p.Properties.SubscriptionIdentifier)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	assert.Equal(t, 0, errLog.Count())
+
+	// An unrequested identifier is logged and removed
+	unknownID := 99
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/b", Properties: &packets.Properties{SubscriptionIdentifier: &unknownID}}))
+	select {
+	case p := <-received:
+		assert.Equal(t, "test/b", p.Topic)
+		assert.Nil(t, p.Properties.SubscriptionIdentifier)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	assert.Equal(t, 1, errLog.Count())
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// ErrInvalidTopicAlias is passed to OnClientError when the server sends a PUBLISH with a topic alias that is outside the
+// permitted range, or that has not been registered (the client disconnects with reason code 0x94).
+var ErrInvalidTopicAlias = errors.New("received PUBLISH with invalid topic alias")
+
+// AliasEvictionPolicy selects the outbound topic alias to reassign when all aliases (up to the servers
+// TopicAliasMaximum) are in use and a message is published to a topic without an alias. Calls are serialised (so an
+// implementation need not be thread-safe unless it is shared between clients that are connected concurrently).
+type AliasEvictionPolicy interface {
+	// Reset is called when a connection is established (aliases do not survive the connection)
+	Reset()
+	// Used is called whenever alias is assigned to a topic, or used in a PUBLISH
+	Used(alias uint16)
+	// Evict returns the alias to reassign, which must be one of candidates (aliases that are not being used by a
+	// PUBLISH in the process of being written), or 0 if the PUBLISH should be sent without an alias
+	Evict(candidates []uint16) uint16
+}
+
+// lruAliasEvictionPolicy is an AliasEvictionPolicy that evicts the least recently used alias
+type lruAliasEvictionPolicy struct {
+	tick     uint64
+	lastUsed map[uint16]uint64
+}
+
+// NewLRUAliasEvictionPolicy returns an AliasEvictionPolicy that reassigns the least recently used alias (this is the
+// default)
+func NewLRUAliasEvictionPolicy() AliasEvictionPolicy {
+	return &lruAliasEvictionPolicy{lastUsed: make(map[uint16]uint64)}
+}
+
+// Reset implements AliasEvictionPolicy
+func (l *lruAliasEvictionPolicy) Reset() {
+	clear(l.lastUsed)
+}
+
+// Used implements AliasEvictionPolicy
+func (l *lruAliasEvictionPolicy) Used(alias uint16) {
+	l.tick++
+	l.lastUsed[alias] = l.tick
+}
+
+// Evict implements AliasEvictionPolicy
+func (l *lruAliasEvictionPolicy) Evict(candidates []uint16) uint16 {
+	var victim uint16
+	for _, c := range candidates {
+		if victim == 0 || l.lastUsed[c] < l.lastUsed[victim] {
+			victim = c
+		}
+	}
+	return victim
+}
+
+// outboundAlias is an alias assigned to a topic
+type outboundAlias struct {
+	alias       uint16
+	topic       string
+	established bool // true once a PUBLISH carrying both the topic and alias has been written to the connection
+	pending     int  // number of PUBLISH packets using the alias that are being written (alias cannot be reassigned)
+}
+
+// outboundAliases assigns topic aliases to outbound PUBLISH packets (see EnableOutboundTopicAlias)
+type outboundAliases struct {
+	mu      sync.Mutex
+	enabled bool
+	max     uint16 // TopicAliasMaximum from the CONNACK
+	policy  AliasEvictionPolicy
+	byTopic map[string]*outboundAlias
+	byAlias map[uint16]*outboundAlias
+}
+
+// setEnabled enables/disables the assignment of aliases (existing assignments are retained, and will be reused if
+// re-enabled, as the server retains them for the life of the connection)
+func (a *outboundAliases) setEnabled(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enabled = enabled
+}
+
+// setPolicy sets the AliasEvictionPolicy (nil means aliases are not reassigned)
+func (a *outboundAliases) setPolicy(policy AliasEvictionPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policy = policy
+}
+
+// setMaximum sets the maximum alias value (the servers TopicAliasMaximum); called when the connection is established
+func (a *outboundAliases) setMaximum(max uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.max = max
+	if a.policy != nil {
+		a.policy.Reset()
+	}
+}
+
+// allocate returns the alias for topic, assigning one if needed (reassigning an existing alias, as selected by the
+// policy, if all are in use). Returns nil if no alias is available. a.mu must be held.
+func (a *outboundAliases) allocate(topic string) *outboundAlias {
+	if oa, ok := a.byTopic[topic]; ok {
+		return oa
+	}
+	if a.byTopic == nil {
+		a.byTopic = make(map[string]*outboundAlias)
+		a.byAlias = make(map[uint16]*outboundAlias)
+	}
+	alias := uint16(len(a.byAlias) + 1)
+	if len(a.byAlias) >= int(a.max) {
+		if a.policy == nil {
+			return nil
+		}
+		var candidates []uint16
+		for _, oa := range a.byAlias {
+			if oa.pending == 0 {
+				candidates = append(candidates, oa.alias)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		slices.Sort(candidates) // consistent ordering for the policy
+		alias = a.policy.Evict(candidates)
+		if _, found := slices.BinarySearch(candidates, alias); !found {
+			return nil
+		}
+		delete(a.byTopic, a.byAlias[alias].topic)
+	}
+	oa := &outboundAlias{alias: alias, topic: topic}
+	a.byTopic[topic] = oa
+	a.byAlias[alias] = oa
+	return oa
+}
+
+// apply returns the packet to write to the connection; this will be a copy of pb using a topic alias if aliases are
+// enabled and one is available. pb itself is not modified (it may be held in the session state and retransmitted
+// on a new connection, where the alias is unknown). If non-nil, done must be called once the attempt to write the
+// returned packet completes. Until an alias has been written the topic continues to be sent alongside it (so
+// concurrent publishes cannot reach the server before the alias has been established), and an alias will not be
+// reassigned whilst a packet using it is being written.
+func (a *outboundAliases) apply(pb *packets.Publish) (*packets.Publish, func(written bool)) {
+	if pb.Topic == "" || (pb.Properties != nil && pb.Properties.TopicAlias != nil) {
+		return pb, nil // user is managing aliases
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.enabled || a.max == 0 {
+		return pb, nil
+	}
+	oa := a.allocate(pb.Topic)
+	if oa == nil {
+		return pb, nil
+	}
+	if a.policy != nil {
+		a.policy.Used(oa.alias)
+	}
+	oa.pending++
+
+	cp := *pb
+	if pb.Properties != nil {
+		props := *pb.Properties
+		cp.Properties = &props
+	} else {
+		cp.Properties = &packets.Properties{}
+	}
+	cp.Properties.TopicAlias = Uint16(oa.alias)
+	if oa.established {
+		cp.Topic = ""
+	}
+	return &cp, func(written bool) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		oa.pending--
+		if written {
+			oa.established = true
+		}
+	}
+}
+
+// EnableOutboundTopicAlias enables, or disables, the automatic use of topic aliases in PUBLISH packets sent to the
+// server (see ClientConfig.EnableOutboundTopicAlias).
+func (c *Client) EnableOutboundTopicAlias(enable bool) {
+	c.outboundAliases.setEnabled(enable)
+}
+
+// writePublish writes pb to the connection, using a topic alias if enabled (see EnableOutboundTopicAlias)
+func (c *Client) writePublish(pb *packets.Publish) error {
+	wp, done := c.outboundAliases.apply(pb)
+	_, err := wp.WriteTo(c.config.Conn)
+	if done != nil {
+		done(err == nil)
+	}
+	return err
+}
+
+// inboundAliases records the topic aliases registered by the server (only accessed from the incoming goroutine)
+type inboundAliases map[uint16]string
+
+// resolveTopicAlias handles the TopicAlias property of a PUBLISH received from the server, registering the alias if a
+// topic is present, and otherwise setting the topic to that previously registered. If the alias is invalid (0,
+// greater than the TopicAliasMaximum sent in the CONNECT, or unknown) a DISCONNECT with reason code 0x94 is sent and
+// false is returned.
+func (c *Client) resolveTopicAlias(pb *packets.Publish) bool {
+	if pb.Properties == nil || pb.Properties.TopicAlias == nil {
+		return true
+	}
+	alias := *pb.Properties.TopicAlias
+	if alias != 0 && alias <= c.clientProps.TopicAliasMaximum {
+		if pb.Topic != "" {
+			if c.inboundAliases == nil {
+				c.inboundAliases = make(inboundAliases)
+			}
+			c.inboundAliases[alias] = pb.Topic
+			return true
+		}
+		if topic, ok := c.inboundAliases[alias]; ok {
+			pb.Topic = topic
+			return true
+		}
+	}
+	c.debug.Printf("received PUBLISH with invalid topic alias %d, disconnecting", alias)
+	d := packets.Disconnect{ReasonCode: packets.DisconnectTopicAliasInvalid}
+	if _, err := d.WriteTo(c.config.Conn); err != nil {
+		c.debug.Printf("failed to send DISCONNECT: %s", err)
+	}
+	// This is called from the incoming goroutine (which close waits on) so shutdown is initiated without waiting for
+	// it to complete.
+	c.cancelFunc()
+	go c.config.OnClientError(fmt.Errorf("%w: %d", ErrInvalidTopicAlias, alias))
+	return false
+}
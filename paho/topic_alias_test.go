@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOutboundTopicAlias confirms that topic aliases are assigned, and reused, when publishing
+func TestOutboundTopicAlias(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	received := make(chan *packets.Publish, 10)
+	go func() { // Server that accepts 2 topic aliases and acknowledges QoS1 messages
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{TopicAliasMaximum: Uint16(2)}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if p, ok := recv.Content.(*packets.Publish); ok {
+				received <- p
+				if p.QoS == 1 {
+					if _, err = (&packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	c := NewClient(ClientConfig{Conn: cliConn, EnableOutboundTopicAlias: true})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "OutboundTopicAlias:"))
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	for _, tt := range []struct {
+		topic     string
+		qos       byte
+		wantTopic string
+		wantAlias uint16 // 0 = no alias
+		disable   bool
+	}{
+		{topic: "test/a", wantTopic: "test/a", wantAlias: 1},
+		{topic: "test/a", wantTopic: "", wantAlias: 1},
+		{topic: "test/b", qos: 1, wantTopic: "test/b", wantAlias: 2},
+		{topic: "test/b", qos: 1, wantTopic: "", wantAlias: 2},
+		{topic: "test/c", wantTopic: "test/c", wantAlias: 1}, // Least recently used alias is reassigned
+		{topic: "test/a", wantTopic: "test/a", wantAlias: 2},
+		{topic: "test/a", wantTopic: "test/a", disable: true},
+	} {
+		if tt.disable {
+			c.EnableOutboundTopicAlias(false)
+		}
+		p := &Publish{Topic: tt.topic, QoS: tt.qos, Payload: []byte("payload")}
+		_, err = c.Publish(context.Background(), p)
+		require.NoError(t, err)
+		assert.Equal(t, tt.topic, p.Topic) // callers Publish must not be modified
+		select {
+		case sp := <-received:
+			assert.Equal(t, tt.wantTopic, sp.Topic)
+			if tt.wantAlias == 0 {
+				assert.Nil(t, sp.Properties.TopicAlias)
+			} else if assert.NotNil(t, sp.Properties.TopicAlias) {
+				assert.Equal(t, tt.wantAlias, *sp.Properties.TopicAlias)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("PUBLISH not received by server")
+		}
+	}
+}
+
+// TestOutboundAliasesApply checks that an alias is only used without the topic once it has been established
+func TestOutboundAliasesApply(t *testing.T) {
+	var a outboundAliases
+	pb := &packets.Publish{Topic: "test", Properties: &packets.Properties{}}
+
+	wp, done := a.apply(pb)
+	assert.Same(t, pb, wp, "disabled, so packet should not be changed")
+	assert.Nil(t, done)
+
+	a.setEnabled(true)
+	a.setMaximum(1)
+	wp, done = a.apply(pb)
+	require.NotNil(t, done)
+	assert.Equal(t, "test", wp.Topic)
+	assert.Equal(t, uint16(1), *wp.Properties.TopicAlias)
+	assert.Nil(t, pb.Properties.TopicAlias, "original packet must not be modified")
+
+	wp, done2 := a.apply(pb) // Not yet written, so the topic must still be sent
+	assert.Equal(t, "test", wp.Topic)
+	done2(false)
+
+	done(true)
+	wp, done = a.apply(pb)
+	assert.Equal(t, "", wp.Topic)
+	assert.Equal(t, uint16(1), *wp.Properties.TopicAlias)
+	assert.Equal(t, "test", pb.Topic)
+	done(true)
+
+	wp, _ = a.apply(&packets.Publish{Topic: "test", Properties: &packets.Properties{TopicAlias: Uint16(1)}})
+	assert.Equal(t, "test", wp.Topic, "user assigned aliases should not be changed")
+}
+
+// mruPolicy is an AliasEvictionPolicy that evicts the most recently used alias
+type mruPolicy struct {
+	last    uint16
+	evicted []uint16
+}
+
+func (m *mruPolicy) Reset()            { m.last = 0 }
+func (m *mruPolicy) Used(alias uint16) { m.last = alias }
+func (m *mruPolicy) Evict(candidates []uint16) uint16 {
+	for _, c := range candidates {
+		if c == m.last {
+			m.evicted = append(m.evicted, c)
+			return c
+		}
+	}
+	return 0
+}
+
+// TestAliasEvictionPolicy confirms that the policy selects the alias that is reassigned when all are in use
+func TestAliasEvictionPolicy(t *testing.T) {
+	// publish applies an alias to a PUBLISH to topic (simulating a successful write) and returns the alias and topic sent
+	publish := func(a *outboundAliases, topic string) (uint16, string) {
+		wp, done := a.apply(&packets.Publish{Topic: topic})
+		if done != nil {
+			done(true)
+		}
+		if wp.Properties == nil || wp.Properties.TopicAlias == nil {
+			return 0, wp.Topic
+		}
+		return *wp.Properties.TopicAlias, wp.Topic
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		policy := &mruPolicy{}
+		a := outboundAliases{enabled: true, policy: policy}
+		a.setMaximum(3)
+		for i, topic := range []string{"a", "b", "c"} {
+			alias, _ := publish(&a, topic)
+			assert.Equal(t, uint16(i+1), alias)
+		}
+		publish(&a, "a") // "a" is now the most recently used
+		alias, topic := publish(&a, "d")
+		assert.Equal(t, uint16(1), alias, "most recently used alias should be reassigned")
+		assert.Equal(t, "d", topic)
+		assert.Equal(t, []uint16{1}, policy.evicted)
+
+		alias, topic = publish(&a, "a") // "a" no longer has an alias so (as "d" is most recent) alias 1 is reassigned
+		assert.Equal(t, uint16(1), alias)
+		assert.Equal(t, "a", topic)
+		alias, topic = publish(&a, "b") // "b" retains its alias
+		assert.Equal(t, uint16(2), alias)
+		assert.Equal(t, "", topic)
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		a := outboundAliases{enabled: true, policy: NewLRUAliasEvictionPolicy()}
+		a.setMaximum(2)
+		publish(&a, "a")
+		publish(&a, "b")
+		publish(&a, "a")
+		alias, topic := publish(&a, "c")
+		assert.Equal(t, uint16(2), alias, "least recently used alias (b) should be reassigned")
+		assert.Equal(t, "c", topic)
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		a := outboundAliases{enabled: true, policy: NewLRUAliasEvictionPolicy()}
+		a.setMaximum(1)
+		wp, done := a.apply(&packets.Publish{Topic: "a"})
+		require.NotNil(t, wp.Properties.TopicAlias)
+		alias, topic := publish(&a, "b") // Alias 1 is being written, so cannot be reassigned
+		assert.Equal(t, uint16(0), alias)
+		assert.Equal(t, "b", topic)
+		done(true)
+		alias, _ = publish(&a, "b")
+		assert.Equal(t, uint16(1), alias)
+	})
+}
+
+// TestInboundTopicAlias confirms that topic aliases used by the server are resolved and that invalid aliases result in
+// a DISCONNECT with reason code 0x94
+func TestInboundTopicAlias(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		badAlias uint16
+		badTopic string
+	}{
+		{name: "unknown", badAlias: 2},
+		{name: "outOfRange", badAlias: 3, badTopic: "test/c"},
+		{name: "zero", badAlias: 0, badTopic: "test/c"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cliConn, srvConn := net.Pipe()
+			defer srvConn.Close()
+			disconnect := make(chan *packets.Disconnect, 1)
+			go func() {
+				if _, err := packets.ReadPacket(srvConn); err != nil {
+					return
+				}
+				if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+					return
+				}
+				for _, p := range []*packets.Publish{
+					{Topic: "test/a", Properties: &packets.Properties{TopicAlias: Uint16(1)}},
+					{Topic: "", Properties: &packets.Properties{TopicAlias: Uint16(1)}},
+					{Topic: tt.badTopic, Properties: &packets.Properties{TopicAlias: Uint16(tt.badAlias)}},
+				} {
+					if _, err := p.WriteTo(srvConn); err != nil {
+						return
+					}
+				}
+				for {
+					recv, err := packets.ReadPacket(srvConn)
+					if err != nil {
+						return
+					}
+					if d, ok := recv.Content.(*packets.Disconnect); ok {
+						disconnect <- d
+						return
+					}
+				}
+			}()
+
+			received := make(chan string, 3)
+			clientErr := make(chan error, 1)
+			c := NewClient(ClientConfig{
+				Conn: cliConn,
+				OnPublishReceived: []func(PublishReceived) (bool, error){
+					func(pr PublishReceived) (bool, error) {
+						received <- pr.Packet.Topic
+						return true, nil
+					},
+				},
+				OnClientError: func(err error) { clientErr <- err },
+			})
+			require.NotNil(t, c)
+			c.SetDebugLogger(paholog.NewTestLogger(t, "InboundTopicAlias:"))
+			_, err := c.Connect(context.Background(), &Connect{
+				KeepAlive:  30,
+				ClientID:   "testClient",
+				CleanStart: true,
+				Properties: &ConnectProperties{TopicAliasMaximum: Uint16(2)},
+			})
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				select {
+				case topic := <-received:
+					assert.Equal(t, "test/a", topic)
+				case <-time.After(time.Second):
+					t.Fatal("PUBLISH not received")
+				}
+			}
+			select {
+			case d := <-disconnect:
+				assert.Equal(t, byte(packets.DisconnectTopicAliasInvalid), d.ReasonCode)
+			case <-time.After(time.Second):
+				t.Fatal("DISCONNECT not received")
+			}
+			select {
+			case err := <-clientErr:
+				assert.ErrorIs(t, err, ErrInvalidTopicAlias)
+			case <-time.After(time.Second):
+				t.Fatal("OnClientError not called")
+			}
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Fatal("client not done")
+			}
+			assert.Empty(t, received)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sharePrefix is the prefix of a shared subscription filter ($share/{ShareName}/{filter})
+const sharePrefix = "$share/"
+
+// ErrInvalidShareName is returned when a shared subscription group (ShareName) is empty or contains "/", "+" or "#"
+var ErrInvalidShareName = errors.New("invalid share name")
+
+// ShareName returns the shared subscription filter ($share/{group}/{filter}) for group and filter. An error is
+// returned if group is empty or contains "/", "+" or "#" (MQTT-4.8.2-2), or filter is empty.
+func ShareName(group, filter string) (string, error) {
+	if group == "" || strings.ContainsAny(group, "/+#") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidShareName, group)
+	}
+	if filter == "" {
+		return "", fmt.Errorf("%w: shared subscription filter must not be empty", ErrInvalidArguments)
+	}
+	return sharePrefix + group + "/" + filter, nil
+}
+
+// IsSharedSubscription returns true if topic is a shared subscription filter (i.e. begins with "$share/")
+func IsSharedSubscription(topic string) bool {
+	return strings.HasPrefix(topic, sharePrefix)
+}
+
+// ParseSharedSubscription splits a shared subscription filter ($share/{group}/{filter}) into its group and filter;
+// ok is false if topic is not a valid shared subscription filter.
+func ParseSharedSubscription(topic string) (group, filter string, ok bool) {
+	if !IsSharedSubscription(topic) {
+		return "", "", false
+	}
+	group, filter, found := strings.Cut(topic[len(sharePrefix):], "/")
+	if !found || group == "" || filter == "" || strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+	return group, filter, true
+}
+
+// FilterMatches returns true if the topic filter matches the topic (i.e. a message published to topic would be
+// delivered to a subscription with filter). Shared subscription filters ($share/{ShareName}/{filter}) are supported.
+func FilterMatches(filter, topic string) bool {
+	return match(filter, topic)
+}
+
+// FilterSubsumes returns true if filter a matches every topic that filter b matches (e.g. "sport/#" subsumes
+// "sport/tennis/+"), meaning that a subscription to b would be redundant alongside a subscription to a. A filter
+// subsumes itself. Shared subscription filters are compared using the filter part only.
+// A filter starting with a wildcard does not match topics beginning with "$" (MQTT-4.7.2-1), so does not subsume a
+// filter whose first level begins with "$" (e.g. "#" does not subsume "$SYS/#").
+func FilterSubsumes(a, b string) bool {
+	as, bs := routeSplit(a), routeSplit(b)
+	if len(as) > 0 && len(bs) > 0 && (as[0] == "#" || as[0] == "+") && strings.HasPrefix(bs[0], "$") {
+		return false
+	}
+	return subsumesDeep(as, bs)
+}
+
+func subsumesDeep(a []string, b []string) bool {
+	if len(a) == 0 {
+		return len(b) == 0
+	}
+	if a[0] == "#" {
+		return true // "#" also matches the parent level (so "a/#" subsumes "a")
+	}
+	if len(b) == 0 || b[0] == "#" {
+		return false
+	}
+	if a[0] == "+" || (a[0] == b[0] && b[0] != "+") {
+		return subsumesDeep(a[1:], b[1:])
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFilterMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/#", "sport", true},
+		{"sport/#", "sport/tennis/player1", true},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"$share/group/sport/+", "sport/tennis", true},
+		{"sport/tennis", "sport/golf", false},
+	}
+	for _, tt := range tests {
+		if got := FilterMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("FilterMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestFilterSubsumes(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"sport/#", "sport/tennis/+", true},
+		{"sport/tennis/+", "sport/#", false},
+		{"sport/#", "sport", true},
+		{"sport", "sport/#", false},
+		{"#", "sport/tennis/+", true},
+		{"#", "#", true},
+		{"sport/+/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/+/player1", false},
+		{"sport/+/+", "sport/+/player1", true},
+		{"sport/+", "sport/tennis/player1", false},
+		{"sport/+", "sport/#", false},
+		{"sport/tennis", "sport/tennis", true},
+		{"sport/tennis", "sport/golf", false},
+		{"+/tennis/#", "sport/tennis/player1/#", true},
+		{"$share/group/sport/#", "sport/tennis", true},
+		{"#", "$SYS/x", false},
+		{"#", "$SYS/#", false},
+		{"+/#", "$SYS/broker/load", false},
+		{"+/x", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+		{"$SYS/+", "$SYS/x", true},
+		{"sport/#", "sport/$x", true}, // "$" only special at the first level
+		{"#", "+/x", true},            // "+/x" does not match "$" topics either
+		{"$share/group/#", "$SYS/x", false},
+	}
+	for _, tt := range tests {
+		if got := FilterSubsumes(tt.a, tt.b); got != tt.want {
+			t.Errorf("FilterSubsumes(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestShareName(t *testing.T) {
+	tests := []struct {
+		group, filter string
+		want          string
+		wantErr       error
+	}{
+		{"group", "sport/tennis/+", "$share/group/sport/tennis/+", nil},
+		{"g1", "#", "$share/g1/#", nil},
+		{"", "sport", "", ErrInvalidShareName},
+		{"a/b", "sport", "", ErrInvalidShareName},
+		{"a+", "sport", "", ErrInvalidShareName},
+		{"#", "sport", "", ErrInvalidShareName},
+		{"group", "", "", ErrInvalidArguments},
+	}
+	for _, tt := range tests {
+		got, err := ShareName(tt.group, tt.filter)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("ShareName(%q, %q) = %q, %v, want %q, %v", tt.group, tt.filter, got, err, tt.want, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if !IsSharedSubscription(got) {
+			t.Errorf("IsSharedSubscription(%q) = false", got)
+		}
+		if g, f, ok := ParseSharedSubscription(got); !ok || g != tt.group || f != tt.filter {
+			t.Errorf("ParseSharedSubscription(%q) = %q, %q, %v, want %q, %q, true", got, g, f, ok, tt.group, tt.filter)
+		}
+	}
+}
+
+func TestParseSharedSubscription(t *testing.T) {
+	tests := []struct {
+		topic         string
+		shared        bool
+		group, filter string
+		ok            bool
+	}{
+		{"sport/tennis", false, "", "", false},
+		{"$shared/group/sport", false, "", "", false},
+		{"$share/group/sport/#", true, "group", "sport/#", true},
+		{"$share/group", true, "", "", false},
+		{"$share//sport", true, "", "", false},
+		{"$share/group/", true, "", "", false},
+		{"$share/gr+up/sport", true, "", "", false},
+	}
+	for _, tt := range tests {
+		if got := IsSharedSubscription(tt.topic); got != tt.shared {
+			t.Errorf("IsSharedSubscription(%q) = %v, want %v", tt.topic, got, tt.shared)
+		}
+		g, f, ok := ParseSharedSubscription(tt.topic)
+		if g != tt.group || f != tt.filter || ok != tt.ok {
+			t.Errorf("ParseSharedSubscription(%q) = %q, %q, %v, want %q, %q, %v", tt.topic, g, f, ok, tt.group, tt.filter, tt.ok)
+		}
+	}
+}
+
+// TestSubscribeInvalidSharedSubscription confirms that Subscribe rejects malformed shared subscription filters
+func TestSubscribeInvalidSharedSubscription(t *testing.T) {
+	c := NewClient(ClientConfig{})
+	_, err := c.Subscribe(context.Background(), &Subscribe{Subscriptions: []SubscribeOptions{{Topic: "$share/group"}}})
+	if !errors.Is(err, ErrInvalidArguments) {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+}
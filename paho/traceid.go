@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// newTraceID returns a random (version 4) UUID
+func newTraceID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// addTraceID adds a user property, with key c.config.TraceIDKey, holding a newly generated trace ID to pb (unless
+// a property with that key is already present).
+func (c *Client) addTraceID(pb *packets.Publish) error {
+	if pb.Properties == nil {
+		pb.Properties = &packets.Properties{}
+	}
+	for _, u := range pb.Properties.User {
+		if u.Key == c.config.TraceIDKey {
+			c.debug.Printf("publish to %s has existing %s %s", pb.Topic, u.Key, u.Value)
+			return nil
+		}
+	}
+	id, err := newTraceID()
+	if err != nil {
+		return fmt.Errorf("failed to generate trace ID: %w", err)
+	}
+	pb.Properties.User = append(pb.Properties.User, packets.User{Key: c.config.TraceIDKey, Value: id})
+	c.debug.Printf("publish to %s assigned %s %s", pb.Topic, c.config.TraceIDKey, id)
+	return nil
+}
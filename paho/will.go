@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// ErrWillMismatch is returned (wrapped) by Connect.CheckWillMessage when a message does not match the Will
+var ErrWillMismatch = errors.New("message does not match will")
+
+// ErrWillNotAccepted is returned (wrapped) by Connect.ValidateWill and Client.WillAccepted when the server does not
+// support the Will as requested (e.g. a retained Will where the server has RetainAvailable=0)
+var ErrWillNotAccepted = errors.New("will not accepted by server")
+
+// ErrNoConnack is returned by Client.WillAccepted if no CONNACK has been received
+var ErrNoConnack = errors.New("no CONNACK received")
+
+// ValidateWill checks the WillMessage in c against the server limits in ca (the CONNACK received in response to c).
+// An error wrapping ErrWillNotAccepted is returned if the server refused the connection due to the Will (reason code
+// 0x9A Retain not supported or 0x9B QoS not supported), or if the Will requests retain, or a QoS, that the server does
+// not support. A server should refuse a CONNECT with such a Will (MQTT-3.2.2-13/14), but as the limits are not known
+// until the CONNACK arrives, this cannot be checked before connecting.
+func (c *Connect) ValidateWill(ca *Connack) error {
+	if c.WillMessage == nil || ca == nil {
+		return nil
+	}
+	switch ca.ReasonCode {
+	case packets.ConnackRetainNotSupported:
+		return fmt.Errorf("%w: connection refused, retain not supported", ErrWillNotAccepted)
+	case packets.ConnackQoSNotSupported:
+		return fmt.Errorf("%w: connection refused, QoS %d not supported", ErrWillNotAccepted, c.WillMessage.QoS)
+	}
+	if ca.Properties == nil {
+		return nil
+	}
+	if c.WillMessage.Retain && !ca.Properties.RetainAvailable {
+		return fmt.Errorf("%w: will is retained but server has RetainAvailable=0", ErrWillNotAccepted)
+	}
+	if ca.Properties.MaximumQoS != nil && c.WillMessage.QoS > *ca.Properties.MaximumQoS {
+		return fmt.Errorf("%w: will QoS %d exceeds server maximum QoS %d", ErrWillNotAccepted, c.WillMessage.QoS, *ca.Properties.MaximumQoS)
+	}
+	return nil
+}
+
+// WillAccepted reports whether the server accepted the Will sent in the CONNECT; it returns false (and a nil error)
+// if no Will was sent. An error wrapping ErrWillNotAccepted is returned if the Will was not accepted (see
+// Connect.ValidateWill), and ErrNoConnack if Connect has not received a CONNACK.
+func (c *Client) WillAccepted() (bool, error) {
+	c.connectCalledMu.Lock()
+	cp, ca := c.connectPacket, c.connack
+	c.connectCalledMu.Unlock()
+	if ca == nil {
+		return false, ErrNoConnack
+	}
+	if cp.WillMessage == nil {
+		return false, nil
+	}
+	if err := cp.ValidateWill(ca); err != nil {
+		return false, err
+	}
+	return ca.ReasonCode < 0x80, nil
+}
+
+// CheckWillMessage confirms that p (a received message) matches the WillMessage and WillProperties in c; i.e. that p
+// is the Will as published by the server. The topic, payload, QoS, retain flag, payload format, content type,
+// response topic, correlation data and user properties are compared; an error wrapping ErrWillMismatch and
+// detailing each difference is returned if these do not match.
+// Note that, when comparing messages received via a subscription, the server may reduce the QoS (to that of the
+// subscription) and clear the retain flag (unless the subscription has RetainAsPublished set); this function expects
+// an exact match, so is primarily intended for use in tests.
+func (c *Connect) CheckWillMessage(p *Publish) error {
+	if c.WillMessage == nil {
+		return fmt.Errorf("%w: connect has no will", ErrWillMismatch)
+	}
+	wm := c.WillMessage
+	wp := c.WillProperties
+	if wp == nil {
+		wp = &WillProperties{}
+	}
+	pp := p.Properties
+	if pp == nil {
+		pp = &PublishProperties{}
+	}
+
+	var errs []error
+	mismatch := func(field string, want, got any) {
+		errs = append(errs, fmt.Errorf("%s: expected %v, got %v", field, want, got))
+	}
+	if p.Topic != wm.Topic {
+		mismatch("topic", wm.Topic, p.Topic)
+	}
+	if !bytes.Equal(p.Payload, wm.Payload) {
+		mismatch("payload", wm.Payload, p.Payload)
+	}
+	if p.QoS != wm.QoS {
+		mismatch("QoS", wm.QoS, p.QoS)
+	}
+	if p.Retain != wm.Retain {
+		mismatch("retain", wm.Retain, p.Retain)
+	}
+	if !equalBytePtr(pp.PayloadFormat, wp.PayloadFormat) {
+		mismatch("payload format", fmtBytePtr(wp.PayloadFormat), fmtBytePtr(pp.PayloadFormat))
+	}
+	if pp.ContentType != wp.ContentType {
+		mismatch("content type", wp.ContentType, pp.ContentType)
+	}
+	if pp.ResponseTopic != wp.ResponseTopic {
+		mismatch("response topic", wp.ResponseTopic, pp.ResponseTopic)
+	}
+	if !bytes.Equal(pp.CorrelationData, wp.CorrelationData) {
+		mismatch("correlation data", wp.CorrelationData, pp.CorrelationData)
+	}
+	if !slices.Equal(pp.User, wp.User) {
+		mismatch("user properties", wp.User, pp.User)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrWillMismatch, errors.Join(errs...))
+	}
+	return nil
+}
+
+// equalBytePtr returns true if a and b are both nil, or point to equal values
+func equalBytePtr(a, b *byte) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// fmtBytePtr formats a *byte for use in error messages
+func fmtBytePtr(b *byte) string {
+	if b == nil {
+		return "<nil>"
+	}
+	return fmt.Sprint(*b)
+}
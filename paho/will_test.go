@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/internal/basictestserver"
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckWillMessage delivers a Will (as a server would) to a client and checks it with CheckWillMessage
+func TestCheckWillMessage(t *testing.T) {
+	will := &Connect{
+		ClientID:    "willClient",
+		WillMessage: &WillMessage{Topic: "test/will", Payload: []byte("gone"), QoS: 1, Retain: true},
+		WillProperties: &WillProperties{
+			PayloadFormat: Byte(1),
+			ContentType:   "text/plain",
+			User:          UserProperties{{Key: "reason", Value: "offline"}},
+		},
+	}
+
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	received := make(chan *Publish, 1)
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+
+	// Publish the Will as the server would upon willClient disconnecting unexpectedly
+	cp := will.Packet()
+	require.NoError(t, ts.SendPacket(&packets.Publish{
+		PacketID: 1,
+		Topic:    cp.WillTopic,
+		Payload:  cp.WillMessage,
+		QoS:      cp.WillQOS,
+		Retain:   cp.WillRetain,
+		Properties: &packets.Properties{
+			PayloadFormat: cp.WillProperties.PayloadFormat,
+			ContentType:   cp.WillProperties.ContentType,
+			User:          cp.WillProperties.User,
+		},
+	}))
+
+	var p *Publish
+	select {
+	case p = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("will not received")
+	}
+	assert.NoError(t, will.CheckWillMessage(p))
+
+	// Differences should be reported
+	p.Topic = "test/other"
+	p.Properties.ContentType = "application/json"
+	err = will.CheckWillMessage(p)
+	require.ErrorIs(t, err, ErrWillMismatch)
+	assert.Contains(t, err.Error(), "topic")
+	assert.Contains(t, err.Error(), "content type")
+	assert.NotContains(t, err.Error(), "payload:")
+
+	assert.ErrorIs(t, (&Connect{}).CheckWillMessage(p), ErrWillMismatch)
+}
+
+// TestWillAccepted documents the behaviour when a retained Will is sent to a server with RetainAvailable=0
+func TestWillAccepted(t *testing.T) {
+	retainedWill := &WillMessage{Topic: "test/will", Payload: []byte("gone"), Retain: true}
+
+	connect := func(t *testing.T, connack *packets.Connack, cp *Connect) (*Client, error) {
+		ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+		ts.SetResponse(packets.CONNACK, connack)
+		go ts.Run()
+		t.Cleanup(ts.Stop)
+
+		c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+		require.NotNil(t, c)
+		c.SetDebugLogger(paholog.NewTestLogger(t, "Client:"))
+		t.Cleanup(c.close)
+		_, err := c.Connect(context.Background(), cp)
+		return c, err
+	}
+
+	t.Run("before connect", func(t *testing.T) {
+		c := NewClient(ClientConfig{})
+		_, err := c.WillAccepted()
+		assert.ErrorIs(t, err, ErrNoConnack)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		// A compliant server refuses the connection (MQTT-3.2.2-13)
+		c, err := connect(t, &packets.Connack{
+			ReasonCode: packets.ConnackRetainNotSupported,
+			Properties: &packets.Properties{RetainAvailable: Byte(0)},
+		}, &Connect{ClientID: "testClient", CleanStart: true, WillMessage: retainedWill})
+		require.Error(t, err)
+		accepted, err := c.WillAccepted()
+		assert.False(t, accepted)
+		assert.ErrorIs(t, err, ErrWillNotAccepted)
+	})
+
+	t.Run("accepted with retain unavailable", func(t *testing.T) {
+		// A non-compliant server may accept the connection; the Will is unlikely to be published as requested
+		c, err := connect(t, &packets.Connack{
+			Properties: &packets.Properties{RetainAvailable: Byte(0)},
+		}, &Connect{ClientID: "testClient", CleanStart: true, WillMessage: retainedWill})
+		require.NoError(t, err)
+		accepted, err := c.WillAccepted()
+		assert.False(t, accepted)
+		assert.ErrorIs(t, err, ErrWillNotAccepted)
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		c, err := connect(t, &packets.Connack{Properties: &packets.Properties{}},
+			&Connect{ClientID: "testClient", CleanStart: true, WillMessage: retainedWill})
+		require.NoError(t, err)
+		accepted, err := c.WillAccepted()
+		assert.True(t, accepted)
+		assert.NoError(t, err)
+	})
+
+	t.Run("no will", func(t *testing.T) {
+		c, err := connect(t, &packets.Connack{Properties: &packets.Properties{RetainAvailable: Byte(0)}},
+			&Connect{ClientID: "testClient", CleanStart: true})
+		require.NoError(t, err)
+		accepted, err := c.WillAccepted()
+		assert.False(t, accepted)
+		assert.NoError(t, err)
+	})
+}
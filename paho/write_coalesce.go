@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+)
+
+// coalesceBufferSize is the number of buffered bytes at which coalescingConn will write to the connection without
+// waiting for the delay to expire
+const coalesceBufferSize = 64 * 1024
+
+// coalescingConn is a net.Conn that buffers PUBLISH packets, for up to delay, so that multiple packets can be sent
+// using fewer writes to the underlying connection (see ClientConfig.WriteCoalesceDelay). All other packets are
+// protocol-critical (e.g. SUBSCRIBE, PUBREL, PINGREQ, DISCONNECT) so are written immediately, along with anything
+// buffered (which must precede them). Implements sync.Locker so that packets.ControlPacket.WriteTo writes each
+// packet atomically; this is what allows the type of each packet (from the first byte written) to be determined.
+type coalescingConn struct {
+	net.Conn
+	delay time.Duration
+
+	writeMu sync.Mutex // held whilst a packet is being written (so buffered data always ends on a packet boundary)
+
+	mu        sync.Mutex  // protects the below
+	buf       []byte      // data waiting to be written
+	inPacket  bool        // true if the first byte of the current packet has been written
+	immediate bool        // true if the current packet should be written without delay
+	timer     *time.Timer // flushes buf when delay expires (nil if not running)
+	err       error       // error from a delayed write (returned by all subsequent writes)
+}
+
+// newCoalescingConn wraps conn
+func newCoalescingConn(conn net.Conn, delay time.Duration) *coalescingConn {
+	return &coalescingConn{Conn: conn, delay: delay}
+}
+
+// Lock implements sync.Locker (used by packets.ControlPacket.WriteTo to ensure packets are written atomically)
+func (c *coalescingConn) Lock() {
+	c.writeMu.Lock()
+	if l, ok := c.Conn.(sync.Locker); ok {
+		l.Lock()
+	}
+}
+
+// Unlock implements sync.Locker; called when a packet has been written
+func (c *coalescingConn) Unlock() {
+	c.mu.Lock()
+	c.inPacket = false
+	if len(c.buf) > 0 && c.timer == nil && c.err == nil {
+		c.timer = time.AfterFunc(c.delay, c.delayExpired)
+	}
+	c.mu.Unlock()
+	if l, ok := c.Conn.(sync.Locker); ok {
+		l.Unlock()
+	}
+	c.writeMu.Unlock()
+}
+
+// Write buffers b if it is part of a PUBLISH packet, otherwise it writes b (and anything buffered) to the connection
+func (c *coalescingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if !c.inPacket && len(b) > 0 {
+		c.inPacket = true
+		c.immediate = b[0]>>4 != packets.PUBLISH
+	}
+	c.buf = append(c.buf, b...)
+	if c.immediate || len(c.buf) >= coalesceBufferSize {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush writes anything buffered to the connection. c.mu must be held.
+func (c *coalescingConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	// Not all net.Conn implementations return an error when writing fewer bytes than requested (see
+	// packets.writeBuffers) so keep writing until everything has been written.
+	b := c.buf
+	for len(b) > 0 {
+		n, err := c.Conn.Write(b)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			c.buf = c.buf[:0]
+			c.err = err
+			return err
+		}
+		b = b[n:]
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// delayExpired writes buffered packets once the delay has expired. An error cannot be returned to the writer (which
+// has already been told the write succeeded), so the connection is closed (which will be picked up by the reader).
+func (c *coalescingConn) delayExpired() {
+	c.Lock()
+	defer c.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if err := c.flush(); err != nil {
+		_ = c.Conn.Close()
+	}
+}
+
+// NetConn returns the underlying connection (matching tls.Conn)
+func (c *coalescingConn) NetConn() net.Conn { return c.Conn }
+
+// Close writes anything buffered (best effort) and closes the connection
+func (c *coalescingConn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		_ = c.flush()
+	} else if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
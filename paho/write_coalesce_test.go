@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtalhouk/paho.golang/packets"
+	paholog "github.com/rtalhouk/paho.golang/paho/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// coalesceTestServer accepts the connection, acknowledges SUBSCRIBE packets, and passes the type of each packet
+// received to the returned channel
+func coalesceTestServer(t *testing.T, srvConn net.Conn) <-chan byte {
+	received := make(chan byte, 10)
+	go func() {
+		if _, err := packets.ReadPacket(srvConn); err != nil {
+			return
+		}
+		if _, err := (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(srvConn); err != nil {
+			return
+		}
+		for {
+			recv, err := packets.ReadPacket(srvConn)
+			if err != nil {
+				return
+			}
+			if s, ok := recv.Content.(*packets.Subscribe); ok {
+				sa := packets.Suback{PacketID: s.PacketID, Reasons: []byte{0}, Properties: &packets.Properties{}}
+				if _, err = sa.WriteTo(srvConn); err != nil {
+					t.Errorf("failed to send SUBACK: %s", err)
+					return
+				}
+			}
+			received <- recv.Type
+		}
+	}()
+	return received
+}
+
+// TestWriteCoalesce confirms that, with write coalescing enabled, QoS0 PUBLISH packets are buffered whereas a
+// SUBSCRIBE is written immediately (along with the buffered packets)
+func TestWriteCoalesce(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	received := coalesceTestServer(t, srvConn)
+
+	conn := &writeCountingConn{Conn: cliConn}
+	c := NewClient(ClientConfig{Conn: conn, WriteCoalesceDelay: time.Hour})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "WriteCoalesce:"))
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+	writes := int(conn.writes.Load())
+
+	for i := 0; i < 3; i++ {
+		_, err = c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 0, Payload: []byte("hello")})
+		require.NoError(t, err)
+	}
+	select {
+	case pt := <-received:
+		t.Fatalf("received packet type %d before SUBSCRIBE sent (PUBLISH should be buffered)", pt)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, writes, int(conn.writes.Load()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = c.Subscribe(ctx, &Subscribe{Subscriptions: []SubscribeOptions{{Topic: "test/#"}}})
+	require.NoError(t, err)
+	for _, want := range []byte{packets.PUBLISH, packets.PUBLISH, packets.PUBLISH, packets.SUBSCRIBE} {
+		select {
+		case pt := <-received:
+			assert.Equal(t, want, pt)
+		case <-time.After(time.Second):
+			t.Fatal("packet not received")
+		}
+	}
+}
+
+// TestWriteCoalesceDelay confirms that buffered PUBLISH packets are written once the delay expires
+func TestWriteCoalesceDelay(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	received := coalesceTestServer(t, srvConn)
+
+	c := NewClient(ClientConfig{Conn: cliConn, WriteCoalesceDelay: 20 * time.Millisecond})
+	require.NotNil(t, c)
+	c.SetDebugLogger(paholog.NewTestLogger(t, "WriteCoalesceDelay:"))
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	defer c.Disconnect(&Disconnect{})
+
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 0, Payload: []byte("hello")})
+	require.NoError(t, err)
+	select {
+	case pt := <-received:
+		assert.Equal(t, packets.PUBLISH, pt)
+	case <-time.After(time.Second):
+		t.Fatal("buffered PUBLISH not written after delay")
+	}
+}
+
+// shortWriteConn accepts at most 3 bytes per call to Write (without returning an error)
+type shortWriteConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (s *shortWriteConn) Write(b []byte) (int, error) { return s.written.Write(b[:min(len(b), 3)]) }
+
+// TestWriteCoalesceShortWrite confirms that buffered data is not lost when the connection accepts fewer bytes than
+// requested
+func TestWriteCoalesceShortWrite(t *testing.T) {
+	conn := &shortWriteConn{}
+	cc := newCoalescingConn(conn, time.Hour)
+
+	pub := &packets.Publish{Topic: "test/1", Payload: []byte("hello"), Properties: &packets.Properties{}}
+	var want bytes.Buffer
+	for _, p := range []io.WriterTo{pub, packets.NewControlPacket(packets.PINGREQ)} {
+		_, err := p.WriteTo(&want)
+		require.NoError(t, err)
+		_, err = p.WriteTo(cc) // PINGREQ is written immediately, along with the buffered PUBLISH
+		require.NoError(t, err)
+	}
+	assert.Equal(t, want.Bytes(), conn.written.Bytes())
+}